@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin"
+
+	defaultSignatureMaxSkew = 5 * time.Minute
+	replayCheckTimeout      = time.Second
+	replayKeyPrefix         = internalKeyPrefix + "replay:"
+
+	headerSignatureKeyID     = "X-Cache-Key-Id"
+	headerSignatureTimestamp = "X-Cache-Timestamp"
+	headerSignatureNonce     = "X-Cache-Nonce"
+	headerSignature          = "X-Cache-Signature"
+)
+
+var (
+	errMissingCredentials = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+	errSignatureExpired   = errors.New("signature timestamp outside allowed window")
+	errSignatureReplayed  = errors.New("signature already used")
+)
+
+var validScopes = map[string]bool{
+	scopeRead:   true,
+	scopeWrite:  true,
+	scopeDelete: true,
+	scopeAdmin:  true,
+}
+
+type AuthConfig struct {
+	RequireReadAuth  bool               `json:"require_read_auth"`
+	SignatureMaxSkew int                `json:"signature_max_skew"`
+	Tokens           []TokenConfig      `json:"tokens"`
+	SigningKeys      []SigningKeyConfig `json:"signing_keys"`
+}
+
+type TokenConfig struct {
+	Name     string   `json:"name"`
+	Token    string   `json:"token"`
+	TokenEnv string   `json:"token_env"`
+	Scopes   []string `json:"scopes"`
+}
+
+type SigningKeyConfig struct {
+	ID        string   `json:"id"`
+	Secret    string   `json:"secret"`
+	SecretEnv string   `json:"secret_env"`
+	Scopes    []string `json:"scopes"`
+}
+
+func (ac *AuthConfig) validate() error {
+	if ac.SignatureMaxSkew < 0 {
+		return fmt.Errorf("auth signature_max_skew must not be negative")
+	}
+	for _, token := range ac.Tokens {
+		if token.Name == "" {
+			return fmt.Errorf("auth token name is required")
+		}
+		if secretValue(token.Token, token.TokenEnv) == "" {
+			return fmt.Errorf("auth token %q has no token or token_env value", token.Name)
+		}
+		if err := validateScopes(token.Scopes); err != nil {
+			return fmt.Errorf("auth token %q: %w", token.Name, err)
+		}
+	}
+	for _, key := range ac.SigningKeys {
+		if key.ID == "" {
+			return fmt.Errorf("auth signing key id is required")
+		}
+		if secretValue(key.Secret, key.SecretEnv) == "" {
+			return fmt.Errorf("auth signing key %q has no secret or secret_env value", key.ID)
+		}
+		if err := validateScopes(key.Scopes); err != nil {
+			return fmt.Errorf("auth signing key %q: %w", key.ID, err)
+		}
+	}
+	return nil
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// secretValue prefers the named environment variable so that real
+// credentials never have to be committed to config.json.
+func secretValue(literal, env string) string {
+	if env != "" {
+		return os.Getenv(env)
+	}
+	return literal
+}
+
+// Credential kinds. A token and a signing key may share a name, so the kind
+// keeps their rate limit buckets apart.
+const (
+	credentialToken = "token"
+	credentialHMAC  = "hmac"
+)
+
+type principal struct {
+	kind   string
+	name   string
+	scopes map[string]bool
+}
+
+func newPrincipal(kind, name string, scopes []string) *principal {
+	p := &principal{kind: kind, name: name, scopes: make(map[string]bool, len(scopes))}
+	for _, scope := range scopes {
+		p.scopes[scope] = true
+	}
+	return p
+}
+
+type principalKey struct{}
+
+func principalFromContext(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok
+}
+
+type tokenCredential struct {
+	sum       [sha256.Size]byte
+	principal *principal
+}
+
+type signingKey struct {
+	secret    []byte
+	principal *principal
+}
+
+// ReplayStore is implemented by stores that can remember accepted signatures
+// for every instance, so that a signed request accepted by one instance
+// cannot be replayed against another.
+type ReplayStore interface {
+	RememberSignature(ctx context.Context, signature string, window time.Duration) (bool, error)
+}
+
+type authenticator struct {
+	enabled         bool
+	requireReadAuth bool
+	tokens          []tokenCredential
+	signingKeys     map[string]signingKey
+	maxSkew         time.Duration
+	replays         *replayCache
+	sharedReplays   ReplayStore
+	breaker         *breakerStore
+	now             func() time.Time
+}
+
+func newAuthenticator(config AuthConfig, store CacheStore, breaker *breakerStore) *authenticator {
+	a := &authenticator{
+		enabled:         len(config.Tokens) > 0 || len(config.SigningKeys) > 0,
+		requireReadAuth: config.RequireReadAuth,
+		signingKeys:     make(map[string]signingKey, len(config.SigningKeys)),
+		maxSkew:         defaultSignatureMaxSkew,
+		breaker:         breaker,
+		now:             time.Now,
+	}
+	if config.SignatureMaxSkew > 0 {
+		a.maxSkew = time.Duration(config.SignatureMaxSkew) * time.Second
+	}
+	a.replays = newReplayCache(2 * a.maxSkew)
+	if rs, ok := store.(ReplayStore); ok {
+		a.sharedReplays = rs
+	}
+
+	for _, token := range config.Tokens {
+		value := secretValue(token.Token, token.TokenEnv)
+		if value == "" {
+			continue
+		}
+		a.tokens = append(a.tokens, tokenCredential{
+			sum:       sha256.Sum256([]byte(value)),
+			principal: newPrincipal(credentialToken, token.Name, token.Scopes),
+		})
+	}
+	for _, key := range config.SigningKeys {
+		secret := secretValue(key.Secret, key.SecretEnv)
+		if secret == "" {
+			continue
+		}
+		a.signingKeys[key.ID] = signingKey{
+			secret:    []byte(secret),
+			principal: newPrincipal(credentialHMAC, key.ID, key.Scopes),
+		}
+	}
+	return a
+}
+
+// require wraps next so that it only runs for callers holding scope. Reads
+// stay public unless require_read_auth is set, but credentials presented on a
+// public read are still checked so the caller can be identified.
+func (a *authenticator) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next(w, r)
+			return
+		}
+		optional := scope == scopeRead && !a.requireReadAuth
+		if optional && !hasCredentials(r) {
+			next(w, r)
+			return
+		}
+
+		p, err := a.authenticate(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeBodyError(w, err)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+			writeCacheError(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized", "details": err.Error()})
+			return
+		}
+		if !optional && !p.scopes[scope] {
+			writeCacheError(w, http.StatusForbidden, map[string]string{"error": "forbidden", "details": fmt.Sprintf("%s scope is required", scope)})
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get(headerSignature) != ""
+}
+
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		scheme, token, ok := strings.Cut(authorization, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return nil, errInvalidCredentials
+		}
+		return a.authenticateToken(token)
+	}
+	if r.Header.Get(headerSignature) != "" {
+		return a.authenticateSignature(r)
+	}
+	return nil, errMissingCredentials
+}
+
+func (a *authenticator) authenticateToken(token string) (*principal, error) {
+	sum := sha256.Sum256([]byte(token))
+	var match *principal
+	for _, credential := range a.tokens {
+		if subtle.ConstantTimeCompare(sum[:], credential.sum[:]) == 1 && match == nil {
+			match = credential.principal
+		}
+	}
+	if match == nil {
+		return nil, errInvalidCredentials
+	}
+	return match, nil
+}
+
+func (a *authenticator) authenticateSignature(r *http.Request) (*principal, error) {
+	key, ok := a.signingKeys[r.Header.Get(headerSignatureKeyID)]
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	rawTimestamp := r.Header.Get(headerSignatureTimestamp)
+	timestamp, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+	now := a.now()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, errSignatureExpired
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(headerSignature))
+	if err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	// The body is read before the signature can be checked. Every
+	// authenticated route is wrapped in limitBody, so it is bounded.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signRequest(key.secret, r.Method, r.URL.RequestURI(), rawTimestamp, r.Header.Get(headerSignatureNonce), body)
+	if !hmac.Equal(signature, expected) {
+		return nil, errInvalidCredentials
+	}
+	if !a.remember(r.Context(), hex.EncodeToString(signature), now) {
+		return nil, errSignatureReplayed
+	}
+	return key.principal, nil
+}
+
+// remember records an accepted signature and reports whether it is new. It
+// uses the shared store when there is one; if that fails or the breaker is
+// open, the local cache still stops replays against this instance.
+func (a *authenticator) remember(ctx context.Context, signature string, now time.Time) bool {
+	if a.sharedReplays != nil && a.breaker.allow() {
+		ctx, cancel := context.WithTimeout(ctx, replayCheckTimeout)
+		defer cancel()
+		fresh, err := a.sharedReplays.RememberSignature(ctx, signature, a.replays.window)
+		if err == nil {
+			return fresh
+		}
+		log.Printf("shared replay check error: %v", err)
+	}
+	return a.replays.remember(signature, now)
+}
+
+func (rs *RedisStore) RememberSignature(ctx context.Context, signature string, window time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, replayKeyPrefix+signature, 1, window).Result()
+}
+
+// signRequest computes the HMAC-SHA256 signature clients send in the
+// X-Cache-Signature header. The signed string is the method, request URI,
+// timestamp, nonce and hex SHA-256 of the body, joined by newlines.
+func signRequest(secret []byte, method, requestURI, timestamp, nonce string, body []byte) []byte {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, requestURI, timestamp, nonce, hex.EncodeToString(bodySum[:])}, "\n")))
+	return mac.Sum(nil)
+}
+
+// replayCache remembers accepted signatures for long enough that a captured
+// request cannot be replayed while its timestamp is still inside the window.
+type replayCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{window: window, seen: make(map[string]time.Time)}
+}
+
+func (rc *replayCache) remember(signature string, now time.Time) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if now.Sub(rc.lastSweep) > rc.window {
+		for seen, at := range rc.seen {
+			if now.Sub(at) > rc.window {
+				delete(rc.seen, seen)
+			}
+		}
+		rc.lastSweep = now
+	}
+
+	if at, ok := rc.seen[signature]; ok && now.Sub(at) <= rc.window {
+		return false
+	}
+	rc.seen[signature] = now
+	return true
+}
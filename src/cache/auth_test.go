@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func authTestConfig() *Config {
+	config := testConfig()
+	config.Auth = AuthConfig{
+		Tokens: []TokenConfig{
+			{Name: "writer", Token: "writer-token", Scopes: []string{scopeWrite}},
+			{Name: "reader", Token: "reader-token", Scopes: []string{scopeRead}},
+		},
+		SigningKeys: []SigningKeyConfig{
+			{ID: "worker", Secret: "worker-secret", Scopes: []string{scopeWrite}},
+		},
+	}
+	return config
+}
+
+func serveWithHeaders(handler http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func signedHeaders(secret, method, path, body string, at time.Time, nonce string) map[string]string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return map[string]string{
+		headerSignatureKeyID:     "worker",
+		headerSignatureTimestamp: timestamp,
+		headerSignatureNonce:     nonce,
+		headerSignature:          hex.EncodeToString(signRequest([]byte(secret), method, path, timestamp, nonce, []byte(body))),
+	}
+}
+
+func TestAuthDisabledWithoutCredentials(t *testing.T) {
+	w := serve(testRouter(newFakeStore()), http.MethodPost, "/api/cache", `{"key":"open","value":"value"}`)
+	requireStatus(t, w, http.StatusOK)
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	store := newFakeStore()
+	router := newRouter(newCacheService(authTestConfig(), store))
+	body := `{"key":"guarded","value":"value"}`
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		errMsg  string
+	}{
+		{name: "missing credentials", status: http.StatusUnauthorized, errMsg: "unauthorized"},
+		{name: "unknown token", headers: map[string]string{"Authorization": "Bearer nope"}, status: http.StatusUnauthorized, errMsg: "unauthorized"},
+		{name: "wrong scheme", headers: map[string]string{"Authorization": "Basic writer-token"}, status: http.StatusUnauthorized, errMsg: "unauthorized"},
+		{name: "missing scope", headers: map[string]string{"Authorization": "Bearer reader-token"}, status: http.StatusForbidden, errMsg: "forbidden"},
+		{name: "write scope", headers: map[string]string{"Authorization": "Bearer writer-token"}, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveWithHeaders(router, http.MethodPost, "/api/cache", body, tt.headers)
+			requireStatus(t, w, tt.status)
+			if tt.errMsg != "" {
+				requireJSONField(t, w, "error", tt.errMsg)
+				if got := w.Header().Get("Cache-Control"); got != "no-store" {
+					t.Fatalf("Cache-Control = %q, want no-store", got)
+				}
+			}
+		})
+	}
+}
+
+func TestReadAuth(t *testing.T) {
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "value", TTL: time.Minute}
+
+	t.Run("public reads", func(t *testing.T) {
+		router := newRouter(newCacheService(authTestConfig(), store))
+		requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=key", ""), http.StatusOK)
+
+		w := serveWithHeaders(router, http.MethodGet, "/api/cache?key=key", "", map[string]string{"Authorization": "Bearer nope"})
+		requireStatus(t, w, http.StatusUnauthorized)
+	})
+
+	t.Run("private reads", func(t *testing.T) {
+		config := authTestConfig()
+		config.Auth.RequireReadAuth = true
+		router := newRouter(newCacheService(config, store))
+		requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=key", ""), http.StatusUnauthorized)
+
+		w := serveWithHeaders(router, http.MethodGet, "/api/cache?key=key", "", map[string]string{"Authorization": "Bearer writer-token"})
+		requireStatus(t, w, http.StatusForbidden)
+
+		w = serveWithHeaders(router, http.MethodGet, "/api/cache?key=key", "", map[string]string{"Authorization": "Bearer reader-token"})
+		requireStatus(t, w, http.StatusOK)
+	})
+}
+
+func TestSignatureAuth(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	newTestRouter := func() http.Handler {
+		service := newCacheService(authTestConfig(), newFakeStore())
+		service.auth.now = func() time.Time { return now }
+		return newRouter(service)
+	}
+	body := `{"key":"signed","value":"value"}`
+
+	t.Run("valid signature", func(t *testing.T) {
+		headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1")
+		requireStatus(t, serveWithHeaders(newTestRouter(), http.MethodPost, "/api/cache", body, headers), http.StatusOK)
+	})
+
+	t.Run("replayed signature", func(t *testing.T) {
+		router := newTestRouter()
+		headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1")
+		requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", body, headers), http.StatusOK)
+		w := serveWithHeaders(router, http.MethodPost, "/api/cache", body, headers)
+		requireStatus(t, w, http.StatusUnauthorized)
+		requireJSONField(t, w, "details", errSignatureReplayed.Error())
+	})
+
+	t.Run("stale timestamp", func(t *testing.T) {
+		headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now.Add(-10*time.Minute), "n1")
+		w := serveWithHeaders(newTestRouter(), http.MethodPost, "/api/cache", body, headers)
+		requireStatus(t, w, http.StatusUnauthorized)
+		requireJSONField(t, w, "details", errSignatureExpired.Error())
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1")
+		w := serveWithHeaders(newTestRouter(), http.MethodPost, "/api/cache", `{"key":"signed","value":"evil"}`, headers)
+		requireStatus(t, w, http.StatusUnauthorized)
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		headers := signedHeaders("other-secret", http.MethodPost, "/api/cache", body, now, "n1")
+		requireStatus(t, serveWithHeaders(newTestRouter(), http.MethodPost, "/api/cache", body, headers), http.StatusUnauthorized)
+	})
+
+	t.Run("unknown key id", func(t *testing.T) {
+		headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1")
+		headers[headerSignatureKeyID] = "stranger"
+		requireStatus(t, serveWithHeaders(newTestRouter(), http.MethodPost, "/api/cache", body, headers), http.StatusUnauthorized)
+	})
+}
+
+func TestAuthConfigValidation(t *testing.T) {
+	t.Setenv("CACHE_TEST_TOKEN", "from-env")
+
+	tests := []struct {
+		name   string
+		config AuthConfig
+		valid  bool
+	}{
+		{name: "empty", config: AuthConfig{}, valid: true},
+		{name: "literal token", config: AuthConfig{Tokens: []TokenConfig{{Name: "a", Token: "t", Scopes: []string{scopeWrite}}}}, valid: true},
+		{name: "env token", config: AuthConfig{Tokens: []TokenConfig{{Name: "a", TokenEnv: "CACHE_TEST_TOKEN", Scopes: []string{scopeAdmin}}}}, valid: true},
+		{name: "empty env token", config: AuthConfig{Tokens: []TokenConfig{{Name: "a", TokenEnv: "CACHE_TEST_MISSING", Scopes: []string{scopeWrite}}}}},
+		{name: "unnamed token", config: AuthConfig{Tokens: []TokenConfig{{Token: "t", Scopes: []string{scopeWrite}}}}},
+		{name: "unknown scope", config: AuthConfig{Tokens: []TokenConfig{{Name: "a", Token: "t", Scopes: []string{"root"}}}}},
+		{name: "no scopes", config: AuthConfig{Tokens: []TokenConfig{{Name: "a", Token: "t"}}}},
+		{name: "signing key without secret", config: AuthConfig{SigningKeys: []SigningKeyConfig{{ID: "k", Scopes: []string{scopeWrite}}}}},
+		{name: "signing key without id", config: AuthConfig{SigningKeys: []SigningKeyConfig{{Secret: "s", Scopes: []string{scopeWrite}}}}},
+		{name: "negative skew", config: AuthConfig{SignatureMaxSkew: -1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.valid && err != nil {
+				t.Fatalf("validate() error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("validate() succeeded for invalid config")
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := []byte(`{"redis_host":"redis","redis_port":6379,"ttl":500,"auth":{"tokens":[{"name":"a","scopes":["write"]}]}}`)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := loadConfigFile(path); err == nil {
+		t.Fatal("invalid auth config error is nil")
+	}
+}
+
+func TestReplayCacheForgetsOldSignatures(t *testing.T) {
+	cache := newReplayCache(time.Minute)
+	now := time.Unix(1_700_000_000, 0)
+	if !cache.remember("sig", now) {
+		t.Fatal("first use rejected")
+	}
+	if cache.remember("sig", now.Add(30*time.Second)) {
+		t.Fatal("replay within window accepted")
+	}
+	if !cache.remember("sig", now.Add(2*time.Minute)) {
+		t.Fatal("signature outside window rejected")
+	}
+	if len(cache.seen) != 1 {
+		t.Fatalf("replay cache size = %d, want 1", len(cache.seen))
+	}
+}
+
+// replayFakeStore shares accepted signatures between services, like Redis.
+type replayFakeStore struct {
+	*fakeStore
+	seen map[string]bool
+}
+
+func (s *replayFakeStore) RememberSignature(_ context.Context, signature string, _ time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[signature] {
+		return false, nil
+	}
+	s.seen[signature] = true
+	return true, nil
+}
+
+func TestSignatureReplayAcrossInstances(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	store := &replayFakeStore{fakeStore: newFakeStore(), seen: make(map[string]bool)}
+	newInstance := func() http.Handler {
+		service := newCacheService(authTestConfig(), store)
+		service.auth.now = func() time.Time { return now }
+		return newRouter(service)
+	}
+	body := `{"key":"signed","value":"value"}`
+	headers := signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1")
+
+	requireStatus(t, serveWithHeaders(newInstance(), http.MethodPost, "/api/cache", body, headers), http.StatusOK)
+	w := serveWithHeaders(newInstance(), http.MethodPost, "/api/cache", body, headers)
+	requireStatus(t, w, http.StatusUnauthorized)
+	requireJSONField(t, w, "details", errSignatureReplayed.Error())
+}
+
+func TestSignatureBodyIsBounded(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	config := authTestConfig()
+	config.Limits.MaxBodySize = 64
+	service := newCacheService(config, newFakeStore())
+	service.auth.now = func() time.Time { return now }
+	router := newRouter(service)
+	body := strings.Repeat("x", 1024)
+
+	// Only the key id and timestamp have to be right for the body to be read.
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/api/cache?key=a"},
+		{http.MethodDelete, "/v2/cache/a"},
+		{http.MethodGet, "/api/admin/stats"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, strings.NewReader(body))
+		req.ContentLength = -1
+		for name, value := range signedHeaders("worker-secret", route.method, route.path, "", now, "n1") {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	}
+}
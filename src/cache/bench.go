@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	benchUniform = "uniform"
+	benchZipf    = "zipf"
+)
+
+// benchOptions describes the load a benchmark generates.
+type benchOptions struct {
+	Duration     time.Duration
+	Concurrency  int
+	ReadRatio    float64
+	Keys         uint64
+	KeyPrefix    string
+	Distribution string
+	ZipfS        float64
+	MinValueSize int
+	MaxValueSize int
+	TTL          int
+	Preload      bool
+
+	// filler backs every written value; values are never read back, so
+	// writes share its bytes instead of allocating their own.
+	filler []byte
+}
+
+func (o benchOptions) validate() error {
+	switch {
+	case o.Duration <= 0:
+		return errors.New("duration must be positive")
+	case o.Concurrency <= 0:
+		return errors.New("concurrency must be positive")
+	case o.ReadRatio < 0 || o.ReadRatio > 1:
+		return errors.New("reads must be between 0 and 1")
+	case o.Keys == 0:
+		return errors.New("keys must be positive")
+	case o.Distribution != benchUniform && o.Distribution != benchZipf:
+		return fmt.Errorf("distribution must be %s or %s", benchUniform, benchZipf)
+	case o.Distribution == benchZipf && o.ZipfS <= 1:
+		return errors.New("zipf exponent must be greater than 1")
+	case o.MinValueSize <= 0 || o.MaxValueSize < o.MinValueSize:
+		return errors.New("value size must be a positive size or MIN-MAX range")
+	case o.TTL <= 0:
+		return errors.New("ttl must be positive")
+	}
+	return nil
+}
+
+// parseValueSize accepts a fixed size such as 1024 or a range such as
+// 256-4096, from which sizes are drawn uniformly.
+func parseValueSize(s string) (int, int, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	minSize, err := strconv.Atoi(lo)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	if !isRange {
+		return minSize, minSize, nil
+	}
+	maxSize, err := strconv.Atoi(hi)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	return minSize, maxSize, nil
+}
+
+// benchLatency holds latency percentiles in milliseconds.
+type benchLatency struct {
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	P999 float64 `json:"p999_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+// benchReport is the result of a benchmark run.
+type benchReport struct {
+	Duration    float64        `json:"duration_seconds"`
+	Concurrency int            `json:"concurrency"`
+	Requests    int            `json:"requests"`
+	Throughput  float64        `json:"requests_per_second"`
+	Reads       int            `json:"reads"`
+	Writes      int            `json:"writes"`
+	Hits        int            `json:"hits"`
+	Misses      int            `json:"misses"`
+	HitRatio    float64        `json:"hit_ratio"`
+	Latency     benchLatency   `json:"latency"`
+	Errors      map[string]int `json:"errors"`
+}
+
+// benchWorker keeps the results of one worker so that workers never share
+// state while the benchmark or a replay runs.
+type benchWorker struct {
+	latencies []time.Duration
+	reads     int
+	writes    int
+	hits      int
+	misses    int
+	errors    map[string]int
+}
+
+// bench drives a running cache with a mix of reads and writes and reports
+// throughput, latency percentiles, hit ratio and errors.
+func (c *cacheClient) bench(flags *flag.FlagSet, args []string) int {
+	opts := benchOptions{}
+	flags.DurationVar(&opts.Duration, "duration", 30*time.Second, "how long to run")
+	flags.IntVar(&opts.Concurrency, "concurrency", 16, "number of concurrent requests")
+	flags.Float64Var(&opts.ReadRatio, "reads", 0.9, "fraction of requests that are reads")
+	flags.Uint64Var(&opts.Keys, "keys", 10000, "number of distinct keys")
+	flags.StringVar(&opts.KeyPrefix, "key-prefix", "bench:", "prefix for generated keys")
+	flags.StringVar(&opts.Distribution, "distribution", benchUniform, "key distribution: uniform or zipf")
+	flags.Float64Var(&opts.ZipfS, "zipf-s", 1.1, "zipf exponent, greater than 1")
+	valueSize := flags.String("value-size", "1024", "value size in bytes, or a MIN-MAX range")
+	flags.IntVar(&opts.TTL, "ttl", 300, "TTL in seconds for written values")
+	flags.BoolVar(&opts.Preload, "preload", false, "write every key once before measuring")
+	if !c.parse(flags, args, "", 0, 0) {
+		return 2
+	}
+	var err error
+	if opts.MinValueSize, opts.MaxValueSize, err = parseValueSize(*valueSize); err != nil {
+		log.Print(err)
+		return 2
+	}
+	if err := opts.validate(); err != nil {
+		log.Print(err)
+		return 2
+	}
+	opts.filler = bytes.Repeat([]byte{'x'}, opts.MaxValueSize)
+	if c.http.Transport == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = opts.Concurrency
+		c.http.Transport = transport
+	}
+
+	ctx := context.Background()
+	if opts.Preload {
+		if err := c.benchPreload(ctx, opts); err != nil {
+			return c.fail(fmt.Errorf("preload failed: %w", err))
+		}
+	}
+	report := c.runBenchmark(ctx, opts)
+	if c.json {
+		return c.writeJSON(report)
+	}
+	writeBenchReport(c.stdout, report)
+	return 0
+}
+
+// benchPreload writes every key once so that reads can hit from the start.
+func (c *cacheClient) benchPreload(ctx context.Context, opts benchOptions) error {
+	keys := make(chan uint64)
+	errs := make(chan error, opts.Concurrency)
+	var wg sync.WaitGroup
+	for range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+			for key := range keys {
+				status, err := c.benchWrite(ctx, opts, rng, key)
+				if err == nil && status != http.StatusOK {
+					err = fmt.Errorf("write returned status %d", status)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var err error
+send:
+	for key := range opts.Keys {
+		select {
+		case keys <- key:
+		case err = <-errs:
+			break send
+		}
+	}
+	close(keys)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// runBenchmark runs the workers until the duration is up and merges their
+// results.
+func (c *cacheClient) runBenchmark(ctx context.Context, opts benchOptions) benchReport {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	workers := make([]*benchWorker, opts.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = &benchWorker{errors: make(map[string]int)}
+		wg.Add(1)
+		go func(worker *benchWorker) {
+			defer wg.Done()
+			c.benchLoop(ctx, opts, worker)
+		}(workers[i])
+	}
+	wg.Wait()
+	return mergeBenchWorkers(time.Since(start), opts.Concurrency, workers)
+}
+
+func (c *cacheClient) benchLoop(ctx context.Context, opts benchOptions, worker *benchWorker) {
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	nextKey := func() uint64 { return rng.Uint64N(opts.Keys) }
+	if opts.Distribution == benchZipf {
+		zipf := rand.NewZipf(rng, opts.ZipfS, 1, opts.Keys-1)
+		nextKey = zipf.Uint64
+	}
+
+	for ctx.Err() == nil {
+		key := nextKey()
+		read := rng.Float64() < opts.ReadRatio
+		began := time.Now()
+		var status int
+		var err error
+		if read {
+			status, err = c.benchRead(ctx, opts, key)
+		} else {
+			status, err = c.benchWrite(ctx, opts, rng, key)
+		}
+		elapsed := time.Since(began)
+		if ctx.Err() != nil {
+			// Requests cut off by the end of the run are not counted.
+			return
+		}
+		op := captureSet
+		if read {
+			op = captureGet
+		}
+		worker.record(op, status, err, elapsed)
+	}
+}
+
+// record counts one request. Reads that miss are not errors, and neither
+// are deletes or TTL changes of keys that do not exist.
+func (w *benchWorker) record(op string, status int, err error, elapsed time.Duration) {
+	w.latencies = append(w.latencies, elapsed)
+	if op == captureGet {
+		w.reads++
+	} else {
+		w.writes++
+	}
+	switch {
+	case err != nil:
+		w.errors[benchErrorKind(err)]++
+	case op == captureGet && status == http.StatusOK:
+		w.hits++
+	case op == captureGet && status == http.StatusNotFound:
+		w.misses++
+	case status == http.StatusNotFound && (op == captureDelete || op == captureTTL):
+	case status >= http.StatusMultipleChoices:
+		w.errors["status_"+strconv.Itoa(status)]++
+	}
+}
+
+func (c *cacheClient) benchRead(ctx context.Context, opts benchOptions, key uint64) (int, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, c.keyPath(opts.KeyPrefix+strconv.FormatUint(key, 10)), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return c.benchDo(req)
+}
+
+func (c *cacheClient) benchWrite(ctx context.Context, opts benchOptions, rng *rand.Rand, key uint64) (int, error) {
+	size := opts.MinValueSize
+	if opts.MaxValueSize > opts.MinValueSize {
+		size += rng.IntN(opts.MaxValueSize - opts.MinValueSize + 1)
+	}
+	query := url.Values{"ttl": {strconv.Itoa(opts.TTL)}}
+	req, err := c.newRequest(ctx, http.MethodPut, c.keyPath(opts.KeyPrefix+strconv.FormatUint(key, 10)), query, bytes.NewReader(opts.filler[:size]))
+	if err != nil {
+		return 0, err
+	}
+	return c.benchDo(req)
+}
+
+// benchDo sends a request and drains the response so the connection is
+// reused.
+func (c *cacheClient) benchDo(req *http.Request) (int, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return 0, err
+	}
+	return resp.StatusCode, nil
+}
+
+// benchErrorKind groups transport errors for the report.
+func benchErrorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "request"
+	}
+}
+
+func mergeBenchWorkers(elapsed time.Duration, concurrency int, workers []*benchWorker) benchReport {
+	report := benchReport{Duration: elapsed.Seconds(), Concurrency: concurrency, Errors: make(map[string]int)}
+	var latencies []time.Duration
+	for _, worker := range workers {
+		latencies = append(latencies, worker.latencies...)
+		report.Reads += worker.reads
+		report.Writes += worker.writes
+		report.Hits += worker.hits
+		report.Misses += worker.misses
+		for kind, n := range worker.errors {
+			report.Errors[kind] += n
+		}
+	}
+	report.Requests = report.Reads + report.Writes
+	if elapsed > 0 {
+		report.Throughput = float64(report.Requests) / elapsed.Seconds()
+	}
+	if lookups := report.Hits + report.Misses; lookups > 0 {
+		report.HitRatio = float64(report.Hits) / float64(lookups)
+	}
+
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		if len(latencies) == 0 {
+			return 0
+		}
+		i := min(int(p*float64(len(latencies))), len(latencies)-1)
+		return float64(latencies[i].Microseconds()) / 1000
+	}
+	report.Latency = benchLatency{P50: percentile(0.5), P90: percentile(0.9), P99: percentile(0.99), P999: percentile(0.999), Max: percentile(1)}
+	return report
+}
+
+func writeBenchReport(w io.Writer, report benchReport) {
+	if report.Concurrency > 0 {
+		fmt.Fprintf(w, "duration     %.1fs, concurrency %d\n", report.Duration, report.Concurrency)
+	} else {
+		fmt.Fprintf(w, "duration     %.1fs\n", report.Duration)
+	}
+	fmt.Fprintf(w, "requests     %d (%d reads, %d writes), %.1f req/s\n", report.Requests, report.Reads, report.Writes, report.Throughput)
+	fmt.Fprintf(w, "hit ratio    %.1f%% (%d hits, %d misses)\n", report.HitRatio*100, report.Hits, report.Misses)
+	fmt.Fprintf(w, "latency      p50 %.2fms  p90 %.2fms  p99 %.2fms  p99.9 %.2fms  max %.2fms\n",
+		report.Latency.P50, report.Latency.P90, report.Latency.P99, report.Latency.P999, report.Latency.Max)
+	if len(report.Errors) == 0 {
+		fmt.Fprintln(w, "errors       none")
+		return
+	}
+	kinds := make([]string, 0, len(report.Errors))
+	for kind := range report.Errors {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	for i, kind := range kinds {
+		label := ""
+		if i == 0 {
+			label = "errors"
+		}
+		fmt.Fprintf(w, "%-12s %s %d\n", label, kind, report.Errors[kind])
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchAgainstServer(t *testing.T) {
+	run, store := clientTestServer(t)
+
+	code, out := run("", "bench", "-json", "-duration", "200ms", "-concurrency", "4", "-keys", "20", "-value-size", "16-64", "-preload")
+	var report benchReport
+	if err := json.Unmarshal([]byte(out), &report); code != 0 || err != nil {
+		t.Fatalf("bench = %d, %q, %v", code, out, err)
+	}
+	if report.Requests == 0 || report.Reads+report.Writes != report.Requests || report.Concurrency != 4 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Misses != 0 || report.HitRatio != 1 || len(report.Errors) != 0 {
+		t.Fatalf("preloaded run = %+v, want only hits", report)
+	}
+	if report.Latency.P50 > report.Latency.P99 || report.Latency.P99 > report.Latency.Max {
+		t.Fatalf("latency percentiles out of order: %+v", report.Latency)
+	}
+
+	store.mu.Lock()
+	for key, item := range store.items {
+		if !strings.HasPrefix(key, "bench:") || len(item.Value) < 16 || len(item.Value) > 64 || item.TTL != 300*time.Second {
+			t.Errorf("written item %q = %d bytes, TTL %v", key, len(item.Value), item.TTL)
+		}
+	}
+	if len(store.items) != 20 {
+		t.Errorf("preload wrote %d keys, want 20", len(store.items))
+	}
+	store.mu.Unlock()
+
+	code, out = run("", "bench", "-duration", "100ms", "-concurrency", "2", "-distribution", "zipf", "-reads", "1", "-key-prefix", "cold:")
+	if code != 0 || !strings.Contains(out, "hit ratio    0.0%") || !strings.Contains(out, "errors       none") {
+		t.Fatalf("zipf bench = %d, %q", code, out)
+	}
+}
+
+func TestBenchCountsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCacheError(w, http.StatusServiceUnavailable, map[string]string{"error": "unavailable"})
+	}))
+	defer server.Close()
+
+	client := &cacheClient{http: server.Client(), baseURL: server.URL}
+	opts := benchOptions{Duration: 100 * time.Millisecond, Concurrency: 2, ReadRatio: 0.5, Keys: 10, Distribution: benchUniform, MinValueSize: 8, MaxValueSize: 8, TTL: 60}
+	opts.filler = make([]byte, 8)
+	report := client.runBenchmark(t.Context(), opts)
+	if report.Requests == 0 || report.Errors["status_503"] != report.Requests || report.Hits+report.Misses != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestBenchOptionErrors(t *testing.T) {
+	run, _ := clientTestServer(t)
+	for _, args := range [][]string{
+		{"-reads", "1.5"},
+		{"-distribution", "pareto"},
+		{"-distribution", "zipf", "-zipf-s", "1"},
+		{"-value-size", "64-16"},
+		{"-value-size", "big"},
+		{"-concurrency", "0"},
+		{"-keys", "0"},
+	} {
+		if code, _ := run("", append([]string{"bench"}, args...)...); code != 2 {
+			t.Fatalf("bench %v = %d, want 2", args, code)
+		}
+	}
+}
+
+func TestMergeBenchWorkers(t *testing.T) {
+	first := &benchWorker{reads: 60, hits: 45, misses: 15, errors: map[string]int{"timeout": 1}}
+	second := &benchWorker{reads: 20, writes: 20, hits: 15, misses: 5, errors: map[string]int{"timeout": 2, "status_500": 1}}
+	for i := 1; i <= 100; i++ {
+		worker := first
+		if i%2 == 0 {
+			worker = second
+		}
+		worker.latencies = append(worker.latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	report := mergeBenchWorkers(2*time.Second, 2, []*benchWorker{first, second})
+	want := benchLatency{P50: 51, P90: 91, P99: 100, P999: 100, Max: 100}
+	if report.Latency != want {
+		t.Fatalf("latency = %+v, want %+v", report.Latency, want)
+	}
+	if report.Requests != 100 || report.Throughput != 50 || report.HitRatio != 0.75 {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Errors["timeout"] != 3 || report.Errors["status_500"] != 1 {
+		t.Fatalf("errors = %v", report.Errors)
+	}
+}
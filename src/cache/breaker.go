@@ -0,0 +1,489 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerProbeInterval    = 2 * time.Second
+	defaultBreakerLocalEntries     = 10000
+	defaultBreakerLocalBytes       = 64 << 20
+	defaultBreakerBufferSize       = 1000
+
+	breakerWritesDrop   = "drop"
+	breakerWritesBuffer = "buffer"
+
+	breakerClosed = "closed"
+	breakerOpen   = "open"
+)
+
+// errStoreUnavailable is returned for operations the breaker cannot serve
+// while Redis is unreachable.
+var errStoreUnavailable = errors.New("cache store unavailable")
+
+// BreakerConfig controls the circuit breaker around the store. After
+// failure_threshold consecutive failures the breaker opens: reads are served
+// from a local copy of recently used entries and writes are dropped or
+// buffered until a probe finds Redis reachable again.
+type BreakerConfig struct {
+	Enabled          bool   `json:"enabled"`
+	FailureThreshold int    `json:"failure_threshold"`
+	ProbeInterval    int    `json:"probe_interval_ms"`
+	LocalEntries     int    `json:"local_entries"`
+	LocalMaxBytes    int64  `json:"local_max_bytes"`
+	WritePolicy      string `json:"write_policy"`
+	BufferSize       int    `json:"buffer_size"`
+}
+
+func (bc *BreakerConfig) validate() error {
+	if bc.FailureThreshold < 0 || bc.ProbeInterval < 0 || bc.LocalEntries < 0 || bc.LocalMaxBytes < 0 || bc.BufferSize < 0 {
+		return fmt.Errorf("breaker limits must not be negative")
+	}
+	switch bc.WritePolicy {
+	case "", breakerWritesDrop, breakerWritesBuffer:
+	default:
+		return fmt.Errorf("breaker write_policy must be %s or %s", breakerWritesDrop, breakerWritesBuffer)
+	}
+	return nil
+}
+
+// breakerStore wraps the store with a circuit breaker. Capability
+// interfaces such as KeyInspector are not forwarded; use unwrapStore to
+// reach them.
+type breakerStore struct {
+	CacheStore
+	threshold     int
+	probeInterval time.Duration
+	bufferWrites  bool
+	bufferSize    int
+	local         *localCache
+
+	open     atomic.Bool
+	mu       sync.Mutex
+	failures int
+	buffer   []bufferedWrite
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// bufferedWrite is a write accepted while the breaker was open. A nil item
+// is a delete.
+type bufferedWrite struct {
+	key  string
+	item *CacheItem
+}
+
+func newBreakerStore(config BreakerConfig, store CacheStore) *breakerStore {
+	b := &breakerStore{
+		CacheStore:    store,
+		threshold:     defaultBreakerFailureThreshold,
+		probeInterval: defaultBreakerProbeInterval,
+		bufferWrites:  config.WritePolicy == breakerWritesBuffer,
+		bufferSize:    defaultBreakerBufferSize,
+		stop:          make(chan struct{}),
+	}
+	if config.FailureThreshold > 0 {
+		b.threshold = config.FailureThreshold
+	}
+	if config.ProbeInterval > 0 {
+		b.probeInterval = time.Duration(config.ProbeInterval) * time.Millisecond
+	}
+	if config.BufferSize > 0 {
+		b.bufferSize = config.BufferSize
+	}
+	entries, maxBytes := defaultBreakerLocalEntries, int64(defaultBreakerLocalBytes)
+	if config.LocalEntries > 0 {
+		entries = config.LocalEntries
+	}
+	if config.LocalMaxBytes > 0 {
+		maxBytes = config.LocalMaxBytes
+	}
+	b.local = newLocalCache(entries, maxBytes)
+	breakerState.Set(breakerClosed)
+	return b
+}
+
+// allow reports whether a call that bypasses the breaker should go to
+// Redis, and counts the calls it turns away. Namespace accounting, shared
+// rate limits, leases, wait notifications, the event log, replay checks and
+// the webhook queue use the raw store; checking first lets them fail fast instead of each waiting for its
+// own timeout while the breaker is open. A nil breaker allows everything.
+func (b *breakerStore) allow() bool {
+	if b == nil || !b.open.Load() {
+		return true
+	}
+	breakerMetrics.Add("bypass_skipped", 1)
+	return false
+}
+
+func (b *breakerStore) state() string {
+	if b.open.Load() {
+		return breakerOpen
+	}
+	return breakerClosed
+}
+
+// isStoreFailure reports whether err means Redis could not serve the call,
+// as opposed to an answer such as a miss or a failed condition, or a
+// caller that gave up.
+func isStoreFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, errCacheMiss) &&
+		!isConditionFailure(err) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// observe counts consecutive failures and opens the breaker at the
+// threshold.
+func (b *breakerStore) observe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isStoreFailure(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold || b.open.Load() || b.closed {
+		return
+	}
+	b.open.Store(true)
+	breakerState.Set(breakerOpen)
+	breakerMetrics.Add("opened", 1)
+	log.Printf("circuit breaker opened after %d store failures: %v", b.failures, err)
+	b.wg.Add(1)
+	go b.probe()
+}
+
+// probe pings Redis until it answers, replays buffered writes and closes
+// the breaker.
+func (b *breakerStore) probe() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := b.CacheStore.Ping(ctx)
+		cancel()
+		if err != nil {
+			breakerMetrics.Add("probe_failures", 1)
+			continue
+		}
+		if b.flush(context.Background()) {
+			b.mu.Lock()
+			b.failures = 0
+			b.mu.Unlock()
+			breakerMetrics.Add("closed", 1)
+			log.Print("circuit breaker closed")
+			return
+		}
+	}
+}
+
+// flush replays buffered writes in order and closes the breaker once the
+// buffer is empty. The breaker stays open while it runs so that newer
+// writes queue behind older ones instead of being overwritten by them.
+func (b *breakerStore) flush(ctx context.Context) bool {
+	for {
+		b.mu.Lock()
+		if len(b.buffer) == 0 {
+			b.open.Store(false)
+			breakerState.Set(breakerClosed)
+			b.mu.Unlock()
+			return true
+		}
+		write := b.buffer[0]
+		b.mu.Unlock()
+
+		writeCtx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+		var err error
+		if write.item != nil {
+			err = b.CacheStore.Set(writeCtx, write.key, *write.item)
+		} else {
+			_, err = b.CacheStore.Delete(writeCtx, write.key)
+		}
+		cancel()
+		if err != nil {
+			breakerMetrics.Add("flush_failures", 1)
+			return false
+		}
+		breakerMetrics.Add("writes_flushed", 1)
+
+		b.mu.Lock()
+		b.buffer = b.buffer[1:]
+		b.mu.Unlock()
+	}
+}
+
+// bufferWrite queues a write while the breaker is open, or drops it when
+// the policy or a full buffer says so.
+func (b *breakerStore) bufferWrite(write bufferedWrite) error {
+	if !b.bufferWrites {
+		breakerMetrics.Add("writes_dropped", 1)
+		return errStoreUnavailable
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.buffer) >= b.bufferSize {
+		breakerMetrics.Add("writes_dropped", 1)
+		return errStoreUnavailable
+	}
+	b.buffer = append(b.buffer, write)
+	breakerMetrics.Add("writes_buffered", 1)
+	if write.item != nil {
+		b.local.put(write.key, *write.item)
+	} else {
+		b.local.delete(write.key)
+	}
+	return nil
+}
+
+// Ping always asks Redis, so health checks count towards opening the
+// breaker.
+func (b *breakerStore) Ping(ctx context.Context) error {
+	err := b.CacheStore.Ping(ctx)
+	b.observe(err)
+	return err
+}
+
+func (b *breakerStore) Get(ctx context.Context, key string) (CacheItem, error) {
+	return b.get(ctx, key, func() (CacheItem, error) { return b.CacheStore.Get(ctx, key) })
+}
+
+func (b *breakerStore) GetAndTouch(ctx context.Context, key string, ttl time.Duration) (CacheItem, error) {
+	return b.get(ctx, key, func() (CacheItem, error) { return b.CacheStore.GetAndTouch(ctx, key, ttl) })
+}
+
+// get reads through to Redis while the breaker is closed, keeping a local
+// copy of what it reads. While open it answers from that copy, marking the
+// item stale, and reports anything it does not hold as a miss.
+func (b *breakerStore) get(_ context.Context, key string, read func() (CacheItem, error)) (CacheItem, error) {
+	if b.open.Load() {
+		item, ok := b.local.get(key)
+		if !ok {
+			breakerMetrics.Add("stale_misses", 1)
+			return CacheItem{}, errCacheMiss
+		}
+		breakerMetrics.Add("stale_hits", 1)
+		item.Stale = true
+		return item, nil
+	}
+	item, err := read()
+	b.observe(err)
+	switch {
+	case err == nil:
+		b.local.put(key, item)
+	case errors.Is(err, errCacheMiss):
+		b.local.delete(key)
+	}
+	return item, err
+}
+
+func (b *breakerStore) Set(ctx context.Context, key string, item CacheItem) error {
+	_, err := b.SetIf(ctx, key, item, WriteCondition{})
+	return err
+}
+
+// SetIf writes through while the breaker is closed. While it is open,
+// unconditional writes follow the write policy; conditional writes cannot be
+// checked and are refused.
+func (b *breakerStore) SetIf(ctx context.Context, key string, item CacheItem, cond WriteCondition) (int64, error) {
+	if b.open.Load() {
+		if cond.Mode != writeAlways {
+			breakerMetrics.Add("writes_dropped", 1)
+			return 0, errStoreUnavailable
+		}
+		return 0, b.bufferWrite(bufferedWrite{key: key, item: &item})
+	}
+	version, err := b.CacheStore.SetIf(ctx, key, item, cond)
+	b.observe(err)
+	if err == nil {
+		item.Version = version
+		b.local.put(key, item)
+	}
+	return version, err
+}
+
+// Delete reports a buffered delete as done, since whether the key exists
+// is only known to Redis.
+func (b *breakerStore) Delete(ctx context.Context, key string) (bool, error) {
+	if b.open.Load() {
+		return true, b.bufferWrite(bufferedWrite{key: key})
+	}
+	deleted, err := b.CacheStore.Delete(ctx, key)
+	b.observe(err)
+	if err == nil {
+		b.local.delete(key)
+	}
+	return deleted, err
+}
+
+// UpdateTTL is refused while the breaker is open, since the resulting TTL
+// depends on the entry in Redis.
+func (b *breakerStore) UpdateTTL(ctx context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	if b.open.Load() {
+		return 0, errStoreUnavailable
+	}
+	ttl, err := b.CacheStore.UpdateTTL(ctx, key, update)
+	b.observe(err)
+	if err == nil {
+		b.local.touch(key, ttl)
+	} else if errors.Is(err, errCacheMiss) {
+		b.local.delete(key)
+	}
+	return ttl, err
+}
+
+// drain stops probing and makes a last attempt to replay buffered writes
+// before shutdown.
+func (b *breakerStore) drain(ctx context.Context) {
+	b.stopProbing()
+	if b.buffered() > 0 && b.flush(ctx) {
+		log.Print("circuit breaker flushed buffered writes on shutdown")
+	}
+}
+
+func (b *breakerStore) stopProbing() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.stop)
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+func (b *breakerStore) Close() error {
+	b.stopProbing()
+	if n := b.buffered(); n > 0 {
+		log.Printf("circuit breaker dropped %d buffered writes on shutdown", n)
+	}
+	return b.CacheStore.Close()
+}
+
+func (b *breakerStore) buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buffer)
+}
+
+// localCache is a bounded LRU copy of entries with their expiry times.
+type localCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List
+	entries    map[string]*list.Element
+	now        func() time.Time
+}
+
+type localEntry struct {
+	key     string
+	item    CacheItem
+	expires time.Time
+}
+
+func newLocalCache(maxEntries int, maxBytes int64) *localCache {
+	return &localCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// get returns the entry with its remaining TTL.
+func (lc *localCache) get(key string) (CacheItem, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	elem, ok := lc.entries[key]
+	if !ok {
+		return CacheItem{}, false
+	}
+	entry := elem.Value.(*localEntry)
+	remaining := entry.expires.Sub(lc.now())
+	if remaining <= 0 {
+		lc.remove(elem)
+		return CacheItem{}, false
+	}
+	lc.order.MoveToFront(elem)
+	item := entry.item
+	item.TTL = remaining
+	return item, true
+}
+
+func (lc *localCache) put(key string, item CacheItem) {
+	size := int64(len(key) + len(item.Value))
+	if item.TTL <= 0 || size > lc.maxBytes {
+		lc.delete(key)
+		return
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if elem, ok := lc.entries[key]; ok {
+		lc.remove(elem)
+	}
+	entry := &localEntry{key: key, item: item, expires: lc.now().Add(item.TTL)}
+	entry.item.Stale = false
+	lc.entries[key] = lc.order.PushFront(entry)
+	lc.bytes += size
+	for len(lc.entries) > lc.maxEntries || lc.bytes > lc.maxBytes {
+		lc.remove(lc.order.Back())
+	}
+}
+
+// touch moves an entry's expiry to ttl from now.
+func (lc *localCache) touch(key string, ttl time.Duration) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if elem, ok := lc.entries[key]; ok {
+		elem.Value.(*localEntry).expires = lc.now().Add(ttl)
+	}
+}
+
+func (lc *localCache) delete(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if elem, ok := lc.entries[key]; ok {
+		lc.remove(elem)
+	}
+}
+
+func (lc *localCache) remove(elem *list.Element) {
+	entry := lc.order.Remove(elem).(*localEntry)
+	delete(lc.entries, entry.key)
+	lc.bytes -= int64(len(entry.key) + len(entry.item.Value))
+}
+
+func (lc *localCache) len() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return len(lc.entries)
+}
+
+// writeStoreError answers a failed store call: 503 while the breaker
+// refuses the operation, 500 for anything else.
+func writeStoreError(w http.ResponseWriter, logPrefix string, err error) {
+	if errors.Is(err, errStoreUnavailable) {
+		writeCacheError(w, http.StatusServiceUnavailable, map[string]string{"error": "cache unavailable", "details": "redis is unreachable; try again later"})
+		return
+	}
+	log.Printf("%s: %v", logPrefix, err)
+	writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+}
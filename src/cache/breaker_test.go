@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func breakerTestService(t *testing.T, config BreakerConfig) (*CacheService, *fakeStore, http.Handler) {
+	t.Helper()
+	cfg := testConfig()
+	config.Enabled = true
+	config.FailureThreshold = 2
+	config.ProbeInterval = 5
+	cfg.Breaker = config
+	store := newFakeStore()
+	service := newCacheService(cfg, store)
+	t.Cleanup(func() { service.Close() })
+	return service, store, newRouter(service)
+}
+
+// failStore makes every call to store fail, or succeed again when err is nil.
+func failStore(store *fakeStore, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.pingErr, store.getErr, store.setErr = err, err, err
+}
+
+func waitForBreaker(t *testing.T, b *breakerStore, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b.state() == state {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("breaker never became %s", state)
+}
+
+func TestBreakerServesStaleReads(t *testing.T) {
+	service, store, router := breakerTestService(t, BreakerConfig{})
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "hello"), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/b?ttl=60", "world"), http.StatusOK)
+	// A miss evicts the local copy like a delete would.
+	store.mu.Lock()
+	delete(store.items, "b")
+	store.mu.Unlock()
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/b", ""), http.StatusNotFound)
+
+	failStore(store, errors.New("redis down"))
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/c", ""), http.StatusInternalServerError)
+	if service.breaker.state() != breakerClosed {
+		t.Fatal("breaker opened before the threshold")
+	}
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/c", ""), http.StatusInternalServerError)
+	waitForBreaker(t, service.breaker, breakerOpen)
+
+	w := serve(router, http.MethodGet, "/v2/cache/a", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "hello")
+	if w.Header().Get("X-CACHE-STALE") != "true" || w.Header().Get("ETag") == "" {
+		t.Fatalf("stale headers = %v", w.Header())
+	}
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/b", ""), http.StatusNotFound)
+
+	w = serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "new")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireJSONField(t, w, "error", "cache unavailable")
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache/a", ""), http.StatusServiceUnavailable)
+
+	w = serve(router, http.MethodGet, "/health", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "DEGRADED")
+	if got := w.Header().Get("X-Cache-Breaker"); got != breakerOpen {
+		t.Fatalf("X-Cache-Breaker = %q, want open", got)
+	}
+	if !strings.Contains(breakerMetrics.String(), `"state": "open"`) {
+		t.Fatalf("metrics = %s", breakerMetrics.String())
+	}
+
+	failStore(store, nil)
+	waitForBreaker(t, service.breaker, breakerClosed)
+	w = serve(router, http.MethodGet, "/v2/cache/a", "")
+	requireStatus(t, w, http.StatusOK)
+	if w.Header().Get("X-CACHE-STALE") != "" {
+		t.Fatal("read after closing is marked stale")
+	}
+	w = serve(router, http.MethodGet, "/health", "")
+	requireBody(t, w, "OK")
+	if got := w.Header().Get("X-Cache-Breaker"); got != breakerClosed {
+		t.Fatalf("X-Cache-Breaker = %q, want closed", got)
+	}
+}
+
+func TestBreakerBuffersWrites(t *testing.T) {
+	service, store, router := breakerTestService(t, BreakerConfig{WritePolicy: breakerWritesBuffer, BufferSize: 3})
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "old"), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/b?ttl=60", "gone"), http.StatusOK)
+
+	failStore(store, errors.New("redis down"))
+	serve(router, http.MethodGet, "/v2/cache/c", "")
+	serve(router, http.MethodGet, "/v2/cache/c", "")
+	waitForBreaker(t, service.breaker, breakerOpen)
+
+	w := serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "first")
+	requireStatus(t, w, http.StatusOK)
+	if w.Header().Get("ETag") != "" {
+		t.Fatal("buffered write has an ETag")
+	}
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "second"), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache/b", ""), http.StatusNoContent)
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/d?ttl=60", "full"), http.StatusServiceUnavailable)
+
+	requireBody(t, serve(router, http.MethodGet, "/v2/cache/a", ""), "second")
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/b", ""), http.StatusNotFound)
+
+	// Writes whose outcome depends on Redis are refused rather than queued.
+	w = serveWithHeaders(router, http.MethodPut, "/v2/cache/e?ttl=60", "v", map[string]string{"If-None-Match": "*"})
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireStatus(t, serve(router, http.MethodPatch, "/v2/cache/a", `{"ttl":"30"}`), http.StatusServiceUnavailable)
+
+	// Redis answers pings but refuses writes, so the buffer cannot drain.
+	failures := counterValue(breakerMetrics, "flush_failures")
+	store.mu.Lock()
+	store.pingErr = nil
+	store.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(breakerMetrics, "flush_failures") == failures && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if service.breaker.state() != breakerOpen {
+		t.Fatal("breaker closed with writes still buffered")
+	}
+
+	failStore(store, nil)
+	waitForBreaker(t, service.breaker, breakerClosed)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.items["a"].Value != "second" {
+		t.Fatalf("a = %+v, want the last buffered write", store.items["a"])
+	}
+	if _, ok := store.items["b"]; ok {
+		t.Fatal("buffered delete was not flushed")
+	}
+	if _, ok := store.items["d"]; ok {
+		t.Fatal("write rejected by a full buffer was flushed")
+	}
+}
+
+// sidePathStore counts the calls made to the capabilities that bypass the
+// breaker.
+type sidePathStore struct {
+	*fakeStore
+	calls    atomic.Int64
+	appended atomic.Int64
+}
+
+func (s *sidePathStore) TakeTokens(context.Context, string, float64, float64, float64) (time.Duration, error) {
+	s.calls.Add(1)
+	return 0, nil
+}
+
+func (s *sidePathStore) ReserveUsage(context.Context, string, string, int64, time.Duration, int64) (NamespaceUsage, *UsageEntry, error) {
+	s.calls.Add(1)
+	return NamespaceUsage{}, nil, nil
+}
+
+func (s *sidePathStore) RestoreUsage(context.Context, string, string, *UsageEntry) error {
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) ReleaseUsage(context.Context, string, string) error {
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) Usage(context.Context, string) (NamespaceUsage, error) {
+	return NamespaceUsage{}, nil
+}
+
+func (s *sidePathStore) AcquireLease(context.Context, string, string, time.Duration) (bool, time.Duration, error) {
+	s.calls.Add(1)
+	return true, 0, nil
+}
+
+func (s *sidePathStore) ReleaseLease(context.Context, string, string) (bool, error) {
+	s.calls.Add(1)
+	return true, nil
+}
+
+func (s *sidePathStore) PublishSet(context.Context, string) error {
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) SubscribeSets(ctx context.Context) <-chan string {
+	return make(chan string)
+}
+
+func (s *sidePathStore) AppendEvent(context.Context, CacheEvent, int64) error {
+	s.calls.Add(1)
+	s.appended.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) ReadEvents(ctx context.Context, _ string, _ int64, block time.Duration) ([]CacheEvent, error) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(block):
+	}
+	return nil, nil
+}
+
+func (s *sidePathStore) SubscribeExpirations(ctx context.Context) <-chan string {
+	return make(chan string)
+}
+
+func (s *sidePathStore) RememberSignature(context.Context, string, time.Duration) (bool, error) {
+	s.calls.Add(1)
+	return true, nil
+}
+
+func (s *sidePathStore) EnqueueWebhook(context.Context, WebhookDelivery, time.Duration) error {
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) ClaimWebhooks(context.Context, int, time.Duration) ([]WebhookDelivery, error) {
+	s.calls.Add(1)
+	return nil, nil
+}
+
+func (s *sidePathStore) FinishWebhook(context.Context, WebhookDelivery, time.Duration, int64) error {
+	s.calls.Add(1)
+	return nil
+}
+
+func (s *sidePathStore) WebhookHistory(context.Context, string, int64) ([]WebhookDelivery, error) {
+	return nil, nil
+}
+
+func TestBreakerCoversSidePaths(t *testing.T) {
+	config := testConfig()
+	config.Breaker = BreakerConfig{Enabled: true, FailureThreshold: 1, ProbeInterval: 5, WritePolicy: breakerWritesBuffer}
+	config.RateLimit = RateLimitConfig{Shared: true, Writes: RateConfig{Rate: 100}}
+	config.Namespaces = []NamespaceConfig{{Name: "tenant", MemoryBudget: 1 << 20}}
+	config.Wait.Enabled = true
+	config.Events.Enabled = true
+	store := &sidePathStore{fakeStore: newFakeStore()}
+	service := newCacheService(config, store)
+	defer service.Close()
+	router := newRouter(service)
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/ns/tenant/cache/a", "v"), http.StatusOK)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.appended.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if store.appended.Load() == 0 {
+		t.Fatal("event was not appended while the breaker was closed")
+	}
+
+	failStore(store.fakeStore, errors.New("redis down"))
+	serve(router, http.MethodGet, "/v2/cache/c", "")
+	waitForBreaker(t, service.breaker, breakerOpen)
+	store.calls.Store(0)
+	dropped := counterValue(eventMetrics, "dropped")
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/ns/tenant/cache/a", "w"), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPost, "/v2/lease/b", ""), http.StatusServiceUnavailable)
+	w := serveWithHeaders(router, http.MethodDelete, "/v2/lease/b", "", map[string]string{leaseTokenHeader: "token"})
+	requireStatus(t, w, http.StatusServiceUnavailable)
+
+	deadline = time.Now().Add(5 * time.Second)
+	for counterValue(eventMetrics, "dropped") == dropped && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	requireCounterDelta(t, eventMetrics, "dropped", dropped, 1)
+	if n := store.calls.Load(); n != 0 {
+		t.Fatalf("%d side path calls reached Redis while the breaker was open", n)
+	}
+}
+
+func TestBreakerCoversReplaysAndWebhooks(t *testing.T) {
+	store := &sidePathStore{fakeStore: newFakeStore()}
+	breaker := newBreakerStore(BreakerConfig{}, store)
+	breaker.open.Store(true)
+	ctx := context.Background()
+	now := time.Now()
+
+	auth := newAuthenticator(AuthConfig{}, store, breaker)
+	if !auth.remember(ctx, "sig", now) {
+		t.Fatal("first signature was reported as a replay")
+	}
+	if auth.remember(ctx, "sig", now) {
+		t.Fatal("replay was not caught by the local cache while the breaker was open")
+	}
+
+	wh := newWebhooks(WebhooksConfig{
+		Endpoints: []WebhookEndpointConfig{{Name: "hook", URL: "http://example.invalid", Secret: "s"}},
+	}, store, breaker)
+	dropped := counterValue(webhookMetrics, "dropped")
+	wh.enqueue(ctx, CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "k"})
+	requireCounterDelta(t, webhookMetrics, "dropped", dropped, 1)
+	if wh.deliverDue(ctx) {
+		t.Fatal("deliverDue() claimed deliveries while the breaker was open")
+	}
+	wh.deliver(ctx, WebhookDelivery{ID: "d", Endpoint: "gone"})
+	if n := store.calls.Load(); n != 0 {
+		t.Fatalf("%d replay and webhook calls reached Redis while the breaker was open", n)
+	}
+
+	breaker.open.Store(false)
+	auth.remember(ctx, "other", now)
+	wh.enqueue(ctx, CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "k"})
+	if !wh.deliverDue(ctx) {
+		t.Fatal("deliverDue() failed with the breaker closed")
+	}
+	if n := store.calls.Load(); n != 3 {
+		t.Fatalf("%d replay and webhook calls reached Redis, want 3", n)
+	}
+}
+
+func TestLocalCacheBounds(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lc := newLocalCache(2, 16)
+	lc.now = func() time.Time { return now }
+
+	lc.put("a", CacheItem{Value: "1", TTL: time.Minute})
+	lc.put("b", CacheItem{Value: "2", TTL: time.Minute})
+	lc.get("a")
+	lc.put("c", CacheItem{Value: "3", TTL: time.Minute})
+	if _, ok := lc.get("b"); ok {
+		t.Fatal("least recently used entry was kept")
+	}
+	if _, ok := lc.get("a"); !ok {
+		t.Fatal("recently read entry was evicted")
+	}
+
+	lc.put("big", CacheItem{Value: strings.Repeat("x", 20), TTL: time.Minute})
+	if _, ok := lc.get("big"); ok || lc.len() != 2 {
+		t.Fatalf("oversized entry cached, len = %d", lc.len())
+	}
+	lc.put("d", CacheItem{Value: strings.Repeat("x", 14), TTL: time.Minute})
+	if lc.len() != 1 {
+		t.Fatalf("len = %d, want byte budget to leave 1 entry", lc.len())
+	}
+
+	now = now.Add(30 * time.Second)
+	if item, ok := lc.get("d"); !ok || item.TTL != 30*time.Second {
+		t.Fatalf("get(d) = %+v, %v, want 30s left", item, ok)
+	}
+	lc.touch("d", time.Second)
+	now = now.Add(2 * time.Second)
+	if _, ok := lc.get("d"); ok {
+		t.Fatal("expired entry was served")
+	}
+}
+
+func TestBreakerConfigValidation(t *testing.T) {
+	for _, config := range []BreakerConfig{
+		{FailureThreshold: -1},
+		{BufferSize: -1},
+		{WritePolicy: "queue"},
+	} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCaptureSampleRate = 0.01
+	defaultCaptureMaxBytes   = 64 << 20
+	defaultCaptureMaxFiles   = 5
+	captureQueueSize         = 4096
+	captureFlushInterval     = time.Second
+
+	captureGet    = "get"
+	captureSet    = "set"
+	captureDelete = "delete"
+	captureTTL    = "ttl"
+)
+
+// CaptureConfig enables recording a sample of cache requests to a rotating
+// file for later replay. Keys can be replaced by a hash of the key when they
+// should not leave production.
+type CaptureConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Path       string  `json:"path"`
+	SampleRate float64 `json:"sample_rate"`
+	HashKeys   bool    `json:"hash_keys"`
+	MaxBytes   int64   `json:"max_bytes"`
+	MaxFiles   int     `json:"max_files"`
+}
+
+func (cc *CaptureConfig) validate() error {
+	if cc.SampleRate < 0 || cc.SampleRate > 1 {
+		return fmt.Errorf("capture sample_rate must be between 0 and 1")
+	}
+	if cc.MaxBytes < 0 || cc.MaxFiles < 0 {
+		return fmt.Errorf("capture limits must not be negative")
+	}
+	if cc.Enabled && cc.Path == "" {
+		return fmt.Errorf("capture needs a path")
+	}
+	return nil
+}
+
+// captureRecord is one captured request. Time is when the request started,
+// in microseconds since the epoch. Size is the value size written, or read
+// on a hit, and TTL is in seconds.
+type captureRecord struct {
+	Time      int64  `json:"ts"`
+	Op        string `json:"op"`
+	Method    string `json:"method"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+	KeyHash   string `json:"key_hash,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Status    int    `json:"status"`
+	Duration  int64  `json:"duration_us"`
+}
+
+type captureKey struct{}
+
+// noteCapture describes the cache operation of a sampled request. Handlers
+// call it once they know the key; requests that never call it, such as
+// health checks and admin calls, are not captured.
+func noteCapture(r *http.Request, op string, ns *namespace, key string, size int64, ttl time.Duration) {
+	record, ok := r.Context().Value(captureKey{}).(*captureRecord)
+	if !ok {
+		return
+	}
+	record.Op = op
+	record.Namespace = ns.name
+	record.Key = key
+	record.Size = size
+	record.TTL = int64(ttl.Seconds())
+}
+
+// hashCaptureKey replaces a key with a stable, shorter stand-in, so replays
+// still see the same key repeat without seeing the key.
+func hashCaptureKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// capture samples requests and hands records to a background writer, so a
+// slow disk never holds up a request.
+type capture struct {
+	sampleRate float64
+	hashKeys   bool
+	file       *rotatingFile
+	records    chan captureRecord
+	stop       context.CancelFunc
+	done       chan struct{}
+}
+
+// startCapture opens the capture file and starts recording, if capture is
+// enabled. It must run before the router is built.
+func (cs *CacheService) startCapture() error {
+	config := cs.config.Capture
+	if !config.Enabled {
+		return nil
+	}
+	cp := &capture{
+		sampleRate: defaultCaptureSampleRate,
+		hashKeys:   config.HashKeys,
+		records:    make(chan captureRecord, captureQueueSize),
+		done:       make(chan struct{}),
+	}
+	if config.SampleRate > 0 {
+		cp.sampleRate = config.SampleRate
+	}
+	maxBytes, maxFiles := int64(defaultCaptureMaxBytes), defaultCaptureMaxFiles
+	if config.MaxBytes > 0 {
+		maxBytes = config.MaxBytes
+	}
+	if config.MaxFiles > 0 {
+		maxFiles = config.MaxFiles
+	}
+	file, err := openRotatingFile(config.Path, maxBytes, maxFiles)
+	if err != nil {
+		return err
+	}
+	cp.file = file
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cp.stop = cancel
+	go cp.run(ctx)
+	cs.capture = cp
+	return nil
+}
+
+// captureRequests wraps the router so that sampled requests carry a record
+// for the handlers to fill in.
+func (cs *CacheService) captureRequests(next http.Handler) http.Handler {
+	cp := cs.capture
+	if cp == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= cp.sampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		record := &captureRecord{Method: r.Method}
+		cw := &captureResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), captureKey{}, record)))
+		if record.Op == "" {
+			return
+		}
+		record.Time = start.UnixMicro()
+		record.Duration = time.Since(start).Microseconds()
+		record.Status = cw.status
+		if cp.hashKeys {
+			record.KeyHash = hashCaptureKey(record.Key)
+			record.Key = ""
+		}
+		cp.add(*record)
+	})
+}
+
+func (cp *capture) add(record captureRecord) {
+	select {
+	case cp.records <- record:
+	default:
+		captureMetrics.Add("dropped", 1)
+	}
+}
+
+func (cp *capture) run(ctx context.Context) {
+	defer close(cp.done)
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-cp.records:
+			cp.write(record)
+		case <-ticker.C:
+			if err := cp.file.flush(); err != nil {
+				captureMetrics.Add("write_errors", 1)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case record := <-cp.records:
+					cp.write(record)
+				default:
+					if err := cp.file.close(); err != nil {
+						log.Printf("capture close error: %v", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (cp *capture) write(record captureRecord) {
+	line, err := json.Marshal(record)
+	if err == nil {
+		err = cp.file.writeLine(line)
+	}
+	if err != nil {
+		captureMetrics.Add("write_errors", 1)
+		log.Printf("capture write error: %v", err)
+		return
+	}
+	captureMetrics.Add("recorded", 1)
+}
+
+// close writes out queued records and closes the file.
+func (cp *capture) close() {
+	cp.stop()
+	<-cp.done
+}
+
+// captureResponseWriter remembers the status a handler wrote. It keeps
+// Flush available for streaming handlers and unwraps for
+// http.ResponseController.
+type captureResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *captureResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *captureResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rotatingFile appends lines to path. Once path would grow past maxBytes it
+// is renamed to path.1, older files shift up by one and at most maxFiles
+// files are kept, counting path itself.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.writer = bufio.NewWriter(file)
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) writeLine(line []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && rf.size+int64(len(line))+1 > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.writer.Write(append(line, '\n'))
+	rf.size += int64(n)
+	return err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.writer.Flush(); err != nil {
+		return err
+	}
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	numbered := func(i int) string { return rf.path + "." + strconv.Itoa(i) }
+	if err := os.Remove(numbered(rf.maxFiles - 1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := rf.maxFiles - 2; i >= 1; i-- {
+		if err := os.Rename(numbered(i), numbered(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if rf.maxFiles > 1 {
+		if err := os.Rename(rf.path, numbered(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	captureMetrics.Add("rotations", 1)
+	return rf.open()
+}
+
+func (rf *rotatingFile) flush() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.writer.Flush()
+}
+
+func (rf *rotatingFile) close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if err := rf.writer.Flush(); err != nil {
+		rf.file.Close()
+		return err
+	}
+	return rf.file.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var _ http.Flusher = (*captureResponseWriter)(nil)
+
+func captureTestService(t *testing.T, config CaptureConfig) (*CacheService, http.Handler) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	cfg.Capture = config
+	service := newCacheService(cfg, newFakeStore())
+	if err := service.startCapture(); err != nil {
+		t.Fatalf("startCapture() error: %v", err)
+	}
+	return service, newRouter(service)
+}
+
+func TestCaptureRecordsCacheRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	service, router := captureTestService(t, CaptureConfig{Enabled: true, Path: path, SampleRate: 1})
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/ns/tenant/cache/a?ttl=60", "hello"), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodGet, "/v2/ns/tenant/cache/a", ""), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=missing", ""), http.StatusNotFound)
+	requireStatus(t, serve(router, http.MethodPatch, "/v2/ns/tenant/cache/a", `{"ttl":"30"}`), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/ns/tenant/cache/a", ""), http.StatusNoContent)
+	requireStatus(t, serve(router, http.MethodGet, "/health", ""), http.StatusOK)
+	service.Close()
+
+	records, err := loadCapture([]string{path})
+	if err != nil {
+		t.Fatalf("loadCapture() error: %v", err)
+	}
+	want := []captureRecord{
+		{Op: captureSet, Method: http.MethodPut, Namespace: "tenant", Key: "a", Size: 5, TTL: 60, Status: http.StatusOK},
+		{Op: captureGet, Method: http.MethodGet, Namespace: "tenant", Key: "a", Size: 5, TTL: 60, Status: http.StatusOK},
+		{Op: captureGet, Method: http.MethodGet, Namespace: defaultNamespace, Key: "missing", Status: http.StatusNotFound},
+		{Op: captureTTL, Method: http.MethodPatch, Namespace: "tenant", Key: "a", TTL: 30, Status: http.StatusOK},
+		{Op: captureDelete, Method: http.MethodDelete, Namespace: "tenant", Key: "a", Status: http.StatusNoContent},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("captured %d records, want %d: %+v", len(records), len(want), records)
+	}
+	for i, record := range records {
+		if record.Time == 0 || record.Duration < 0 {
+			t.Fatalf("record %d has no timing: %+v", i, record)
+		}
+		record.Time, record.Duration = 0, 0
+		if record != want[i] {
+			t.Fatalf("record %d = %+v, want %+v", i, record, want[i])
+		}
+	}
+}
+
+func TestCaptureHashesKeysAndSamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	service, router := captureTestService(t, CaptureConfig{Enabled: true, Path: path, SampleRate: 1, HashKeys: true})
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/secret", "v"), http.StatusOK)
+	service.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read capture: %v", err)
+	}
+	if strings.Contains(string(data), "secret") || !strings.Contains(string(data), hashCaptureKey("secret")) {
+		t.Fatalf("capture = %s, want only the key hash", data)
+	}
+
+	// A tiny sample rate records nothing from a handful of requests.
+	path = filepath.Join(t.TempDir(), "capture.jsonl")
+	service, router = captureTestService(t, CaptureConfig{Enabled: true, Path: path, SampleRate: 1e-12})
+	for range 20 {
+		serve(router, http.MethodGet, "/v2/cache/k", "")
+	}
+	service.Close()
+	if data, err := os.ReadFile(path); err != nil || len(data) != 0 {
+		t.Fatalf("capture = %q, %v, want empty", data, err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	rf, err := openRotatingFile(path, 20, 3)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error: %v", err)
+	}
+	for _, line := range []string{"first-line", "second-line", "third-line", "fourth-line"} {
+		if err := rf.writeLine([]byte(line)); err != nil {
+			t.Fatalf("writeLine() error: %v", err)
+		}
+	}
+	if err := rf.close(); err != nil {
+		t.Fatalf("close() error: %v", err)
+	}
+
+	for suffix, want := range map[string]string{"": "fourth-line\n", ".1": "third-line\n", ".2": "second-line\n"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v, want %q", path+suffix, data, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more than 3 files: %v", err)
+	}
+}
+
+func TestCaptureConfigValidation(t *testing.T) {
+	for _, config := range []CaptureConfig{
+		{SampleRate: 1.5},
+		{MaxFiles: -1},
+		{Enabled: true},
+	} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultClientURL     = "http://127.0.0.1:8080"
+	defaultClientTimeout = 10 * time.Second
+)
+
+// clientCommands are the subcommands that talk to a running cache over HTTP.
+var clientCommands = map[string]func(*cacheClient, *flag.FlagSet, []string) int{
+	"get":    (*cacheClient).get,
+	"set":    (*cacheClient).set,
+	"del":    (*cacheClient).del,
+	"ttl":    (*cacheClient).ttl,
+	"keys":   (*cacheClient).keys,
+	"stats":  (*cacheClient).stats,
+	"bench":  (*cacheClient).bench,
+	"replay": (*cacheClient).replay,
+}
+
+// cacheClient is the HTTP client behind the get, set, del, ttl, keys, stats
+// and bench subcommands. Values are printed as stored unless JSON output is
+// requested.
+type cacheClient struct {
+	http      *http.Client
+	baseURL   string
+	token     string
+	namespace string
+	json      bool
+	timeout   time.Duration
+	stdin     io.Reader
+	stdout    io.Writer
+}
+
+// clientError is a non-2xx response, carrying the error the server reported.
+type clientError struct {
+	message string
+	details string
+}
+
+func (e *clientError) Error() string {
+	if e.details != "" {
+		return fmt.Sprintf("%s: %s", e.message, e.details)
+	}
+	return e.message
+}
+
+func runClient(name string, args []string) int {
+	return runClientWith(&http.Client{}, os.Getenv, name, args, os.Stdin, os.Stdout)
+}
+
+// runClientWith parses the flags shared by every client subcommand, then
+// hands the remaining arguments to the subcommand. The base URL comes from
+// CACHE_URL and the token from CACHE_TOKEN unless flags override them.
+func runClientWith(httpClient *http.Client, getenv func(string) string, name string, args []string, stdin io.Reader, stdout io.Writer) int {
+	command, ok := clientCommands[name]
+	if !ok {
+		log.Printf("unknown command %q", name)
+		return 2
+	}
+	baseURL := getenv("CACHE_URL")
+	if baseURL == "" {
+		baseURL = defaultClientURL
+	}
+
+	client := &cacheClient{http: httpClient, stdin: stdin, stdout: stdout}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&client.baseURL, "url", baseURL, "cache base URL (CACHE_URL)")
+	flags.StringVar(&client.token, "token", getenv("CACHE_TOKEN"), "bearer token (CACHE_TOKEN)")
+	flags.StringVar(&client.namespace, "namespace", "", "namespace to use instead of the default")
+	flags.BoolVar(&client.json, "json", false, "print JSON instead of raw output")
+	flags.DurationVar(&client.timeout, "timeout", defaultClientTimeout, "request timeout")
+	return command(client, flags, args)
+}
+
+// parse finishes flag parsing for a subcommand and checks its argument
+// count.
+func (c *cacheClient) parse(flags *flag.FlagSet, args []string, usage string, minArgs, maxArgs int) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() < minArgs || flags.NArg() > maxArgs {
+		log.Print(strings.TrimSpace("usage: cache " + flags.Name() + " [flags] " + usage))
+		return false
+	}
+	c.baseURL = strings.TrimRight(c.baseURL, "/")
+	c.http.Timeout = c.timeout
+	return true
+}
+
+// keyPath is the v2 path of key in the client's namespace. The key is
+// escaped as a single segment, so keys may contain slashes or '?'.
+func (c *cacheClient) keyPath(key string) string {
+	return keyPathIn(c.namespace, key)
+}
+
+func keyPathIn(namespace, key string) string {
+	if namespace != "" && namespace != defaultNamespace {
+		return "/v2/ns/" + url.PathEscape(namespace) + "/cache/" + url.PathEscape(key)
+	}
+	return "/v2/cache/" + url.PathEscape(key)
+}
+
+// newRequest builds a request for path on the cache, with the client's
+// token.
+func (c *cacheClient) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and turns non-2xx responses into a clientError.
+func (c *cacheClient) do(method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := c.newRequest(context.Background(), method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var payload map[string]string
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &payload); err != nil || payload["error"] == "" {
+		return nil, &clientError{message: fmt.Sprintf("request failed with status %d", resp.StatusCode)}
+	}
+	return nil, &clientError{message: payload["error"], details: payload["details"]}
+}
+
+// fail logs err and returns the exit status for it.
+func (c *cacheClient) fail(err error) int {
+	log.Print(err)
+	return 1
+}
+
+func (c *cacheClient) writeJSON(v any) int {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return c.fail(err)
+	}
+	return 0
+}
+
+// clientValue is the JSON form of a value. Values that are not valid UTF-8
+// are base64 encoded, as in exports.
+type clientValue struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTL         int    `json:"ttl"`
+	ETag        string `json:"etag,omitempty"`
+}
+
+func (c *cacheClient) get(flags *flag.FlagSet, args []string) int {
+	if !c.parse(flags, args, "KEY", 1, 1) {
+		return 2
+	}
+	key := flags.Arg(0)
+	resp, err := c.do(http.MethodGet, c.keyPath(key), nil, nil, nil)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer resp.Body.Close()
+
+	if !c.json {
+		if _, err := io.Copy(c.stdout, resp.Body); err != nil {
+			return c.fail(err)
+		}
+		return 0
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return c.fail(err)
+	}
+	ttl, _ := strconv.Atoi(resp.Header.Get("X-CACHE-TTL"))
+	value := clientValue{
+		Namespace:   c.namespace,
+		Key:         key,
+		Value:       string(data),
+		ContentType: resp.Header.Get("Content-Type"),
+		TTL:         ttl,
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if !utf8.Valid(data) {
+		value.Value = base64.StdEncoding.EncodeToString(data)
+		value.Encoding = snapshotEncodingBase64
+	}
+	return c.writeJSON(value)
+}
+
+func (c *cacheClient) set(flags *flag.FlagSet, args []string) int {
+	file := flags.String("file", "", "read the value from this file instead of stdin")
+	ttl := flags.String("ttl", "", "TTL in seconds")
+	contentType := flags.String("content-type", "", "content type to store with the value")
+	ifMatch := flags.String("if-match", "", "only write if the entry has this ETag")
+	ifAbsent := flags.Bool("if-absent", false, "only write if the key does not exist")
+	if !c.parse(flags, args, "KEY [VALUE]", 1, 2) {
+		return 2
+	}
+	key := flags.Arg(0)
+
+	var value []byte
+	var err error
+	switch {
+	case flags.NArg() == 2 && *file != "":
+		log.Print("set takes a value argument or -file, not both")
+		return 2
+	case flags.NArg() == 2:
+		value = []byte(flags.Arg(1))
+	case *file != "":
+		value, err = os.ReadFile(*file)
+	default:
+		value, err = io.ReadAll(c.stdin)
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+
+	query := url.Values{}
+	if *ttl != "" {
+		query.Set("ttl", *ttl)
+	}
+	header := http.Header{}
+	if *contentType != "" {
+		header.Set("Content-Type", *contentType)
+	}
+	if *ifMatch != "" {
+		header.Set("If-Match", *ifMatch)
+	}
+	if *ifAbsent {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := c.do(http.MethodPut, c.keyPath(key), query, bytes.NewReader(value), header)
+	if err != nil {
+		return c.fail(err)
+	}
+	resp.Body.Close()
+
+	if c.json {
+		return c.writeJSON(map[string]string{"key": key, "etag": resp.Header.Get("ETag")})
+	}
+	return 0
+}
+
+func (c *cacheClient) del(flags *flag.FlagSet, args []string) int {
+	if !c.parse(flags, args, "KEY", 1, 1) {
+		return 2
+	}
+	key := flags.Arg(0)
+	resp, err := c.do(http.MethodDelete, c.keyPath(key), nil, nil, nil)
+	if err != nil {
+		return c.fail(err)
+	}
+	resp.Body.Close()
+
+	if c.json {
+		return c.writeJSON(map[string]any{"key": key, "deleted": true})
+	}
+	return 0
+}
+
+// ttl prints the remaining TTL of a key or, given a TTL, changes it.
+func (c *cacheClient) ttl(flags *flag.FlagSet, args []string) int {
+	mode := flags.String("mode", ttlModeSet, "how to apply a new TTL: set, extend or cap")
+	if !c.parse(flags, args, "KEY [SECONDS]", 1, 2) {
+		return 2
+	}
+	key := flags.Arg(0)
+
+	var ttl string
+	if flags.NArg() == 2 {
+		body, err := json.Marshal(ttlPatchBody{TTL: flags.Arg(1), Mode: *mode})
+		if err != nil {
+			return c.fail(err)
+		}
+		resp, err := c.do(http.MethodPatch, c.keyPath(key), nil, bytes.NewReader(body), http.Header{"Content-Type": {"application/json"}})
+		if err != nil {
+			return c.fail(err)
+		}
+		resp.Body.Close()
+		ttl = resp.Header.Get("X-CACHE-TTL")
+	} else {
+		resp, err := c.do(http.MethodHead, c.keyPath(key), nil, nil, nil)
+		if err != nil {
+			return c.fail(err)
+		}
+		resp.Body.Close()
+		ttl = resp.Header.Get("X-CACHE-TTL")
+	}
+
+	if c.json {
+		seconds, _ := strconv.Atoi(ttl)
+		return c.writeJSON(map[string]any{"key": key, "ttl": seconds})
+	}
+	fmt.Fprintln(c.stdout, ttl)
+	return 0
+}
+
+// keys lists keys through the admin API, following the cursor until the
+// listing ends or limit keys have been printed.
+func (c *cacheClient) keys(flags *flag.FlagSet, args []string) int {
+	prefix := flags.String("prefix", "", "only list keys with this prefix")
+	pattern := flags.String("pattern", "", "only list keys matching this glob pattern")
+	limit := flags.Int("limit", 0, "stop after this many keys (0 for all)")
+	if !c.parse(flags, args, "", 0, 0) {
+		return 2
+	}
+
+	query := url.Values{"count": {strconv.Itoa(maxKeyListCount)}}
+	if *prefix != "" {
+		query.Set("prefix", *prefix)
+	}
+	if *pattern != "" {
+		query.Set("pattern", *pattern)
+	}
+	if c.namespace != "" {
+		query.Set("namespace", c.namespace)
+	}
+
+	keys := []string{}
+	cursor := "0"
+	for {
+		query.Set("cursor", cursor)
+		resp, err := c.do(http.MethodGet, "/api/admin/keys", query, nil, nil)
+		if err != nil {
+			return c.fail(err)
+		}
+		var page keyListResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return c.fail(fmt.Errorf("invalid key listing: %w", err))
+		}
+		keys = append(keys, page.Keys...)
+		if *limit > 0 && len(keys) >= *limit {
+			keys = keys[:*limit]
+			break
+		}
+		if cursor = page.Cursor; cursor == "0" {
+			break
+		}
+	}
+
+	if c.json {
+		return c.writeJSON(keys)
+	}
+	for _, key := range keys {
+		fmt.Fprintln(c.stdout, key)
+	}
+	return 0
+}
+
+// stats prints the admin statistics report, indented unless JSON output is
+// requested.
+func (c *cacheClient) stats(flags *flag.FlagSet, args []string) int {
+	if !c.parse(flags, args, "", 0, 0) {
+		return 2
+	}
+	resp, err := c.do(http.MethodGet, "/api/admin/stats", nil, nil, nil)
+	if err != nil {
+		return c.fail(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return c.fail(err)
+	}
+
+	var out bytes.Buffer
+	if c.json {
+		err = json.Compact(&out, data)
+	} else {
+		err = json.Indent(&out, data, "", "  ")
+	}
+	if err != nil {
+		return c.fail(errors.New("invalid statistics response"))
+	}
+	out.WriteByte('\n')
+	_, err = c.stdout.Write(out.Bytes())
+	if err != nil {
+		return c.fail(err)
+	}
+	return 0
+}
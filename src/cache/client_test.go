@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientTestServer runs a cache with tokens for reading, writing and admin
+// access and returns a way to run client subcommands against it.
+func clientTestServer(t *testing.T) (func(stdin string, args ...string) (int, string), *inspectFakeStore) {
+	t.Helper()
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{{Name: "ops", Token: "ops-token", Scopes: []string{scopeRead, scopeWrite, scopeDelete, scopeAdmin}}}}
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := &inspectFakeStore{fakeStore: newFakeStore()}
+	server := httptest.NewServer(newRouter(newCacheService(config, store)))
+	t.Cleanup(server.Close)
+
+	env := map[string]string{"CACHE_URL": server.URL + "/", "CACHE_TOKEN": "ops-token"}
+	run := func(stdin string, args ...string) (int, string) {
+		var out bytes.Buffer
+		code := runClientWith(server.Client(), func(name string) string { return env[name] }, args[0], args[1:], strings.NewReader(stdin), &out)
+		return code, out.String()
+	}
+	return run, store
+}
+
+func TestClientSetGetDelete(t *testing.T) {
+	run, store := clientTestServer(t)
+
+	if code, _ := run("from stdin", "set", "-ttl", "120", "-content-type", "text/plain", "a/b?c"); code != 0 {
+		t.Fatalf("set from stdin = %d", code)
+	}
+	if item := store.items["a/b?c"]; item.Value != "from stdin" || item.TTL != 120*time.Second || item.ContentType != "text/plain" {
+		t.Fatalf("stored item = %+v", item)
+	}
+	if code, out := run("", "get", "a/b?c"); code != 0 || out != "from stdin" {
+		t.Fatalf("get = %d, %q", code, out)
+	}
+
+	code, out := run("", "get", "-json", "a/b?c")
+	var value clientValue
+	if err := json.Unmarshal([]byte(out), &value); code != 0 || err != nil {
+		t.Fatalf("get -json = %d, %q, %v", code, out, err)
+	}
+	if value.Key != "a/b?c" || value.Value != "from stdin" || value.TTL != 120 || value.ETag != `"1"` || value.ContentType != "text/plain" {
+		t.Fatalf("get -json = %+v", value)
+	}
+
+	path := filepath.Join(t.TempDir(), "value.bin")
+	if err := os.WriteFile(path, []byte{0xff, 0x00}, 0o600); err != nil {
+		t.Fatalf("write value: %v", err)
+	}
+	if code, _ := run("", "set", "-namespace", "tenant", "-file", path, "bin"); code != 0 {
+		t.Fatalf("set -file = %d", code)
+	}
+	code, out = run("", "get", "-namespace", "tenant", "-json", "bin")
+	if err := json.Unmarshal([]byte(out), &value); code != 0 || err != nil || value.Value != "/wA=" || value.Encoding != snapshotEncodingBase64 {
+		t.Fatalf("get binary -json = %d, %q, %v", code, out, err)
+	}
+
+	if code, _ := run("", "set", "-if-absent", "a/b?c", "again"); code != 1 {
+		t.Fatalf("set -if-absent on existing key = %d, want 1", code)
+	}
+	if code, out := run("", "del", "-json", "a/b?c"); code != 0 || out != `{"deleted":true,"key":"a/b?c"}`+"\n" {
+		t.Fatalf("del = %d, %q", code, out)
+	}
+	if code, _ := run("", "get", "a/b?c"); code != 1 {
+		t.Fatalf("get after delete = %d, want 1", code)
+	}
+	if code, _ := run("", "del", "a/b?c"); code != 1 {
+		t.Fatalf("del of missing key = %d, want 1", code)
+	}
+}
+
+func TestClientTTL(t *testing.T) {
+	run, store := clientTestServer(t)
+	store.items["k"] = CacheItem{Value: "v", TTL: time.Minute, Version: 1}
+
+	if code, out := run("", "ttl", "k"); code != 0 || out != "60\n" {
+		t.Fatalf("ttl = %d, %q", code, out)
+	}
+	if code, out := run("", "ttl", "-mode", "extend", "k", "30"); code != 0 || out != "90\n" {
+		t.Fatalf("ttl extend = %d, %q", code, out)
+	}
+	if code, out := run("", "ttl", "-json", "k", "10"); code != 0 || out != `{"key":"k","ttl":10}`+"\n" {
+		t.Fatalf("ttl -json = %d, %q", code, out)
+	}
+	if code, _ := run("", "ttl", "-mode", "sideways", "k", "10"); code != 1 {
+		t.Fatalf("ttl with invalid mode = %d, want 1", code)
+	}
+}
+
+func TestClientKeysAndStats(t *testing.T) {
+	run, store := clientTestServer(t)
+	for _, key := range []string{"items:1", "items:2", "users:1"} {
+		store.items[key] = CacheItem{Value: "v", TTL: time.Minute}
+	}
+
+	if code, out := run("", "keys", "-prefix", "items:"); code != 0 || out != "items:1\nitems:2\n" {
+		t.Fatalf("keys = %d, %q", code, out)
+	}
+	if code, out := run("", "keys", "-json", "-limit", "1"); code != 0 || out != `["items:1"]`+"\n" {
+		t.Fatalf("keys -json -limit = %d, %q", code, out)
+	}
+	code, out := run("", "stats")
+	if code != 0 || !json.Valid([]byte(out)) || !strings.Contains(out, "\n  ") {
+		t.Fatalf("stats = %d, %q, want indented JSON", code, out)
+	}
+	code, out = run("", "stats", "-json")
+	if code != 0 || !json.Valid([]byte(out)) || strings.Count(out, "\n") != 1 {
+		t.Fatalf("stats -json = %d, %q, want compact JSON", code, out)
+	}
+}
+
+func TestClientAuthAndUsage(t *testing.T) {
+	run, _ := clientTestServer(t)
+
+	if code, _ := run("", "get", "-token", "wrong", "k"); code != 1 {
+		t.Fatalf("get with wrong token = %d, want 1", code)
+	}
+	if code, _ := run("", "get"); code != 2 {
+		t.Fatalf("get without key = %d, want 2", code)
+	}
+	if code, _ := run("", "set", "-file", "x", "k", "v"); code != 2 {
+		t.Fatalf("set with value and file = %d, want 2", code)
+	}
+	if code, _ := run("", "keys", "extra"); code != 2 {
+		t.Fatalf("keys with argument = %d, want 2", code)
+	}
+	if code, _ := run("", "stats", "-url", "http://127.0.0.1:1"); code != 1 {
+		t.Fatalf("stats against closed port = %d, want 1", code)
+	}
+}
+
+func TestClientErrorMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid key", "details": "too long"})
+	}))
+	defer server.Close()
+
+	client := &cacheClient{http: server.Client(), baseURL: server.URL}
+	_, err := client.do(http.MethodGet, "/v2/cache/k", nil, nil, nil)
+	if err == nil || err.Error() != "invalid key: too long" {
+		t.Fatalf("do() error = %v", err)
+	}
+}
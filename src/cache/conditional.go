@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Write conditions accepted by CacheStore.SetIf.
+const (
+	writeAlways    = ""
+	writeIfAbsent  = "nx"
+	writeIfPresent = "xx"
+	writeIfVersion = "cas"
+)
+
+// versionCounterKey holds the counter every write draws its version from.
+// Versions are global rather than per key so that a deleted and recreated
+// key never reuses a version an old reader may still hold.
+const versionCounterKey = internalKeyPrefix + "version"
+
+var (
+	errKeyExists       = errors.New("key already exists")
+	errKeyMissing      = errors.New("key not found")
+	errVersionMismatch = errors.New("version mismatch")
+)
+
+// WriteCondition guards a write. Version is only used by writeIfVersion.
+type WriteCondition struct {
+	Mode    string
+	Version int64
+
+	// failStatus is the response status when the condition does not hold:
+	// 412 for HTTP precondition headers and 409 for envelope fields.
+	failStatus int
+}
+
+// setItemScript writes an entry if its condition holds. KEYS[1] is the entry
+// and KEYS[2] the version counter. ARGV is the mode, expected version, TTL in
+// milliseconds, value, content type and comma-separated tags. The write time is recorded in
+// milliseconds so that admins can see when an entry was filled. It returns the
+// new version, or -1 if the key exists, -2 if it is missing and -3 if its
+// version differs.
+var setItemScript = redis.NewScript(`
+local exists = redis.call('EXISTS', KEYS[1]) == 1
+local mode = ARGV[1]
+if mode == 'nx' and exists then
+  return -1
+end
+if (mode == 'xx' or mode == 'cas') and not exists then
+  return -2
+end
+if mode == 'cas' then
+  local current = 0
+  if redis.call('TYPE', KEYS[1]).ok == 'hash' then
+    current = tonumber(redis.call('HGET', KEYS[1], 'ver')) or 0
+  end
+  if current ~= tonumber(ARGV[2]) then
+    return -3
+  end
+end
+local version = redis.call('INCR', KEYS[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'v', ARGV[4], 'ver', version, 'at', now, 'ttl', ARGV[3])
+if ARGV[5] ~= '' then
+  redis.call('HSET', KEYS[1], 'ct', ARGV[5])
+end
+if ARGV[6] ~= '' then
+  redis.call('HSET', KEYS[1], 'tags', ARGV[6])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return version
+`)
+
+func (rs *RedisStore) SetIf(ctx context.Context, key string, item CacheItem, cond WriteCondition) (int64, error) {
+	if item.TTL <= 0 {
+		return 0, fmt.Errorf("ttl must be greater than zero")
+	}
+
+	keys := []string{key, versionCounterKey}
+	version, err := setItemScript.Run(ctx, rs.client, keys, cond.Mode, cond.Version, item.TTL.Milliseconds(), item.Value, item.ContentType, strings.Join(item.Tags, ",")).Int64()
+	if err != nil {
+		return 0, err
+	}
+	switch version {
+	case -1:
+		return 0, errKeyExists
+	case -2:
+		return 0, errKeyMissing
+	case -3:
+		return 0, errVersionMismatch
+	}
+	return version, nil
+}
+
+func isConditionFailure(err error) bool {
+	return errors.Is(err, errKeyExists) || errors.Is(err, errKeyMissing) || errors.Is(err, errVersionMismatch)
+}
+
+// formatETag renders a version as a strong entity tag.
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseVersion accepts a bare version number or the ETag GET returned for it.
+func parseVersion(raw string) (int64, error) {
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(raw), `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("version must be a positive integer or an ETag")
+	}
+	return version, nil
+}
+
+// requestCondition reads the write condition from the If-Match and
+// If-None-Match headers, or from the condition and version fields of a JSON
+// envelope. Only If-None-Match: * and a single ETag or * in If-Match are
+// supported.
+func requestCondition(r *http.Request, condition, version string) (WriteCondition, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if (ifMatch != "" || ifNoneMatch != "") && (condition != "" || version != "") {
+		return WriteCondition{}, fmt.Errorf("use either conditional headers or condition fields, not both")
+	}
+
+	switch {
+	case ifMatch != "" && ifNoneMatch != "":
+		return WriteCondition{}, fmt.Errorf("If-Match and If-None-Match cannot be combined")
+	case ifNoneMatch != "":
+		if strings.TrimSpace(ifNoneMatch) != "*" {
+			return WriteCondition{}, fmt.Errorf("If-None-Match only supports *")
+		}
+		return WriteCondition{Mode: writeIfAbsent, failStatus: http.StatusPreconditionFailed}, nil
+	case ifMatch != "":
+		if strings.TrimSpace(ifMatch) == "*" {
+			return WriteCondition{Mode: writeIfPresent, failStatus: http.StatusPreconditionFailed}, nil
+		}
+		v, err := parseVersion(ifMatch)
+		if err != nil {
+			return WriteCondition{}, err
+		}
+		return WriteCondition{Mode: writeIfVersion, Version: v, failStatus: http.StatusPreconditionFailed}, nil
+	}
+
+	cond := WriteCondition{Mode: condition, failStatus: http.StatusConflict}
+	switch condition {
+	case writeAlways, writeIfVersion:
+		if version == "" {
+			if condition == writeIfVersion {
+				return WriteCondition{}, fmt.Errorf("version is required for cas")
+			}
+			return cond, nil
+		}
+		v, err := parseVersion(version)
+		if err != nil {
+			return WriteCondition{}, err
+		}
+		cond.Mode, cond.Version = writeIfVersion, v
+	case writeIfAbsent, writeIfPresent:
+		if version != "" {
+			return WriteCondition{}, fmt.Errorf("version can only be used with cas")
+		}
+	default:
+		return WriteCondition{}, fmt.Errorf("condition must be one of nx, xx or cas")
+	}
+	return cond, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConditionalEnvelopeWrites(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"first","condition":"xx"}`)
+	requireStatus(t, w, http.StatusConflict)
+	requireJSONField(t, w, "error", "write condition failed")
+	requireJSONField(t, w, "details", "key not found")
+
+	w = serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"first","condition":"nx"}`)
+	requireStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("write did not return an ETag")
+	}
+
+	w = serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"second","condition":"nx"}`)
+	requireStatus(t, w, http.StatusConflict)
+	requireJSONField(t, w, "details", "key already exists")
+
+	w = serve(router, http.MethodGet, "/api/cache?key=k", "")
+	requireBody(t, w, `"first"`)
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Fatalf("GET ETag = %q, want %q", got, etag)
+	}
+
+	w = serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"second","version":`+quoteJSON(etag)+`}`)
+	requireStatus(t, w, http.StatusOK)
+	if w.Header().Get("ETag") == etag {
+		t.Fatal("ETag did not change after a write")
+	}
+
+	w = serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"stale","condition":"cas","version":`+quoteJSON(etag)+`}`)
+	requireStatus(t, w, http.StatusConflict)
+	requireJSONField(t, w, "details", "version mismatch")
+	requireBody(t, serve(router, http.MethodGet, "/api/cache?key=k", ""), `"second"`)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"v","condition":"xx"}`), http.StatusOK)
+}
+
+func TestConditionalHeaderWrites(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+	put := func(headers map[string]string, value string) int {
+		return serveWithHeaders(router, http.MethodPut, "/v2/cache/k", value, headers).Code
+	}
+
+	if got := put(map[string]string{"If-Match": "*"}, "v"); got != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match * on missing key = %d, want 412", got)
+	}
+	if got := put(map[string]string{"If-None-Match": "*"}, "v1"); got != http.StatusOK {
+		t.Fatalf("If-None-Match * on missing key = %d, want 200", got)
+	}
+	if got := put(map[string]string{"If-None-Match": "*"}, "v2"); got != http.StatusPreconditionFailed {
+		t.Fatalf("If-None-Match * on existing key = %d, want 412", got)
+	}
+
+	etag := serveRaw(router, http.MethodGet, "/v2/cache/k", "", nil).Header().Get("ETag")
+	if got := put(map[string]string{"If-Match": etag}, "v2"); got != http.StatusOK {
+		t.Fatalf("If-Match current ETag = %d, want 200", got)
+	}
+	if got := put(map[string]string{"If-Match": etag}, "v3"); got != http.StatusPreconditionFailed {
+		t.Fatalf("If-Match stale ETag = %d, want 412", got)
+	}
+	requireBody(t, serveRaw(router, http.MethodGet, "/v2/cache/k", "", nil), "v2")
+}
+
+func TestConditionalWriteErrors(t *testing.T) {
+	router := testRouter(newFakeStore())
+
+	for _, body := range []string{
+		`{"key":"k","value":"v","condition":"maybe"}`,
+		`{"key":"k","value":"v","condition":"cas"}`,
+		`{"key":"k","value":"v","condition":"nx","version":"1"}`,
+		`{"key":"k","value":"v","version":"-1"}`,
+		`{"key":"k","value":"v","version":"abc"}`,
+	} {
+		w := serve(router, http.MethodPost, "/api/cache", body)
+		requireStatus(t, w, http.StatusBadRequest)
+		requireJSONField(t, w, "error", "invalid write condition")
+	}
+
+	for _, headers := range []map[string]string{
+		{"If-None-Match": `"1"`},
+		{"If-Match": `W/"1"`},
+		{"If-Match": "*", "If-None-Match": "*"},
+	} {
+		w := serveWithHeaders(router, http.MethodPut, "/v2/cache/k", "v", headers)
+		requireStatus(t, w, http.StatusBadRequest)
+		requireJSONField(t, w, "error", "invalid write condition")
+	}
+
+	w := serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"k","value":"v","condition":"nx"}`, map[string]string{"If-None-Match": "*"})
+	requireStatus(t, w, http.StatusBadRequest)
+}
+
+func TestParseVersion(t *testing.T) {
+	for raw, want := range map[string]int64{"7": 7, `"7"`: 7, ` "12" `: 12} {
+		if got, err := parseVersion(raw); err != nil || got != want {
+			t.Fatalf("parseVersion(%q) = %d, %v, want %d", raw, got, err, want)
+		}
+	}
+	if got := formatETag(42); got != `"42"` {
+		t.Fatalf("formatETag(42) = %s", got)
+	}
+}
+
+func TestRedisStoreRejectsInvalidSetIfTTL(t *testing.T) {
+	store := NewRedisStore(testConfig())
+	defer store.Close()
+
+	if _, err := store.SetIf(context.Background(), "key", CacheItem{Value: "v"}, WriteCondition{Mode: writeIfAbsent}); err == nil {
+		t.Fatal("SetIf accepted a zero ttl")
+	}
+	if _, err := store.SetIf(context.Background(), "key", CacheItem{Value: "v", TTL: -time.Second}, WriteCondition{}); err == nil {
+		t.Fatal("SetIf accepted a negative ttl")
+	}
+}
+
+func quoteJSON(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Event operations.
+const (
+	eventSet        = "set"
+	eventDelete     = "delete"
+	eventTTL        = "ttl"
+	eventExpire     = "expire"
+	eventInvalidate = "invalidate"
+)
+
+const (
+	defaultEventBufferSize  = 256
+	defaultEventRetention   = 10000
+	defaultEventResumeLimit = 1000
+
+	eventStreamKey      = internalKeyPrefix + "events"
+	eventDedupePrefix   = internalKeyPrefix + "events:expired:"
+	eventDedupeWindow   = 5 * time.Second
+	eventAppendQueue    = 1024
+	eventReadBlock      = 5 * time.Second
+	eventRetryDelay     = time.Second
+	eventKeepAlive      = 15 * time.Second
+	keyExpiredEventChan = "__keyevent@0__:expired"
+)
+
+// EventsConfig turns on the change event stream and sizes it. While it is
+// off, writes are not appended to the shared log and expirations are not
+// followed. Zero values fall back to the defaults above.
+type EventsConfig struct {
+	Enabled     bool  `json:"enabled"`
+	BufferSize  int   `json:"buffer_size"`
+	Retention   int64 `json:"retention"`
+	ResumeLimit int   `json:"resume_limit"`
+}
+
+func (ec *EventsConfig) validate() error {
+	if ec.BufferSize < 0 || ec.Retention < 0 || ec.ResumeLimit < 0 {
+		return fmt.Errorf("events limits must not be negative")
+	}
+	return nil
+}
+
+// CacheEvent describes one change to a cache entry. TTL is in seconds and
+// Size is the value size in bytes, both only set where they apply. An
+// invalidate event covers every key starting with Prefix instead of a single
+// Key, and Count is the number of keys it removed.
+type CacheEvent struct {
+	ID        string    `json:"id,omitempty"`
+	Op        string    `json:"op"`
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Count     int64     `json:"count,omitempty"`
+	TTL       int64     `json:"ttl,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Time      time.Time `json:"timestamp"`
+}
+
+// matchesPrefix reports whether the event may concern keys starting with
+// prefix. An invalidation matches when the two prefixes overlap, and a tag
+// invalidation may concern any key.
+func (event CacheEvent) matchesPrefix(prefix string) bool {
+	if event.Op == eventInvalidate && event.Tag != "" {
+		return true
+	}
+	if event.Op == eventInvalidate {
+		return strings.HasPrefix(event.Prefix, prefix) || strings.HasPrefix(prefix, event.Prefix)
+	}
+	return strings.HasPrefix(event.Key, prefix)
+}
+
+// EventStore is implemented by stores that keep events in a shared log.
+// With it every instance streams the writes of every other instance, and
+// clients can resume from the last event they saw. Without it events stay
+// in the process that produced them.
+type EventStore interface {
+	// AppendEvent adds event to the log, trimming it to about maxLen
+	// entries. Expire events are appended once even when several instances
+	// report the same expiry.
+	AppendEvent(ctx context.Context, event CacheEvent, maxLen int64) error
+	// ReadEvents returns up to count events after the given ID, waiting up
+	// to block for new ones when block is positive.
+	ReadEvents(ctx context.Context, after string, count int64, block time.Duration) ([]CacheEvent, error)
+	// SubscribeExpirations delivers the Redis keys that expire until ctx is
+	// done. It needs keyspace notifications for expired events enabled.
+	SubscribeExpirations(ctx context.Context) <-chan string
+}
+
+// appendEventScript appends ARGV[3] to the stream in KEYS[1]. When ARGV[1]
+// is set, KEYS[2] is claimed for that many milliseconds first and the event
+// is skipped if another instance already claimed it.
+var appendEventScript = redis.NewScript(`
+if ARGV[1] ~= '' then
+  if not redis.call('SET', KEYS[2], '1', 'NX', 'PX', ARGV[1]) then
+    return false
+  end
+end
+return redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[2], '*', 'e', ARGV[3])
+`)
+
+func (rs *RedisStore) AppendEvent(ctx context.Context, event CacheEvent, maxLen int64) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	dedupeKey, dedupeMs := eventDedupePrefix, ""
+	if event.Op == eventExpire {
+		dedupeKey += event.Namespace + ":" + event.Key
+		dedupeMs = strconv.FormatInt(eventDedupeWindow.Milliseconds(), 10)
+	}
+	err = appendEventScript.Run(ctx, rs.client, []string{eventStreamKey, dedupeKey}, dedupeMs, maxLen, payload).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+func (rs *RedisStore) ReadEvents(ctx context.Context, after string, count int64, block time.Duration) ([]CacheEvent, error) {
+	if block <= 0 {
+		block = -1
+	}
+	streams, err := rs.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{eventStreamKey, after},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var events []CacheEvent
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			payload, _ := msg.Values["e"].(string)
+			var event CacheEvent
+			if err := json.Unmarshal([]byte(payload), &event); err != nil {
+				log.Printf("invalid event %s: %v", msg.ID, err)
+				continue
+			}
+			event.ID = msg.ID
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (rs *RedisStore) SubscribeExpirations(ctx context.Context) <-chan string {
+	keys := make(chan string, 64)
+	go func() {
+		defer close(keys)
+		sub := rs.client.Subscribe(ctx, keyExpiredEventChan)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case keys <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return keys
+}
+
+// eventSubscriber is one event stream client. Its channel is closed when it
+// falls more than its buffer behind.
+type eventSubscriber struct {
+	namespace string
+	prefixes  []string
+	events    chan CacheEvent
+}
+
+func (s *eventSubscriber) matches(event CacheEvent) bool {
+	if event.Namespace != s.namespace {
+		return false
+	}
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if event.matchesPrefix(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventBroker fans change events out to stream subscribers. With an
+// EventStore events go through the shared log and come back to every
+// instance from there; otherwise they are delivered directly.
+type eventBroker struct {
+	enabled     bool
+	store       EventStore
+	bufferSize  int
+	retention   int64
+	resumeLimit int
+	queue       chan CacheEvent
+	breaker     *breakerStore
+	stop        context.CancelFunc
+	seq         atomic.Int64
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+	sinks       []func(CacheEvent)
+}
+
+// newEventBroker starts the shared log when events are enabled. Expirations
+// are watched when events are enabled or when expirations is set, so that
+// webhooks see expire events even while the stream is off.
+func newEventBroker(config EventsConfig, expirations bool, store CacheStore, namespaces *namespaces, breaker *breakerStore) *eventBroker {
+	b := &eventBroker{
+		enabled:     config.Enabled,
+		breaker:     breaker,
+		bufferSize:  defaultEventBufferSize,
+		retention:   defaultEventRetention,
+		resumeLimit: defaultEventResumeLimit,
+		stop:        func() {},
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+	if config.BufferSize > 0 {
+		b.bufferSize = config.BufferSize
+	}
+	if config.Retention > 0 {
+		b.retention = config.Retention
+	}
+	if config.ResumeLimit > 0 {
+		b.resumeLimit = config.ResumeLimit
+	}
+
+	eventStore, ok := store.(EventStore)
+	if !ok || (!b.enabled && !expirations) {
+		return b
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stop = cancel
+	if b.enabled {
+		b.store = eventStore
+		b.queue = make(chan CacheEvent, eventAppendQueue)
+		go b.appendEvents(ctx)
+		go b.tailEvents(ctx)
+	}
+	go func() {
+		for storeKey := range eventStore.SubscribeExpirations(ctx) {
+			if ns, key, ok := namespaces.split(storeKey); ok {
+				b.publish(CacheEvent{Op: eventExpire, Namespace: ns.name, Key: key})
+			}
+		}
+	}()
+	return b
+}
+
+// publish records an event. It never blocks the write path: when the log
+// cannot keep up, events are dropped and counted. While the stream is off,
+// only the sinks see the event.
+func (b *eventBroker) publish(event CacheEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	b.mu.Lock()
+	sinks := b.sinks
+	b.mu.Unlock()
+	for _, sink := range sinks {
+		sink(event)
+	}
+	if !b.enabled {
+		return
+	}
+	if b.store == nil {
+		event.ID = strconv.FormatInt(b.seq.Add(1), 10)
+		b.fanOut(event)
+		return
+	}
+	select {
+	case b.queue <- event:
+	default:
+		eventMetrics.Add("dropped", 1)
+	}
+}
+
+// addSink registers a consumer that sees every event published by this
+// instance, before it reaches the shared log.
+func (b *eventBroker) addSink(sink func(CacheEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+func (b *eventBroker) appendEvents(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-b.queue:
+			b.append(ctx, event)
+		}
+	}
+}
+
+// append writes event to the shared log. Events that cannot be written,
+// including those that arrive while the breaker is open, are dropped.
+func (b *eventBroker) append(ctx context.Context, event CacheEvent) {
+	if !b.breaker.allow() {
+		eventMetrics.Add("dropped", 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+	if err := b.store.AppendEvent(ctx, event, b.retention); err != nil {
+		eventMetrics.Add("dropped", 1)
+		log.Printf("Redis event append error: %v", err)
+	}
+}
+
+// tailEvents follows the shared log from the moment the instance started
+// and hands every new event to local subscribers. It starts from the current
+// time rather than "$" so that no event is lost between two reads.
+func (b *eventBroker) tailEvents(ctx context.Context) {
+	last := strconv.FormatInt(time.Now().UnixMilli(), 10) + "-0"
+	for ctx.Err() == nil {
+		events, err := b.store.ReadEvents(ctx, last, 100, eventReadBlock)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Redis event read error: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(eventRetryDelay):
+			}
+			continue
+		}
+		for _, event := range events {
+			last = event.ID
+			b.fanOut(event)
+		}
+	}
+}
+
+func (b *eventBroker) fanOut(event CacheEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	eventMetrics.Add("published", 1)
+	for sub := range b.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// A subscriber this far behind is cut off; it can reconnect
+			// with Last-Event-ID and catch up from the log.
+			delete(b.subscribers, sub)
+			close(sub.events)
+			eventMetrics.Add("overflows", 1)
+		}
+	}
+}
+
+func (b *eventBroker) subscribe(namespace string, prefixes []string) (*eventSubscriber, func()) {
+	sub := &eventSubscriber{namespace: namespace, prefixes: prefixes, events: make(chan CacheEvent, b.bufferSize)}
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+func (b *eventBroker) close() {
+	b.stop()
+}
+
+// flush stops the broker and appends events still queued to the shared log.
+func (b *eventBroker) flush(ctx context.Context) {
+	b.stop()
+	for ctx.Err() == nil {
+		select {
+		case event := <-b.queue:
+			b.append(ctx, event)
+		default:
+			return
+		}
+	}
+}
+
+// split maps a Redis key back to its namespace and cache key. Internal keys
+// that do not belong to a namespace are not reported.
+func (n *namespaces) split(storeKey string) (*namespace, string, bool) {
+	rest, ok := strings.CutPrefix(storeKey, namespaceKeyPrefix)
+	if !ok {
+		if strings.HasPrefix(storeKey, internalKeyPrefix) {
+			return nil, "", false
+		}
+		return n.defaultNS, storeKey, true
+	}
+	name, key, ok := strings.Cut(rest, ":")
+	ns := n.byName[name]
+	if !ok || ns == nil {
+		return nil, "", false
+	}
+	return ns, key, true
+}
+
+// compareEventIDs orders Redis stream IDs of the form <ms>-<seq>.
+func compareEventIDs(a, b string) int {
+	aMs, aSeq, _ := strings.Cut(a, "-")
+	bMs, bSeq, _ := strings.Cut(b, "-")
+	for _, pair := range [][2]string{{aMs, bMs}, {aSeq, bSeq}} {
+		x, _ := strconv.ParseUint(pair[0], 10, 64)
+		y, _ := strconv.ParseUint(pair[1], 10, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// EventStream serves change events in the request namespace as
+// Server-Sent Events. Repeated prefix parameters filter by key prefix. A
+// client that reconnects with Last-Event-ID first receives what it missed,
+// as far back as the log reaches.
+func (cs *CacheService) EventStream(w http.ResponseWriter, r *http.Request) {
+	if !cs.events.enabled {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "events are not enabled"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+	ns := cs.requestNamespace(r)
+	sub, unsubscribe := cs.events.subscribe(ns.name, r.URL.Query()["prefix"])
+	defer unsubscribe()
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	writeNoStore(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	eventMetrics.Add("subscribers", 1)
+	defer eventMetrics.Add("subscribers", -1)
+
+	lastSent := ""
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" && cs.events.store != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+		missed, err := cs.events.store.ReadEvents(ctx, lastID, int64(cs.events.resumeLimit), 0)
+		cancel()
+		if err != nil {
+			log.Printf("Redis event read error: %v", err)
+		}
+		for _, event := range missed {
+			if !sub.matches(event) {
+				continue
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+			lastSent = event.ID
+		}
+		flusher.Flush()
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-cs.stopping:
+			// The client reconnects with Last-Event-ID to another instance.
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			// Events replayed from the log may also arrive live.
+			if lastSent != "" && compareEventIDs(event.ID, lastSent) <= 0 {
+				continue
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event CacheEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Op, data)
+	return err
+}
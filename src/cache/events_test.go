@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventFakeStore keeps an in-memory event log with stream-like IDs.
+type eventFakeStore struct {
+	*fakeStore
+	log     []CacheEvent
+	seq     int
+	expired chan string
+}
+
+func newEventFakeStore() *eventFakeStore {
+	return &eventFakeStore{fakeStore: newFakeStore(), expired: make(chan string, 8)}
+}
+
+func (s *eventFakeStore) AppendEvent(_ context.Context, event CacheEvent, _ int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	event.ID = fmt.Sprintf("%d-%d", time.Now().UnixMilli()+1, s.seq)
+	s.log = append(s.log, event)
+	return nil
+}
+
+func (s *eventFakeStore) ReadEvents(ctx context.Context, after string, count int64, block time.Duration) ([]CacheEvent, error) {
+	deadline := time.Now().Add(block)
+	for {
+		s.mu.Lock()
+		var events []CacheEvent
+		for _, event := range s.log {
+			if compareEventIDs(event.ID, after) > 0 && int64(len(events)) < count {
+				events = append(events, event)
+			}
+		}
+		s.mu.Unlock()
+		if len(events) > 0 || time.Now().After(deadline) || ctx.Err() != nil {
+			return events, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *eventFakeStore) SubscribeExpirations(ctx context.Context) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case key := <-s.expired:
+				keys <- key
+			}
+		}
+	}()
+	return keys
+}
+
+type sseEvent struct {
+	id    string
+	op    string
+	event CacheEvent
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, path string, headers map[string]string) (*bufio.Reader, func()) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("open event stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("event stream status = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+func readSSE(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && ev.op != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.op = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev.event); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+		}
+	}
+}
+
+func waitForSubscribers(t *testing.T, b *eventBroker, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		count := len(b.subscribers)
+		b.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("subscribers never reached %d", n)
+}
+
+func eventsTestConfig() *Config {
+	config := testConfig()
+	config.Events.Enabled = true
+	return config
+}
+
+func TestEventStreamWritePaths(t *testing.T) {
+	service := newCacheService(eventsTestConfig(), newFakeStore())
+	router := newRouter(service)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	all, closeAll := openEventStream(t, server, "/api/events", nil)
+	defer closeAll()
+	filtered, closeFiltered := openEventStream(t, server, "/api/events?prefix=items:", nil)
+	defer closeFiltered()
+	waitForSubscribers(t, service.events, 2)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"other","value":"x"}`), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"items:1","value":"abc","ttl":"60"}`), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPatch, "/v2/cache/items:1", `{"ttl":"90"}`), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache/items:1", ""), http.StatusNoContent)
+
+	if ev := readSSE(t, all); ev.op != eventSet || ev.event.Key != "other" {
+		t.Fatalf("first event = %+v", ev)
+	}
+
+	set := readSSE(t, filtered)
+	if set.op != eventSet || set.event.Key != "items:1" || set.event.Namespace != defaultNamespace || set.event.TTL != 60 || set.event.Size != 3 || set.event.Time.IsZero() || set.id == "" {
+		t.Fatalf("set event = %+v", set)
+	}
+	if ev := readSSE(t, filtered); ev.op != eventTTL || ev.event.TTL != 90 {
+		t.Fatalf("ttl event = %+v", ev)
+	}
+	if ev := readSSE(t, filtered); ev.op != eventDelete || ev.event.Key != "items:1" {
+		t.Fatalf("delete event = %+v", ev)
+	}
+}
+
+func TestEventStreamNamespaceIsolation(t *testing.T) {
+	config := eventsTestConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	service := newCacheService(config, newFakeStore())
+	router := newRouter(service)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	stream, closeStream := openEventStream(t, server, "/api/ns/tenant/events", nil)
+	defer closeStream()
+	waitForSubscribers(t, service.events, 1)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"a","value":"default"}`), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodPost, "/api/ns/tenant/cache", `{"key":"b","value":"tenant"}`), http.StatusOK)
+
+	if ev := readSSE(t, stream); ev.event.Key != "b" || ev.event.Namespace != "tenant" {
+		t.Fatalf("tenant stream got %+v", ev)
+	}
+}
+
+func TestEventsDisabled(t *testing.T) {
+	store := newEventFakeStore()
+	service := newCacheService(testConfig(), store)
+	defer service.Close()
+	router := newRouter(service)
+	var seen []CacheEvent
+	service.events.addSink(func(event CacheEvent) { seen = append(seen, event) })
+
+	w := serve(router, http.MethodGet, "/api/events", "")
+	requireStatus(t, w, http.StatusNotFound)
+	requireJSONField(t, w, "error", "events are not enabled")
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/k", "v"), http.StatusOK)
+	if len(seen) != 1 || seen[0].Op != eventSet {
+		t.Fatalf("sink saw %+v, want the set event", seen)
+	}
+	store.mu.Lock()
+	appended := len(store.log)
+	store.mu.Unlock()
+	if appended != 0 {
+		t.Fatalf("%d events appended to the log while events are off", appended)
+	}
+}
+
+func TestEventBrokerDropsSlowSubscribers(t *testing.T) {
+	broker := newEventBroker(EventsConfig{Enabled: true, BufferSize: 1}, false, newFakeStore(), newNamespaces(nil, newFakeStore(), nil), nil)
+	sub, unsubscribe := broker.subscribe(defaultNamespace, nil)
+	defer unsubscribe()
+
+	before := counterValue(eventMetrics, "overflows")
+	broker.publish(CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "a"})
+	broker.publish(CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "b"})
+
+	if ev, ok := <-sub.events; !ok || ev.Key != "a" {
+		t.Fatalf("first event = %+v, %v", ev, ok)
+	}
+	if _, ok := <-sub.events; ok {
+		t.Fatal("slow subscriber was not cut off")
+	}
+	requireCounterDelta(t, eventMetrics, "overflows", before, 1)
+}
+
+func TestEventStreamSharedLogAndResume(t *testing.T) {
+	config := eventsTestConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := newEventFakeStore()
+	service := newCacheService(config, store)
+	defer service.Close()
+	router := newRouter(service)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	stream, closeStream := openEventStream(t, server, "/api/ns/tenant/events", nil)
+	waitForSubscribers(t, service.events, 1)
+
+	store.expired <- namespaceKeyPrefix + "tenant:session"
+	store.expired <- internalKeyPrefix + "lease:ignored"
+	expired := readSSE(t, stream)
+	if expired.op != eventExpire || expired.event.Key != "session" || expired.event.Namespace != "tenant" {
+		t.Fatalf("expire event = %+v", expired)
+	}
+	closeStream()
+	waitForSubscribers(t, service.events, 0)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/ns/tenant/cache", `{"key":"missed","value":"v"}`), http.StatusOK)
+
+	resumed, closeResumed := openEventStream(t, server, "/api/ns/tenant/events", map[string]string{"Last-Event-ID": expired.id})
+	defer closeResumed()
+	if ev := readSSE(t, resumed); ev.event.Key != "missed" {
+		t.Fatalf("resumed stream started with %+v", ev)
+	}
+	requireStatus(t, serve(router, http.MethodPost, "/api/ns/tenant/cache", `{"key":"live","value":"v"}`), http.StatusOK)
+	if ev := readSSE(t, resumed); ev.event.Key != "live" {
+		t.Fatalf("live event after resume = %+v", ev)
+	}
+}
+
+func TestNamespaceSplit(t *testing.T) {
+	n := newNamespaces([]NamespaceConfig{{Name: "tenant"}}, newFakeStore(), nil)
+	tests := []struct {
+		storeKey string
+		ns       string
+		key      string
+		ok       bool
+	}{
+		{storeKey: "plain", ns: defaultNamespace, key: "plain", ok: true},
+		{storeKey: namespaceKeyPrefix + "tenant:a:b", ns: "tenant", key: "a:b", ok: true},
+		{storeKey: namespaceKeyPrefix + "missing:a"},
+		{storeKey: rateLimitKeyPrefix + "x"},
+	}
+	for _, tt := range tests {
+		ns, key, ok := n.split(tt.storeKey)
+		if ok != tt.ok || (ok && (ns.name != tt.ns || key != tt.key)) {
+			t.Fatalf("split(%q) = %v, %q, %v", tt.storeKey, ns, key, ok)
+		}
+	}
+}
+
+func TestCompareEventIDs(t *testing.T) {
+	if compareEventIDs("10-0", "9-5") != 1 || compareEventIDs("10-1", "10-2") != -1 || compareEventIDs("10-2", "10-2") != 0 {
+		t.Fatal("compareEventIDs ordered IDs incorrectly")
+	}
+}
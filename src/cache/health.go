@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Health statuses in the verbose report. A degraded service still answers
+// requests, such as stale reads behind an open circuit breaker.
+const (
+	healthOK          = "ok"
+	healthDegraded    = "degraded"
+	healthUnavailable = "unavailable"
+)
+
+// PoolReporter is implemented by stores that keep a connection pool.
+type PoolReporter interface {
+	PoolStats() *redis.PoolStats
+}
+
+func (rs *RedisStore) PoolStats() *redis.PoolStats {
+	return rs.client.PoolStats()
+}
+
+// healthReport is the verbose health response.
+type healthReport struct {
+	Status   string                 `json:"status"`
+	Ready    bool                   `json:"ready"`
+	Draining bool                   `json:"draining"`
+	Uptime   int64                  `json:"uptime_seconds"`
+	Checks   map[string]healthCheck `json:"checks"`
+	Build    buildInfo              `json:"build"`
+}
+
+// healthCheck is the state of one dependency. Latency is in milliseconds.
+type healthCheck struct {
+	Status  string       `json:"status"`
+	Latency float64      `json:"latency_ms,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Server  *ServerStats `json:"server,omitempty"`
+	Pool    *poolStats   `json:"pool,omitempty"`
+	State   string       `json:"state,omitempty"`
+}
+
+type poolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
+}
+
+// buildInfo describes the running binary. Revision, Time and Modified come
+// from version control and are empty when the binary was built outside a
+// checkout.
+type buildInfo struct {
+	GoVersion string `json:"go_version"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Version = bi.Main.Version
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// livezHandler answers as long as the process can serve HTTP. It never
+// touches Redis, so a Redis outage does not get the container restarted.
+func (cs *CacheService) livezHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeNoStore(w)
+		http.NotFound(w, r)
+		return
+	}
+	writeNoStore(w)
+	writeText(w, http.StatusOK, "OK")
+}
+
+// readyzHandler answers whether the instance should receive traffic: it is
+// not draining, every subsystem the config turns on is running, and the
+// store is reachable, or the circuit breaker can serve stale reads in its
+// place.
+func (cs *CacheService) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeNoStore(w)
+		http.NotFound(w, r)
+		return
+	}
+	writeNoStore(w)
+	if cs.draining.Load() {
+		writeText(w, http.StatusServiceUnavailable, "draining")
+		return
+	}
+	if err := cs.checkStartup(); err != nil {
+		writeText(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err := cs.HealthCheck(r.Context()); err != nil && !cs.breakerOpen() {
+		writeText(w, http.StatusServiceUnavailable, "Redis connection failed")
+		return
+	}
+	writeText(w, http.StatusOK, "OK")
+}
+
+// verboseHealth writes the JSON health report. The status code matches the
+// plain /health response.
+func (cs *CacheService) verboseHealth(w http.ResponseWriter, r *http.Request) {
+	report := cs.healthReport(r.Context())
+	status := http.StatusOK
+	if report.Status == healthUnavailable {
+		status = http.StatusServiceUnavailable
+	}
+	if cs.breaker != nil {
+		w.Header().Set("X-Cache-Breaker", cs.breaker.state())
+	}
+	writeNoStore(w)
+	writeJSON(w, status, report)
+}
+
+func (cs *CacheService) healthReport(ctx context.Context) healthReport {
+	report := healthReport{
+		Status:   healthOK,
+		Draining: cs.draining.Load(),
+		Uptime:   int64(time.Since(cs.started).Seconds()),
+		Checks:   make(map[string]healthCheck),
+		Build:    readBuildInfo(),
+	}
+	startupCheck := healthCheck{Status: healthOK}
+	if err := cs.checkStartup(); err != nil {
+		startupCheck.Status = healthUnavailable
+		startupCheck.Error = err.Error()
+		report.Status = healthUnavailable
+	}
+	report.Checks["startup"] = startupCheck
+
+	redisCheck := healthCheck{Status: healthOK}
+	start := time.Now()
+	err := cs.HealthCheck(ctx)
+	redisCheck.Latency = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		redisCheck.Status = healthUnavailable
+		redisCheck.Error = err.Error()
+		report.Status = healthUnavailable
+	} else if statsStore, ok := unwrapStore(cs.store).(StatsStore); ok {
+		infoCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		server, err := statsStore.ServerStats(infoCtx)
+		cancel()
+		if err != nil {
+			redisCheck.Error = err.Error()
+		} else {
+			redisCheck.Server = &server
+		}
+	}
+	if pool, ok := unwrapStore(cs.store).(PoolReporter); ok {
+		stats := pool.PoolStats()
+		redisCheck.Pool = &poolStats{
+			Hits:       stats.Hits,
+			Misses:     stats.Misses,
+			Timeouts:   stats.Timeouts,
+			TotalConns: stats.TotalConns,
+			IdleConns:  stats.IdleConns,
+			StaleConns: stats.StaleConns,
+		}
+	}
+	report.Checks["redis"] = redisCheck
+
+	// Reads fall back to the primary, so replicas out of rotation only
+	// degrade the service.
+	if replicas, ok := unwrapStore(cs.store).(ReplicaReporter); ok {
+		if healthy, total := replicas.ReplicaHealth(); total > 0 {
+			replicaCheck := healthCheck{Status: healthOK, State: fmt.Sprintf("%d/%d healthy", healthy, total)}
+			if healthy < total {
+				replicaCheck.Status = healthDegraded
+				if report.Status == healthOK {
+					report.Status = healthDegraded
+				}
+			}
+			report.Checks["replicas"] = replicaCheck
+		}
+	}
+
+	if cs.breaker != nil {
+		breakerCheck := healthCheck{Status: healthOK, State: cs.breaker.state()}
+		if cs.breakerOpen() {
+			breakerCheck.Status = healthDegraded
+			report.Status = healthDegraded
+		}
+		report.Checks["breaker"] = breakerCheck
+	}
+	report.Ready = !report.Draining && report.Status != healthUnavailable
+	return report
+}
+
+// checkStartup reports a subsystem that the config turns on but that is not
+// running, because it was never started or its worker has exited.
+func (cs *CacheService) checkStartup() error {
+	if cs.config.Warm.Refresh.Enabled && (cs.refresher == nil || isClosed(cs.refresher.done)) {
+		return errors.New("refresh-ahead is not running")
+	}
+	if cs.config.Capture.Enabled && (cs.capture == nil || isClosed(cs.capture.done)) {
+		return errors.New("request capture is not running")
+	}
+	if len(cs.config.Webhooks.Endpoints) > 0 && cs.webhooks.intake == nil {
+		return errors.New("webhook delivery is not running")
+	}
+	return nil
+}
+
+func isClosed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cs *CacheService) breakerOpen() bool {
+	return cs.breaker != nil && cs.breaker.open.Load()
+}
+
+func writeText(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body))
+}
+
+// verboseParam reports whether the request asked for the verbose report.
+func verboseParam(r *http.Request) bool {
+	verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	return verbose
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// poolFakeStore reports server figures and a connection pool like Redis.
+type poolFakeStore struct {
+	*statsFakeStore
+}
+
+func (p poolFakeStore) PoolStats() *redis.PoolStats {
+	return &redis.PoolStats{Hits: 10, Misses: 2, TotalConns: 3, IdleConns: 1}
+}
+
+func TestLivezIgnoresRedis(t *testing.T) {
+	store := newFakeStore()
+	store.pingErr = errors.New("redis down")
+	router := testRouter(store)
+
+	w := serve(router, http.MethodGet, "/livez", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "OK")
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+	requireStatus(t, serve(router, http.MethodPost, "/livez", ""), http.StatusNotFound)
+}
+
+func TestReadyz(t *testing.T) {
+	store := newFakeStore()
+	service := newCacheService(testConfig(), store)
+	router := newRouter(service)
+
+	w := serve(router, http.MethodGet, "/readyz", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "OK")
+
+	store.pingErr = errors.New("redis down")
+	w = serve(router, http.MethodGet, "/readyz", "")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireBody(t, w, "Redis connection failed")
+
+	store.pingErr = nil
+	service.draining.Store(true)
+	w = serve(router, http.MethodGet, "/readyz", "")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireBody(t, w, "draining")
+	requireStatus(t, serve(router, http.MethodPost, "/readyz", ""), http.StatusNotFound)
+}
+
+func TestReadyzStartup(t *testing.T) {
+	config := testConfig()
+	config.Capture = CaptureConfig{Enabled: true, Path: filepath.Join(t.TempDir(), "capture.jsonl")}
+	service := newCacheService(config, newFakeStore())
+	defer service.Close()
+	handler := http.HandlerFunc(service.readyzHandler)
+
+	w := serve(handler, http.MethodGet, "/readyz", "")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireBody(t, w, "request capture is not running")
+	if report := service.healthReport(context.Background()); report.Ready || report.Checks["startup"].Error != "request capture is not running" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	if err := service.startCapture(); err != nil {
+		t.Fatalf("startCapture() error: %v", err)
+	}
+	requireStatus(t, serve(handler, http.MethodGet, "/readyz", ""), http.StatusOK)
+	if report := service.healthReport(context.Background()); !report.Ready || report.Checks["startup"].Status != healthOK {
+		t.Fatalf("report = %+v", report)
+	}
+
+	service.capture.close()
+	requireStatus(t, serve(handler, http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable)
+}
+
+func TestReadyzWithOpenBreaker(t *testing.T) {
+	service, store, router := breakerTestService(t, BreakerConfig{})
+	failStore(store, errors.New("redis down"))
+	serve(router, http.MethodGet, "/readyz", "")
+	serve(router, http.MethodGet, "/readyz", "")
+	waitForBreaker(t, service.breaker, breakerOpen)
+
+	requireStatus(t, serve(router, http.MethodGet, "/readyz", ""), http.StatusOK)
+
+	var report healthReport
+	w := serve(router, http.MethodGet, "/health?verbose=1", "")
+	requireStatus(t, w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("verbose health is not JSON: %v", err)
+	}
+	if report.Status != healthDegraded || !report.Ready || report.Checks["breaker"].State != breakerOpen || report.Checks["redis"].Status != healthUnavailable {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestVerboseHealth(t *testing.T) {
+	stats := &statsFakeStore{fakeStore: newFakeStore(), server: ServerStats{Version: "7.2.4", UsedMemory: 1 << 20}}
+	router := newRouter(newCacheService(testConfig(), poolFakeStore{stats}))
+
+	for _, path := range []string{"/health?verbose=1", "/api/health?verbose=true"} {
+		w := serve(router, http.MethodGet, path, "")
+		requireStatus(t, w, http.StatusOK)
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Fatalf("Cache-Control = %q, want no-store", got)
+		}
+		var report healthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s is not JSON: %v", path, err)
+		}
+		redisCheck := report.Checks["redis"]
+		if report.Status != healthOK || !report.Ready || report.Checks["startup"].Status != healthOK {
+			t.Fatalf("report = %+v", report)
+		}
+		if redisCheck.Status != healthOK || redisCheck.Server == nil || redisCheck.Server.Version != "7.2.4" || redisCheck.Pool == nil || redisCheck.Pool.TotalConns != 3 {
+			t.Fatalf("redis check = %+v", redisCheck)
+		}
+		if report.Build.GoVersion != runtime.Version() {
+			t.Fatalf("build = %+v", report.Build)
+		}
+	}
+
+	// The plain response is unchanged.
+	w := serve(router, http.MethodGet, "/health?verbose=0", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "OK")
+
+	stats.mu.Lock()
+	stats.pingErr = errors.New("redis down")
+	stats.mu.Unlock()
+	w = serve(router, http.MethodGet, "/health?verbose=1", "")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	var report healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("verbose health is not JSON: %v", err)
+	}
+	if report.Status != healthUnavailable || report.Ready || report.Checks["redis"].Error != "redis down" || report.Checks["redis"].Server != nil {
+		t.Fatalf("report = %+v", report)
+	}
+}
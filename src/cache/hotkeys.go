@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"hash/maphash"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHotKeysTopK   = 20
+	defaultHotKeysWindow = time.Minute
+	defaultHotKeysSlots  = 6
+	maxHotKeysTopK       = 1000
+	hotKeysSketchWidth   = 2048
+	hotKeysSketchDepth   = 4
+)
+
+// HotKeysConfig sizes the hot key trackers. Counts cover the last window_ms,
+// kept as slots sub-windows that are dropped one at a time as they age out.
+type HotKeysConfig struct {
+	TopK   int `json:"top_k"`
+	Window int `json:"window_ms"`
+	Slots  int `json:"slots"`
+}
+
+func (hc *HotKeysConfig) validate() error {
+	if hc.TopK < 0 || hc.Window < 0 || hc.Slots < 0 {
+		return fmt.Errorf("hot key limits must not be negative")
+	}
+	if hc.TopK > maxHotKeysTopK {
+		return fmt.Errorf("hot key top_k must not exceed %d", maxHotKeysTopK)
+	}
+	return nil
+}
+
+// countMinSketch estimates how often each key was seen in fixed memory. The
+// estimate never undercounts and overcounts only on hash collisions.
+type countMinSketch struct {
+	seed   maphash.Seed
+	counts [hotKeysSketchDepth][hotKeysSketchWidth]uint32
+}
+
+// add counts key once and returns its new estimate.
+func (s *countMinSketch) add(key string) uint32 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	estimate := ^uint32(0)
+	for i := range s.counts {
+		cell := &s.counts[i][(h1+uint32(i)*h2)%hotKeysSketchWidth]
+		if *cell < ^uint32(0) {
+			*cell++
+		}
+		estimate = min(estimate, *cell)
+	}
+	return estimate
+}
+
+func (s *countMinSketch) estimate(key string) uint32 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	estimate := ^uint32(0)
+	for i := range s.counts {
+		estimate = min(estimate, s.counts[i][(h1+uint32(i)*h2)%hotKeysSketchWidth])
+	}
+	return estimate
+}
+
+type heapEntry struct {
+	key   string
+	count uint32
+}
+
+// topKHeap is a min-heap of the k keys with the highest estimates, so the
+// weakest candidate is always at the root and can be replaced cheaply.
+type topKHeap struct {
+	entries []heapEntry
+	index   map[string]int
+}
+
+func (h *topKHeap) Len() int           { return len(h.entries) }
+func (h *topKHeap) Less(i, j int) bool { return h.entries[i].count < h.entries[j].count }
+func (h *topKHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].key] = i
+	h.index[h.entries[j].key] = j
+}
+func (h *topKHeap) Push(x any) {
+	entry := x.(heapEntry)
+	h.index[entry.key] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+func (h *topKHeap) Pop() any {
+	entry := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, entry.key)
+	return entry
+}
+
+// hotKeySlot is one sub-window: a sketch plus the candidates it ranked.
+type hotKeySlot struct {
+	sketch *countMinSketch
+	top    *topKHeap
+}
+
+// hotKeyTracker ranks keys over a sliding window. Memory is bounded by the
+// sketch size and k candidates per slot, whatever the number of keys.
+type hotKeyTracker struct {
+	k        int
+	slotSize time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	slots   []hotKeySlot
+	current int64 // number of the slot being written, in slotSize units
+}
+
+func newHotKeyTracker(k int, window time.Duration, slots int, now func() time.Time) *hotKeyTracker {
+	t := &hotKeyTracker{k: k, slotSize: max(window/time.Duration(slots), time.Millisecond), now: now, slots: make([]hotKeySlot, slots)}
+	for i := range t.slots {
+		t.slots[i] = newHotKeySlot()
+	}
+	t.current = t.slotNumber()
+	return t
+}
+
+func newHotKeySlot() hotKeySlot {
+	return hotKeySlot{sketch: &countMinSketch{seed: maphash.MakeSeed()}, top: &topKHeap{index: make(map[string]int)}}
+}
+
+func (t *hotKeyTracker) slotNumber() int64 {
+	return t.now().UnixNano() / int64(t.slotSize)
+}
+
+// advance clears the slots that have aged out since the last call.
+func (t *hotKeyTracker) advance() {
+	number := t.slotNumber()
+	for n := t.current + 1; n <= number && n <= t.current+int64(len(t.slots)); n++ {
+		t.slots[n%int64(len(t.slots))] = newHotKeySlot()
+	}
+	t.current = max(t.current, number)
+}
+
+func (t *hotKeyTracker) add(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance()
+
+	slot := t.slots[t.current%int64(len(t.slots))]
+	count := slot.sketch.add(key)
+	top := slot.top
+	if i, ok := top.index[key]; ok {
+		top.entries[i].count = count
+		heap.Fix(top, i)
+		return
+	}
+	if top.Len() < t.k {
+		heap.Push(top, heapEntry{key: key, count: count})
+		return
+	}
+	if count > top.entries[0].count {
+		delete(top.index, top.entries[0].key)
+		top.entries[0] = heapEntry{key: key, count: count}
+		top.index[key] = 0
+		heap.Fix(top, 0)
+	}
+}
+
+// top returns up to n keys with their estimated counts over the window,
+// summed across slots, highest first.
+func (t *hotKeyTracker) top(n int) []heapEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance()
+
+	candidates := make(map[string]bool)
+	for _, slot := range t.slots {
+		for _, entry := range slot.top.entries {
+			candidates[entry.key] = true
+		}
+	}
+	entries := make([]heapEntry, 0, len(candidates))
+	for key := range candidates {
+		var count uint32
+		for _, slot := range t.slots {
+			count += slot.sketch.estimate(key)
+		}
+		entries = append(entries, heapEntry{key: key, count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].key < entries[j].key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// hotKeys tracks the most read and most written keys of a service.
+type hotKeys struct {
+	namespaces *namespaces
+	k          int
+	window     time.Duration
+	reads      *hotKeyTracker
+	writes     *hotKeyTracker
+}
+
+func newHotKeys(config HotKeysConfig, namespaces *namespaces) *hotKeys {
+	k, window, slots := defaultHotKeysTopK, defaultHotKeysWindow, defaultHotKeysSlots
+	if config.TopK > 0 {
+		k = config.TopK
+	}
+	if config.Window > 0 {
+		window = time.Duration(config.Window) * time.Millisecond
+	}
+	if config.Slots > 0 {
+		slots = config.Slots
+	}
+	hk := &hotKeys{
+		namespaces: namespaces,
+		k:          k,
+		window:     window,
+		reads:      newHotKeyTracker(k, window, slots, time.Now),
+		writes:     newHotKeyTracker(k, window, slots, time.Now),
+	}
+	currentHotKeys.Store(hk)
+	return hk
+}
+
+func (hk *hotKeys) read(ns *namespace, key string) {
+	hk.reads.add(ns.key(key))
+}
+
+// recordEvent is the event broker sink that counts writes. Expirations are
+// not writes made by clients, so they are left out.
+func (hk *hotKeys) recordEvent(event CacheEvent) {
+	if event.Op == eventExpire || event.Op == eventInvalidate {
+		return
+	}
+	if ns, ok := hk.namespaces.byName[event.Namespace]; ok {
+		hk.writes.add(ns.key(event.Key))
+	}
+}
+
+type hotKey struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Count     uint32 `json:"count"`
+}
+
+type hotKeysReport struct {
+	WindowSeconds float64  `json:"window_seconds"`
+	Reads         []hotKey `json:"reads"`
+	Writes        []hotKey `json:"writes"`
+}
+
+func (hk *hotKeys) report(n int) hotKeysReport {
+	return hotKeysReport{
+		WindowSeconds: hk.window.Seconds(),
+		Reads:         hk.resolve(hk.reads.top(n)),
+		Writes:        hk.resolve(hk.writes.top(n)),
+	}
+}
+
+func (hk *hotKeys) resolve(entries []heapEntry) []hotKey {
+	keys := make([]hotKey, 0, len(entries))
+	for _, entry := range entries {
+		if ns, key, ok := hk.namespaces.split(entry.key); ok {
+			keys = append(keys, hotKey{Namespace: ns.name, Key: key, Count: entry.count})
+		}
+	}
+	return keys
+}
+
+func (cs *CacheService) hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	n := cs.hotKeys.k
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > cs.hotKeys.k {
+			writeCacheError(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", cs.hotKeys.k)})
+			return
+		}
+		n = limit
+	}
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, cs.hotKeys.report(n))
+}
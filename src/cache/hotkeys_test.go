@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestHotKeyTrackerFindsHeavyHitters(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	tracker := newHotKeyTracker(5, time.Minute, 6, clock.now)
+
+	// A long tail of keys read once each, interleaved with a few hot ones.
+	for i := 0; i < 20000; i++ {
+		tracker.add(fmt.Sprintf("tail:%d", i))
+		if i%10 == 0 {
+			tracker.add("hot:a")
+		}
+		if i%20 == 0 {
+			tracker.add("hot:b")
+		}
+		if i%40 == 0 {
+			tracker.add("hot:c")
+		}
+	}
+
+	top := tracker.top(3)
+	want := []string{"hot:a", "hot:b", "hot:c"}
+	for i, key := range want {
+		if top[i].key != key {
+			t.Fatalf("top = %+v, want %v", top, want)
+		}
+	}
+	if top[0].count < 2000 {
+		t.Fatalf("hot:a count = %d, want at least 2000", top[0].count)
+	}
+}
+
+func TestHotKeyTrackerSlidingWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	tracker := newHotKeyTracker(5, time.Minute, 6, clock.now)
+
+	for i := 0; i < 3; i++ {
+		tracker.add("old")
+	}
+	clock.t = clock.t.Add(30 * time.Second)
+	tracker.add("new")
+
+	top := tracker.top(5)
+	if len(top) != 2 || top[0] != (heapEntry{key: "old", count: 3}) || top[1] != (heapEntry{key: "new", count: 1}) {
+		t.Fatalf("top within window = %+v", top)
+	}
+
+	// The first slot ages out once a full window has passed since it opened.
+	clock.t = clock.t.Add(35 * time.Second)
+	top = tracker.top(5)
+	if len(top) != 1 || top[0].key != "new" {
+		t.Fatalf("top after old slot expired = %+v", top)
+	}
+
+	clock.t = clock.t.Add(10 * time.Minute)
+	if top := tracker.top(5); len(top) != 0 {
+		t.Fatalf("top after idle window = %+v", top)
+	}
+}
+
+func TestHotKeysEndpoint(t *testing.T) {
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin, scopeRead, scopeWrite}}}}
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	config.HotKeys = HotKeysConfig{TopK: 3}
+	service := newCacheService(config, newFakeStore())
+	router := newRouter(service)
+
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"items:1","value":"v"}`, admin), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/ns/tenant/cache/users:1", "v", admin), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/ns/tenant/cache/users:1", "v", admin), http.StatusOK)
+	for i := 0; i < 3; i++ {
+		requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=items:1", "", admin), http.StatusOK)
+	}
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/ns/tenant/cache/missing", "", admin), http.StatusNotFound)
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/hot-keys", ""), http.StatusUnauthorized)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/hot-keys?limit=4", "", admin), http.StatusBadRequest)
+
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/hot-keys?limit=2", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	var report hotKeysReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode hot keys: %v", err)
+	}
+	wantReads := []hotKey{{Namespace: defaultNamespace, Key: "items:1", Count: 3}, {Namespace: "tenant", Key: "missing", Count: 1}}
+	wantWrites := []hotKey{{Namespace: "tenant", Key: "users:1", Count: 2}, {Namespace: defaultNamespace, Key: "items:1", Count: 1}}
+	if report.WindowSeconds != 60 || fmt.Sprint(report.Reads) != fmt.Sprint(wantReads) || fmt.Sprint(report.Writes) != fmt.Sprint(wantWrites) {
+		t.Fatalf("report = %+v", report)
+	}
+
+	var metric hotKeysReport
+	if err := json.Unmarshal([]byte(expvar.Get("cache_hot_keys").String()), &metric); err != nil {
+		t.Fatalf("decode metric: %v", err)
+	}
+	if len(metric.Reads) != 2 || metric.Reads[0].Key != "items:1" {
+		t.Fatalf("cache_hot_keys metric = %+v", metric)
+	}
+}
+
+func TestHotKeysConfigValidation(t *testing.T) {
+	for _, config := range []HotKeysConfig{{TopK: -1}, {Window: -1}, {Slots: -1}, {TopK: maxHotKeysTopK + 1}} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultKeyListCount = 100
+	maxKeyListCount     = 1000
+)
+
+// KeyInfo describes an entry without its value. TTL is negative for keys
+// without an expiry, and WrittenAt is zero for entries written before write
+// times were recorded.
+type KeyInfo struct {
+	Type        string
+	Size        int64
+	Bytes       int64
+	TTL         time.Duration
+	WrittenAt   time.Time
+	ContentType string
+	Version     int64
+	Tags        []string
+	Encoding    string
+	IdleTime    time.Duration
+}
+
+// KeyInspector is implemented by stores that can list and describe keys for
+// the admin API.
+type KeyInspector interface {
+	// ScanKeys runs one SCAN step over keys matching a glob pattern.
+	ScanKeys(ctx context.Context, match string, cursor uint64, count int64) ([]string, uint64, error)
+	// InspectKey describes key, or returns errCacheMiss if it does not exist.
+	InspectKey(ctx context.Context, key string) (KeyInfo, error)
+}
+
+func (rs *RedisStore) ScanKeys(ctx context.Context, match string, cursor uint64, count int64) ([]string, uint64, error) {
+	return rs.client.Scan(ctx, cursor, match, count).Result()
+}
+
+func (rs *RedisStore) InspectKey(ctx context.Context, key string) (KeyInfo, error) {
+	// OBJECT IDLETIME goes first: any other command on the key would reset
+	// the idle time it reports.
+	pipe := rs.client.Pipeline()
+	idleCmd := pipe.ObjectIdleTime(ctx, key)
+	encodingCmd := pipe.ObjectEncoding(ctx, key)
+	typeCmd := pipe.Type(ctx, key)
+	ttlCmd := pipe.PTTL(ctx, key)
+	bytesCmd := pipe.MemoryUsage(ctx, key, 0)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return KeyInfo{}, err
+	}
+	if typeCmd.Val() == "none" {
+		return KeyInfo{}, errCacheMiss
+	}
+
+	info := KeyInfo{
+		Type:     typeCmd.Val(),
+		Bytes:    bytesCmd.Val(),
+		TTL:      ttlCmd.Val(),
+		Encoding: encodingCmd.Val(),
+		IdleTime: idleCmd.Val(),
+	}
+	switch info.Type {
+	case "hash":
+		pipe := rs.client.Pipeline()
+		sizeCmd := pipe.Do(ctx, "hstrlen", key, itemValueField)
+		fieldsCmd := pipe.HMGet(ctx, key, itemContentTypeField, itemVersionField, itemWrittenAtField, itemTagsField)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return KeyInfo{}, err
+		}
+		info.Size, _ = sizeCmd.Int64()
+		fields := fieldsCmd.Val()
+		info.ContentType, _ = fields[0].(string)
+		if version, ok := fields[1].(string); ok {
+			info.Version, _ = strconv.ParseInt(version, 10, 64)
+		}
+		if at, ok := fields[2].(string); ok {
+			if ms, err := strconv.ParseInt(at, 10, 64); err == nil {
+				info.WrittenAt = time.UnixMilli(ms).UTC()
+			}
+		}
+		if tags, ok := fields[3].(string); ok && tags != "" {
+			info.Tags = strings.Split(tags, ",")
+		}
+	case "string":
+		size, err := rs.client.StrLen(ctx, key).Result()
+		if err != nil {
+			return KeyInfo{}, err
+		}
+		info.Size = size
+	}
+	return info, nil
+}
+
+// escapeGlob quotes the characters SCAN MATCH treats as wildcards.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// adminNamespace picks the namespace named by the namespace query parameter,
+// or the default namespace.
+func (cs *CacheService) adminNamespace(w http.ResponseWriter, r *http.Request) (*namespace, bool) {
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		return cs.namespaces.defaultNS, true
+	}
+	ns, ok := cs.namespaces.byName[name]
+	if !ok {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "namespace not found"})
+	}
+	return ns, ok
+}
+
+func (cs *CacheService) keyInspector(w http.ResponseWriter) (KeyInspector, bool) {
+	inspector, ok := unwrapStore(cs.store).(KeyInspector)
+	if !ok {
+		writeCacheError(w, http.StatusNotImplemented, map[string]string{"error": "key inspection is not supported by this store"})
+	}
+	return inspector, ok
+}
+
+type keyListResponse struct {
+	Namespace string   `json:"namespace"`
+	Keys      []string `json:"keys"`
+	Cursor    string   `json:"cursor"`
+}
+
+// ListKeys runs one SCAN step over a namespace. prefix matches keys
+// literally and pattern is a SCAN glob; both apply within the namespace. A
+// page can hold fewer than count keys, or none, before the scan is done, so
+// callers should follow the cursor until it comes back as "0".
+func (cs *CacheService) ListKeys(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := cs.keyInspector(w)
+	if !ok {
+		return
+	}
+	ns, ok := cs.adminNamespace(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	prefix, pattern := query.Get("prefix"), query.Get("pattern")
+	if prefix != "" && pattern != "" {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "prefix and pattern cannot be combined"})
+		return
+	}
+	match := escapeGlob(ns.prefix) + escapeGlob(prefix) + "*"
+	if pattern != "" {
+		match = escapeGlob(ns.prefix) + pattern
+	}
+
+	var cursor uint64
+	if raw := query.Get("cursor"); raw != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "cursor must be a value returned by a previous page"})
+			return
+		}
+	}
+	count := int64(defaultKeyListCount)
+	if raw := query.Get("count"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n <= 0 || n > maxKeyListCount {
+			writeCacheError(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("count must be between 1 and %d", maxKeyListCount)})
+			return
+		}
+		count = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+	defer cancel()
+
+	storeKeys, next, err := inspector.ScanKeys(ctx, match, cursor, count)
+	if err != nil {
+		log.Printf("Redis scan error: %v", err)
+		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+	// The default namespace has no prefix, so its scan also sees internal
+	// keys and other namespaces' keys.
+	keys := make([]string, 0, len(storeKeys))
+	for _, storeKey := range storeKeys {
+		if keyNS, key, ok := cs.namespaces.split(storeKey); ok && keyNS == ns {
+			keys = append(keys, key)
+		}
+	}
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, keyListResponse{Namespace: ns.name, Keys: keys, Cursor: strconv.FormatUint(next, 10)})
+}
+
+// keyInfoResponse has no compression codec: values are always stored as
+// written.
+type keyInfoResponse struct {
+	Namespace   string    `json:"namespace"`
+	Key         string    `json:"key"`
+	Type        string    `json:"type"`
+	Size        int64     `json:"size"`
+	Bytes       int64     `json:"bytes"`
+	TTL         int64     `json:"ttl_ms"`
+	WrittenAt   time.Time `json:"created_at,omitzero"`
+	ContentType string    `json:"content_type,omitempty"`
+	Version     int64     `json:"version,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Encoding    string    `json:"encoding"`
+	IdleSeconds int64     `json:"idle_seconds"`
+}
+
+// InspectKey shows an entry's metadata without its value. ttl_ms is -1 for
+// keys without an expiry.
+func (cs *CacheService) InspectKey(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := cs.keyInspector(w)
+	if !ok {
+		return
+	}
+	ns, ok := cs.adminNamespace(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+	defer cancel()
+
+	info, err := inspector.InspectKey(ctx, ns.key(key))
+	if errors.Is(err, errCacheMiss) {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Redis inspect error: %v", err)
+		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+	ttl := info.TTL.Milliseconds()
+	if info.TTL < 0 {
+		ttl = -1
+	}
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, keyInfoResponse{
+		Namespace:   ns.name,
+		Key:         key,
+		Type:        info.Type,
+		Size:        info.Size,
+		Bytes:       info.Bytes,
+		TTL:         ttl,
+		WrittenAt:   info.WrittenAt,
+		ContentType: info.ContentType,
+		Version:     info.Version,
+		Tags:        info.Tags,
+		Encoding:    info.Encoding,
+		IdleSeconds: int64(info.IdleTime.Seconds()),
+	})
+}
+
+// InspectValue returns a value exactly as stored. Unlike the public read
+// routes it neither touches sliding TTLs nor counts towards hits and misses,
+// and it reads the primary directly, bypassing retries, the breaker's stale
+// copies and the replicas.
+func (cs *CacheService) InspectValue(w http.ResponseWriter, r *http.Request) {
+	ns, ok := cs.adminNamespace(w, r)
+	if !ok {
+		return
+	}
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+	defer cancel()
+
+	item, err := unwrapStore(cs.store).Get(withPrimaryReads(ctx), ns.key(key))
+	if errors.Is(err, errCacheMiss) || (err == nil && item.TTL <= 0) {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Redis error: %v", err)
+		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+	writeNoStore(w)
+	writeRawItem(w, item)
+}
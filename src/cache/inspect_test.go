@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// inspectFakeStore pages through its sorted keys the way SCAN would, with
+// the cursor as an offset.
+type inspectFakeStore struct {
+	*fakeStore
+	internal []string
+}
+
+func (s *inspectFakeStore) ScanKeys(_ context.Context, match string, cursor uint64, count int64) ([]string, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := append([]string(nil), s.internal...)
+	for key := range s.items {
+		all = append(all, key)
+	}
+	sort.Strings(all)
+
+	end := min(int(cursor)+int(count), len(all))
+	var keys []string
+	for _, key := range all[cursor:end] {
+		if ok, _ := path.Match(match, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	if end == len(all) {
+		return keys, 0, nil
+	}
+	return keys, uint64(end), nil
+}
+
+func (s *inspectFakeStore) InspectKey(_ context.Context, key string) (KeyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return KeyInfo{}, errCacheMiss
+	}
+	return KeyInfo{
+		Type:        "hash",
+		Size:        int64(len(item.Value)),
+		Bytes:       int64(len(item.Value)) + 64,
+		TTL:         item.TTL,
+		WrittenAt:   time.UnixMilli(1718000000000).UTC(),
+		ContentType: item.ContentType,
+		Version:     item.Version,
+		Tags:        item.Tags,
+		Encoding:    "listpack",
+		IdleTime:    3 * time.Second,
+	}, nil
+}
+
+func inspectTestRouter(t *testing.T) (http.Handler, map[string]string) {
+	t.Helper()
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin, scopeWrite}}}}
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := &inspectFakeStore{fakeStore: newFakeStore(), internal: []string{versionCounterKey, leaseKeyPrefix + "items:1"}}
+	router := newRouter(newCacheService(config, store))
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+
+	for _, key := range []string{"items:1", "items:2", "items:3", "users:1"} {
+		requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/"+key+"?ttl=60", "value-"+key, admin), http.StatusOK)
+	}
+	tagged := map[string]string{"Authorization": admin["Authorization"], tagsHeader: "items,tenant"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/ns/tenant/cache/items:9", "tenant", tagged), http.StatusOK)
+	return router, admin
+}
+
+func listAllKeys(t *testing.T, router http.Handler, admin map[string]string, query string) []string {
+	t.Helper()
+	var keys []string
+	cursor := "0"
+	for pages := 0; pages < 20; pages++ {
+		w := serveWithHeaders(router, http.MethodGet, "/api/admin/keys?count=2&cursor="+cursor+query, "", admin)
+		requireStatus(t, w, http.StatusOK)
+		var page keyListResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decode keys: %v", err)
+		}
+		keys = append(keys, page.Keys...)
+		if cursor = page.Cursor; cursor == "0" {
+			sort.Strings(keys)
+			return keys
+		}
+	}
+	t.Fatal("key listing never finished")
+	return nil
+}
+
+func TestListKeys(t *testing.T) {
+	router, admin := inspectTestRouter(t)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "", want: []string{"items:1", "items:2", "items:3", "users:1"}},
+		{query: "&prefix=items:", want: []string{"items:1", "items:2", "items:3"}},
+		{query: "&pattern=*:1", want: []string{"items:1", "users:1"}},
+		{query: "&namespace=tenant", want: []string{"items:9"}},
+	}
+	for _, tt := range tests {
+		if got := listAllKeys(t, router, admin, tt.query); !slices.Equal(got, tt.want) {
+			t.Fatalf("keys%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/keys", ""), http.StatusUnauthorized)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/keys?prefix=a&pattern=b", "", admin), http.StatusBadRequest)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/keys?count=1001", "", admin), http.StatusBadRequest)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/keys?cursor=abc", "", admin), http.StatusBadRequest)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/keys?namespace=missing", "", admin), http.StatusNotFound)
+}
+
+func TestInspectKeyAndValue(t *testing.T) {
+	router, admin := inspectTestRouter(t)
+
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/keys/items:9?namespace=tenant", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	var info keyInfoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decode key info: %v", err)
+	}
+	want := keyInfoResponse{
+		Namespace:   "tenant",
+		Key:         "items:9",
+		Type:        "hash",
+		Size:        6,
+		Bytes:       70,
+		TTL:         300000,
+		WrittenAt:   time.UnixMilli(1718000000000).UTC(),
+		ContentType: "application/json",
+		Version:     5,
+		Tags:        []string{"items", "tenant"},
+		Encoding:    "listpack",
+		IdleSeconds: 3,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("key info = %+v, want %+v", info, want)
+	}
+	fields := jsonFields(t, w.Body.Bytes())
+	if _, ok := fields["value"]; ok {
+		t.Fatal("key info included the value")
+	}
+	if _, ok := fields["compression"]; ok {
+		t.Fatal("key info reported a compression codec")
+	}
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/keys/missing", "", admin), http.StatusNotFound)
+
+	w = serveWithHeaders(router, http.MethodGet, "/api/admin/values/users:1", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "value-users:1")
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q", got)
+	}
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/values/items:9", "", admin), http.StatusNotFound)
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/values/users:1", ""), http.StatusUnauthorized)
+}
+
+// primaryRecordingStore records whether each Get asked for the primary.
+type primaryRecordingStore struct {
+	*fakeStore
+	primary []bool
+}
+
+func (s *primaryRecordingStore) Get(ctx context.Context, key string) (CacheItem, error) {
+	s.mu.Lock()
+	s.primary = append(s.primary, primaryReads(ctx))
+	s.mu.Unlock()
+	return s.fakeStore.Get(ctx, key)
+}
+
+func TestInspectValueReadsPrimary(t *testing.T) {
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin, scopeWrite}}}}
+	config.Breaker = BreakerConfig{Enabled: true}
+	config.Retry = RetryConfig{Enabled: true}
+	store := &primaryRecordingStore{fakeStore: newFakeStore()}
+	router := newRouter(newCacheService(config, store))
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/k", "v", admin), http.StatusOK)
+
+	store.primary = nil
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/values/k", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "v")
+	if !slices.Equal(store.primary, []bool{true}) {
+		t.Fatalf("primary reads = %v, want one read from the primary", store.primary)
+	}
+}
+
+func TestInspectWithoutKeyInspector(t *testing.T) {
+	router := testRouter(newFakeStore())
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/keys", ""), http.StatusNotImplemented)
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/keys/a", ""), http.StatusNotImplemented)
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := escapeGlob(`a*b?[c]\`); got != `a\*b\?\[c\]\\` {
+		t.Fatalf("escapeGlob() = %q", got)
+	}
+}
+
+func jsonFields(t *testing.T, body []byte) map[string]json.RawMessage {
+	t.Helper()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return fields
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultLeaseTTL     = 10 * time.Second
+	defaultLeaseMaxTTL  = time.Minute
+	defaultLeaseMaxWait = 10 * time.Second
+
+	leaseKeyPrefix   = internalKeyPrefix + "lease:"
+	leaseTokenHeader = "X-Cache-Lease-Token"
+)
+
+// LeasesConfig bounds the recompute leases callers can take on keys. All
+// values are milliseconds and fall back to the defaults above when zero.
+type LeasesConfig struct {
+	DefaultTTL int `json:"default_ttl_ms"`
+	MaxTTL     int `json:"max_ttl_ms"`
+	MaxWait    int `json:"max_wait_ms"`
+}
+
+func (lc *LeasesConfig) validate() error {
+	if lc.DefaultTTL < 0 || lc.MaxTTL < 0 || lc.MaxWait < 0 {
+		return fmt.Errorf("lease timings must not be negative")
+	}
+	if lc.DefaultTTL > 0 && lc.MaxTTL > 0 && lc.DefaultTTL > lc.MaxTTL {
+		return fmt.Errorf("lease default_ttl_ms must not exceed max_ttl_ms")
+	}
+	return nil
+}
+
+// LeaseStore is implemented by stores that can hold leases. Leases are only
+// offered when the store implements it, since a lease held in one process
+// would not keep workers talking to other replicas away.
+type LeaseStore interface {
+	// AcquireLease takes the lease on key for ttl if nobody holds it. When
+	// the lease is held it reports how long the holder has left.
+	AcquireLease(ctx context.Context, key, token string, ttl time.Duration) (bool, time.Duration, error)
+	// ReleaseLease drops the lease on key if it is still held by token.
+	ReleaseLease(ctx context.Context, key, token string) (bool, error)
+}
+
+// acquireLeaseScript returns {1, ttl} when it took the lease and {0, pttl}
+// with the holder's remaining time otherwise.
+var acquireLeaseScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+  return {1, tonumber(ARGV[2])}
+end
+return {0, redis.call('PTTL', KEYS[1])}
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (rs *RedisStore) AcquireLease(ctx context.Context, key, token string, ttl time.Duration) (bool, time.Duration, error) {
+	result, err := acquireLeaseScript.Run(ctx, rs.client, []string{key}, token, ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected lease result %v", result)
+	}
+	return result[0] == 1, time.Duration(max(result[1], 0)) * time.Millisecond, nil
+}
+
+func (rs *RedisStore) ReleaseLease(ctx context.Context, key, token string) (bool, error) {
+	released, err := releaseLeaseScript.Run(ctx, rs.client, []string{key}, token).Int64()
+	return released == 1, err
+}
+
+type leases struct {
+	store      LeaseStore
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	maxWait    time.Duration
+}
+
+func newLeases(config LeasesConfig, store CacheStore) *leases {
+	l := &leases{
+		defaultTTL: defaultLeaseTTL,
+		maxTTL:     defaultLeaseMaxTTL,
+		maxWait:    defaultLeaseMaxWait,
+	}
+	if config.DefaultTTL > 0 {
+		l.defaultTTL = time.Duration(config.DefaultTTL) * time.Millisecond
+	}
+	if config.MaxTTL > 0 {
+		l.maxTTL = time.Duration(config.MaxTTL) * time.Millisecond
+	}
+	if config.MaxWait > 0 {
+		l.maxWait = time.Duration(config.MaxWait) * time.Millisecond
+	}
+	if leaseStore, ok := store.(LeaseStore); ok {
+		l.store = leaseStore
+	}
+	return l
+}
+
+func leaseKey(ns *namespace, key string) string {
+	return leaseKeyPrefix + ns.key(key)
+}
+
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// millisParam reads an optional millisecond query parameter, bounded by max.
+func millisParam(r *http.Request, name string, fallback, max time.Duration) (time.Duration, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	if ms > max.Milliseconds() {
+		return 0, fmt.Errorf("%s must not exceed %d", name, max.Milliseconds())
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+type leaseResponse struct {
+	Token string `json:"token"`
+	TTL   int64  `json:"ttl_ms"`
+}
+
+type leaseHeldResponse struct {
+	Error        string `json:"error"`
+	Details      string `json:"details"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+// AcquireLease is called by a worker that missed on a key. It answers with
+// the value if it has been cached in the meantime, with a lease token (201)
+// if the caller should recompute it, or with 409 and how long to wait if
+// another worker holds the lease. With wait_ms the request long-polls until
+// the value arrives or the lease becomes free. Long polls are woken by the
+// same notifications as key waits, so they need waits to be enabled.
+func (cs *CacheService) AcquireLease(w http.ResponseWriter, r *http.Request) {
+	if cs.leases.store == nil {
+		writeCacheError(w, http.StatusNotImplemented, map[string]string{"error": "leases are not supported by this store"})
+		return
+	}
+	ns := cs.requestNamespace(r)
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+	ttl, err := millisParam(r, "ttl_ms", cs.leases.defaultTTL, cs.leases.maxTTL)
+	if err == nil && ttl <= 0 {
+		err = errors.New("ttl_ms must be greater than zero")
+	}
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	wait, err := millisParam(r, "wait_ms", 0, cs.leases.maxWait)
+	if err == nil && wait > 0 && !cs.waiters.enabled {
+		err = errWaitDisabled
+	}
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	token, err := newRandomID()
+	if err != nil {
+		log.Printf("lease token error: %v", err)
+		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+		return
+	}
+
+	if wait > 0 {
+		// Long polls may outlast the server write timeout.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + writeOpTimeout))
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		// Waiters are registered before the check so that a write or
+		// release in between still wakes this request.
+		var woken leaseWake
+		if wait > 0 {
+			woken, err = cs.watchLease(ns, key)
+			if err != nil {
+				countRejection("waiters")
+				writeCacheError(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		item, acquired, remaining, err := cs.tryLease(r.Context(), ns, key, token, ttl)
+		if err != nil {
+			woken.done()
+			writeStoreError(w, "Redis lease error", err)
+			return
+		}
+		if item != nil {
+			leaseMetrics.Add("value_ready", 1)
+			writeItemHeaders(w, *item)
+			writeRawItem(w, *item)
+			return
+		}
+		if acquired {
+			leaseMetrics.Add("acquired", 1)
+			writeNoStore(w)
+			writeJSON(w, http.StatusCreated, leaseResponse{Token: token, TTL: ttl.Milliseconds()})
+			return
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			woken.done()
+			leaseMetrics.Add("contended", 1)
+			writeLeaseHeld(w, remaining)
+			return
+		}
+		// A lease that runs out frees up without a notification, so the
+		// wait also ends when the holder's time is up.
+		timer := time.NewTimer(min(left, max(remaining, time.Millisecond)))
+		select {
+		case <-woken.set:
+		case <-woken.released:
+		case <-timer.C:
+		case <-r.Context().Done():
+		case <-cs.stopping:
+		}
+		timer.Stop()
+		woken.done()
+		if r.Context().Err() != nil || isClosed(cs.stopping) {
+			leaseMetrics.Add("contended", 1)
+			writeLeaseHeld(w, remaining)
+			return
+		}
+	}
+}
+
+// leaseWake holds the waiters of a lease long poll: one woken when the key is
+// written and one when its lease is released.
+type leaseWake struct {
+	set      <-chan struct{}
+	released <-chan struct{}
+	remove   []func()
+}
+
+func (lw leaseWake) done() {
+	for _, remove := range lw.remove {
+		remove()
+	}
+}
+
+func (cs *CacheService) watchLease(ns *namespace, key string) (leaseWake, error) {
+	set, removeSet, err := cs.waiters.add(ns.key(key))
+	if err != nil {
+		return leaseWake{}, err
+	}
+	released, removeReleased, err := cs.waiters.add(leaseKey(ns, key))
+	if err != nil {
+		removeSet()
+		return leaseWake{}, err
+	}
+	return leaseWake{set: set, released: released, remove: []func(){removeSet, removeReleased}}, nil
+}
+
+// tryLease checks whether key has been cached and, if not, tries to take
+// its lease. Checking the value first keeps a caller that lost the race from
+// recomputing a value another worker has just written, so the check reads
+// from the primary.
+func (cs *CacheService) tryLease(ctx context.Context, ns *namespace, key, token string, ttl time.Duration) (*CacheItem, bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+
+	item, err := cs.store.Get(withPrimaryReads(ctx), ns.key(key))
+	if err == nil && item.TTL > 0 {
+		return &item, false, 0, nil
+	}
+	if err != nil && !errors.Is(err, errCacheMiss) {
+		return nil, false, 0, err
+	}
+	if !cs.breaker.allow() {
+		return nil, false, 0, errStoreUnavailable
+	}
+	acquired, remaining, err := cs.leases.store.AcquireLease(ctx, leaseKey(ns, key), token, ttl)
+	return nil, acquired, remaining, err
+}
+
+func writeLeaseHeld(w http.ResponseWriter, remaining time.Duration) {
+	ms := max(remaining.Milliseconds(), 1)
+	w.Header().Set("Retry-After", strconv.FormatInt((ms+999)/1000, 10))
+	writeNoStore(w)
+	writeJSON(w, http.StatusConflict, leaseHeldResponse{
+		Error:        "lease held",
+		Details:      fmt.Sprintf("value is being recomputed, retry after %d ms", ms),
+		RetryAfterMs: ms,
+	})
+}
+
+// ReleaseLease drops a lease early. The token from AcquireLease must be sent
+// in the X-Cache-Lease-Token header; a lease that expired or was taken over
+// cannot be released.
+func (cs *CacheService) ReleaseLease(w http.ResponseWriter, r *http.Request) {
+	if cs.leases.store == nil {
+		writeCacheError(w, http.StatusNotImplemented, map[string]string{"error": "leases are not supported by this store"})
+		return
+	}
+	ns := cs.requestNamespace(r)
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+	token := r.Header.Get(leaseTokenHeader)
+	if token == "" {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "lease token is required", "details": "send the token in the " + leaseTokenHeader + " header"})
+		return
+	}
+
+	if !cs.breaker.allow() {
+		writeStoreError(w, "Redis lease error", errStoreUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), writeOpTimeout)
+	defer cancel()
+
+	released, err := cs.leases.store.ReleaseLease(ctx, leaseKey(ns, key), token)
+	if err != nil {
+		writeStoreError(w, "Redis lease error", err)
+		return
+	}
+	if !released {
+		writeCacheError(w, http.StatusConflict, map[string]string{"error": "lease not held"})
+		return
+	}
+	leaseMetrics.Add("released", 1)
+	cs.waiters.notify(ctx, leaseKey(ns, key))
+	writeNoStore(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseAfterWrite lets a lease holder hand back its lease with the write
+// that fills the key, by sending its token on the write request.
+func (cs *CacheService) releaseAfterWrite(ctx context.Context, r *http.Request, ns *namespace, key string) {
+	token := r.Header.Get(leaseTokenHeader)
+	if token == "" || cs.leases.store == nil || !cs.breaker.allow() {
+		return
+	}
+	released, err := cs.leases.store.ReleaseLease(ctx, leaseKey(ns, key), token)
+	if err != nil {
+		log.Printf("Redis lease error: %v", err)
+		return
+	}
+	if released {
+		leaseMetrics.Add("released", 1)
+		cs.waiters.notify(ctx, leaseKey(ns, key))
+	}
+}
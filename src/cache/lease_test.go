@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeLease struct {
+	token   string
+	expires time.Time
+}
+
+type leaseFakeStore struct {
+	*fakeStore
+	leases   map[string]fakeLease
+	acquires int
+}
+
+func newLeaseFakeStore() *leaseFakeStore {
+	return &leaseFakeStore{fakeStore: newFakeStore(), leases: make(map[string]fakeLease)}
+}
+
+func (s *leaseFakeStore) AcquireLease(_ context.Context, key, token string, ttl time.Duration) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.acquires++
+	if held, ok := s.leases[key]; ok && time.Now().Before(held.expires) {
+		return false, time.Until(held.expires), nil
+	}
+	s.leases[key] = fakeLease{token: token, expires: time.Now().Add(ttl)}
+	return true, ttl, nil
+}
+
+func (s *leaseFakeStore) ReleaseLease(_ context.Context, key, token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if held, ok := s.leases[key]; ok && held.token == token && time.Now().Before(held.expires) {
+		delete(s.leases, key)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *leaseFakeStore) leasesSnapshot() map[string]fakeLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]fakeLease, len(s.leases))
+	for key, lease := range s.leases {
+		snapshot[key] = lease
+	}
+	return snapshot
+}
+
+func (s *leaseFakeStore) acquireCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acquires
+}
+
+func leaseTestService(store CacheStore) *CacheService {
+	return newCacheService(waitTestConfig(), store)
+}
+
+func decodeLease(t *testing.T, w *httptest.ResponseRecorder) leaseResponse {
+	t.Helper()
+	var lease leaseResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &lease); err != nil {
+		t.Fatalf("decode lease: %v", err)
+	}
+	return lease
+}
+
+func TestLeaseAcquireAndRelease(t *testing.T) {
+	router := newRouter(leaseTestService(newLeaseFakeStore()))
+
+	w := serve(router, http.MethodPost, "/v2/lease/query?ttl_ms=5000", "")
+	requireStatus(t, w, http.StatusCreated)
+	lease := decodeLease(t, w)
+	if lease.Token == "" || lease.TTL != 5000 {
+		t.Fatalf("lease = %+v", lease)
+	}
+
+	w = serve(router, http.MethodPost, "/v2/lease/query", "")
+	requireStatus(t, w, http.StatusConflict)
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Fatalf("Retry-After = %q, want 5", got)
+	}
+	var held leaseHeldResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &held); err != nil || held.Error != "lease held" || held.RetryAfterMs <= 0 || held.RetryAfterMs > 5000 {
+		t.Fatalf("held response = %+v, %v", held, err)
+	}
+
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/lease/query", ""), http.StatusBadRequest)
+	w = serveWithHeaders(router, http.MethodDelete, "/v2/lease/query", "", map[string]string{leaseTokenHeader: "wrong"})
+	requireStatus(t, w, http.StatusConflict)
+	requireJSONField(t, w, "error", "lease not held")
+	w = serveWithHeaders(router, http.MethodDelete, "/v2/lease/query", "", map[string]string{leaseTokenHeader: lease.Token})
+	requireStatus(t, w, http.StatusNoContent)
+
+	requireStatus(t, serve(router, http.MethodPost, "/v2/lease/query", ""), http.StatusCreated)
+}
+
+func TestLeaseReturnsCachedValue(t *testing.T) {
+	store := newLeaseFakeStore()
+	store.items["query"] = CacheItem{Value: `{"data":{}}`, TTL: time.Minute, ContentType: "application/json"}
+	router := newRouter(leaseTestService(store))
+
+	w := serve(router, http.MethodPost, "/v2/lease/query", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"data":{}}`)
+	if len(store.leases) != 0 {
+		t.Fatalf("lease taken for a cached key: %v", store.leases)
+	}
+}
+
+func TestLeaseLongPoll(t *testing.T) {
+	store := newLeaseFakeStore()
+	router := newRouter(leaseTestService(store))
+
+	w := serve(router, http.MethodPost, "/v2/lease/query", "")
+	requireStatus(t, w, http.StatusCreated)
+	lease := decodeLease(t, w)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(router, http.MethodPost, "/v2/lease/query?wait_ms=5000", "")
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	headers := map[string]string{leaseTokenHeader: lease.Token, "Content-Type": "text/plain"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/query", "fresh", headers), http.StatusOK)
+	if len(store.leasesSnapshot()) != 0 {
+		t.Fatal("write with lease token did not release the lease")
+	}
+
+	select {
+	case w := <-done:
+		requireStatus(t, w, http.StatusOK)
+		requireBody(t, w, "fresh")
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll did not return")
+	}
+
+	requireStatus(t, serve(router, http.MethodPost, "/v2/lease/other", ""), http.StatusCreated)
+	w = serve(router, http.MethodPost, "/v2/lease/other?wait_ms=20", "")
+	requireStatus(t, w, http.StatusConflict)
+}
+
+func TestLeaseLongPollWakesOnRelease(t *testing.T) {
+	store := newLeaseFakeStore()
+	service := leaseTestService(store)
+	router := newRouter(service)
+
+	w := serve(router, http.MethodPost, "/v2/lease/query?ttl_ms=30000", "")
+	requireStatus(t, w, http.StatusCreated)
+	lease := decodeLease(t, w)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serve(router, http.MethodPost, "/v2/lease/query?wait_ms=5000", "")
+	}()
+	waitForWaiters(t, service.waiters, 2)
+	time.Sleep(50 * time.Millisecond)
+	if got := store.acquireCount(); got != 2 {
+		t.Fatalf("lease attempts while waiting = %d, want 2", got)
+	}
+
+	w = serveWithHeaders(router, http.MethodDelete, "/v2/lease/query", "", map[string]string{leaseTokenHeader: lease.Token})
+	requireStatus(t, w, http.StatusNoContent)
+	select {
+	case w := <-done:
+		requireStatus(t, w, http.StatusCreated)
+	case <-time.After(time.Second):
+		t.Fatal("long poll was not woken by the release")
+	}
+	if got := store.acquireCount(); got != 3 {
+		t.Fatalf("lease attempts = %d, want 3", got)
+	}
+}
+
+func TestLeaseErrors(t *testing.T) {
+	router := newRouter(leaseTestService(newLeaseFakeStore()))
+
+	for path, errMsg := range map[string]string{
+		"/v2/lease/k?ttl_ms=0":       "ttl_ms must be greater than zero",
+		"/v2/lease/k?ttl_ms=soon":    "ttl_ms must be a non-negative integer",
+		"/v2/lease/k?ttl_ms=3600000": "ttl_ms must not exceed 60000",
+		"/v2/lease/k?wait_ms=60000":  "wait_ms must not exceed 10000",
+	} {
+		w := serve(router, http.MethodPost, path, "")
+		requireStatus(t, w, http.StatusBadRequest)
+		requireJSONField(t, w, "error", errMsg)
+	}
+	requireStatus(t, serve(router, http.MethodGet, "/v2/lease/k", ""), http.StatusMethodNotAllowed)
+
+	store := newLeaseFakeStore()
+	w := serve(newRouter(newCacheService(testConfig(), store)), http.MethodPost, "/v2/lease/k?wait_ms=100", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", errWaitDisabled.Error())
+
+	w = serve(testRouter(newFakeStore()), http.MethodPost, "/v2/lease/k", "")
+	requireStatus(t, w, http.StatusNotImplemented)
+}
+
+func TestLeasesConfigValidation(t *testing.T) {
+	if err := (&LeasesConfig{DefaultTTL: 100, MaxTTL: 1000, MaxWait: 500}).validate(); err != nil {
+		t.Fatalf("validate() error: %v", err)
+	}
+	for _, config := range []LeasesConfig{{DefaultTTL: -1}, {MaxWait: -1}, {DefaultTTL: 2000, MaxTTL: 1000}} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
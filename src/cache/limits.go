@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultMaxKeyLength = 64 << 10
+	defaultMaxValueSize = 32 << 20
+	defaultMaxBodySize  = 48 << 20
+)
+
+// LimitsConfig bounds what a single request may ask the cache to hold. Zero
+// values fall back to the defaults above.
+type LimitsConfig struct {
+	MaxKeyLength int   `json:"max_key_length"`
+	MaxValueSize int64 `json:"max_value_size"`
+	MaxBodySize  int64 `json:"max_body_size"`
+}
+
+func (lc *LimitsConfig) validate() error {
+	if lc.MaxKeyLength < 0 || lc.MaxValueSize < 0 || lc.MaxBodySize < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+func (lc LimitsConfig) withDefaults() LimitsConfig {
+	if lc.MaxKeyLength == 0 {
+		lc.MaxKeyLength = defaultMaxKeyLength
+	}
+	if lc.MaxValueSize == 0 {
+		lc.MaxValueSize = defaultMaxValueSize
+	}
+	if lc.MaxBodySize == 0 {
+		lc.MaxBodySize = defaultMaxBodySize
+	}
+	return lc
+}
+
+// limitBody caps the request body before anything reads it, including the
+// signature check and the write quota, so no caller can buffer more than
+// max_body_size bytes in memory.
+func (cs *CacheService) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	maxBodySize := cs.sizeLimits.MaxBodySize
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBodySize {
+			writeBodyError(w, &http.MaxBytesError{Limit: maxBodySize})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next(w, r)
+	}
+}
+
+// writeBodyError reports a failure to read or decode the request body,
+// separating oversized bodies from malformed ones.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		countRejection("body_too_large")
+		writeCacheError(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large", "details": fmt.Sprintf("request body must not exceed %d bytes", tooLarge.Limit)})
+		return
+	}
+	writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid request body", "details": err.Error()})
+}
+
+// checkKey validates a key and writes the error response when it is
+// rejected. Keys in the default namespace may not use the internal prefix,
+// since they would otherwise collide with the service's own Redis keys.
+func (cs *CacheService) checkKey(w http.ResponseWriter, ns *namespace, key string) bool {
+	if len(key) > cs.sizeLimits.MaxKeyLength {
+		countRejection("key_too_long")
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "key too long", "details": fmt.Sprintf("key must not exceed %d bytes", cs.sizeLimits.MaxKeyLength)})
+		return false
+	}
+	if ns.prefix == "" && strings.HasPrefix(key, internalKeyPrefix) {
+		countRejection("reserved_key")
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid key", "details": fmt.Sprintf("keys must not start with %s", internalKeyPrefix)})
+		return false
+	}
+	return true
+}
+
+// maxValueSize is the smaller of the global and namespace value size limits.
+func (cs *CacheService) maxValueSize(ns *namespace) int64 {
+	if ns.maxValueSize > 0 && ns.maxValueSize < cs.sizeLimits.MaxValueSize {
+		return ns.maxValueSize
+	}
+	return cs.sizeLimits.MaxValueSize
+}
+
+// checkValueSize applies the smaller of the global and namespace value size
+// limits and writes the error response when the value is too large.
+func (cs *CacheService) checkValueSize(w http.ResponseWriter, ns *namespace, size int64) bool {
+	maxValueSize := cs.maxValueSize(ns)
+	if size <= maxValueSize {
+		return true
+	}
+
+	ns.rejected.Add(1)
+	countRejection("value_too_large")
+	writeCacheError(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "value too large", "details": fmt.Sprintf("value must not exceed %d bytes", maxValueSize)})
+	return false
+}
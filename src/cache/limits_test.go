@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func counterValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func requireCounterDelta(t *testing.T, m *expvar.Map, key string, before, want int64) {
+	t.Helper()
+	if got := counterValue(m, key) - before; got != want {
+		t.Fatalf("%s counter delta = %d, want %d", key, got, want)
+	}
+}
+
+func limitsTestRouter(store *fakeStore) http.Handler {
+	config := testConfig()
+	config.Limits = LimitsConfig{MaxKeyLength: 8, MaxValueSize: 10, MaxBodySize: 64}
+	return newRouter(newCacheService(config, store))
+}
+
+func TestKeyLengthLimit(t *testing.T) {
+	store := newFakeStore()
+	router := limitsTestRouter(store)
+
+	before := counterValue(rejectionMetrics, "key_too_long")
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"123456789","value":"v"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "key too long")
+	requireJSONField(t, w, "details", "key must not exceed 8 bytes")
+
+	w = serve(router, http.MethodGet, "/api/cache?key=123456789", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "key too long")
+	requireCounterDelta(t, rejectionMetrics, "key_too_long", before, 2)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"12345678","value":"v"}`), http.StatusOK)
+}
+
+func TestValueSizeLimit(t *testing.T) {
+	router := limitsTestRouter(newFakeStore())
+
+	before := counterValue(rejectionMetrics, "value_too_large")
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"01234567890"}`)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	requireJSONField(t, w, "error", "value too large")
+	requireJSONField(t, w, "details", "value must not exceed 10 bytes")
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+	requireCounterDelta(t, rejectionMetrics, "value_too_large", before, 1)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"0123456789"}`), http.StatusOK)
+}
+
+func TestBodySizeLimit(t *testing.T) {
+	store := newFakeStore()
+	router := limitsTestRouter(store)
+	body := `{"key":"k","value":"v","padding":"` + strings.Repeat("x", 64) + `"}`
+
+	before := counterValue(rejectionMetrics, "body_too_large")
+	w := serve(router, http.MethodPost, "/api/cache", body)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	requireJSONField(t, w, "error", "request body too large")
+	requireJSONField(t, w, "details", "request body must not exceed 64 bytes")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cache", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	requireCounterDelta(t, rejectionMetrics, "body_too_large", before, 2)
+
+	if len(store.sets) != 0 {
+		t.Fatalf("oversized bodies were stored: %v", store.sets)
+	}
+}
+
+func TestBodySizeLimitBeforeSignatureCheck(t *testing.T) {
+	config := authTestConfig()
+	config.Limits.MaxBodySize = 16
+	service := newCacheService(config, newFakeStore())
+	now := time.Unix(1_700_000_000, 0)
+	service.auth.now = func() time.Time { return now }
+	body := `{"key":"signed","value":"value"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cache", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	for name, value := range signedHeaders("worker-secret", http.MethodPost, "/api/cache", body, now, "n1") {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	newRouter(service).ServeHTTP(w, req)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	requireJSONField(t, w, "error", "request body too large")
+}
+
+func TestReservedKeyPrefix(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+
+	before := counterValue(rejectionMetrics, "reserved_key")
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"`+rateLimitKeyPrefix+`x","value":"v"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "invalid key")
+
+	w = serve(router, http.MethodGet, "/api/cache?key="+internalKeyPrefix+"x", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireCounterDelta(t, rejectionMetrics, "reserved_key", before, 2)
+
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	w = serve(newRouter(newCacheService(config, store)), http.MethodPost, "/api/ns/tenant/cache", `{"key":"`+internalKeyPrefix+`x","value":"v"}`)
+	requireStatus(t, w, http.StatusOK)
+}
+
+func TestDefaultLimits(t *testing.T) {
+	limits := LimitsConfig{}.withDefaults()
+	if limits.MaxKeyLength != defaultMaxKeyLength || limits.MaxValueSize != defaultMaxValueSize || limits.MaxBodySize != defaultMaxBodySize {
+		t.Fatalf("defaults = %+v", limits)
+	}
+	custom := LimitsConfig{MaxKeyLength: 1, MaxValueSize: 2, MaxBodySize: 3}
+	if got := custom.withDefaults(); got != custom {
+		t.Fatalf("withDefaults() = %+v, want %+v", got, custom)
+	}
+	if err := (&LimitsConfig{MaxBodySize: -1}).validate(); err == nil {
+		t.Fatal("negative limit accepted")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	config := namespaceTestConfig()
+	router := newRouter(newCacheService(config, newFakeStore()))
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/metrics", ""), http.StatusUnauthorized)
+
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/admin/metrics", "", admin), http.StatusNotFound)
+
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/metrics", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("metrics are not JSON: %v", err)
+	}
+	if _, ok := body["cache_rejections"]; !ok {
+		t.Fatalf("cache_rejections missing from metrics: %s", w.Body.String())
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,59 +26,196 @@ const (
 	writeOpTimeout     = 10 * time.Second
 	healthCheckTimeout = 2 * time.Second
 	maxTTLSeconds      = int64(1<<63-1) / int64(time.Second)
+
+	// internalKeyPrefix is prepended to every Redis key the service manages
+	// for itself, such as rate limit buckets and namespaced entries.
+	internalKeyPrefix = "_cache:"
 )
 
 var errCacheMiss = errors.New("cache miss")
 
 type cacheSetBody struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	TTL   string `json:"ttl"`
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	TTL       string   `json:"ttl"`
+	Condition string   `json:"condition"`
+	Version   string   `json:"version"`
+	Tags      []string `json:"tags"`
 }
 
 type Config struct {
-	RedisHost string `json:"redis_host"`
-	RedisPort int    `json:"redis_port"`
-	TTL       int    `json:"ttl"`
+	RedisHost  string            `json:"redis_host"`
+	RedisPort  int               `json:"redis_port"`
+	TTL        int               `json:"ttl"`
+	Auth       AuthConfig        `json:"auth"`
+	RateLimit  RateLimitConfig   `json:"rate_limit"`
+	Namespaces []NamespaceConfig `json:"namespaces"`
+	Limits     LimitsConfig      `json:"limits"`
+	Leases     LeasesConfig      `json:"leases"`
+	Wait       WaitConfig        `json:"wait"`
+	Events     EventsConfig      `json:"events"`
+	Webhooks   WebhooksConfig    `json:"webhooks"`
+	Stats      StatsConfig       `json:"stats"`
+	HotKeys    HotKeysConfig     `json:"hot_keys"`
+	Warm       WarmConfig        `json:"warm"`
+	Capture    CaptureConfig     `json:"capture"`
+	Breaker    BreakerConfig     `json:"breaker"`
+	Shutdown   ShutdownConfig    `json:"shutdown"`
+	Retry      RetryConfig       `json:"retry"`
+	Replicas   ReplicasConfig    `json:"replicas"`
 }
 
+// CacheItem is an entry as held by a CacheStore. TTL is the remaining
+// lifetime on reads and the lifetime to apply on writes. ContentType is only
+// set for values written through the raw API. Version is assigned by the
+// store on every write and is zero for entries that predate versioning.
+// Stale marks a read served from the circuit breaker's local copy while
+// Redis is unreachable.
 type CacheItem struct {
-	Value string
-	TTL   time.Duration
+	Value       string
+	TTL         time.Duration
+	ContentType string
+	Version     int64
+	Tags        []string
+	Stale       bool
 }
 
 type CacheStore interface {
 	Ping(context.Context) error
 	Get(context.Context, string) (CacheItem, error)
-	Set(context.Context, string, string, time.Duration) error
+	GetAndTouch(context.Context, string, time.Duration) (CacheItem, error)
+	Set(context.Context, string, CacheItem) error
+	SetIf(context.Context, string, CacheItem, WriteCondition) (int64, error)
+	Delete(context.Context, string) (bool, error)
+	UpdateTTL(context.Context, string, TTLUpdate) (time.Duration, error)
 	Close() error
 }
 
+// unwrapStore returns the store beneath the circuit breaker and retries, for
+// capability checks.
+func unwrapStore(store CacheStore) CacheStore {
+	for {
+		switch s := store.(type) {
+		case *breakerStore:
+			store = s.CacheStore
+		case *retryStore:
+			store = s.CacheStore
+		default:
+			return store
+		}
+	}
+}
+
 type RedisStore struct {
-	client *redis.Client
+	client   *redis.Client
+	replicas *replicaSet
 }
 
 func NewRedisStore(config *Config) *RedisStore {
-	return &RedisStore{
-		client: redis.NewClient(&redis.Options{
-			Addr:         fmt.Sprintf("%s:%d", config.RedisHost, config.RedisPort),
-			Password:     "",
-			DB:           0,
-			PoolSize:     20,
-			ReadTimeout:  3 * time.Second,
-			WriteTimeout: 3 * time.Second,
-			DialTimeout:  5 * time.Second,
-		}),
+	// With a retry policy the service decides what to retry; the client's
+	// own retries would multiply its attempts. Zero keeps the client default.
+	maxRetries := 0
+	if config.Retry.Enabled {
+		maxRetries = -1
+	}
+	rs := &RedisStore{client: newRedisClient(config.RedisHost, config.RedisPort, maxRetries)}
+	if len(config.Replicas.Hosts) > 0 {
+		replicas := make([]*replica, 0, len(config.Replicas.Hosts))
+		for _, host := range config.Replicas.Hosts {
+			replicas = append(replicas, &replica{
+				addr:   fmt.Sprintf("%s:%d", host.Host, host.Port),
+				client: newRedisClient(host.Host, host.Port, maxRetries),
+			})
+		}
+		rs.replicas = newReplicaSet(config.Replicas, replicas)
+		rs.replicas.start()
 	}
+	return rs
+}
+
+func newRedisClient(host string, port int, maxRetries int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         fmt.Sprintf("%s:%d", host, port),
+		Password:     "",
+		DB:           0,
+		PoolSize:     20,
+		MaxRetries:   maxRetries,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+		DialTimeout:  5 * time.Second,
+	})
 }
 
 func (rs *RedisStore) Ping(ctx context.Context) error {
 	return rs.client.Ping(ctx).Err()
 }
 
+// Entries are stored as hashes so that metadata such as the content type
+// travels with the value.
+const (
+	itemValueField       = "v"
+	itemContentTypeField = "ct"
+	itemVersionField     = "ver"
+	itemWrittenAtField   = "at"
+	itemLifetimeField    = "ttl"
+	itemTagsField        = "tags"
+)
+
+// Get reads from a replica when replicas are configured, unless ctx asks
+// for the primary.
 func (rs *RedisStore) Get(ctx context.Context, key string) (CacheItem, error) {
-	pipe := rs.client.Pipeline()
+	if rs.replicas != nil && !primaryReads(ctx) {
+		return rs.readReplica(ctx, key)
+	}
+	return rs.get(ctx, rs.client, key, 0)
+}
+
+// get reads key through client and, when touch is positive, slides its TTL
+// like touchScript before reading the remaining TTL back.
+func (rs *RedisStore) get(ctx context.Context, client *redis.Client, key string, touch time.Duration) (CacheItem, error) {
+	pipe := client.Pipeline()
+	fieldsCmd := pipe.HGetAll(ctx, key)
+	if touch > 0 {
+		keys, args := usageScriptArgs(ctx, []string{key}, touch.Milliseconds())
+		touchScript.Eval(ctx, pipe, keys, args...)
+	}
+	ttlCmd := pipe.TTL(ctx, key)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		if isWrongType(err) {
+			return rs.getString(ctx, client, key, touch)
+		}
+		return CacheItem{}, err
+	}
+
+	fields := fieldsCmd.Val()
+	value, ok := fields[itemValueField]
+	if !ok {
+		return CacheItem{}, errCacheMiss
+	}
+
+	ttl := ttlCmd.Val()
+	if ttl <= 0 {
+		return CacheItem{}, errCacheMiss
+	}
+
+	version, _ := strconv.ParseInt(fields[itemVersionField], 10, 64)
+	item := CacheItem{Value: value, TTL: ttl, ContentType: fields[itemContentTypeField], Version: version}
+	if tags := fields[itemTagsField]; tags != "" {
+		item.Tags = strings.Split(tags, ",")
+	}
+	return item, nil
+}
+
+// getString reads entries written as plain strings before values were
+// stored as hashes.
+func (rs *RedisStore) getString(ctx context.Context, client *redis.Client, key string, touch time.Duration) (CacheItem, error) {
+	pipe := client.Pipeline()
 	getCmd := pipe.Get(ctx, key)
+	if touch > 0 {
+		keys, args := usageScriptArgs(ctx, []string{key}, touch.Milliseconds())
+		touchScript.Eval(ctx, pipe, keys, args...)
+	}
 	ttlCmd := pipe.TTL(ctx, key)
 
 	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
@@ -101,33 +241,112 @@ func (rs *RedisStore) Get(ctx context.Context, key string) (CacheItem, error) {
 	return CacheItem{Value: value, TTL: ttl}, nil
 }
 
-func (rs *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
-	if ttl <= 0 {
-		return fmt.Errorf("ttl must be greater than zero")
-	}
-	return rs.client.Set(ctx, key, value, ttl).Err()
+func (rs *RedisStore) Set(ctx context.Context, key string, item CacheItem) error {
+	_, err := rs.SetIf(ctx, key, item, WriteCondition{})
+	return err
+}
+
+func (rs *RedisStore) Delete(ctx context.Context, key string) (bool, error) {
+	deleted, err := rs.client.Del(ctx, key).Result()
+	return deleted > 0, err
+}
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
 }
 
 func (rs *RedisStore) Close() error {
+	if rs.replicas != nil {
+		if err := rs.replicas.Close(); err != nil {
+			log.Printf("Replica close error: %v", err)
+		}
+	}
 	return rs.client.Close()
 }
 
 type CacheService struct {
-	config *Config
-	store  CacheStore
+	config     *Config
+	store      CacheStore
+	auth       *authenticator
+	limits     *rateLimits
+	namespaces *namespaces
+	tags       *tagIndex
+	sizeLimits LimitsConfig
+	leases     *leases
+	waiters    *keyWaiters
+	events     *eventBroker
+	webhooks   *webhooks
+	stats      *stats
+	hotKeys    *hotKeys
+	refresher  *refresher
+	capture    *capture
+	breaker    *breakerStore
+	writers    *recentWriters
+	started    time.Time
+	draining   atomic.Bool
+	stopping   chan struct{}
+	stopOnce   sync.Once
 }
 
 func NewCacheService(config *Config) *CacheService {
-	return &CacheService{
-		config: config,
-		store:  NewRedisStore(config),
-	}
+	return newCacheService(config, NewRedisStore(config))
 }
 
 func newCacheService(config *Config, store CacheStore) *CacheService {
+	wrapped := store
+	if config.Retry.Enabled {
+		wrapped = newRetryStore(config.Retry, wrapped)
+	}
+	var breaker *breakerStore
+	if config.Breaker.Enabled {
+		breaker = newBreakerStore(config.Breaker, wrapped)
+		wrapped = breaker
+	}
+
+	namespaces := newNamespaces(config.Namespaces, store, breaker)
+	cs := &CacheService{
+		config:     config,
+		store:      wrapped,
+		breaker:    breaker,
+		auth:       newAuthenticator(config.Auth, store, breaker),
+		limits:     newRateLimits(config.RateLimit, store, breaker),
+		namespaces: namespaces,
+		tags:       newTagIndex(store, breaker),
+		sizeLimits: config.Limits.withDefaults(),
+		leases:     newLeases(config.Leases, store),
+		waiters:    newKeyWaiters(config.Wait, store, breaker),
+		events:     newEventBroker(config.Events, config.Webhooks.subscribes(eventExpire), store, namespaces, breaker),
+		webhooks:   newWebhooks(config.Webhooks, store, breaker),
+		stats:      newStats(config.Stats, store, namespaces),
+		hotKeys:    newHotKeys(config.HotKeys, namespaces),
+		writers:    newRecentWriters(config.Replicas),
+		started:    time.Now(),
+		stopping:   make(chan struct{}),
+	}
+	cs.events.addSink(cs.webhooks.handle)
+	cs.events.addSink(cs.hotKeys.recordEvent)
+	cs.webhooks.start()
+	return cs
+}
+
+// newStoreService builds a service for the subcommands that work on the
+// cache directly. It enforces namespace limits and accounting and indexes
+// tags, but starts nothing in the background: its writes wake no waiters and
+// emit no events or webhooks.
+func newStoreService(config *Config, store CacheStore) *CacheService {
+	namespaces := newNamespaces(config.Namespaces, store, nil)
 	return &CacheService{
-		config: config,
-		store:  store,
+		config:     config,
+		store:      store,
+		namespaces: namespaces,
+		tags:       newTagIndex(store, nil),
+		sizeLimits: config.Limits.withDefaults(),
+		leases:     newLeases(config.Leases, store),
+		waiters:    newKeyWaiters(WaitConfig{}, store, nil),
+		events:     newEventBroker(EventsConfig{}, false, store, namespaces, nil),
+		webhooks:   newWebhooks(WebhooksConfig{}, store, nil),
+		started:    time.Now(),
+		stopping:   make(chan struct{}),
 	}
 }
 
@@ -151,10 +370,62 @@ func loadConfigFile(path string) (*Config, error) {
 	if err := json.Unmarshal(byteValue, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
 
 	return &config, nil
 }
 
+func (c *Config) validate() error {
+	if err := c.Auth.validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if err := c.Leases.validate(); err != nil {
+		return err
+	}
+	if err := c.Wait.validate(); err != nil {
+		return err
+	}
+	if err := c.Events.validate(); err != nil {
+		return err
+	}
+	if err := c.Webhooks.validate(); err != nil {
+		return err
+	}
+	if err := c.Stats.validate(); err != nil {
+		return err
+	}
+	if err := c.HotKeys.validate(); err != nil {
+		return err
+	}
+	if err := c.Warm.validate(); err != nil {
+		return err
+	}
+	if err := c.Capture.validate(); err != nil {
+		return err
+	}
+	if err := c.Breaker.validate(); err != nil {
+		return err
+	}
+	if err := c.Shutdown.validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.validate(); err != nil {
+		return err
+	}
+	if err := c.Replicas.validate(); err != nil {
+		return err
+	}
+	return validateNamespaces(c.Namespaces)
+}
+
 func (cs *CacheService) HealthCheck(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
 	defer cancel()
@@ -169,34 +440,99 @@ func (cs *CacheService) GetCache(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
-	defer cancel()
+	item, ok := cs.lookup(w, r, key)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, item.Value)
+}
+
+// lookup reads key from the request namespace and sets the cache headers for
+// a hit. On a miss or failure it writes the error response and returns false.
+func (cs *CacheService) lookup(w http.ResponseWriter, r *http.Request, key string) (CacheItem, bool) {
+	ns := cs.requestNamespace(r)
+	if !cs.checkKey(w, ns, key) {
+		return CacheItem{}, false
+	}
+
+	touch, err := cs.slidingTTL(r, ns)
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return CacheItem{}, false
+	}
+	wait, err := millisParam(r, "wait", 0, cs.waiters.maxWait)
+	if err == nil && wait > 0 && !cs.waiters.enabled {
+		err = errWaitDisabled
+	}
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return CacheItem{}, false
+	}
 
-	item, err := cs.store.Get(ctx, key)
+	noteCapture(r, captureGet, ns, key, 0, 0)
+	ns.reads.Add(1)
+	cs.hotKeys.read(ns, key)
+	item, err := cs.read(cs.readContext(r), ns, key, touch)
+	if errors.Is(err, errCacheMiss) && wait > 0 {
+		item, err = cs.waitForKey(w, r, ns, key, touch, wait)
+	}
 	if errors.Is(err, errCacheMiss) {
+		ns.misses.Add(1)
 		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
-		return
+		return CacheItem{}, false
+	}
+	if errors.Is(err, errTooManyWaiters) {
+		countRejection("waiters")
+		writeCacheError(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return CacheItem{}, false
 	}
 	if err != nil {
-		log.Printf("Redis error: %v", err)
-		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
-		return
+		writeStoreError(w, "Redis error", err)
+		return CacheItem{}, false
 	}
-	if item.TTL <= 0 {
-		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
-		return
+	ns.hits.Add(1)
+	noteCapture(r, captureGet, ns, key, int64(len(item.Value)), item.TTL)
+
+	writeItemHeaders(w, item)
+	return item, true
+}
+
+// read fetches key from ns, resetting its TTL to touch when it is positive.
+// Expired entries are reported as misses.
+func (cs *CacheService) read(ctx context.Context, ns *namespace, key string, touch time.Duration) (CacheItem, error) {
+	ctx, cancel := context.WithTimeout(ctx, readOpTimeout)
+	defer cancel()
+
+	var item CacheItem
+	var err error
+	if touch > 0 {
+		item, err = cs.store.GetAndTouch(cs.namespaces.withUsageMember(ctx, ns, key), ns.key(key), touch)
+	} else {
+		item, err = cs.store.Get(ctx, ns.key(key))
+	}
+	if err == nil && item.TTL <= 0 {
+		return CacheItem{}, errCacheMiss
 	}
+	return item, err
+}
 
+// writeItemHeaders sets the TTL, caching and version headers for a hit.
+func writeItemHeaders(w http.ResponseWriter, item CacheItem) {
 	ttlSeconds := int(item.TTL.Seconds())
 	w.Header().Set("X-CACHE-TTL", strconv.Itoa(ttlSeconds))
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ttlSeconds))
-	writeJSON(w, http.StatusOK, item.Value)
+	if item.Version > 0 {
+		w.Header().Set("ETag", formatETag(item.Version))
+	}
+	if item.Stale {
+		w.Header().Set("X-CACHE-STALE", "true")
+	}
 }
 
 func (cs *CacheService) SetCache(w http.ResponseWriter, r *http.Request) {
 	var requestBody cacheSetBody
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid request body", "details": err.Error()})
+		writeBodyError(w, err)
 		return
 	}
 	if requestBody.Key == "" || requestBody.Value == "" {
@@ -204,22 +540,74 @@ func (cs *CacheService) SetCache(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ttl, err := cs.cacheTTL(requestBody.TTL)
+	cond, err := requestCondition(r, requestBody.Condition, requestBody.Version)
 	if err != nil {
-		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid write condition", "details": err.Error()})
 		return
 	}
+	tags, err := parseTags(requestBody.Tags)
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid tags", "details": err.Error()})
+		return
+	}
+
+	if cs.save(w, r, requestBody.Key, CacheItem{Value: requestBody.Value, Tags: tags}, requestBody.TTL, cond) {
+		writeJSON(w, http.StatusOK, map[string]string{"message": "cached"})
+	}
+}
+
+// save validates and stores item under key in the request namespace, using
+// rawTTL to pick its lifetime, if cond holds. On success it sets the ETag of
+// the new version; on failure it writes the error response and returns false.
+func (cs *CacheService) save(w http.ResponseWriter, r *http.Request, key string, item CacheItem, rawTTL string, cond WriteCondition) bool {
+	ns := cs.requestNamespace(r)
+	if !cs.checkKey(w, ns, key) {
+		return false
+	}
+	ttl, err := cs.namespaceTTL(ns, rawTTL)
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return false
+	}
+	noteCapture(r, captureSet, ns, key, int64(len(item.Value)), ttl)
+	if !cs.checkValueSize(w, ns, int64(len(item.Value))) {
+		return false
+	}
+	item.TTL = ttl
 
 	ctx, cancel := context.WithTimeout(r.Context(), writeOpTimeout)
 	defer cancel()
 
-	if err := cs.store.Set(ctx, requestBody.Key, requestBody.Value, ttl); err != nil {
-		log.Printf("Redis set error: %v", err)
-		writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
-		return
+	size := int64(len(key) + len(item.Value))
+	reservation, err := cs.namespaces.reserve(ctx, ns, key, size, ttl)
+	if err != nil {
+		ns.rejected.Add(1)
+		countRejection("namespace_budget")
+		writeCacheError(w, http.StatusInsufficientStorage, map[string]string{"error": err.Error()})
+		return false
 	}
-
-	writeJSON(w, http.StatusOK, map[string]string{"message": "cached"})
+	version, err := cs.store.SetIf(ctx, ns.key(key), item, cond)
+	if err != nil {
+		cs.namespaces.undo(ctx, reservation)
+	}
+	if isConditionFailure(err) {
+		writeCacheError(w, cond.failStatus, map[string]string{"error": "write condition failed", "details": err.Error()})
+		return false
+	}
+	if err != nil {
+		writeStoreError(w, "Redis set error", err)
+		return false
+	}
+	ns.writes.Add(1)
+	cs.noteWrite(r)
+	cs.tags.add(ctx, ns, key, item.Tags, ttl)
+	cs.releaseAfterWrite(ctx, r, ns, key)
+	cs.waiters.notify(ctx, ns.key(key))
+	cs.events.publish(CacheEvent{Op: eventSet, Namespace: ns.name, Key: key, TTL: int64(ttl.Seconds()), Size: int64(len(item.Value))})
+	if version > 0 {
+		w.Header().Set("ETag", formatETag(version))
+	}
+	return true
 }
 
 func (cs *CacheService) cacheTTL(rawTTL string) (time.Duration, error) {
@@ -248,25 +636,103 @@ func (cs *CacheService) cacheTTL(rawTTL string) (time.Duration, error) {
 }
 
 func (cs *CacheService) Close() error {
+	if cs.refresher != nil {
+		cs.refresher.close()
+	}
+	if cs.capture != nil {
+		cs.capture.close()
+	}
+	cs.waiters.close()
+	cs.events.close()
+	cs.webhooks.close()
 	return cs.store.Close()
 }
 
 func newRouter(cacheService *CacheService) http.Handler {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", cacheService.healthHandler)
-	mux.HandleFunc("/api/health", cacheService.healthHandler)
-	mux.HandleFunc("/api/cache", func(w http.ResponseWriter, r *http.Request) {
+	auth := cacheService.auth
+	limits := cacheService.limits
+	namespaces := cacheService.namespaces
+	// Every authenticated route bounds its body, since signature checks
+	// read it before the caller is known.
+	read := func(handler http.HandlerFunc) http.HandlerFunc {
+		return cacheService.limitBody(auth.require(scopeRead, namespaces.resolve(limits.limitReads(handler))))
+	}
+	write := func(handler http.HandlerFunc) http.HandlerFunc {
+		return cacheService.limitBody(auth.require(scopeWrite, namespaces.resolve(limits.limitWrites(handler))))
+	}
+	admin := func(handler http.HandlerFunc) http.HandlerFunc {
+		return cacheService.limitBody(auth.require(scopeAdmin, handler))
+	}
+
+	getCache := read(cacheService.GetCache)
+	setCache := write(cacheService.SetCache)
+	cacheHandler := func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet, http.MethodHead:
-			cacheService.GetCache(w, r)
+			getCache(w, r)
 		case http.MethodPost:
-			cacheService.SetCache(w, r)
+			setCache(w, r)
 		default:
 			writeNoStore(w)
 			http.NotFound(w, r)
 		}
-	})
-	return mux
+	}
+
+	getRaw := read(cacheService.GetRaw)
+	putRaw := write(cacheService.PutRaw)
+	rawHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			getRaw(w, r)
+		case http.MethodPut:
+			putRaw(w, r)
+		default:
+			writeNoStore(w)
+			http.NotFound(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", cacheService.healthHandler)
+	mux.HandleFunc("/api/health", cacheService.healthHandler)
+	mux.HandleFunc("/livez", cacheService.livezHandler)
+	mux.HandleFunc("/readyz", cacheService.readyzHandler)
+	mux.HandleFunc("/api/cache", cacheHandler)
+	mux.HandleFunc("/api/ns/{namespace}/cache", cacheHandler)
+	mux.HandleFunc("/api/cache/{key...}", rawHandler)
+	mux.HandleFunc("/api/ns/{namespace}/cache/{key...}", rawHandler)
+	deleteCache := cacheService.limitBody(auth.require(scopeDelete, namespaces.resolve(limits.limitWrites(cacheService.DeleteCache))))
+	patchTTL := write(cacheService.PatchTTL)
+	invalidate := cacheService.limitBody(auth.require(scopeDelete, namespaces.resolve(limits.limitWrites(cacheService.Invalidate))))
+	mux.HandleFunc("DELETE /v2/cache", invalidate)
+	mux.HandleFunc("DELETE /v2/ns/{namespace}/cache", invalidate)
+	for _, prefix := range []string{"/v2/cache/", "/v2/ns/{namespace}/cache/"} {
+		mux.HandleFunc("GET "+prefix+"{key...}", getRaw)
+		mux.HandleFunc("PUT "+prefix+"{key...}", putRaw)
+		mux.HandleFunc("DELETE "+prefix+"{key...}", deleteCache)
+		mux.HandleFunc("PATCH "+prefix+"{key...}", patchTTL)
+	}
+	acquireLease := write(cacheService.AcquireLease)
+	releaseLease := write(cacheService.ReleaseLease)
+	for _, prefix := range []string{"/v2/lease/", "/v2/ns/{namespace}/lease/"} {
+		mux.HandleFunc("POST "+prefix+"{key...}", acquireLease)
+		mux.HandleFunc("DELETE "+prefix+"{key...}", releaseLease)
+	}
+
+	eventStream := read(cacheService.EventStream)
+	mux.HandleFunc("GET /api/events", eventStream)
+	mux.HandleFunc("GET /api/ns/{namespace}/events", eventStream)
+
+	mux.HandleFunc("/api/admin/namespaces", admin(cacheService.namespacesHandler))
+	mux.HandleFunc("/api/admin/metrics", admin(metricsHandler))
+	mux.HandleFunc("GET /api/admin/stats", admin(cacheService.statsHandler))
+	mux.HandleFunc("GET /api/admin/hot-keys", admin(cacheService.hotKeysHandler))
+	mux.HandleFunc("GET /api/admin/keys", admin(cacheService.ListKeys))
+	mux.HandleFunc("GET /api/admin/keys/{key...}", admin(cacheService.InspectKey))
+	mux.HandleFunc("GET /api/admin/values/{key...}", admin(cacheService.InspectValue))
+	mux.HandleFunc("GET /api/admin/webhooks/deliveries", admin(cacheService.webhookHistoryHandler(webhookLogList)))
+	mux.HandleFunc("GET /api/admin/webhooks/dead-letters", admin(cacheService.webhookHistoryHandler(webhookDeadList)))
+	return cacheService.captureRequests(mux)
 }
 
 func (cs *CacheService) healthHandler(w http.ResponseWriter, r *http.Request) {
@@ -275,16 +741,26 @@ func (cs *CacheService) healthHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
-	if err := cs.HealthCheck(r.Context()); err != nil {
+	if verboseParam(r) {
+		cs.verboseHealth(w, r)
+		return
+	}
+	err := cs.HealthCheck(r.Context())
+	if cs.breaker != nil {
+		w.Header().Set("X-Cache-Breaker", cs.breaker.state())
+	}
+	if err != nil {
 		writeNoStore(w)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = w.Write([]byte("Redis connection failed"))
+		// An open breaker still serves stale reads, so the instance stays
+		// in rotation.
+		if cs.breakerOpen() {
+			writeText(w, http.StatusOK, "DEGRADED")
+			return
+		}
+		writeText(w, http.StatusServiceUnavailable, "Redis connection failed")
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("OK"))
+	writeText(w, http.StatusOK, "OK")
 }
 
 func writeCacheError(w http.ResponseWriter, status int, payload map[string]string) {
@@ -334,8 +810,19 @@ func runHealthcheckWithClient(client *http.Client, url string) int {
 }
 
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
-		os.Exit(runHealthcheck())
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "healthcheck":
+			os.Exit(runHealthcheck())
+		case "warm":
+			os.Exit(runWarm(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "get", "set", "del", "ttl", "keys", "stats", "bench", "replay":
+			os.Exit(runClient(os.Args[1], os.Args[2:]))
+		}
 	}
 
 	config, err := loadConfig()
@@ -344,11 +831,16 @@ func main() {
 	}
 
 	cacheService := NewCacheService(config)
-	defer cacheService.Close()
 
 	if err := cacheService.HealthCheck(context.Background()); err != nil {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
+	if err := cacheService.startRefresh(); err != nil {
+		log.Fatalf("Failed to start refresh-ahead: %v", err)
+	}
+	if err := cacheService.startCapture(); err != nil {
+		log.Fatalf("Failed to start request capture: %v", err)
+	}
 
 	srv := &http.Server{
 		Addr:         ":8080",
@@ -370,9 +862,7 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := cacheService.shutdown(srv); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
 
@@ -24,6 +24,10 @@ type fakeStore struct {
 	setErr  error
 	items   map[string]CacheItem
 	sets    []setCall
+	version int64
+	// lifetimes holds the TTL each entry was last given, like the ttl
+	// field of a Redis entry.
+	lifetimes map[string]time.Duration
 }
 
 type setCall struct {
@@ -33,10 +37,12 @@ type setCall struct {
 }
 
 func newFakeStore() *fakeStore {
-	return &fakeStore{items: make(map[string]CacheItem)}
+	return &fakeStore{items: make(map[string]CacheItem), lifetimes: make(map[string]time.Duration)}
 }
 
 func (f *fakeStore) Ping(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	return f.pingErr
 }
 
@@ -54,16 +60,93 @@ func (f *fakeStore) Get(_ context.Context, key string) (CacheItem, error) {
 	return item, nil
 }
 
-func (f *fakeStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+func (f *fakeStore) Set(ctx context.Context, key string, item CacheItem) error {
+	_, err := f.SetIf(ctx, key, item, WriteCondition{})
+	return err
+}
+
+func (f *fakeStore) SetIf(_ context.Context, key string, item CacheItem, cond WriteCondition) (int64, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	if f.setErr != nil {
-		return f.setErr
+		return 0, f.setErr
+	}
+	current, exists := f.items[key]
+	switch {
+	case cond.Mode == writeIfAbsent && exists:
+		return 0, errKeyExists
+	case (cond.Mode == writeIfPresent || cond.Mode == writeIfVersion) && !exists:
+		return 0, errKeyMissing
+	case cond.Mode == writeIfVersion && current.Version != cond.Version:
+		return 0, errVersionMismatch
+	}
+	f.version++
+	item.Version = f.version
+	f.items[key] = item
+	f.lifetimes[key] = item.TTL
+	f.sets = append(f.sets, setCall{key: key, value: item.Value, ttl: item.TTL})
+	return item.Version, nil
+}
+
+func (f *fakeStore) Delete(_ context.Context, key string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.setErr != nil {
+		return false, f.setErr
 	}
-	f.items[key] = CacheItem{Value: value, TTL: ttl}
-	f.sets = append(f.sets, setCall{key: key, value: value, ttl: ttl})
-	return nil
+	_, ok := f.items[key]
+	delete(f.items, key)
+	return ok, nil
+}
+
+func (f *fakeStore) GetAndTouch(_ context.Context, key string, ttl time.Duration) (CacheItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.getErr != nil {
+		return CacheItem{}, f.getErr
+	}
+	item, ok := f.items[key]
+	if !ok {
+		return CacheItem{}, errCacheMiss
+	}
+	if lifetime, ok := f.lifetimes[key]; ok {
+		ttl = lifetime
+	}
+	item.TTL = max(item.TTL, ttl)
+	f.items[key] = item
+	return item, nil
+}
+
+func (f *fakeStore) UpdateTTL(_ context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.setErr != nil {
+		return 0, f.setErr
+	}
+	item, ok := f.items[key]
+	if !ok {
+		return 0, errCacheMiss
+	}
+	ttl := update.TTL
+	switch update.Mode {
+	case ttlModeExtend:
+		ttl += item.TTL
+	case ttlModeCap:
+		if lifetime, ok := f.lifetimes[key]; ok {
+			f.lifetimes[key] = min(lifetime, ttl)
+		}
+		ttl = min(ttl, item.TTL)
+	}
+	item.TTL = min(ttl, update.Max)
+	f.items[key] = item
+	if update.Mode != ttlModeCap {
+		f.lifetimes[key] = item.TTL
+	}
+	return item.TTL, nil
 }
 
 func (f *fakeStore) Close() error {
@@ -547,7 +630,7 @@ func TestCacheTTLRejectsOverflow(t *testing.T) {
 
 func TestRedisStoreRejectsInvalidSetTTL(t *testing.T) {
 	store := &RedisStore{}
-	if err := store.Set(context.Background(), "key", "value", 0); err == nil {
+	if err := store.Set(context.Background(), "key", CacheItem{Value: "value"}); err == nil {
 		t.Fatal("expected error for invalid ttl")
 	}
 }
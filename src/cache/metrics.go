@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+)
+
+// Counters are published through expvar and served on the admin metrics
+// route rather than the default /debug/vars handler.
+var (
+	rejectionMetrics = expvar.NewMap("cache_rejections")
+	leaseMetrics     = expvar.NewMap("cache_leases")
+	waitMetrics      = expvar.NewMap("cache_waits")
+	eventMetrics     = expvar.NewMap("cache_events")
+	webhookMetrics   = expvar.NewMap("cache_webhooks")
+	warmMetrics      = expvar.NewMap("cache_warm")
+	captureMetrics   = expvar.NewMap("cache_capture")
+	breakerMetrics   = expvar.NewMap("cache_breaker")
+	retryMetrics     = expvar.NewMap("cache_retries")
+	replicaMetrics   = expvar.NewMap("cache_replicas")
+)
+
+// breakerState is the circuit breaker state, published in cache_breaker.
+var breakerState = new(expvar.String)
+
+// currentHotKeys is the tracker of the running service, published as the
+// cache_hot_keys metric.
+var currentHotKeys atomic.Pointer[hotKeys]
+
+func init() {
+	breakerMetrics.Set("state", breakerState)
+	expvar.Publish("cache_hot_keys", expvar.Func(func() any {
+		if hk := currentHotKeys.Load(); hk != nil {
+			return hk.report(hk.k)
+		}
+		return nil
+	}))
+}
+
+func countRejection(reason string) {
+	rejectionMetrics.Add(reason, 1)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeNoStore(w)
+		http.NotFound(w, r)
+		return
+	}
+	writeNoStore(w)
+	expvar.Handler().ServeHTTP(w, r)
+}
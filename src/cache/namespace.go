@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultNamespace      = "default"
+	namespaceKeyPrefix    = internalKeyPrefix + "ns:"
+	namespaceUsagePrefix  = internalKeyPrefix + "nsusage:"
+	namespaceUsageTimeout = time.Second
+)
+
+var (
+	errBudgetExceeded  = errors.New("namespace memory budget exceeded")
+	validNamespaceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+// NamespaceConfig describes an isolated key space. Entries are stored under
+// their own Redis prefix, and callers reach them either through the
+// /api/ns/{namespace}/cache route or by authenticating with one of Tokens,
+// which lists auth token names and signing key ids. The "default" namespace
+// is the legacy unprefixed key space and may be configured to add limits.
+type NamespaceConfig struct {
+	Name         string   `json:"name"`
+	DefaultTTL   int      `json:"default_ttl"`
+	MaxTTL       int      `json:"max_ttl"`
+	MaxValueSize int64    `json:"max_value_size"`
+	MemoryBudget int64    `json:"memory_budget"`
+	SlidingTTL   bool     `json:"sliding_ttl"`
+	Tokens       []string `json:"tokens"`
+}
+
+func validateNamespaces(configs []NamespaceConfig) error {
+	names := make(map[string]bool, len(configs))
+	tokens := make(map[string]string)
+	for _, ns := range configs {
+		if !validNamespaceName.MatchString(ns.Name) {
+			return fmt.Errorf("namespace name %q must match %s", ns.Name, validNamespaceName)
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("namespace %q is configured more than once", ns.Name)
+		}
+		names[ns.Name] = true
+
+		if ns.DefaultTTL < 0 || ns.MaxTTL < 0 || ns.MaxValueSize < 0 || ns.MemoryBudget < 0 {
+			return fmt.Errorf("namespace %q limits must not be negative", ns.Name)
+		}
+		if ns.MaxTTL > 0 && ns.DefaultTTL > ns.MaxTTL {
+			return fmt.Errorf("namespace %q default_ttl must not exceed max_ttl", ns.Name)
+		}
+		for _, token := range ns.Tokens {
+			if other, ok := tokens[token]; ok {
+				return fmt.Errorf("token %q is bound to namespaces %q and %q", token, other, ns.Name)
+			}
+			tokens[token] = ns.Name
+		}
+	}
+	return nil
+}
+
+type NamespaceUsage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// UsageEntry is the accounting of a single key.
+type UsageEntry struct {
+	Size   int64
+	Expiry time.Time
+}
+
+// UsageStore is implemented by stores that can account for the keys and
+// bytes held by each namespace. Accounting entries expire with the TTL of the
+// entry they describe, so the counters heal themselves after evictions.
+//
+// ReserveUsage also returns the entry a reservation replaced, or nil when the
+// key was not accounted for, so that RestoreUsage can put it back when the
+// write fails.
+type UsageStore interface {
+	ReserveUsage(ctx context.Context, namespace, key string, size int64, ttl time.Duration, budget int64) (NamespaceUsage, *UsageEntry, error)
+	RestoreUsage(ctx context.Context, namespace, key string, previous *UsageEntry) error
+	ReleaseUsage(ctx context.Context, namespace, key string) error
+	Usage(ctx context.Context, namespace string) (NamespaceUsage, error)
+}
+
+type namespace struct {
+	name         string
+	prefix       string
+	tracked      bool
+	defaultTTL   int64
+	maxTTL       int64
+	maxValueSize int64
+	memoryBudget int64
+	slidingTTL   bool
+
+	reads    atomic.Int64
+	hits     atomic.Int64
+	misses   atomic.Int64
+	writes   atomic.Int64
+	rejected atomic.Int64
+}
+
+func (ns *namespace) key(key string) string {
+	return ns.prefix + key
+}
+
+type namespaces struct {
+	defaultNS   *namespace
+	byName      map[string]*namespace
+	byPrincipal map[string]*namespace
+	order       []*namespace
+	usage       UsageStore
+	breaker     *breakerStore
+}
+
+func newNamespaces(configs []NamespaceConfig, store CacheStore, breaker *breakerStore) *namespaces {
+	defaultNS := &namespace{name: defaultNamespace}
+	n := &namespaces{
+		defaultNS:   defaultNS,
+		byName:      map[string]*namespace{defaultNamespace: defaultNS},
+		byPrincipal: make(map[string]*namespace),
+		order:       []*namespace{defaultNS},
+		breaker:     breaker,
+	}
+	if usage, ok := store.(UsageStore); ok {
+		n.usage = usage
+	}
+
+	for _, config := range configs {
+		ns := defaultNS
+		if config.Name != defaultNamespace {
+			ns = &namespace{name: config.Name, prefix: namespaceKeyPrefix + config.Name + ":"}
+			n.byName[config.Name] = ns
+			n.order = append(n.order, ns)
+		}
+		ns.tracked = true
+		ns.defaultTTL = int64(config.DefaultTTL)
+		ns.maxTTL = int64(config.MaxTTL)
+		ns.maxValueSize = config.MaxValueSize
+		ns.memoryBudget = config.MemoryBudget
+		ns.slidingTTL = config.SlidingTTL
+		for _, token := range config.Tokens {
+			n.byPrincipal[token] = ns
+		}
+	}
+	return n
+}
+
+type namespaceKey struct{}
+
+// resolve picks the namespace for a request from the route or, failing that,
+// from the namespace the caller's credentials are bound to. A bound caller
+// may not reach into any other namespace.
+func (n *namespaces) resolve(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var bound *namespace
+		if p, ok := principalFromContext(r.Context()); ok {
+			bound = n.byPrincipal[p.name]
+		}
+
+		ns := n.defaultNS
+		if name := r.PathValue("namespace"); name != "" {
+			var ok bool
+			if ns, ok = n.byName[name]; !ok {
+				writeCacheError(w, http.StatusNotFound, map[string]string{"error": "namespace not found"})
+				return
+			}
+			if bound != nil && bound != ns {
+				writeCacheError(w, http.StatusForbidden, map[string]string{"error": "forbidden", "details": fmt.Sprintf("credentials are bound to namespace %s", bound.name)})
+				return
+			}
+		} else if bound != nil {
+			ns = bound
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns)))
+	}
+}
+
+func (cs *CacheService) requestNamespace(r *http.Request) *namespace {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns
+	}
+	return cs.namespaces.defaultNS
+}
+
+// namespaceTTL applies the namespace default and maximum TTL on top of the
+// global TTL rules in cacheTTL.
+func (cs *CacheService) namespaceTTL(ns *namespace, rawTTL string) (time.Duration, error) {
+	if rawTTL == "" && ns.defaultTTL > 0 {
+		rawTTL = strconv.FormatInt(ns.defaultTTL, 10)
+	}
+	ttl, err := cs.cacheTTL(rawTTL)
+	if err != nil {
+		return 0, err
+	}
+	if ns.maxTTL > 0 && ttl > time.Duration(ns.maxTTL)*time.Second {
+		return 0, fmt.Errorf("ttl must not exceed %d seconds", ns.maxTTL)
+	}
+	return ttl, nil
+}
+
+// usageReservation is a write recorded against a namespace budget, and the
+// accounting it replaced.
+type usageReservation struct {
+	ns       *namespace
+	key      string
+	previous *UsageEntry
+	held     bool
+}
+
+// reserve records a write against the namespace memory budget. Accounting
+// failures are logged and let the write through, and so does an open
+// breaker.
+func (n *namespaces) reserve(ctx context.Context, ns *namespace, key string, size int64, ttl time.Duration) (usageReservation, error) {
+	if !ns.tracked || n.usage == nil || !n.breaker.allow() {
+		return usageReservation{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, namespaceUsageTimeout)
+	defer cancel()
+
+	_, previous, err := n.usage.ReserveUsage(ctx, ns.name, key, size, ttl, ns.memoryBudget)
+	if errors.Is(err, errBudgetExceeded) {
+		return usageReservation{}, err
+	}
+	if err != nil {
+		log.Printf("namespace usage error: %v", err)
+		return usageReservation{}, nil
+	}
+	return usageReservation{ns: ns, key: key, previous: previous, held: true}, nil
+}
+
+// undo puts back the accounting a reservation replaced after its write
+// failed. It runs even when the write failed because ctx ran out.
+func (n *namespaces) undo(ctx context.Context, res usageReservation) {
+	if !res.held || !n.breaker.allow() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), namespaceUsageTimeout)
+	defer cancel()
+
+	if err := n.usage.RestoreUsage(ctx, res.ns.name, res.key, res.previous); err != nil {
+		log.Printf("namespace usage error: %v", err)
+	}
+}
+
+// release removes a deleted key from the namespace accounting.
+func (n *namespaces) release(ctx context.Context, ns *namespace, key string) {
+	if !ns.tracked || n.usage == nil || !n.breaker.allow() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, namespaceUsageTimeout)
+	defer cancel()
+
+	if err := n.usage.ReleaseUsage(ctx, ns.name, key); err != nil {
+		log.Printf("namespace usage error: %v", err)
+	}
+}
+
+type namespaceReport struct {
+	Name         string          `json:"name"`
+	KeyPrefix    string          `json:"key_prefix"`
+	DefaultTTL   int64           `json:"default_ttl"`
+	MaxTTL       int64           `json:"max_ttl"`
+	MaxValueSize int64           `json:"max_value_size"`
+	MemoryBudget int64           `json:"memory_budget"`
+	SlidingTTL   bool            `json:"sliding_ttl"`
+	Usage        *NamespaceUsage `json:"usage,omitempty"`
+	Reads        int64           `json:"reads"`
+	Hits         int64           `json:"hits"`
+	Misses       int64           `json:"misses"`
+	Writes       int64           `json:"writes"`
+	Rejected     int64           `json:"rejected"`
+}
+
+func (cs *CacheService) namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeNoStore(w)
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+	defer cancel()
+
+	reports := make([]namespaceReport, 0, len(cs.namespaces.order))
+	for _, ns := range cs.namespaces.order {
+		report := namespaceReport{
+			Name:         ns.name,
+			KeyPrefix:    ns.prefix,
+			DefaultTTL:   ns.defaultTTL,
+			MaxTTL:       ns.maxTTL,
+			MaxValueSize: ns.maxValueSize,
+			MemoryBudget: ns.memoryBudget,
+			SlidingTTL:   ns.slidingTTL,
+			Reads:        ns.reads.Load(),
+			Hits:         ns.hits.Load(),
+			Misses:       ns.misses.Load(),
+			Writes:       ns.writes.Load(),
+			Rejected:     ns.rejected.Load(),
+		}
+		if ns.defaultTTL == 0 {
+			report.DefaultTTL = int64(cs.config.TTL)
+		}
+		if ns.tracked && cs.namespaces.usage != nil {
+			usage, err := cs.namespaces.usage.Usage(ctx, ns.name)
+			if err != nil {
+				log.Printf("namespace usage error: %v", err)
+			} else {
+				report.Usage = &usage
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, map[string][]namespaceReport{"namespaces": reports})
+}
+
+// pruneUsageScript is shared by the usage scripts. KEYS[1] is a sorted set of
+// keys scored by expiry time, KEYS[2] a hash of key sizes and KEYS[3] the
+// total byte count.
+const pruneUsageScript = `
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, 1000)
+local freed = 0
+for _, member in ipairs(expired) do
+  freed = freed + (tonumber(redis.call('HGET', KEYS[2], member)) or 0)
+  redis.call('HDEL', KEYS[2], member)
+  redis.call('ZREM', KEYS[1], member)
+end
+if freed > 0 then
+  redis.call('DECRBY', KEYS[3], freed)
+end
+`
+
+// reserveUsageScript returns the usage result followed by the size and
+// expiry the key was accounted with before, or -1 for both when it was not.
+var reserveUsageScript = redis.NewScript(pruneUsageScript + `
+local size = tonumber(ARGV[2])
+local previous = 0
+local expiry = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if expiry then
+  previous = tonumber(redis.call('HGET', KEYS[2], ARGV[1])) or 0
+end
+local used = tonumber(redis.call('GET', KEYS[3])) or 0
+local budget = tonumber(ARGV[4])
+if budget > 0 and used - previous + size > budget then
+  return {0, redis.call('ZCARD', KEYS[1]), used}
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], size)
+used = redis.call('INCRBY', KEYS[3], size - previous)
+if not expiry then
+  return {1, redis.call('ZCARD', KEYS[1]), used, -1, -1}
+end
+return {1, redis.call('ZCARD', KEYS[1]), used, previous, tonumber(expiry)}
+`)
+
+// restoreUsageScript puts back the size ARGV[2] and expiry ARGV[3] a key was
+// accounted with, or removes the key when they are not given.
+var restoreUsageScript = redis.NewScript(pruneUsageScript + `
+local current = 0
+if redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+  current = tonumber(redis.call('HGET', KEYS[2], ARGV[1])) or 0
+end
+if ARGV[2] == nil then
+  if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+    redis.call('HDEL', KEYS[2], ARGV[1])
+    redis.call('DECRBY', KEYS[3], current)
+  end
+  return 1
+end
+redis.call('ZADD', KEYS[1], tonumber(ARGV[3]), ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('INCRBY', KEYS[3], tonumber(ARGV[2]) - current)
+return 1
+`)
+
+var releaseUsageScript = redis.NewScript(pruneUsageScript + `
+local size = tonumber(redis.call('HGET', KEYS[2], ARGV[1])) or 0
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 1 then
+  redis.call('HDEL', KEYS[2], ARGV[1])
+  redis.call('DECRBY', KEYS[3], size)
+end
+return 1
+`)
+
+var usageScript = redis.NewScript(pruneUsageScript + `
+return {1, redis.call('ZCARD', KEYS[1]), tonumber(redis.call('GET', KEYS[3])) or 0}
+`)
+
+func namespaceUsageKeys(namespace string) []string {
+	prefix := namespaceUsagePrefix + namespace + ":"
+	return []string{prefix + "expiry", prefix + "size", prefix + "bytes"}
+}
+
+type usageMemberKey struct{}
+
+// usageMember names the accounting entry of a key in a tracked namespace.
+type usageMember struct {
+	namespace string
+	key       string
+}
+
+// withUsageMember marks ctx so that TTL changes made with it also move the
+// expiry of key in the namespace accounting. Untracked namespaces and an
+// open breaker leave ctx unmarked.
+func (n *namespaces) withUsageMember(ctx context.Context, ns *namespace, key string) context.Context {
+	if !ns.tracked || n.usage == nil || !n.breaker.allow() {
+		return ctx
+	}
+	return context.WithValue(ctx, usageMemberKey{}, usageMember{namespace: ns.name, key: key})
+}
+
+func usageMemberOf(ctx context.Context) (usageMember, bool) {
+	member, ok := ctx.Value(usageMemberKey{}).(usageMember)
+	return member, ok
+}
+
+// usageScriptArgs appends the accounting sorted set and member carried by ctx
+// to the keys and arguments of a TTL script.
+func usageScriptArgs(ctx context.Context, keys []string, args ...interface{}) ([]string, []interface{}) {
+	if member, ok := usageMemberOf(ctx); ok {
+		keys = append(keys, namespaceUsageKeys(member.namespace)[0])
+		args = append(args, member.key)
+	}
+	return keys, args
+}
+
+func (rs *RedisStore) ReserveUsage(ctx context.Context, namespace, key string, size int64, ttl time.Duration, budget int64) (NamespaceUsage, *UsageEntry, error) {
+	result, err := reserveUsageScript.Run(ctx, rs.client, namespaceUsageKeys(namespace), key, size, ttl.Milliseconds(), budget).Int64Slice()
+	if err != nil {
+		return NamespaceUsage{}, nil, err
+	}
+	if len(result) != 5 {
+		usage, err := usageResult(result)
+		return usage, nil, err
+	}
+	usage, err := usageResult(result[:3])
+	if err != nil || result[4] < 0 {
+		return usage, nil, err
+	}
+	return usage, &UsageEntry{Size: result[3], Expiry: time.UnixMilli(result[4])}, nil
+}
+
+func (rs *RedisStore) RestoreUsage(ctx context.Context, namespace, key string, previous *UsageEntry) error {
+	args := []interface{}{key}
+	if previous != nil {
+		args = append(args, previous.Size, previous.Expiry.UnixMilli())
+	}
+	return restoreUsageScript.Run(ctx, rs.client, namespaceUsageKeys(namespace), args...).Err()
+}
+
+func (rs *RedisStore) ReleaseUsage(ctx context.Context, namespace, key string) error {
+	return releaseUsageScript.Run(ctx, rs.client, namespaceUsageKeys(namespace), key).Err()
+}
+
+func (rs *RedisStore) Usage(ctx context.Context, namespace string) (NamespaceUsage, error) {
+	result, err := usageScript.Run(ctx, rs.client, namespaceUsageKeys(namespace)).Int64Slice()
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+	return usageResult(result)
+}
+
+func usageResult(result []int64) (NamespaceUsage, error) {
+	if len(result) != 3 {
+		return NamespaceUsage{}, fmt.Errorf("unexpected usage script result %v", result)
+	}
+	usage := NamespaceUsage{Keys: result[1], Bytes: result[2]}
+	if result[0] == 0 {
+		return usage, errBudgetExceeded
+	}
+	return usage, nil
+}
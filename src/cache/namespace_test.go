@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// usageFakeStore accounts namespace usage like the Redis scripts, pruning
+// entries whose accounted expiry has passed on the clock in now.
+type usageFakeStore struct {
+	*fakeStore
+	sizes    map[string]map[string]int64
+	expiries map[string]map[string]time.Time
+	now      time.Time
+}
+
+func newUsageFakeStore() *usageFakeStore {
+	return &usageFakeStore{
+		fakeStore: newFakeStore(),
+		sizes:     make(map[string]map[string]int64),
+		expiries:  make(map[string]map[string]time.Time),
+		now:       time.Unix(0, 0),
+	}
+}
+
+func (s *usageFakeStore) ReserveUsage(_ context.Context, namespace, key string, size int64, ttl time.Duration, budget int64) (NamespaceUsage, *UsageEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(namespace)
+	sizes := s.sizes[namespace]
+	if sizes == nil {
+		sizes = make(map[string]int64)
+		s.sizes[namespace] = sizes
+		s.expiries[namespace] = make(map[string]time.Time)
+	}
+	usage := usageOf(sizes)
+	if budget > 0 && usage.Bytes-sizes[key]+size > budget {
+		return usage, nil, errBudgetExceeded
+	}
+	var previous *UsageEntry
+	if expiry, ok := s.expiries[namespace][key]; ok {
+		previous = &UsageEntry{Size: sizes[key], Expiry: expiry}
+	}
+	sizes[key] = size
+	s.expiries[namespace][key] = s.now.Add(ttl)
+	return usageOf(sizes), previous, nil
+}
+
+func (s *usageFakeStore) RestoreUsage(_ context.Context, namespace, key string, previous *UsageEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous == nil {
+		delete(s.sizes[namespace], key)
+		delete(s.expiries[namespace], key)
+		return nil
+	}
+	s.sizes[namespace][key] = previous.Size
+	s.expiries[namespace][key] = previous.Expiry
+	return nil
+}
+
+func (s *usageFakeStore) ReleaseUsage(_ context.Context, namespace, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sizes[namespace], key)
+	delete(s.expiries[namespace], key)
+	return nil
+}
+
+func (s *usageFakeStore) Usage(_ context.Context, namespace string) (NamespaceUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(namespace)
+	return usageOf(s.sizes[namespace]), nil
+}
+
+func (s *usageFakeStore) UpdateTTL(ctx context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	ttl, err := s.fakeStore.UpdateTTL(ctx, key, update)
+	if err == nil {
+		s.rescore(ctx, ttl)
+	}
+	return ttl, err
+}
+
+func (s *usageFakeStore) GetAndTouch(ctx context.Context, key string, ttl time.Duration) (CacheItem, error) {
+	item, err := s.fakeStore.GetAndTouch(ctx, key, ttl)
+	if err == nil {
+		s.rescore(ctx, item.TTL)
+	}
+	return item, err
+}
+
+// advance moves the accounting clock forward by d.
+func (s *usageFakeStore) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *usageFakeStore) rescore(ctx context.Context, ttl time.Duration) {
+	member, ok := usageMemberOf(ctx)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.expiries[member.namespace][member.key]; ok {
+		s.expiries[member.namespace][member.key] = s.now.Add(ttl)
+	}
+}
+
+func (s *usageFakeStore) prune(namespace string) {
+	for key, expiry := range s.expiries[namespace] {
+		if !expiry.After(s.now) {
+			delete(s.sizes[namespace], key)
+			delete(s.expiries[namespace], key)
+		}
+	}
+}
+
+func usageOf(sizes map[string]int64) NamespaceUsage {
+	usage := NamespaceUsage{Keys: int64(len(sizes))}
+	for _, size := range sizes {
+		usage.Bytes += size
+	}
+	return usage
+}
+
+func namespaceTestConfig() *Config {
+	config := authTestConfig()
+	config.Auth.Tokens = append(config.Auth.Tokens,
+		TokenConfig{Name: "tenant-writer", Token: "tenant-token", Scopes: []string{scopeRead, scopeWrite}},
+		TokenConfig{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}},
+	)
+	config.Namespaces = []NamespaceConfig{
+		{Name: "tenant", DefaultTTL: 60, MaxTTL: 120, MaxValueSize: 16, MemoryBudget: 40, Tokens: []string{"tenant-writer"}},
+		{Name: "other"},
+	}
+	return config
+}
+
+func TestNamespaceRouteIsolation(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	writer := map[string]string{"Authorization": "Bearer writer-token"}
+
+	w := serveWithHeaders(router, http.MethodPost, "/api/ns/other/cache", `{"key":"shared","value":"other value"}`, writer)
+	requireStatus(t, w, http.StatusOK)
+	w = serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"shared","value":"default value"}`, writer)
+	requireStatus(t, w, http.StatusOK)
+
+	if _, ok := store.items[namespaceKeyPrefix+"other:shared"]; !ok {
+		t.Fatalf("namespaced key was not stored with its prefix: %v", store.items)
+	}
+
+	requireBody(t, serve(router, http.MethodGet, "/api/ns/other/cache?key=shared", ""), `"other value"`)
+	requireBody(t, serve(router, http.MethodGet, "/api/cache?key=shared", ""), `"default value"`)
+
+	w = serve(router, http.MethodGet, "/api/ns/missing/cache?key=shared", "")
+	requireStatus(t, w, http.StatusNotFound)
+	requireJSONField(t, w, "error", "namespace not found")
+
+	// The default namespace cannot reach namespaced entries by their Redis key.
+	w = serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"_cache:ns:other:shared","value":"overwritten"}`, writer)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "invalid key")
+	requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=_cache:ns:other:shared", ""), http.StatusBadRequest)
+	if got := store.items[namespaceKeyPrefix+"other:shared"].Value; got != "other value" {
+		t.Fatalf("namespaced value = %q, want it untouched", got)
+	}
+}
+
+func TestNamespaceTokenBinding(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	tenant := map[string]string{"Authorization": "Bearer tenant-token"}
+
+	w := serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"mine","value":"tenant"}`, tenant)
+	requireStatus(t, w, http.StatusOK)
+	if _, ok := store.items[namespaceKeyPrefix+"tenant:mine"]; !ok {
+		t.Fatalf("bound token did not write into its namespace: %v", store.items)
+	}
+
+	w = serveWithHeaders(router, http.MethodGet, "/api/cache?key=mine", "", tenant)
+	requireStatus(t, w, http.StatusOK)
+	requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=mine", ""), http.StatusNotFound)
+
+	w = serveWithHeaders(router, http.MethodPost, "/api/ns/other/cache", `{"key":"theirs","value":"x"}`, tenant)
+	requireStatus(t, w, http.StatusForbidden)
+	requireJSONField(t, w, "error", "forbidden")
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	tenant := map[string]string{"Authorization": "Bearer tenant-token"}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v"}`, tenant), http.StatusOK)
+	if got := store.items[namespaceKeyPrefix+"tenant:a"].TTL; got != 60*time.Second {
+		t.Fatalf("default namespace ttl = %s, want 60s", got)
+	}
+
+	w := serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v","ttl":"121"}`, tenant)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "ttl must not exceed 120 seconds")
+
+	w = serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"a","value":"this value is too long"}`, tenant)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	requireJSONField(t, w, "error", "value too large")
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"b","value":"0123456789abcdef"}`, tenant), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"c","value":"0123456789abcdef"}`, tenant), http.StatusOK)
+	w = serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"d","value":"0123456789abcdef"}`, tenant)
+	requireStatus(t, w, http.StatusInsufficientStorage)
+	requireJSONField(t, w, "error", errBudgetExceeded.Error())
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"b","value":"overwrite"}`, tenant), http.StatusOK)
+}
+
+func TestFailedWriteKeepsNamespaceUsage(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	tenant := map[string]string{"Authorization": "Bearer tenant-token"}
+	usage := func() NamespaceUsage {
+		t.Helper()
+		usage, err := store.Usage(context.Background(), "tenant")
+		if err != nil {
+			t.Fatalf("Usage: %v", err)
+		}
+		return usage
+	}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/a?ttl=10", "v", tenant), http.StatusOK)
+	want := usage()
+
+	stale := map[string]string{"Authorization": "Bearer tenant-token", "If-Match": `"999"`}
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/a?ttl=100", "a longer value", stale), http.StatusPreconditionFailed)
+	missing := map[string]string{"Authorization": "Bearer tenant-token", "If-Match": "*"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/b", "v", missing), http.StatusPreconditionFailed)
+	store.mu.Lock()
+	store.setErr = errors.New("connection refused")
+	store.mu.Unlock()
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/c", "v", tenant), http.StatusInternalServerError)
+
+	if got := usage(); got != want {
+		t.Fatalf("usage after failed writes = %+v, want %+v", got, want)
+	}
+	store.advance(11 * time.Second)
+	if got := usage(); got.Keys != 0 {
+		t.Fatalf("usage after the original TTL passed = %+v, want none", got)
+	}
+}
+
+func TestNamespacesAdminListing(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	tenant := map[string]string{"Authorization": "Bearer tenant-token"}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v"}`, tenant), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=a", "", tenant), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=b", "", tenant), http.StatusNotFound)
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/namespaces", ""), http.StatusUnauthorized)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/namespaces", "", tenant), http.StatusForbidden)
+
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/admin/namespaces", "", admin), http.StatusNotFound)
+
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/namespaces", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+
+	var body struct {
+		Namespaces []namespaceReport `json:"namespaces"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode namespaces: %v", err)
+	}
+	if len(body.Namespaces) != 3 {
+		t.Fatalf("namespaces = %d, want 3", len(body.Namespaces))
+	}
+	if body.Namespaces[0].Name != defaultNamespace || body.Namespaces[0].DefaultTTL != 300 || body.Namespaces[0].Usage != nil {
+		t.Fatalf("default namespace report = %+v", body.Namespaces[0])
+	}
+	tenantReport := body.Namespaces[1]
+	if tenantReport.Name != "tenant" || tenantReport.KeyPrefix != namespaceKeyPrefix+"tenant:" {
+		t.Fatalf("tenant report = %+v", tenantReport)
+	}
+	if tenantReport.Reads != 2 || tenantReport.Hits != 1 || tenantReport.Misses != 1 || tenantReport.Writes != 1 {
+		t.Fatalf("tenant counters = %+v", tenantReport)
+	}
+	if tenantReport.Usage == nil || tenantReport.Usage.Keys != 1 || tenantReport.Usage.Bytes != 2 {
+		t.Fatalf("tenant usage = %+v", tenantReport.Usage)
+	}
+}
+
+func TestConfiguredDefaultNamespace(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: defaultNamespace, MaxTTL: 30}}
+	store := newFakeStore()
+	router := newRouter(newCacheService(config, store))
+
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "ttl must not exceed 30 seconds")
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v","ttl":"30"}`), http.StatusOK)
+	if _, ok := store.items["a"]; !ok {
+		t.Fatal("default namespace key was prefixed")
+	}
+}
+
+func TestNamespaceConfigValidation(t *testing.T) {
+	valid := []NamespaceConfig{{Name: "tenant-1", DefaultTTL: 10, MaxTTL: 20, Tokens: []string{"a"}}, {Name: defaultNamespace}}
+	if err := validateNamespaces(valid); err != nil {
+		t.Fatalf("validateNamespaces() error: %v", err)
+	}
+
+	for name, configs := range map[string][]NamespaceConfig{
+		"bad name":          {{Name: "Tenant"}},
+		"empty name":        {{Name: ""}},
+		"duplicate":         {{Name: "a"}, {Name: "a"}},
+		"negative":          {{Name: "a", MemoryBudget: -1}},
+		"default over max":  {{Name: "a", DefaultTTL: 30, MaxTTL: 20}},
+		"token bound twice": {{Name: "a", Tokens: []string{"t"}}, {Name: "b", Tokens: []string{"t"}}},
+	} {
+		if err := validateNamespaces(configs); err == nil {
+			t.Fatalf("%s: validateNamespaces() succeeded", name)
+		}
+	}
+}
+
+func TestUsageResult(t *testing.T) {
+	usage, err := usageResult([]int64{1, 2, 30})
+	if err != nil || usage != (NamespaceUsage{Keys: 2, Bytes: 30}) {
+		t.Fatalf("usageResult = %+v, %v", usage, err)
+	}
+	if _, err := usageResult([]int64{0, 2, 30}); err != errBudgetExceeded {
+		t.Fatalf("usageResult error = %v, want budget exceeded", err)
+	}
+	if _, err := usageResult([]int64{1}); err == nil {
+		t.Fatal("usageResult accepted a short result")
+	}
+}
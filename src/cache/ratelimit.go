@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	rateLimitKeyPrefix   = internalKeyPrefix + "ratelimit:"
+	rateLimitOpTimeout   = 250 * time.Millisecond
+	rateLimitSweepPeriod = time.Minute
+)
+
+type RateLimitConfig struct {
+	Reads               RateConfig `json:"reads"`
+	Writes              RateConfig `json:"writes"`
+	WriteBytesPerMinute int64      `json:"write_bytes_per_minute"`
+	TrustedProxyHeader  string     `json:"trusted_proxy_header"`
+	Shared              bool       `json:"shared"`
+}
+
+// RateConfig describes a token bucket refilled at Rate tokens per second and
+// holding at most Burst tokens. A zero rate disables the limit.
+type RateConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (rlc *RateLimitConfig) validate() error {
+	for name, rate := range map[string]RateConfig{"reads": rlc.Reads, "writes": rlc.Writes} {
+		if rate.Rate < 0 || rate.Burst < 0 {
+			return fmt.Errorf("rate_limit %s rate and burst must not be negative", name)
+		}
+	}
+	if rlc.WriteBytesPerMinute < 0 {
+		return fmt.Errorf("rate_limit write_bytes_per_minute must not be negative")
+	}
+	return nil
+}
+
+// TokenBucketStore is implemented by stores that can hold token buckets
+// shared between cache instances.
+type TokenBucketStore interface {
+	TakeTokens(ctx context.Context, key string, rate, burst, cost float64) (time.Duration, error)
+}
+
+// limiter takes cost tokens from the bucket named key. It returns zero when
+// the tokens were available and otherwise how long the caller should wait.
+type limiter interface {
+	take(ctx context.Context, key string, cost float64) (time.Duration, error)
+}
+
+func newLimiter(name string, rate, burst float64, shared TokenBucketStore, breaker *breakerStore) limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = math.Max(1, rate)
+	}
+	if shared != nil {
+		return &sharedLimiter{store: shared, breaker: breaker, prefix: rateLimitKeyPrefix + name + ":", rate: rate, burst: burst}
+	}
+	return newLocalLimiter(rate, burst)
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+type localLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLocalLimiter(rate, burst float64) *localLimiter {
+	return &localLimiter{rate: rate, burst: burst, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (ll *localLimiter) take(_ context.Context, key string, cost float64) (time.Duration, error) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	now := ll.now()
+	if now.Sub(ll.lastSweep) > rateLimitSweepPeriod {
+		ll.sweep(now)
+	}
+
+	b, ok := ll.buckets[key]
+	if !ok {
+		b = &bucket{tokens: ll.burst, at: now}
+		ll.buckets[key] = b
+	}
+	b.tokens = math.Min(ll.burst, b.tokens+now.Sub(b.at).Seconds()*ll.rate)
+	b.at = now
+
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return 0, nil
+	}
+	return secondsDuration((cost - b.tokens) / ll.rate), nil
+}
+
+// sweep drops buckets that have refilled completely, since a fresh bucket
+// behaves identically and idle clients should not hold memory forever.
+func (ll *localLimiter) sweep(now time.Time) {
+	for key, b := range ll.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*ll.rate >= ll.burst {
+			delete(ll.buckets, key)
+		}
+	}
+	ll.lastSweep = now
+}
+
+type sharedLimiter struct {
+	store   TokenBucketStore
+	breaker *breakerStore
+	prefix  string
+	rate    float64
+	burst   float64
+}
+
+func (sl *sharedLimiter) take(ctx context.Context, key string, cost float64) (time.Duration, error) {
+	// Like a failed call, an open breaker lets the request through.
+	if !sl.breaker.allow() {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, rateLimitOpTimeout)
+	defer cancel()
+
+	return sl.store.TakeTokens(ctx, sl.prefix+key, sl.rate, sl.burst, cost)
+}
+
+var takeTokensScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'at')
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - at) * rate)
+local wait = 0
+if tokens >= cost then
+  tokens = tokens - cost
+else
+  wait = (cost - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return tostring(wait)
+`)
+
+func (rs *RedisStore) TakeTokens(ctx context.Context, key string, rate, burst, cost float64) (time.Duration, error) {
+	args := []interface{}{
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.FormatFloat(burst, 'f', -1, 64),
+		strconv.FormatFloat(cost, 'f', -1, 64),
+	}
+	raw, err := takeTokensScript.Run(ctx, rs.client, []string{key}, args...).Text()
+	if err != nil {
+		return 0, err
+	}
+	wait, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse rate limit wait: %w", err)
+	}
+	return secondsDuration(wait), nil
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+type rateLimits struct {
+	reads         limiter
+	writes        limiter
+	writeBytes    limiter
+	maxWriteBytes int64
+	proxyHeader   string
+}
+
+func newRateLimits(config RateLimitConfig, store CacheStore, breaker *breakerStore) *rateLimits {
+	var shared TokenBucketStore
+	if config.Shared {
+		if tbs, ok := store.(TokenBucketStore); ok {
+			shared = tbs
+		} else {
+			log.Printf("rate_limit shared mode is not supported by the store, using local limits")
+		}
+	}
+
+	bytesPerMinute := float64(config.WriteBytesPerMinute)
+	return &rateLimits{
+		reads:         newLimiter("reads", config.Reads.Rate, float64(config.Reads.Burst), shared, breaker),
+		writes:        newLimiter("writes", config.Writes.Rate, float64(config.Writes.Burst), shared, breaker),
+		writeBytes:    newLimiter("write_bytes", bytesPerMinute/60, bytesPerMinute, shared, breaker),
+		maxWriteBytes: config.WriteBytesPerMinute,
+		proxyHeader:   config.TrustedProxyHeader,
+	}
+}
+
+func (rl *rateLimits) limitReads(next http.HandlerFunc) http.HandlerFunc {
+	if rl.reads == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rl.check(w, r, rl.reads, 1, "rate_limited", "rate limit exceeded") {
+			next(w, r)
+		}
+	}
+}
+
+func (rl *rateLimits) limitWrites(next http.HandlerFunc) http.HandlerFunc {
+	if rl.writes == nil && rl.writeBytes == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rl.writes != nil && !rl.check(w, r, rl.writes, 1, "rate_limited", "rate limit exceeded") {
+			return
+		}
+		if rl.writeBytes != nil {
+			size, err := requestBodySize(r)
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			// A write larger than the whole quota would never fit, so
+			// retrying it is pointless.
+			if size > rl.maxWriteBytes {
+				countRejection("write_quota_too_large")
+				writeCacheError(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "write quota exceeded", "details": fmt.Sprintf("a single write must not exceed the quota of %d bytes per minute", rl.maxWriteBytes)})
+				return
+			}
+			if size > 0 && !rl.check(w, r, rl.writeBytes, float64(size), "write_quota", "write quota exceeded") {
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// check reports whether the request may proceed and writes a 429 response
+// when it may not. Limiter failures are logged and let the request through
+// so that an unreachable shared store never takes the cache down with it.
+func (rl *rateLimits) check(w http.ResponseWriter, r *http.Request, l limiter, cost float64, reason, message string) bool {
+	wait, err := l.take(r.Context(), rl.clientID(r), cost)
+	if err != nil {
+		log.Printf("rate limit error: %v", err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	countRejection(reason)
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	writeCacheError(w, http.StatusTooManyRequests, map[string]string{"error": message})
+	return false
+}
+
+// clientID identifies the caller by its authenticated credential when there
+// is one, and otherwise by its IP address. The proxy header is only honoured
+// when configured, and its last entry is used because that is the one the
+// trusted proxy appended.
+func (rl *rateLimits) clientID(r *http.Request) string {
+	if p, ok := principalFromContext(r.Context()); ok {
+		return p.kind + ":" + p.name
+	}
+	if rl.proxyHeader != "" {
+		if forwarded := r.Header.Values(rl.proxyHeader); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return "ip:" + ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// requestBodySize returns the size of the request body, buffering it when the
+// client did not send a Content-Length.
+func requestBodySize(r *http.Request) (int64, error) {
+	if r.ContentLength >= 0 {
+		return r.ContentLength, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return 0, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r.ContentLength, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sharedBucketStore struct {
+	*fakeStore
+	keys []string
+	wait time.Duration
+	err  error
+}
+
+func (s *sharedBucketStore) TakeTokens(_ context.Context, key string, _, _, _ float64) (time.Duration, error) {
+	s.keys = append(s.keys, key)
+	return s.wait, s.err
+}
+
+func TestLocalLimiter(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	limiter := newLocalLimiter(2, 2)
+	limiter.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := limiter.take(ctx, "client", 1); wait != 0 {
+			t.Fatalf("take %d wait = %s, want 0", i, wait)
+		}
+	}
+	if wait, _ := limiter.take(ctx, "client", 1); wait != 500*time.Millisecond {
+		t.Fatalf("exhausted wait = %s, want 500ms", wait)
+	}
+	if wait, _ := limiter.take(ctx, "other", 1); wait != 0 {
+		t.Fatalf("other client wait = %s, want 0", wait)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if wait, _ := limiter.take(ctx, "client", 1); wait != 0 {
+		t.Fatalf("refilled wait = %s, want 0", wait)
+	}
+
+	now = now.Add(2 * rateLimitSweepPeriod)
+	limiter.take(ctx, "client", 1)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("buckets after sweep = %d, want 1", len(limiter.buckets))
+	}
+}
+
+func TestReadRateLimit(t *testing.T) {
+	config := testConfig()
+	config.RateLimit.Reads = RateConfig{Rate: 0.5, Burst: 1}
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "value", TTL: time.Minute}
+	router := newRouter(newCacheService(config, store))
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=key", ""), http.StatusOK)
+
+	w := serve(router, http.MethodGet, "/api/cache?key=key", "")
+	requireStatus(t, w, http.StatusTooManyRequests)
+	requireJSONField(t, w, "error", "rate limit exceeded")
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"a","value":"b"}`), http.StatusOK)
+}
+
+func TestWriteRateLimitByToken(t *testing.T) {
+	config := authTestConfig()
+	config.Auth.Tokens = append(config.Auth.Tokens, TokenConfig{Name: "second", Token: "second-token", Scopes: []string{scopeWrite}})
+	config.RateLimit.Writes = RateConfig{Rate: 1, Burst: 1}
+	router := newRouter(newCacheService(config, newFakeStore()))
+	body := `{"key":"a","value":"b"}`
+
+	first := map[string]string{"Authorization": "Bearer writer-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", body, first), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", body, first), http.StatusTooManyRequests)
+
+	second := map[string]string{"Authorization": "Bearer second-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", body, second), http.StatusOK)
+}
+
+func TestWriteByteQuota(t *testing.T) {
+	config := testConfig()
+	config.RateLimit.WriteBytesPerMinute = 100
+	router := newRouter(newCacheService(config, newFakeStore()))
+
+	body := `{"key":"quota","value":"` + strings.Repeat("x", 40) + `"}`
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", body), http.StatusOK)
+
+	w := serve(router, http.MethodPost, "/api/cache", body)
+	requireStatus(t, w, http.StatusTooManyRequests)
+	requireJSONField(t, w, "error", "write quota exceeded")
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("Retry-After header is missing")
+	}
+
+	// A write over the whole quota can never succeed, so it is not told to
+	// retry.
+	before := counterValue(rejectionMetrics, "write_quota_too_large")
+	w = serve(router, http.MethodPost, "/api/cache", `{"key":"quota","value":"`+strings.Repeat("x", 100)+`"}`)
+	requireStatus(t, w, http.StatusRequestEntityTooLarge)
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Fatalf("Retry-After = %q for a write over the quota", got)
+	}
+	requireCounterDelta(t, rejectionMetrics, "write_quota_too_large", before, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cache", strings.NewReader(body))
+	req.ContentLength = -1
+	size, err := requestBodySize(req)
+	if err != nil || size != int64(len(body)) {
+		t.Fatalf("requestBodySize = %d, %v; want %d", size, err, len(body))
+	}
+}
+
+func TestRateLimitClientID(t *testing.T) {
+	limits := newRateLimits(RateLimitConfig{TrustedProxyHeader: "X-Forwarded-For"}, newFakeStore(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/cache", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if got := limits.clientID(req); got != "ip:10.0.0.1" {
+		t.Fatalf("clientID = %q, want ip:10.0.0.1", got)
+	}
+
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.9")
+	if got := limits.clientID(req); got != "ip:203.0.113.9" {
+		t.Fatalf("clientID = %q, want ip:203.0.113.9", got)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), principalKey{}, newPrincipal(credentialToken, "worker", nil)))
+	if got := limits.clientID(req); got != "token:worker" {
+		t.Fatalf("clientID = %q, want token:worker", got)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), principalKey{}, newPrincipal(credentialHMAC, "worker", nil)))
+	if got := limits.clientID(req); got != "hmac:worker" {
+		t.Fatalf("clientID = %q, want hmac:worker", got)
+	}
+
+	untrusted := newRateLimits(RateLimitConfig{}, newFakeStore(), nil)
+	req = httptest.NewRequest(http.MethodGet, "/api/cache", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	if got := untrusted.clientID(req); got != "ip:10.0.0.1" {
+		t.Fatalf("clientID = %q, want ip:10.0.0.1", got)
+	}
+}
+
+func TestSharedRateLimits(t *testing.T) {
+	store := &sharedBucketStore{fakeStore: newFakeStore(), wait: 1500 * time.Millisecond}
+	config := testConfig()
+	config.RateLimit = RateLimitConfig{Reads: RateConfig{Rate: 10, Burst: 10}, Shared: true}
+	store.items["key"] = CacheItem{Value: "value", TTL: time.Minute}
+	router := newRouter(newCacheService(config, store))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/cache?key=key", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	requireStatus(t, w, http.StatusTooManyRequests)
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+	if len(store.keys) != 1 || store.keys[0] != rateLimitKeyPrefix+"reads:ip:10.0.0.1" {
+		t.Fatalf("bucket keys = %v", store.keys)
+	}
+
+	store.err = errors.New("redis down")
+	requireStatus(t, serve(router, http.MethodGet, "/api/cache?key=key", ""), http.StatusOK)
+}
+
+func TestRateLimitConfigValidation(t *testing.T) {
+	valid := RateLimitConfig{Reads: RateConfig{Rate: 10, Burst: 20}, WriteBytesPerMinute: 1 << 20}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("validate() error: %v", err)
+	}
+	for _, invalid := range []RateLimitConfig{
+		{Reads: RateConfig{Rate: -1}},
+		{Writes: RateConfig{Rate: 1, Burst: -1}},
+		{WriteBytesPerMinute: -1},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", invalid)
+		}
+	}
+}
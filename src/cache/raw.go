@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const defaultRawContentType = "application/octet-stream"
+
+// GetRaw serves a value exactly as it was stored, with the Content-Type it
+// was written with, instead of wrapping it in a JSON string.
+func (cs *CacheService) GetRaw(w http.ResponseWriter, r *http.Request) {
+	item, ok := cs.lookup(w, r, r.PathValue("key"))
+	if !ok {
+		return
+	}
+	writeRawItem(w, item)
+}
+
+// writeRawItem writes the stored bytes of item with its content type.
+func writeRawItem(w http.ResponseWriter, item CacheItem) {
+	contentType := item.ContentType
+	if contentType == "" {
+		contentType = defaultRawContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(item.Value)))
+	// Stored bytes are arbitrary, so never let a browser sniff or run them.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, item.Value)
+}
+
+// PutRaw stores the request body as the value for the key in the path. The
+// TTL comes from the optional ttl query parameter, tags from X-Cache-Tags,
+// and If-Match or If-None-Match make the write conditional.
+func (cs *CacheService) PutRaw(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultRawContentType
+	}
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid content type", "details": err.Error()})
+		return
+	}
+
+	cond, err := requestCondition(r, "", "")
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid write condition", "details": err.Error()})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(body) == 0 {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid request body", "details": "value is required"})
+		return
+	}
+
+	tags, err := headerTags(r.Header.Get(tagsHeader))
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid tags", "details": err.Error()})
+		return
+	}
+
+	item := CacheItem{Value: string(body), ContentType: contentType, Tags: tags}
+	if cs.save(w, r, r.PathValue("key"), item, r.URL.Query().Get("ttl"), cond) {
+		writeJSON(w, http.StatusOK, map[string]string{"message": "cached"})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func serveRaw(handler http.Handler, method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+	graphql := []byte(`{"data":{"items":[{"name":"Salewa"}]}}`)
+
+	w := serveRaw(router, http.MethodPut, "/api/cache/items-query?ttl=120", "application/json", graphql)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"message":"cached"}`)
+
+	w = serveRaw(router, http.MethodGet, "/api/cache/items-query", "", nil)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, string(graphql))
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", got)
+	}
+	if got := w.Header().Get("X-CACHE-TTL"); got != "120" {
+		t.Fatalf("X-CACHE-TTL = %q, want 120", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=120" {
+		t.Fatalf("Cache-Control = %q, want public, max-age=120", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+
+	w = serve(router, http.MethodGet, "/api/cache?key=items-query", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `"{\"data\":{\"items\":[{\"name\":\"Salewa\"}]}}"`)
+
+	w = serveRaw(router, http.MethodHead, "/api/cache/items-query", "", nil)
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(graphql)) {
+		t.Fatalf("Content-Length = %q, want %d", got, len(graphql))
+	}
+}
+
+func TestRawBinaryValue(t *testing.T) {
+	router := testRouter(newFakeStore())
+	value := []byte{0x00, 0xff, 0x10, 0x80, 'x'}
+
+	requireStatus(t, serveRaw(router, http.MethodPut, "/api/cache/binary", "image/png", value), http.StatusOK)
+
+	w := serveRaw(router, http.MethodGet, "/api/cache/binary", "", nil)
+	requireStatus(t, w, http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), value) {
+		t.Fatalf("body = %v, want %v", w.Body.Bytes(), value)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Fatalf("Content-Type = %q, want image/png", got)
+	}
+}
+
+func TestRawDefaultsAndKeys(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+
+	requireStatus(t, serveRaw(router, http.MethodPut, "/api/cache/no-type", "", []byte("bytes")), http.StatusOK)
+	if got := store.items["no-type"]; got.ContentType != defaultRawContentType || got.TTL != 300*time.Second {
+		t.Fatalf("stored item = %+v", got)
+	}
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"envelope","value":"text"}`), http.StatusOK)
+	w := serveRaw(router, http.MethodGet, "/api/cache/envelope", "", nil)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "text")
+	if got := w.Header().Get("Content-Type"); got != defaultRawContentType {
+		t.Fatalf("Content-Type = %q, want %s", got, defaultRawContentType)
+	}
+
+	requireStatus(t, serveRaw(router, http.MethodPut, "/api/cache/a/b%20c%3Fd", "text/plain", []byte("nested")), http.StatusOK)
+	if _, ok := store.items["a/b c?d"]; !ok {
+		t.Fatalf("escaped key was not decoded: %v", store.items)
+	}
+}
+
+func TestRawNamespaceRoute(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := newFakeStore()
+	router := newRouter(newCacheService(config, store))
+
+	requireStatus(t, serveRaw(router, http.MethodPut, "/api/ns/tenant/cache/key", "text/plain", []byte("v")), http.StatusOK)
+	if _, ok := store.items[namespaceKeyPrefix+"tenant:key"]; !ok {
+		t.Fatalf("raw value was not namespaced: %v", store.items)
+	}
+	requireBody(t, serveRaw(router, http.MethodGet, "/api/ns/tenant/cache/key", "", nil), "v")
+}
+
+func TestRawErrors(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        []byte
+		status      int
+		errMsg      string
+	}{
+		{name: "missing key", method: http.MethodGet, path: "/api/cache/missing", status: http.StatusNotFound, errMsg: "key not found"},
+		{name: "empty body", method: http.MethodPut, path: "/api/cache/empty", contentType: "text/plain", status: http.StatusBadRequest, errMsg: "invalid request body"},
+		{name: "invalid content type", method: http.MethodPut, path: "/api/cache/bad", contentType: "text/", body: []byte("v"), status: http.StatusBadRequest, errMsg: "invalid content type"},
+		{name: "invalid ttl", method: http.MethodPut, path: "/api/cache/bad?ttl=soon", contentType: "text/plain", body: []byte("v"), status: http.StatusBadRequest, errMsg: "ttl must be a string representation of an integer"},
+		{name: "zero ttl", method: http.MethodPut, path: "/api/cache/bad?ttl=0", contentType: "text/plain", body: []byte("v"), status: http.StatusBadRequest, errMsg: "ttl must be greater than zero"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveRaw(router, tt.method, tt.path, tt.contentType, tt.body)
+			requireStatus(t, w, tt.status)
+			requireJSONField(t, w, "error", tt.errMsg)
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Fatalf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		w := serveRaw(router, method, "/api/cache/key", "", nil)
+		requireStatus(t, w, http.StatusNotFound)
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Fatalf("%s Cache-Control = %q, want no-store", method, got)
+		}
+	}
+
+	store.setErr = errors.New("redis failed")
+	w := serveRaw(router, http.MethodPut, "/api/cache/key", "text/plain", []byte("v"))
+	requireStatus(t, w, http.StatusInternalServerError)
+}
+
+func TestIsWrongType(t *testing.T) {
+	if !isWrongType(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")) {
+		t.Fatal("WRONGTYPE error not detected")
+	}
+	if isWrongType(errors.New("ERR something else")) || isWrongType(nil) {
+		t.Fatal("unrelated error detected as WRONGTYPE")
+	}
+}
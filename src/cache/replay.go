@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplayConcurrency = 64
+	maxCaptureLine           = 1 << 20
+)
+
+// replayReport compares what the capture saw with what the replay saw.
+type replayReport struct {
+	Records  int         `json:"records"`
+	Speed    float64     `json:"speed"`
+	Original benchReport `json:"original"`
+	Replay   benchReport `json:"replay"`
+}
+
+// replay sends the requests in one or more capture files to a running
+// cache, keeping their original spacing divided by speed, and compares the
+// hit ratio and latency of the capture with those of the replay. Speed 0
+// sends requests as fast as concurrency allows.
+func (c *cacheClient) replay(flags *flag.FlagSet, args []string) int {
+	speed := flags.Float64("speed", 1, "replay speed relative to the capture, or 0 for as fast as possible")
+	concurrency := flags.Int("concurrency", defaultReplayConcurrency, "maximum requests in flight")
+	if !c.parse(flags, args, "FILE...", 1, math.MaxInt) {
+		return 2
+	}
+	if *speed < 0 || *concurrency <= 0 {
+		log.Print("speed must not be negative and concurrency must be positive")
+		return 2
+	}
+	if c.http.Transport == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = *concurrency
+		c.http.Transport = transport
+	}
+
+	records, err := loadCapture(flags.Args())
+	if err != nil {
+		return c.fail(err)
+	}
+	if len(records) == 0 {
+		return c.fail(fmt.Errorf("no records to replay"))
+	}
+	report := replayReport{
+		Records:  len(records),
+		Speed:    *speed,
+		Original: captureReport(records),
+		Replay:   c.runReplay(context.Background(), records, *speed, *concurrency),
+	}
+	if c.json {
+		return c.writeJSON(report)
+	}
+	writeReplayReport(c.stdout, report)
+	return 0
+}
+
+// loadCapture reads capture files, such as a file and its rotated
+// predecessors, and orders their records by start time.
+func loadCapture(paths []string) ([]captureRecord, error) {
+	var records []captureRecord
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64<<10), maxCaptureLine)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var record captureRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			records = append(records, record)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	slices.SortStableFunc(records, func(a, b captureRecord) int {
+		return cmp.Compare(a.Time, b.Time)
+	})
+	return records, nil
+}
+
+// captureReport summarizes the requests as the capturing server saw them.
+func captureReport(records []captureRecord) benchReport {
+	worker := &benchWorker{errors: make(map[string]int)}
+	for _, record := range records {
+		worker.record(record.Op, record.Status, nil, time.Duration(record.Duration)*time.Microsecond)
+	}
+	first, last := records[0], records[len(records)-1]
+	span := time.Duration(last.Time-first.Time+last.Duration) * time.Microsecond
+	return mergeBenchWorkers(span, 0, []*benchWorker{worker})
+}
+
+// runReplay dispatches records on their original schedule, scaled by
+// speed. When every worker is busy the schedule slips rather than exceeding
+// concurrency.
+func (c *cacheClient) runReplay(ctx context.Context, records []captureRecord, speed float64, concurrency int) benchReport {
+	var maxSize int64 = 1
+	for _, record := range records {
+		maxSize = max(maxSize, record.Size)
+	}
+	filler := bytes.Repeat([]byte{'x'}, int(maxSize))
+
+	jobs := make(chan captureRecord)
+	workers := make([]*benchWorker, concurrency)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = &benchWorker{errors: make(map[string]int)}
+		wg.Add(1)
+		go func(worker *benchWorker) {
+			defer wg.Done()
+			for record := range jobs {
+				began := time.Now()
+				status, err := c.replayRequest(ctx, record, filler)
+				worker.record(record.Op, status, err, time.Since(began))
+			}
+		}(workers[i])
+	}
+
+	start := time.Now()
+	first := records[0].Time
+	for _, record := range records {
+		if speed > 0 {
+			offset := time.Duration(float64(record.Time-first)/speed) * time.Microsecond
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		jobs <- record
+	}
+	close(jobs)
+	wg.Wait()
+	return mergeBenchWorkers(time.Since(start), concurrency, workers)
+}
+
+// replayRequest sends one captured request. Hashed keys are replayed as the
+// hash, and writes send filler of the captured size.
+func (c *cacheClient) replayRequest(ctx context.Context, record captureRecord, filler []byte) (int, error) {
+	key := record.Key
+	if key == "" {
+		key = record.KeyHash
+	}
+	namespace := record.Namespace
+	if c.namespace != "" {
+		namespace = c.namespace
+	}
+	path := keyPathIn(namespace, key)
+
+	var req *http.Request
+	var err error
+	switch record.Op {
+	case captureGet:
+		method := http.MethodGet
+		if record.Method == http.MethodHead {
+			method = http.MethodHead
+		}
+		req, err = c.newRequest(ctx, method, path, nil, nil)
+	case captureSet:
+		query := url.Values{}
+		if record.TTL > 0 {
+			query.Set("ttl", strconv.FormatInt(record.TTL, 10))
+		}
+		req, err = c.newRequest(ctx, http.MethodPut, path, query, bytes.NewReader(filler[:max(record.Size, 1)]))
+	case captureDelete:
+		req, err = c.newRequest(ctx, http.MethodDelete, path, nil, nil)
+	case captureTTL:
+		body, _ := json.Marshal(ttlPatchBody{TTL: strconv.FormatInt(record.TTL, 10), Mode: ttlModeSet})
+		req, err = c.newRequest(ctx, http.MethodPatch, path, nil, bytes.NewReader(body))
+	default:
+		return 0, fmt.Errorf("unknown operation %q", record.Op)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return c.benchDo(req)
+}
+
+func writeReplayReport(w io.Writer, report replayReport) {
+	speed := "as fast as possible"
+	if report.Speed > 0 {
+		speed = fmt.Sprintf("at %gx speed", report.Speed)
+	}
+	fmt.Fprintf(w, "replayed %d records %s\n\noriginal\n", report.Records, speed)
+	writeBenchReport(w, report.Original)
+	fmt.Fprintln(w, "\nreplay")
+	writeBenchReport(w, report.Replay)
+	fmt.Fprintf(w, "\nhit ratio    %.1f%% -> %.1f%% (%+.1f points)\n",
+		report.Original.HitRatio*100, report.Replay.HitRatio*100, (report.Replay.HitRatio-report.Original.HitRatio)*100)
+	fmt.Fprintf(w, "p50 latency  %.2fms -> %.2fms\n", report.Original.Latency.P50, report.Replay.Latency.P50)
+	fmt.Fprintf(w, "p99 latency  %.2fms -> %.2fms\n", report.Original.Latency.P99, report.Replay.Latency.P99)
+}
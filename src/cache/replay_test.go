@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCapture(t *testing.T, name string, records ...captureRecord) string {
+	t.Helper()
+	var b strings.Builder
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatalf("write capture: %v", err)
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	run, store := clientTestServer(t)
+	const ms = int64(time.Millisecond / time.Microsecond)
+	start := time.Now().UnixMicro()
+	older := writeCapture(t, "capture.jsonl.1",
+		captureRecord{Time: start, Op: captureSet, Method: "PUT", Namespace: "tenant", Key: "a", Size: 32, TTL: 60, Status: 200, Duration: 2 * ms},
+		captureRecord{Time: start + 10*ms, Op: captureGet, Method: "GET", Namespace: "tenant", Key: "a", Status: 200, Duration: 1 * ms},
+	)
+	newer := writeCapture(t, "capture.jsonl",
+		captureRecord{Time: start + 20*ms, Op: captureGet, Method: "GET", Namespace: defaultNamespace, KeyHash: "0123abcd", Status: 200, Duration: 1 * ms},
+		captureRecord{Time: start + 30*ms, Op: captureTTL, Method: "PATCH", Namespace: "tenant", Key: "a", TTL: 30, Status: 200, Duration: 1 * ms},
+		captureRecord{Time: start + 40*ms, Op: captureDelete, Method: "DELETE", Namespace: "tenant", Key: "a", Status: 204, Duration: 1 * ms},
+		captureRecord{Time: start + 50*ms, Op: captureDelete, Method: "DELETE", Namespace: "tenant", Key: "a", Status: 404, Duration: 1 * ms},
+	)
+
+	began := time.Now()
+	code, out := run("", "replay", "-json", "-speed", "2", "-concurrency", "1", newer, older)
+	var report replayReport
+	if err := json.Unmarshal([]byte(out), &report); code != 0 || err != nil {
+		t.Fatalf("replay = %d, %q, %v", code, out, err)
+	}
+	if elapsed := time.Since(began); elapsed < 25*time.Millisecond {
+		t.Fatalf("replay at 2x took %v, want at least 25ms", elapsed)
+	}
+
+	if report.Records != 6 || report.Original.Hits != 2 || report.Original.HitRatio != 1 || report.Original.Duration != 0.051 {
+		t.Fatalf("original = %+v", report.Original)
+	}
+	// The hashed key was never written, so the replay misses it.
+	if report.Replay.Requests != 6 || report.Replay.Hits != 1 || report.Replay.Misses != 1 || len(report.Replay.Errors) != 0 {
+		t.Fatalf("replay = %+v", report.Replay)
+	}
+	if len(store.sets) != 1 || store.sets[0].key != namespaceKeyPrefix+"tenant:a" || len(store.sets[0].value) != 32 || store.sets[0].ttl != time.Minute {
+		t.Fatalf("replayed writes = %+v", store.sets)
+	}
+
+	code, out = run("", "replay", "-speed", "0", newer)
+	if code != 0 || !strings.Contains(out, "as fast as possible") || !strings.Contains(out, "hit ratio    100.0% -> 0.0% (-100.0 points)") {
+		t.Fatalf("text replay = %d, %q", code, out)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	run, _ := clientTestServer(t)
+	bad := filepath.Join(t.TempDir(), "bad.jsonl")
+	if err := os.WriteFile(bad, []byte("{\"op\":\"get\"}\nnot json\n"), 0o600); err != nil {
+		t.Fatalf("write capture: %v", err)
+	}
+	if _, err := loadCapture([]string{bad}); err == nil || !strings.Contains(err.Error(), "bad.jsonl:2") {
+		t.Fatalf("loadCapture() error = %v, want the bad line", err)
+	}
+
+	empty := writeCapture(t, "empty.jsonl")
+	for _, args := range [][]string{{"replay"}, {"replay", "-speed", "-1", empty}} {
+		if code, _ := run("", args...); code != 2 {
+			t.Fatalf("%v = %d, want 2", args, code)
+		}
+	}
+	if code, _ := run("", "replay", empty); code != 1 {
+		t.Fatalf("replay of empty capture = %d, want 1", code)
+	}
+}
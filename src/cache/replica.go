@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultReplicaHealthInterval   = time.Second
+	defaultReplicaFailureThreshold = 3
+
+	// minWriterSweep is the number of tracked clients below which recent
+	// writers are not swept for expired entries.
+	minWriterSweep = 1024
+)
+
+// ReplicaHostConfig is the address of one read replica.
+type ReplicaHostConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// ReplicasConfig lists the Redis replicas that serve GET traffic. Each
+// replica is checked every HealthInterval milliseconds and taken out of
+// rotation after FailureThreshold consecutive failed checks or reads, until a
+// check passes again. ReadYourWrites, when positive, sends a client's reads to
+// the primary for that many milliseconds after it writes, so that it does not
+// miss its own write on a lagging replica. Zero values fall back to the
+// defaults above; a zero ReadYourWrites turns it off.
+type ReplicasConfig struct {
+	Hosts            []ReplicaHostConfig `json:"hosts"`
+	HealthInterval   int                 `json:"health_interval_ms"`
+	FailureThreshold int                 `json:"failure_threshold"`
+	ReadYourWrites   int                 `json:"read_your_writes_ms"`
+}
+
+func (rc *ReplicasConfig) validate() error {
+	for _, host := range rc.Hosts {
+		if host.Host == "" {
+			return fmt.Errorf("replica host is required")
+		}
+		if host.Port <= 0 || host.Port > 65535 {
+			return fmt.Errorf("replica %s port must be between 1 and 65535", host.Host)
+		}
+	}
+	if rc.HealthInterval < 0 || rc.FailureThreshold < 0 || rc.ReadYourWrites < 0 {
+		return fmt.Errorf("replica settings must not be negative")
+	}
+	return nil
+}
+
+// ReplicaReporter is implemented by stores that read from replicas.
+type ReplicaReporter interface {
+	ReplicaHealth() (healthy, total int)
+}
+
+// replica is one read replica and its health.
+type replica struct {
+	addr     string
+	client   *redis.Client
+	healthy  atomic.Bool
+	mu       sync.Mutex
+	failures int
+}
+
+// replicaSet balances reads over the healthy replicas and checks their
+// health in the background.
+type replicaSet struct {
+	replicas  []*replica
+	threshold int
+	interval  time.Duration
+	check     func(context.Context, *replica) error
+	next      atomic.Uint64
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newReplicaSet(config ReplicasConfig, replicas []*replica) *replicaSet {
+	set := &replicaSet{
+		replicas:  replicas,
+		threshold: defaultReplicaFailureThreshold,
+		interval:  defaultReplicaHealthInterval,
+		check:     checkReplica,
+		stop:      make(chan struct{}),
+	}
+	if config.FailureThreshold > 0 {
+		set.threshold = config.FailureThreshold
+	}
+	if config.HealthInterval > 0 {
+		set.interval = time.Duration(config.HealthInterval) * time.Millisecond
+	}
+	for _, r := range replicas {
+		r.healthy.Store(true)
+	}
+	return set
+}
+
+// pick returns the next healthy replica in turn, or nil if there is none.
+func (set *replicaSet) pick() *replica {
+	if set == nil {
+		return nil
+	}
+	n := uint64(len(set.replicas))
+	start := set.next.Add(1)
+	for i := range n {
+		if r := set.replicas[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// observe records the outcome of a check or read of r. A replica leaves
+// rotation after threshold consecutive failures and returns on the next
+// success.
+func (set *replicaSet) observe(r *replica, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+		if !r.healthy.Swap(true) {
+			replicaMetrics.Add("restored", 1)
+			log.Printf("Replica %s restored", r.addr)
+		}
+		return
+	}
+	r.failures++
+	if r.failures >= set.threshold && r.healthy.Swap(false) {
+		replicaMetrics.Add("removed", 1)
+		log.Printf("Replica %s removed after %d failures: %v", r.addr, r.failures, err)
+	}
+}
+
+func (set *replicaSet) start() {
+	set.wg.Add(1)
+	go func() {
+		defer set.wg.Done()
+		ticker := time.NewTicker(set.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-set.stop:
+				return
+			case <-ticker.C:
+				set.checkAll()
+			}
+		}
+	}()
+}
+
+func (set *replicaSet) checkAll() {
+	for _, r := range set.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		set.observe(r, set.check(ctx, r))
+		cancel()
+	}
+}
+
+// healthy counts the replicas in rotation.
+func (set *replicaSet) healthy() int {
+	n := 0
+	for _, r := range set.replicas {
+		if r.healthy.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+func (set *replicaSet) Close() error {
+	var firstErr error
+	set.closeOnce.Do(func() {
+		close(set.stop)
+		set.wg.Wait()
+		for _, r := range set.replicas {
+			if err := r.client.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+// checkReplica passes when r answers as a replica whose link to the primary
+// is up. A replica that lost its primary serves ever older data.
+func checkReplica(ctx context.Context, r *replica) error {
+	info, err := r.client.Info(ctx, "replication").Result()
+	if err != nil {
+		return err
+	}
+	return replicationStatus(info)
+}
+
+// replicationStatus checks the replication section of INFO.
+func replicationStatus(info string) error {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		if name, value, ok := strings.Cut(strings.TrimSpace(line), ":"); ok {
+			fields[name] = value
+		}
+	}
+	if fields["role"] != "slave" {
+		return fmt.Errorf("role is %q, not a replica", fields["role"])
+	}
+	if status := fields["master_link_status"]; status != "up" {
+		return fmt.Errorf("master link is %q", status)
+	}
+	return nil
+}
+
+// readReplica reads key from the next healthy replica. Reads fall back to
+// the primary when no replica is healthy, or when the replica fails.
+func (rs *RedisStore) readReplica(ctx context.Context, key string) (CacheItem, error) {
+	r := rs.replicas.pick()
+	if r == nil {
+		replicaMetrics.Add("primary_reads", 1)
+		return rs.get(ctx, rs.client, key, 0)
+	}
+	item, err := rs.get(ctx, r.client, key, 0)
+	if isStoreFailure(err) && ctx.Err() == nil {
+		rs.replicas.observe(r, err)
+		replicaMetrics.Add("fallbacks", 1)
+		return rs.get(ctx, rs.client, key, 0)
+	}
+	rs.replicas.observe(r, nil)
+	replicaMetrics.Add("reads", 1)
+	return item, err
+}
+
+// GetReplica reads from a replica for hedged reads. Without a healthy
+// replica, or when ctx asks for the primary, the hedge goes to the primary
+// over another pooled connection.
+func (rs *RedisStore) GetReplica(ctx context.Context, key string) (CacheItem, error) {
+	if !primaryReads(ctx) {
+		if r := rs.replicas.pick(); r != nil {
+			return rs.get(ctx, r.client, key, 0)
+		}
+	}
+	return rs.get(ctx, rs.client, key, 0)
+}
+
+func (rs *RedisStore) ReplicaHealth() (healthy, total int) {
+	if rs.replicas == nil {
+		return 0, 0
+	}
+	return rs.replicas.healthy(), len(rs.replicas.replicas)
+}
+
+type primaryReadKey struct{}
+
+// withPrimaryReads marks ctx so that reads made with it go to the primary.
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadKey{}).(bool)
+	return primary
+}
+
+// recentWriters remembers when each client last wrote, for read-your-writes.
+type recentWriters struct {
+	window  time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	last    map[string]time.Time
+	sweepAt int
+}
+
+// newRecentWriters returns nil unless replicas and read-your-writes are
+// configured.
+func newRecentWriters(config ReplicasConfig) *recentWriters {
+	if len(config.Hosts) == 0 || config.ReadYourWrites <= 0 {
+		return nil
+	}
+	return &recentWriters{
+		window:  time.Duration(config.ReadYourWrites) * time.Millisecond,
+		now:     time.Now,
+		last:    make(map[string]time.Time),
+		sweepAt: minWriterSweep,
+	}
+}
+
+// wrote records a write by client. Clients whose window has passed are
+// swept out whenever the map has doubled since the last sweep.
+func (rw *recentWriters) wrote(client string) {
+	now := rw.now()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.last[client] = now
+	if len(rw.last) < rw.sweepAt {
+		return
+	}
+	for id, at := range rw.last {
+		if now.Sub(at) >= rw.window {
+			delete(rw.last, id)
+		}
+	}
+	rw.sweepAt = max(2*len(rw.last), minWriterSweep)
+}
+
+// recent reports whether client wrote within the window.
+func (rw *recentWriters) recent(client string) bool {
+	rw.mu.Lock()
+	at, ok := rw.last[client]
+	rw.mu.Unlock()
+	return ok && rw.now().Sub(at) < rw.window
+}
+
+// readContext returns the context for reads made on behalf of r. It sends
+// them to the primary while a write of the same client may not have reached
+// the replicas yet.
+func (cs *CacheService) readContext(r *http.Request) context.Context {
+	if cs.writers != nil && cs.writers.recent(cs.limits.clientID(r)) {
+		return withPrimaryReads(r.Context())
+	}
+	return r.Context()
+}
+
+// noteWrite starts the read-your-writes window of the client behind r.
+func (cs *CacheService) noteWrite(r *http.Request) {
+	if cs.writers != nil {
+		cs.writers.wrote(cs.limits.clientID(r))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// primaryFakeStore records whether each read asked for the primary.
+type primaryFakeStore struct {
+	*fakeStore
+	healthy, total int
+	primary        []bool
+}
+
+func (s *primaryFakeStore) Get(ctx context.Context, key string) (CacheItem, error) {
+	s.mu.Lock()
+	s.primary = append(s.primary, primaryReads(ctx))
+	s.mu.Unlock()
+	return s.fakeStore.Get(ctx, key)
+}
+
+func (s *primaryFakeStore) ReplicaHealth() (int, int) {
+	return s.healthy, s.total
+}
+
+func (s *primaryFakeStore) lastRead(t *testing.T) bool {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.primary) == 0 {
+		t.Fatal("no read reached the store")
+	}
+	return s.primary[len(s.primary)-1]
+}
+
+func testReplicaSet(n int) *replicaSet {
+	replicas := make([]*replica, n)
+	for i := range replicas {
+		replicas[i] = &replica{addr: fmt.Sprintf("replica-%d:6379", i)}
+	}
+	return newReplicaSet(ReplicasConfig{FailureThreshold: 2}, replicas)
+}
+
+func TestReplicaRotation(t *testing.T) {
+	set := testReplicaSet(3)
+	seen := make(map[string]int)
+	for range 6 {
+		seen[set.pick().addr]++
+	}
+	if len(seen) != 3 {
+		t.Fatalf("reads went to %v, want all three replicas", seen)
+	}
+
+	// A replica leaves rotation after the threshold of consecutive failures.
+	down := set.replicas[1]
+	removed := counterValue(replicaMetrics, "removed")
+	set.observe(down, errConnReset)
+	set.observe(down, nil)
+	set.observe(down, errConnReset)
+	if !down.healthy.Load() {
+		t.Fatal("replica removed before consecutive failures reached the threshold")
+	}
+	set.observe(down, errConnReset)
+	if down.healthy.Load() {
+		t.Fatal("replica still in rotation after reaching the threshold")
+	}
+	requireCounterDelta(t, replicaMetrics, "removed", removed, 1)
+	for range 6 {
+		if r := set.pick(); r == down {
+			t.Fatal("picked a removed replica")
+		}
+	}
+	if healthy := set.healthy(); healthy != 2 {
+		t.Fatalf("healthy = %d, want 2", healthy)
+	}
+
+	// A passing health check brings it back.
+	restored := counterValue(replicaMetrics, "restored")
+	set.check = func(context.Context, *replica) error { return nil }
+	set.checkAll()
+	if !down.healthy.Load() {
+		t.Fatal("replica not restored by a passing check")
+	}
+	requireCounterDelta(t, replicaMetrics, "restored", restored, 1)
+
+	set.check = func(context.Context, *replica) error { return errors.New("master link is \"down\"") }
+	set.checkAll()
+	set.checkAll()
+	if r := set.pick(); r != nil {
+		t.Fatalf("picked %s with every replica down", r.addr)
+	}
+	var none *replicaSet
+	if r := none.pick(); r != nil {
+		t.Fatal("picked a replica without replicas")
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	up := "# Replication\r\nrole:slave\r\nmaster_host:redis\r\nmaster_link_status:up\r\n"
+	if err := replicationStatus(up); err != nil {
+		t.Fatalf("replicationStatus(up) error: %v", err)
+	}
+	for _, info := range []string{
+		"# Replication\r\nrole:slave\r\nmaster_link_status:down\r\n",
+		"# Replication\r\nrole:master\r\nconnected_slaves:1\r\n",
+		"",
+	} {
+		if err := replicationStatus(info); err == nil {
+			t.Fatalf("replicationStatus(%q) succeeded", info)
+		}
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	config := testConfig()
+	config.RateLimit.TrustedProxyHeader = "X-Forwarded-For"
+	config.Replicas = ReplicasConfig{Hosts: []ReplicaHostConfig{{Host: "replica", Port: 6379}}, ReadYourWrites: 1000}
+	store := &primaryFakeStore{fakeStore: newFakeStore()}
+	service := newCacheService(config, store)
+	now := time.Now()
+	service.writers.now = func() time.Time { return now }
+	router := newRouter(service)
+	writer := map[string]string{"X-Forwarded-For": "198.51.100.1"}
+	reader := map[string]string{"X-Forwarded-For": "198.51.100.2"}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/cache/a", "", writer), http.StatusNotFound)
+	if store.lastRead(t) {
+		t.Fatal("read before any write went to the primary")
+	}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPut, "/v2/cache/a?ttl=60", "v", writer), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/cache/a", "", writer), http.StatusOK)
+	if !store.lastRead(t) {
+		t.Fatal("read after the client's own write did not go to the primary")
+	}
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/cache/a", "", reader), http.StatusOK)
+	if store.lastRead(t) {
+		t.Fatal("another client's read went to the primary")
+	}
+
+	now = now.Add(time.Second)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/cache/a", "", writer), http.StatusOK)
+	if store.lastRead(t) {
+		t.Fatal("read after the window went to the primary")
+	}
+
+	// Deletes open the window too.
+	requireStatus(t, serveWithHeaders(router, http.MethodDelete, "/v2/cache/a", "", writer), http.StatusNoContent)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/v2/cache/a", "", writer), http.StatusNotFound)
+	if !store.lastRead(t) {
+		t.Fatal("read after the client's own delete did not go to the primary")
+	}
+}
+
+func TestRecentWritersSweep(t *testing.T) {
+	rw := newRecentWriters(ReplicasConfig{Hosts: []ReplicaHostConfig{{Host: "replica", Port: 6379}}, ReadYourWrites: 100})
+	now := time.Now()
+	rw.now = func() time.Time { return now }
+	for i := range minWriterSweep - 1 {
+		rw.wrote(fmt.Sprintf("ip:%d", i))
+	}
+	now = now.Add(time.Second)
+	rw.wrote("token:reader")
+	if len(rw.last) != 1 || !rw.recent("token:reader") || rw.recent("ip:0") {
+		t.Fatalf("tracked %d writers after the sweep, want 1", len(rw.last))
+	}
+
+	if newRecentWriters(ReplicasConfig{ReadYourWrites: 100}) != nil {
+		t.Fatal("read-your-writes tracked without replicas")
+	}
+}
+
+func TestReplicaHealthReport(t *testing.T) {
+	store := &primaryFakeStore{fakeStore: newFakeStore(), healthy: 1, total: 2}
+	router := newRouter(newCacheService(testConfig(), store))
+
+	w := serve(router, http.MethodGet, "/health?verbose=1", "")
+	requireStatus(t, w, http.StatusOK)
+	var report healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("verbose health is not JSON: %v", err)
+	}
+	check := report.Checks["replicas"]
+	if report.Status != healthDegraded || !report.Ready || check.Status != healthDegraded || check.State != "1/2 healthy" {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestReplicasConfigValidation(t *testing.T) {
+	for _, config := range []ReplicasConfig{
+		{Hosts: []ReplicaHostConfig{{Port: 6379}}},
+		{Hosts: []ReplicaHostConfig{{Host: "replica"}}},
+		{Hosts: []ReplicaHostConfig{{Host: "replica", Port: 70000}}},
+		{ReadYourWrites: -1},
+		{FailureThreshold: -1},
+	} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 10 * time.Millisecond
+	defaultRetryMaxBackoff     = 200 * time.Millisecond
+	defaultRetryLatencyBudget  = 250 * time.Millisecond
+	defaultRetryRatio          = 0.1
+	defaultRetryBurst          = 10
+)
+
+// RetryConfig controls retries of idempotent store calls. Backoffs and the
+// latency budget are in milliseconds. No retry starts once an operation has
+// used up its latency budget, so that retries do not pile onto an overloaded
+// Redis, nor once the backoff would run past the operation's deadline.
+// HedgeAfter, when positive, sends a second read if the first has not
+// answered by then. Retries and hedges across all calls are held to
+// RetryRatio of the calls made, with up to RetryBurst saved up. Zero values
+// fall back to the defaults above.
+type RetryConfig struct {
+	Enabled        bool    `json:"enabled"`
+	MaxAttempts    int     `json:"max_attempts"`
+	InitialBackoff int     `json:"initial_backoff_ms"`
+	MaxBackoff     int     `json:"max_backoff_ms"`
+	LatencyBudget  int     `json:"latency_budget_ms"`
+	HedgeAfter     int     `json:"hedge_after_ms"`
+	RetryRatio     float64 `json:"retry_ratio"`
+	RetryBurst     int     `json:"retry_burst"`
+}
+
+func (rc *RetryConfig) validate() error {
+	if rc.MaxAttempts < 0 || rc.InitialBackoff < 0 || rc.MaxBackoff < 0 || rc.LatencyBudget < 0 || rc.HedgeAfter < 0 || rc.RetryBurst < 0 {
+		return fmt.Errorf("retry limits must not be negative")
+	}
+	if rc.RetryRatio < 0 || rc.RetryRatio > 1 {
+		return fmt.Errorf("retry retry_ratio must be between 0 and 1")
+	}
+	if rc.InitialBackoff > 0 && rc.MaxBackoff > 0 && rc.InitialBackoff > rc.MaxBackoff {
+		return fmt.Errorf("retry initial_backoff_ms must not exceed max_backoff_ms")
+	}
+	return nil
+}
+
+// ReplicaReader is implemented by stores that can serve a read from a
+// replica, for hedged reads.
+type ReplicaReader interface {
+	GetReplica(ctx context.Context, key string) (CacheItem, error)
+}
+
+// retryBudget is a token bucket shared by all calls. Every call adds ratio
+// tokens, up to burst, and every retry or hedge takes a whole one, so extra
+// attempts stay a fixed share of recent traffic however many calls fail.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64, burst int) *retryBudget {
+	return &retryBudget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, b.burst)
+	b.mu.Unlock()
+}
+
+// withdraw takes a token for one extra attempt, counting a refusal.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		retryMetrics.Add("budget_exhausted", 1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// retryStore retries idempotent calls on transient errors with jittered
+// exponential backoff. Conditional writes, deletes and TTL extensions are
+// not idempotent and are never retried.
+type retryStore struct {
+	CacheStore
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	budget         time.Duration
+	hedgeAfter     time.Duration
+	replica        ReplicaReader
+	retries        *retryBudget
+}
+
+func newRetryStore(config RetryConfig, store CacheStore) *retryStore {
+	rs := &retryStore{
+		CacheStore:     store,
+		maxAttempts:    defaultRetryMaxAttempts,
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+		budget:         defaultRetryLatencyBudget,
+		hedgeAfter:     time.Duration(config.HedgeAfter) * time.Millisecond,
+	}
+	if config.MaxAttempts > 0 {
+		rs.maxAttempts = config.MaxAttempts
+	}
+	if config.InitialBackoff > 0 {
+		rs.initialBackoff = time.Duration(config.InitialBackoff) * time.Millisecond
+	}
+	if config.MaxBackoff > 0 {
+		rs.maxBackoff = time.Duration(config.MaxBackoff) * time.Millisecond
+	}
+	if config.LatencyBudget > 0 {
+		rs.budget = time.Duration(config.LatencyBudget) * time.Millisecond
+	}
+	if replica, ok := store.(ReplicaReader); ok {
+		rs.replica = replica
+	}
+	ratio, burst := defaultRetryRatio, defaultRetryBurst
+	if config.RetryRatio > 0 {
+		ratio = config.RetryRatio
+	}
+	if config.RetryBurst > 0 {
+		burst = config.RetryBurst
+	}
+	rs.retries = newRetryBudget(ratio, burst)
+	return rs
+}
+
+// isTransient reports whether err may go away if the call is repeated.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		msg := redisErr.Error()
+		for _, prefix := range []string{"LOADING ", "BUSY ", "TRYAGAIN ", "MASTERDOWN "} {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff is the delay before retry number attempt: half of an
+// exponentially growing step, plus a random share of the other half so that
+// clients that failed together do not retry together.
+func (rs *retryStore) backoff(attempt int) time.Duration {
+	step := rs.maxBackoff
+	if shift := attempt - 1; shift < 32 {
+		step = min(rs.initialBackoff<<shift, rs.maxBackoff)
+	}
+	half := step / 2
+	return half + rand.N(step-half+1)
+}
+
+// do runs call until it succeeds, fails for good or runs out of attempts,
+// budget or time.
+func (rs *retryStore) do(ctx context.Context, call func(context.Context) error) error {
+	start := time.Now()
+	rs.retries.deposit()
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil {
+			if attempt > 1 {
+				retryMetrics.Add("recovered", 1)
+			}
+			return nil
+		}
+		if !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= rs.maxAttempts {
+			retryMetrics.Add("exhausted", 1)
+			return err
+		}
+		wait := rs.backoff(attempt)
+		deadline, hasDeadline := ctx.Deadline()
+		if time.Since(start)+wait > rs.budget || (hasDeadline && time.Until(deadline) < wait) {
+			retryMetrics.Add("over_budget", 1)
+			return err
+		}
+		if !rs.retries.withdraw() {
+			return err
+		}
+		retryMetrics.Add("retries", 1)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (rs *retryStore) Get(ctx context.Context, key string) (CacheItem, error) {
+	var item CacheItem
+	err := rs.do(ctx, func(ctx context.Context) error {
+		var err error
+		item, err = rs.hedgedGet(ctx, key)
+		return err
+	})
+	return item, err
+}
+
+// hedgedGet reads key and, if the read is still outstanding after
+// hedgeAfter, reads it again through GetReplica. The first answer wins;
+// an error only counts once both reads have failed.
+func (rs *retryStore) hedgedGet(ctx context.Context, key string) (CacheItem, error) {
+	if rs.hedgeAfter <= 0 || rs.replica == nil {
+		return rs.CacheStore.Get(ctx, key)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		item  CacheItem
+		err   error
+		hedge bool
+	}
+	results := make(chan result, 2)
+	go func() {
+		item, err := rs.CacheStore.Get(ctx, key)
+		results <- result{item, err, false}
+	}()
+	timer := time.NewTimer(rs.hedgeAfter)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.item, r.err
+	case <-timer.C:
+	}
+	if !rs.retries.withdraw() {
+		r := <-results
+		return r.item, r.err
+	}
+
+	retryMetrics.Add("hedges", 1)
+	go func() {
+		item, err := rs.replica.GetReplica(ctx, key)
+		results <- result{item, err, true}
+	}()
+	var first result
+	for i := range 2 {
+		r := <-results
+		if r.err == nil || errors.Is(r.err, errCacheMiss) {
+			if r.hedge {
+				retryMetrics.Add("hedge_wins", 1)
+			}
+			return r.item, r.err
+		}
+		if i == 0 {
+			first = r
+		}
+	}
+	return first.item, first.err
+}
+
+func (rs *retryStore) GetAndTouch(ctx context.Context, key string, ttl time.Duration) (CacheItem, error) {
+	var item CacheItem
+	err := rs.do(ctx, func(ctx context.Context) error {
+		var err error
+		item, err = rs.CacheStore.GetAndTouch(ctx, key, ttl)
+		return err
+	})
+	return item, err
+}
+
+func (rs *retryStore) Set(ctx context.Context, key string, item CacheItem) error {
+	_, err := rs.SetIf(ctx, key, item, WriteCondition{})
+	return err
+}
+
+// SetIf retries unconditional writes only: repeating a conditional write
+// that reached Redis would see its own result and fail the condition.
+func (rs *retryStore) SetIf(ctx context.Context, key string, item CacheItem, cond WriteCondition) (int64, error) {
+	if cond.Mode != writeAlways {
+		return rs.CacheStore.SetIf(ctx, key, item, cond)
+	}
+	var version int64
+	err := rs.do(ctx, func(ctx context.Context) error {
+		var err error
+		version, err = rs.CacheStore.SetIf(ctx, key, item, cond)
+		return err
+	})
+	return version, err
+}
+
+// Delete is not retried: after a failed attempt that reached Redis, a retry
+// would report the key as never there, and callers act on that answer.
+func (rs *retryStore) Delete(ctx context.Context, key string) (bool, error) {
+	return rs.CacheStore.Delete(ctx, key)
+}
+
+// UpdateTTL retries setting and capping a TTL, which give the same result
+// when repeated, but not extending it.
+func (rs *retryStore) UpdateTTL(ctx context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	if update.Mode == ttlModeExtend {
+		return rs.CacheStore.UpdateTTL(ctx, key, update)
+	}
+	var ttl time.Duration
+	err := rs.do(ctx, func(ctx context.Context) error {
+		var err error
+		ttl, err = rs.CacheStore.UpdateTTL(ctx, key, update)
+		return err
+	})
+	return ttl, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+var errConnReset = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+// flakyStore fails its next calls with err and can answer reads slowly. Its
+// replica reads come straight from the items.
+type flakyStore struct {
+	*fakeStore
+	fail         int
+	err          error
+	calls        int
+	delay        time.Duration
+	replicaReads int
+}
+
+func newFlakyStore(fail int, err error) *flakyStore {
+	return &flakyStore{fakeStore: newFakeStore(), fail: fail, err: err}
+}
+
+func (s *flakyStore) attempt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.fail > 0 {
+		s.fail--
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStore) Get(ctx context.Context, key string) (CacheItem, error) {
+	if err := s.attempt(); err != nil {
+		return CacheItem{}, err
+	}
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return CacheItem{}, ctx.Err()
+		}
+	}
+	return s.fakeStore.Get(ctx, key)
+}
+
+func (s *flakyStore) SetIf(ctx context.Context, key string, item CacheItem, cond WriteCondition) (int64, error) {
+	if err := s.attempt(); err != nil {
+		return 0, err
+	}
+	return s.fakeStore.SetIf(ctx, key, item, cond)
+}
+
+func (s *flakyStore) Delete(ctx context.Context, key string) (bool, error) {
+	if err := s.attempt(); err != nil {
+		return false, err
+	}
+	return s.fakeStore.Delete(ctx, key)
+}
+
+func (s *flakyStore) UpdateTTL(ctx context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	if err := s.attempt(); err != nil {
+		return 0, err
+	}
+	return s.fakeStore.UpdateTTL(ctx, key, update)
+}
+
+func (s *flakyStore) GetReplica(ctx context.Context, key string) (CacheItem, error) {
+	s.mu.Lock()
+	s.replicaReads++
+	s.mu.Unlock()
+	return s.fakeStore.Get(ctx, key)
+}
+
+func (s *flakyStore) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestRetryRecoversTransientErrors(t *testing.T) {
+	store := newFlakyStore(0, errConnReset)
+	config := testConfig()
+	config.Retry = RetryConfig{Enabled: true, InitialBackoff: 1, MaxBackoff: 2}
+	router := newRouter(newCacheService(config, store))
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "v"), http.StatusOK)
+
+	retries, recovered := counterValue(retryMetrics, "retries"), counterValue(retryMetrics, "recovered")
+	store.fail = 2
+	w := serve(router, http.MethodGet, "/v2/cache/a", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, "v")
+	requireCounterDelta(t, retryMetrics, "retries", retries, 2)
+	requireCounterDelta(t, retryMetrics, "recovered", recovered, 1)
+
+	exhausted := counterValue(retryMetrics, "exhausted")
+	store.fail = 3
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/a?ttl=60", "w"), http.StatusInternalServerError)
+	requireCounterDelta(t, retryMetrics, "exhausted", exhausted, 1)
+}
+
+func TestRetrySkipsUnsafeCalls(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		call func(*retryStore) error
+	}{
+		{"permanent error", errors.New("ERR syntax error"), func(rs *retryStore) error {
+			_, err := rs.Get(t.Context(), "a")
+			return err
+		}},
+		{"conditional write", errConnReset, func(rs *retryStore) error {
+			_, err := rs.SetIf(t.Context(), "a", CacheItem{Value: "v", TTL: time.Minute}, WriteCondition{Mode: writeIfAbsent})
+			return err
+		}},
+		{"delete", errConnReset, func(rs *retryStore) error {
+			_, err := rs.Delete(t.Context(), "a")
+			return err
+		}},
+		{"ttl extension", errConnReset, func(rs *retryStore) error {
+			_, err := rs.UpdateTTL(t.Context(), "a", TTLUpdate{Mode: ttlModeExtend, TTL: time.Minute, Max: time.Hour})
+			return err
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newFlakyStore(1, tc.err)
+			rs := newRetryStore(RetryConfig{Enabled: true, InitialBackoff: 1}, store)
+			if err := tc.call(rs); !errors.Is(err, tc.err) {
+				t.Fatalf("error = %v, want %v", err, tc.err)
+			}
+			if calls := store.callCount(); calls != 1 {
+				t.Fatalf("calls = %d, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestRetryLatencyBudget(t *testing.T) {
+	store := newFlakyStore(5, errConnReset)
+	rs := newRetryStore(RetryConfig{Enabled: true, MaxAttempts: 5, InitialBackoff: 50, MaxBackoff: 50, LatencyBudget: 1}, store)
+	overBudget := counterValue(retryMetrics, "over_budget")
+	if _, err := rs.Get(t.Context(), "a"); !errors.Is(err, errConnReset) {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if calls := store.callCount(); calls != 1 {
+		t.Fatalf("calls = %d, want no retry past the budget", calls)
+	}
+	requireCounterDelta(t, retryMetrics, "over_budget", overBudget, 1)
+
+	// Nor past the deadline of the operation.
+	store = newFlakyStore(5, errConnReset)
+	rs = newRetryStore(RetryConfig{Enabled: true, MaxAttempts: 5, InitialBackoff: 50, MaxBackoff: 50, LatencyBudget: 10000}, store)
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	rs.Get(ctx, "a")
+	if calls := store.callCount(); calls != 1 {
+		t.Fatalf("calls = %d, want no retry past the deadline", calls)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	store := newFlakyStore(100, errConnReset)
+	rs := newRetryStore(RetryConfig{Enabled: true, MaxAttempts: 5, InitialBackoff: 1, MaxBackoff: 1, RetryRatio: 0.5, RetryBurst: 2}, store)
+	exhausted := counterValue(retryMetrics, "budget_exhausted")
+
+	// The first call spends the burst: two retries, then the budget is empty.
+	if _, err := rs.Get(t.Context(), "a"); !errors.Is(err, errConnReset) {
+		t.Fatalf("Get() error = %v, want %v", err, errConnReset)
+	}
+	if calls := store.callCount(); calls != 3 {
+		t.Fatalf("calls = %d, want 3", calls)
+	}
+	requireCounterDelta(t, retryMetrics, "budget_exhausted", exhausted, 1)
+
+	// Half a token per call: the next call gets no retry, the one after one.
+	rs.Get(t.Context(), "a")
+	rs.Get(t.Context(), "a")
+	if calls := store.callCount(); calls != 6 {
+		t.Fatalf("calls = %d, want 6", calls)
+	}
+	requireCounterDelta(t, retryMetrics, "budget_exhausted", exhausted, 3)
+}
+
+func TestHedgedRead(t *testing.T) {
+	store := newFlakyStore(0, nil)
+	store.items["a"] = CacheItem{Value: "v", TTL: time.Minute}
+	rs := newRetryStore(RetryConfig{Enabled: true, HedgeAfter: 10}, store)
+
+	hedges, wins := counterValue(retryMetrics, "hedges"), counterValue(retryMetrics, "hedge_wins")
+	item, err := rs.Get(t.Context(), "a")
+	if err != nil || item.Value != "v" || store.replicaReads != 0 {
+		t.Fatalf("fast read = %+v, %v, %d replica reads", item, err, store.replicaReads)
+	}
+
+	store.delay = time.Second
+	start := time.Now()
+	item, err = rs.Get(t.Context(), "a")
+	if err != nil || item.Value != "v" {
+		t.Fatalf("hedged read = %+v, %v", item, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged read took %v", elapsed)
+	}
+	requireCounterDelta(t, retryMetrics, "hedges", hedges, 1)
+	requireCounterDelta(t, retryMetrics, "hedge_wins", wins, 1)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errConnReset, true},
+		{io.EOF, true},
+		{fmt.Errorf("pipeline: %w", io.ErrUnexpectedEOF), true},
+		{redis.ErrClosed, false},
+		{errCacheMiss, false},
+		{errKeyExists, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("WRONGTYPE Operation against a key"), false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryConfigValidation(t *testing.T) {
+	for _, config := range []RetryConfig{
+		{MaxAttempts: -1},
+		{HedgeAfter: -1},
+		{RetryBurst: -1},
+		{RetryRatio: 1.5},
+		{InitialBackoff: 100, MaxBackoff: 10},
+	} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	rs := newRetryStore(RetryConfig{InitialBackoff: 10, MaxBackoff: 60}, newFakeStore())
+	for attempt, step := range []time.Duration{10, 20, 40, 60, 60} {
+		step *= time.Millisecond
+		for range 100 {
+			if wait := rs.backoff(attempt + 1); wait < step/2 || wait > step {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", attempt+1, wait, step/2, step)
+			}
+		}
+	}
+}
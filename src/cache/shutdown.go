@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultReadinessDelay = 5 * time.Second
+	defaultDrainTimeout   = 10 * time.Second
+	defaultFlushTimeout   = 5 * time.Second
+)
+
+// ShutdownConfig times the shutdown sequence, in milliseconds. The
+// readiness delay is how long the instance keeps serving after /readyz
+// starts failing, so that the ingress stops routing to it first. Zero values
+// fall back to the defaults above; a negative readiness delay skips the
+// wait.
+type ShutdownConfig struct {
+	ReadinessDelay int `json:"readiness_delay_ms"`
+	DrainTimeout   int `json:"drain_timeout_ms"`
+	FlushTimeout   int `json:"flush_timeout_ms"`
+}
+
+func (sc *ShutdownConfig) validate() error {
+	if sc.DrainTimeout < 0 || sc.FlushTimeout < 0 {
+		return fmt.Errorf("shutdown timeouts must not be negative")
+	}
+	return nil
+}
+
+func (sc ShutdownConfig) withDefaults() ShutdownConfig {
+	if sc.ReadinessDelay == 0 {
+		sc.ReadinessDelay = int(defaultReadinessDelay.Milliseconds())
+	}
+	if sc.DrainTimeout == 0 {
+		sc.DrainTimeout = int(defaultDrainTimeout.Milliseconds())
+	}
+	if sc.FlushTimeout == 0 {
+		sc.FlushTimeout = int(defaultFlushTimeout.Milliseconds())
+	}
+	return sc
+}
+
+// httpServer is the part of http.Server the shutdown sequence drives.
+type httpServer interface {
+	RegisterOnShutdown(func())
+	Shutdown(context.Context) error
+}
+
+// shutdown takes the instance out of service in order:
+//  1. /readyz starts failing
+//  2. requests keep being served for the readiness delay
+//  3. the listener closes, long polls and event streams end early and
+//     in-flight requests finish, up to the drain timeout
+//  4. buffered writes, queued events and webhook intake are flushed to
+//     Redis, up to the flush timeout
+//  5. the store is closed
+//
+// It returns the error of the drain step, if requests were still running
+// when it timed out.
+func (cs *CacheService) shutdown(srv httpServer) error {
+	config := cs.config.Shutdown.withDefaults()
+
+	cs.draining.Store(true)
+	if config.ReadinessDelay > 0 {
+		log.Printf("Not ready; draining in %v", time.Duration(config.ReadinessDelay)*time.Millisecond)
+		time.Sleep(time.Duration(config.ReadinessDelay) * time.Millisecond)
+	}
+
+	srv.RegisterOnShutdown(cs.stopStreams)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.DrainTimeout)*time.Millisecond)
+	drainErr := srv.Shutdown(ctx)
+	cancel()
+	if drainErr != nil {
+		log.Printf("Drain timed out: %v", drainErr)
+	}
+	cs.stopStreams()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(config.FlushTimeout)*time.Millisecond)
+	cs.flush(ctx)
+	cancel()
+
+	if err := cs.Close(); err != nil {
+		log.Printf("Store close error: %v", err)
+	}
+	return drainErr
+}
+
+// stopStreams ends long polls and event streams so that draining does not
+// wait for them to time out.
+func (cs *CacheService) stopStreams() {
+	cs.stopOnce.Do(func() { close(cs.stopping) })
+}
+
+// flush writes out what is held in memory on its way to Redis.
+func (cs *CacheService) flush(ctx context.Context) {
+	if cs.breaker != nil {
+		cs.breaker.drain(ctx)
+	}
+	cs.events.flush(ctx)
+	cs.webhooks.flush(ctx)
+}
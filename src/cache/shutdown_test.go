@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeRecordingStore notes whether a buffered write reached it before it
+// was closed.
+type closeRecordingStore struct {
+	*fakeStore
+	closeOnce     sync.Once
+	closed        chan struct{}
+	flushedBefore bool
+}
+
+func (s *closeRecordingStore) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		_, s.flushedBefore = s.items["buffered"]
+		s.mu.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
+
+func TestShutdownSequence(t *testing.T) {
+	config := waitTestConfig()
+	config.Shutdown = ShutdownConfig{ReadinessDelay: 200, DrainTimeout: 5000, FlushTimeout: 1000}
+	config.Breaker = BreakerConfig{Enabled: true, FailureThreshold: 1, ProbeInterval: 3600000, WritePolicy: breakerWritesBuffer}
+	store := &closeRecordingStore{fakeStore: newFakeStore(), closed: make(chan struct{})}
+	service := newCacheService(config, store)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: newRouter(service)}
+	go srv.Serve(ln)
+	base := "http://" + ln.Addr().String()
+	get := func(path string) (int, string) {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// A write buffered while Redis was down is still waiting when shutdown
+	// starts.
+	failStore(store.fakeStore, errors.New("redis down"))
+	get("/v2/cache/x")
+	waitForBreaker(t, service.breaker, breakerOpen)
+	req, _ := http.NewRequest(http.MethodPut, base+"/v2/cache/buffered?ttl=60", strings.NewReader("v"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("buffered write = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	failStore(store.fakeStore, nil)
+
+	stream, err := http.Get(base + "/api/events")
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	streamEnded := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, stream.Body)
+		stream.Body.Close()
+		close(streamEnded)
+	}()
+	pollStatus := make(chan int, 1)
+	go func() {
+		status, _ := get("/v2/cache/missing?wait=10000")
+		pollStatus <- status
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		service.waiters.mu.Lock()
+		waiting := service.waiters.count
+		service.waiters.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("long poll never started waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- service.shutdown(srv) }()
+
+	// Readiness fails while the instance still serves requests.
+	for {
+		status, body := get("/readyz")
+		if status == http.StatusServiceUnavailable && body == "draining" {
+			break
+		}
+		if time.Since(started) > 150*time.Millisecond {
+			t.Fatalf("readyz = %d %q during the readiness delay", status, body)
+		}
+	}
+	if status, _ := get("/livez"); status != http.StatusOK {
+		t.Fatalf("livez = %d while draining", status)
+	}
+	select {
+	case <-store.closed:
+		t.Fatal("store closed during the readiness delay")
+	default:
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+	if status := <-pollStatus; status != http.StatusNotFound {
+		t.Fatalf("long poll = %d, want 404 when draining", status)
+	}
+	select {
+	case <-streamEnded:
+	case <-time.After(time.Second):
+		t.Fatal("event stream was not ended")
+	}
+	select {
+	case <-store.closed:
+	default:
+		t.Fatal("store was not closed")
+	}
+	if !store.flushedBefore {
+		t.Fatal("buffered write was not flushed before the store closed")
+	}
+	if status, _ := get("/livez"); status != 0 {
+		t.Fatalf("livez = %d after shutdown, want the listener closed", status)
+	}
+}
+
+func TestWebhooksFlushIntake(t *testing.T) {
+	config := WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "origin", URL: "http://127.0.0.1:1", Secret: "s"}}}
+	wh := newWebhooks(config, newFakeStore(), nil)
+	wh.intake = make(chan CacheEvent, 4)
+	wh.handle(CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "a"})
+	wh.handle(CacheEvent{Op: eventDelete, Namespace: defaultNamespace, Key: "a"})
+
+	wh.flush(t.Context())
+	deliveries, err := wh.store.ClaimWebhooks(t.Context(), 10, time.Minute)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("queued deliveries = %+v, %v", deliveries, err)
+	}
+}
+
+func TestShutdownConfigValidation(t *testing.T) {
+	if err := (&ShutdownConfig{ReadinessDelay: -1}).validate(); err != nil {
+		t.Fatalf("validate() error: %v", err)
+	}
+	for _, config := range []ShutdownConfig{{DrainTimeout: -1}, {FlushTimeout: -1}} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+	got := ShutdownConfig{ReadinessDelay: -1}.withDefaults()
+	if got.ReadinessDelay != -1 || got.DrainTimeout != 10000 || got.FlushTimeout != 5000 {
+		t.Fatalf("withDefaults() = %+v", got)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	exportPageSize = 500
+
+	snapshotEncodingBase64 = "base64"
+)
+
+// snapshotRecord is one line of an export. An export is a gzip file made of
+// one gzip member per SCAN step: the entries found in that step followed by
+// a checkpoint line holding the cursor of the next step. The last member's
+// checkpoint has cursor 0. Because each member is complete on its own, an
+// interrupted export or import can pick up at the last member boundary.
+type snapshotRecord struct {
+	Namespace   string   `json:"namespace,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	Value       string   `json:"value,omitempty"`
+	Encoding    string   `json:"encoding,omitempty"`
+	ContentType string   `json:"content_type,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	TTL         int64    `json:"ttl_ms,omitempty"`
+	ExportedAt  int64    `json:"exported_at,omitempty"`
+
+	Cursor *uint64 `json:"cursor,omitempty"`
+}
+
+// snapshotFilter selects entries by namespace and key prefix. Empty lists
+// select everything.
+type snapshotFilter struct {
+	Namespaces []string
+	Prefixes   []string
+}
+
+func (f snapshotFilter) match(namespace, key string) bool {
+	if len(f.Namespaces) > 0 && !slices.Contains(f.Namespaces, namespace) {
+		return false
+	}
+	if len(f.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanPattern narrows SCAN to a single namespace and prefix when the filter
+// allows it. Anything else is filtered after the scan.
+func (cs *CacheService) scanPattern(filter snapshotFilter) (string, error) {
+	for _, name := range filter.Namespaces {
+		if _, ok := cs.namespaces.byName[name]; !ok {
+			return "", fmt.Errorf("namespace %q not found", name)
+		}
+	}
+	if len(filter.Namespaces) != 1 || len(filter.Prefixes) > 1 {
+		return "*", nil
+	}
+	ns := cs.namespaces.byName[filter.Namespaces[0]]
+	prefix := ""
+	if len(filter.Prefixes) == 1 {
+		prefix = filter.Prefixes[0]
+	}
+	return escapeGlob(ns.prefix+prefix) + "*", nil
+}
+
+// snapshotSummary counts what an export or import did with each entry.
+type snapshotSummary struct {
+	Entries int
+	Expired int
+	Skipped int
+}
+
+// snapshotPosition is the end of the last complete member read from an
+// export.
+type snapshotPosition struct {
+	Offset   int64
+	Cursor   uint64
+	Complete bool
+}
+
+// countingReader counts the bytes gzip consumes. It implements io.ByteReader
+// so gzip reads through it without buffering past the end of a member.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readSnapshot calls fn for every entry in the complete members of r, which
+// starts offset bytes into the export, and calls done after each member.
+// Reading stops at the member with cursor 0. A truncated or corrupt member
+// is reported as an error along with the position reached before it.
+func readSnapshot(r io.Reader, offset int64, fn func(snapshotRecord) error, done func(snapshotPosition) error) (snapshotPosition, error) {
+	pos := snapshotPosition{Offset: offset}
+	cr := &countingReader{r: bufio.NewReader(r), n: offset}
+	var zr gzip.Reader
+	for {
+		if err := zr.Reset(cr); err != nil {
+			if errors.Is(err, io.EOF) {
+				return pos, nil
+			}
+			return pos, fmt.Errorf("export is damaged at byte %d: %w", pos.Offset, err)
+		}
+		zr.Multistream(false)
+
+		decoder := json.NewDecoder(&zr)
+		var cursor *uint64
+		for {
+			var record snapshotRecord
+			err := decoder.Decode(&record)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return pos, fmt.Errorf("export is damaged at byte %d: %w", pos.Offset, err)
+			}
+			if record.Cursor != nil {
+				cursor = record.Cursor
+				continue
+			}
+			if err := fn(record); err != nil {
+				return pos, err
+			}
+		}
+		if cursor == nil {
+			return pos, fmt.Errorf("export is damaged at byte %d: missing checkpoint", pos.Offset)
+		}
+
+		pos = snapshotPosition{Offset: cr.n, Cursor: *cursor, Complete: *cursor == 0}
+		if err := done(pos); err != nil {
+			return pos, err
+		}
+		if pos.Complete {
+			return pos, nil
+		}
+	}
+}
+
+// exportSnapshot writes every live entry selected by filter to path. With
+// resume, an existing export is truncated to its last complete member and
+// the scan continues from that member's cursor. SCAN may return a key more
+// than once, in which case the key is exported more than once; importing it
+// again is harmless.
+func (cs *CacheService) exportSnapshot(ctx context.Context, path string, filter snapshotFilter, resume bool) (snapshotSummary, error) {
+	var summary snapshotSummary
+	inspector, ok := unwrapStore(cs.store).(KeyInspector)
+	if !ok {
+		return summary, errors.New("key scanning is not supported by this store")
+	}
+	match, err := cs.scanPattern(filter)
+	if err != nil {
+		return summary, err
+	}
+
+	file, cursor, err := openExport(path, resume)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+	if cursor == 0 && resume {
+		if info, err := file.Stat(); err == nil && info.Size() > 0 {
+			// The export already finished.
+			return summary, nil
+		}
+	}
+
+	zw := gzip.NewWriter(file)
+	encoder := json.NewEncoder(zw)
+	for {
+		keys, next, err := inspector.ScanKeys(ctx, match, cursor, exportPageSize)
+		if err != nil {
+			return summary, err
+		}
+		for _, storeKey := range keys {
+			record, ok, err := cs.exportRecord(ctx, storeKey, filter)
+			if err != nil {
+				return summary, err
+			}
+			if !ok {
+				continue
+			}
+			if err := encoder.Encode(record); err != nil {
+				return summary, err
+			}
+			summary.Entries++
+		}
+
+		if err := encoder.Encode(snapshotRecord{Cursor: &next}); err != nil {
+			return summary, err
+		}
+		if err := zw.Close(); err != nil {
+			return summary, err
+		}
+		if err := file.Sync(); err != nil {
+			return summary, err
+		}
+		if next == 0 {
+			return summary, file.Close()
+		}
+		cursor = next
+		zw.Reset(file)
+	}
+}
+
+// openExport creates the export file, or on resume reopens it positioned
+// after its last complete member and returns the cursor to continue from.
+func openExport(path string, resume bool) (*os.File, uint64, error) {
+	if !resume {
+		file, err := os.Create(path)
+		return file, 0, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	skip := func(snapshotRecord) error { return nil }
+	pos, err := readSnapshot(file, 0, skip, func(snapshotPosition) error { return nil })
+	if err != nil {
+		log.Printf("resuming export after byte %d: %v", pos.Offset, err)
+	}
+	if err := file.Truncate(pos.Offset); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, pos.Cursor, nil
+}
+
+// exportRecord reads one Redis key into a record. Internal keys, keys
+// outside the filter and keys that expired since the scan are skipped.
+func (cs *CacheService) exportRecord(ctx context.Context, storeKey string, filter snapshotFilter) (snapshotRecord, bool, error) {
+	ns, key, ok := cs.namespaces.split(storeKey)
+	if !ok || !filter.match(ns.name, key) {
+		return snapshotRecord{}, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readOpTimeout)
+	defer cancel()
+
+	item, err := cs.store.Get(ctx, storeKey)
+	if errors.Is(err, errCacheMiss) {
+		return snapshotRecord{}, false, nil
+	}
+	if err != nil {
+		return snapshotRecord{}, false, err
+	}
+
+	record := snapshotRecord{
+		Key:         key,
+		Value:       item.Value,
+		ContentType: item.ContentType,
+		Tags:        item.Tags,
+		TTL:         item.TTL.Milliseconds(),
+		ExportedAt:  time.Now().UnixMilli(),
+	}
+	if ns != cs.namespaces.defaultNS {
+		record.Namespace = ns.name
+	}
+	if !utf8.ValidString(item.Value) {
+		record.Value = base64.StdEncoding.EncodeToString([]byte(item.Value))
+		record.Encoding = snapshotEncodingBase64
+	}
+	return record, true, nil
+}
+
+// importSnapshot writes the entries in path back to the cache. Each entry's
+// TTL is reduced by the time since it was exported unless keepTTL is set;
+// entries whose TTL has run out are not written. Progress is recorded in a
+// .progress file next to the export after each member, so that resume can
+// skip the members that were already imported.
+func (cs *CacheService) importSnapshot(ctx context.Context, path string, filter snapshotFilter, resume, keepTTL bool) (snapshotSummary, error) {
+	var summary snapshotSummary
+	for _, name := range filter.Namespaces {
+		if _, ok := cs.namespaces.byName[name]; !ok {
+			return summary, fmt.Errorf("namespace %q not found", name)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+
+	progressPath := path + ".progress"
+	var offset int64
+	if resume {
+		if data, err := os.ReadFile(progressPath); err == nil {
+			if offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+				return summary, fmt.Errorf("invalid progress file %s: %w", progressPath, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return summary, err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return summary, err
+		}
+	}
+
+	importEntry := func(record snapshotRecord) error {
+		return cs.importRecord(ctx, record, filter, keepTTL, &summary)
+	}
+	saveProgress := func(pos snapshotPosition) error {
+		return os.WriteFile(progressPath, []byte(strconv.FormatInt(pos.Offset, 10)+"\n"), 0o644)
+	}
+	pos, err := readSnapshot(file, offset, importEntry, saveProgress)
+	if err != nil {
+		return summary, err
+	}
+	if !pos.Complete {
+		return summary, fmt.Errorf("export is incomplete after byte %d", pos.Offset)
+	}
+	if err := os.Remove(progressPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// importRecord writes one entry like a POST to /api/cache would. Entries
+// this service would reject are skipped and logged; store failures stop the
+// import.
+func (cs *CacheService) importRecord(ctx context.Context, record snapshotRecord, filter snapshotFilter, keepTTL bool, summary *snapshotSummary) error {
+	name := record.Namespace
+	if name == "" {
+		name = defaultNamespace
+	}
+	if !filter.match(name, record.Key) {
+		return nil
+	}
+
+	skip := func(reason string) error {
+		log.Printf("import %q skipped: %s", record.Key, reason)
+		summary.Skipped++
+		return nil
+	}
+	ns, ok := cs.namespaces.byName[name]
+	if !ok {
+		return skip(fmt.Sprintf("namespace %q not found", name))
+	}
+	if record.Key == "" || len(record.Key) > cs.sizeLimits.MaxKeyLength {
+		return skip("invalid key")
+	}
+	if ns.prefix == "" && strings.HasPrefix(record.Key, internalKeyPrefix) {
+		return skip(fmt.Sprintf("keys must not start with %s", internalKeyPrefix))
+	}
+	value := record.Value
+	if record.Encoding == snapshotEncodingBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(record.Value)
+		if err != nil {
+			return skip("invalid base64 value")
+		}
+		value = string(decoded)
+	}
+	if int64(len(value)) > cs.maxValueSize(ns) {
+		return skip(fmt.Sprintf("value exceeds %d bytes", cs.maxValueSize(ns)))
+	}
+	tags, err := parseTags(record.Tags)
+	if err != nil {
+		return skip(err.Error())
+	}
+
+	ttl := time.Duration(record.TTL) * time.Millisecond
+	if !keepTTL {
+		ttl -= time.Since(time.UnixMilli(record.ExportedAt))
+	}
+	if ttl < time.Millisecond {
+		summary.Expired++
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+
+	reservation, err := cs.namespaces.reserve(ctx, ns, record.Key, int64(len(record.Key)+len(value)), ttl)
+	if errors.Is(err, errBudgetExceeded) {
+		return skip(err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if err := cs.store.Set(ctx, ns.key(record.Key), CacheItem{Value: value, TTL: ttl, ContentType: record.ContentType, Tags: tags}); err != nil {
+		cs.namespaces.undo(ctx, reservation)
+		return err
+	}
+	cs.tags.add(ctx, ns, record.Key, tags, ttl)
+	ns.writes.Add(1)
+	cs.waiters.notify(ctx, ns.key(record.Key))
+	cs.events.publish(CacheEvent{Op: eventSet, Namespace: ns.name, Key: record.Key, TTL: int64(ttl.Seconds()), Size: int64(len(value))})
+	summary.Entries++
+	return nil
+}
+
+// stringList collects a flag that may be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	var filter snapshotFilter
+	flags.Var((*stringList)(&filter.Namespaces), "namespace", "only export this namespace (repeatable)")
+	flags.Var((*stringList)(&filter.Prefixes), "prefix", "only export keys with this prefix (repeatable)")
+	resume := flags.Bool("resume", false, "continue an interrupted export")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		log.Print("usage: cache export [flags] FILE")
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return 1
+	}
+	return withStoreService(config, func(cs *CacheService) int {
+		summary, err := cs.exportSnapshot(context.Background(), flags.Arg(0), filter, *resume)
+		fmt.Printf("exported %d entries\n", summary.Entries)
+		if err != nil {
+			log.Printf("export failed: %v", err)
+			return 1
+		}
+		return 0
+	})
+}
+
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	var filter snapshotFilter
+	flags.Var((*stringList)(&filter.Namespaces), "namespace", "only import this namespace (repeatable)")
+	flags.Var((*stringList)(&filter.Prefixes), "prefix", "only import keys with this prefix (repeatable)")
+	resume := flags.Bool("resume", false, "continue an interrupted import")
+	keepTTL := flags.Bool("keep-ttl", false, "restore TTLs as exported instead of subtracting the time since export")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		log.Print("usage: cache import [flags] FILE")
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return 1
+	}
+	return withStoreService(config, func(cs *CacheService) int {
+		summary, err := cs.importSnapshot(context.Background(), flags.Arg(0), filter, *resume, *keepTTL)
+		fmt.Printf("imported %d entries, %d expired, %d skipped\n", summary.Entries, summary.Expired, summary.Skipped)
+		if err != nil {
+			log.Printf("import failed: %v", err)
+			return 1
+		}
+		return 0
+	})
+}
+
+// withStoreService runs fn against a store-only service connected to the
+// configured Redis, for subcommands that work on the cache directly.
+func withStoreService(config *Config, fn func(*CacheService) int) int {
+	cacheService := newStoreService(config, NewRedisStore(config))
+	defer cacheService.Close()
+	if err := cacheService.HealthCheck(context.Background()); err != nil {
+		log.Printf("Failed to connect to Redis: %v", err)
+		return 1
+	}
+	return fn(cacheService)
+}
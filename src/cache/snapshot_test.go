@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func snapshotTestService(t *testing.T) (*CacheService, *inspectFakeStore) {
+	t.Helper()
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := &inspectFakeStore{fakeStore: newFakeStore(), internal: []string{versionCounterKey, leaseKeyPrefix + "items:1"}}
+	return newStoreService(config, store), store
+}
+
+func TestStoreServiceStartsNothing(t *testing.T) {
+	config := eventsTestConfig()
+	config.Wait.Enabled = true
+	config.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "edge", URL: "http://127.0.0.1:1"}}}
+	store := newEventFakeStore()
+	service := newStoreService(config, store)
+	defer service.Close()
+
+	path := writeSnapshotFile(t, snapshotMember(t, 0, snapshotRecord{Namespace: defaultNamespace, Key: "k", Value: "v", TTL: 60000, ExportedAt: time.Now().UnixMilli()}))
+	if summary, err := service.importSnapshot(context.Background(), path, snapshotFilter{}, false, false); err != nil || summary.Entries != 1 {
+		t.Fatalf("importSnapshot() = %+v, %v", summary, err)
+	}
+	if service.webhooks.intake != nil || service.events.enabled || service.waiters.enabled {
+		t.Fatal("store-only service started background work")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.log) != 0 {
+		t.Fatalf("import appended events: %+v", store.log)
+	}
+}
+
+// snapshotMember renders one gzip member of an export.
+func snapshotMember(t *testing.T, cursor uint64, records ...snapshotRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	for _, record := range append(records, snapshotRecord{Cursor: &cursor}) {
+		if err := encoder.Encode(record); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func writeSnapshotFile(t *testing.T, members ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export.jsonl.gz")
+	if err := os.WriteFile(path, bytes.Join(members, nil), 0o600); err != nil {
+		t.Fatalf("write export: %v", err)
+	}
+	return path
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source, sourceStore := snapshotTestService(t)
+	sourceStore.items["items:1"] = CacheItem{Value: `{"id":1}`, TTL: time.Minute, Tags: []string{"item:1", "items"}}
+	sourceStore.items["users:1"] = CacheItem{Value: "\xff\x00binary", TTL: time.Hour, ContentType: "application/octet-stream"}
+	sourceStore.items[namespaceKeyPrefix+"tenant:items:9"] = CacheItem{Value: "tenant", TTL: time.Minute}
+
+	path := filepath.Join(t.TempDir(), "export.jsonl.gz")
+	summary, err := source.exportSnapshot(context.Background(), path, snapshotFilter{}, false)
+	if err != nil || summary.Entries != 3 {
+		t.Fatalf("exportSnapshot() = %+v, %v", summary, err)
+	}
+
+	target, targetStore := snapshotTestService(t)
+	summary, err = target.importSnapshot(context.Background(), path, snapshotFilter{}, false, false)
+	if err != nil || summary.Entries != 3 {
+		t.Fatalf("importSnapshot() = %+v, %v", summary, err)
+	}
+	for key, want := range sourceStore.items {
+		got, ok := targetStore.items[key]
+		if !ok || got.Value != want.Value || got.ContentType != want.ContentType || !slices.Equal(got.Tags, want.Tags) {
+			t.Fatalf("imported %q = %+v, want %+v", key, got, want)
+		}
+		if got.TTL > want.TTL || got.TTL < want.TTL-time.Minute/2 {
+			t.Fatalf("imported %q TTL = %v, want about %v", key, got.TTL, want.TTL)
+		}
+	}
+	if len(targetStore.items) != 3 {
+		t.Fatalf("imported %d entries, want 3", len(targetStore.items))
+	}
+	if _, err := os.Stat(path + ".progress"); !os.IsNotExist(err) {
+		t.Fatalf("progress file left behind: %v", err)
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	service, store := snapshotTestService(t)
+	for _, key := range []string{"items:1", "items:2", "users:1", namespaceKeyPrefix + "tenant:items:9"} {
+		store.items[key] = CacheItem{Value: "v", TTL: time.Minute}
+	}
+
+	tests := []struct {
+		filter snapshotFilter
+		want   int
+	}{
+		{filter: snapshotFilter{Prefixes: []string{"items:"}}, want: 3},
+		{filter: snapshotFilter{Namespaces: []string{defaultNamespace}, Prefixes: []string{"items:"}}, want: 2},
+		{filter: snapshotFilter{Namespaces: []string{"tenant"}}, want: 1},
+		{filter: snapshotFilter{Prefixes: []string{"users:", "items:2"}}, want: 2},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "export.jsonl.gz")
+		summary, err := service.exportSnapshot(context.Background(), path, tt.filter, false)
+		if err != nil || summary.Entries != tt.want {
+			t.Fatalf("exportSnapshot(%+v) = %+v, %v, want %d entries", tt.filter, summary, err, tt.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "export.jsonl.gz")
+	if _, err := service.exportSnapshot(context.Background(), path, snapshotFilter{Namespaces: []string{"missing"}}, false); err == nil {
+		t.Fatal("exportSnapshot() succeeded for an unknown namespace")
+	}
+}
+
+func TestExportResume(t *testing.T) {
+	service, store := snapshotTestService(t)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		store.items[key] = CacheItem{Value: key, TTL: time.Minute}
+	}
+
+	// The fake store's cursor is an offset into its sorted keys, which start
+	// with the two internal keys. The first member covered "a" and "b"; the
+	// second was cut off mid-write.
+	first := snapshotMember(t, 4,
+		snapshotRecord{Key: "a", Value: "a", TTL: 60000, ExportedAt: time.Now().UnixMilli()},
+		snapshotRecord{Key: "b", Value: "b", TTL: 60000, ExportedAt: time.Now().UnixMilli()})
+	partial := snapshotMember(t, 0, snapshotRecord{Key: "c", Value: "c", TTL: 60000})
+	path := writeSnapshotFile(t, first, partial[:len(partial)/2])
+
+	summary, err := service.exportSnapshot(context.Background(), path, snapshotFilter{}, true)
+	if err != nil || summary.Entries != 2 {
+		t.Fatalf("exportSnapshot(resume) = %+v, %v, want 2 new entries", summary, err)
+	}
+
+	var keys []string
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open export: %v", err)
+	}
+	defer file.Close()
+	pos, err := readSnapshot(file, 0, func(record snapshotRecord) error {
+		keys = append(keys, record.Key)
+		return nil
+	}, func(snapshotPosition) error { return nil })
+	if err != nil || !pos.Complete {
+		t.Fatalf("readSnapshot() = %+v, %v", pos, err)
+	}
+	if got := len(keys); got != 4 || keys[0] != "a" || keys[3] != "d" {
+		t.Fatalf("exported keys = %v, want a through d once each", keys)
+	}
+
+	// Resuming a finished export does nothing.
+	summary, err = service.exportSnapshot(context.Background(), path, snapshotFilter{}, true)
+	if err != nil || summary.Entries != 0 {
+		t.Fatalf("exportSnapshot(resume finished) = %+v, %v", summary, err)
+	}
+}
+
+func TestImportAdjustsTTLsAndSkipsInvalidEntries(t *testing.T) {
+	service, store := snapshotTestService(t)
+	exportedAt := time.Now().Add(-40 * time.Second).UnixMilli()
+	path := writeSnapshotFile(t, snapshotMember(t, 0,
+		snapshotRecord{Key: "aged", Value: "v", TTL: 60000, ExportedAt: exportedAt},
+		snapshotRecord{Key: "expired", Value: "v", TTL: 30000, ExportedAt: exportedAt},
+		snapshotRecord{Key: "k", Namespace: "missing", Value: "v", TTL: 60000, ExportedAt: exportedAt},
+		snapshotRecord{Key: internalKeyPrefix + "x", Value: "v", TTL: 60000, ExportedAt: exportedAt},
+		snapshotRecord{Key: "bad", Value: "!", Encoding: snapshotEncodingBase64, TTL: 60000, ExportedAt: exportedAt},
+	))
+
+	summary, err := service.importSnapshot(context.Background(), path, snapshotFilter{}, false, false)
+	if err != nil {
+		t.Fatalf("importSnapshot() error: %v", err)
+	}
+	if summary != (snapshotSummary{Entries: 1, Expired: 1, Skipped: 3}) {
+		t.Fatalf("importSnapshot() = %+v", summary)
+	}
+	if ttl := store.items["aged"].TTL; ttl > 20*time.Second || ttl < 15*time.Second {
+		t.Fatalf("aged TTL = %v, want about 20s", ttl)
+	}
+
+	summary, err = service.importSnapshot(context.Background(), path, snapshotFilter{Prefixes: []string{"exp"}}, false, true)
+	if err != nil || summary.Entries != 1 {
+		t.Fatalf("importSnapshot(keep-ttl) = %+v, %v", summary, err)
+	}
+	if ttl := store.items["expired"].TTL; ttl != 30*time.Second {
+		t.Fatalf("kept TTL = %v, want 30s", ttl)
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	service, store := snapshotTestService(t)
+	now := time.Now().UnixMilli()
+	first := snapshotMember(t, 7, snapshotRecord{Key: "first", Value: "v", TTL: 60000, ExportedAt: now})
+	second := snapshotMember(t, 9, snapshotRecord{Key: "second", Value: "v", TTL: 60000, ExportedAt: now})
+	last := snapshotMember(t, 0, snapshotRecord{Key: "last", Value: "v", TTL: 60000, ExportedAt: now})
+
+	// An interrupted export imports what it has and keeps its progress.
+	path := writeSnapshotFile(t, first, second)
+	summary, err := service.importSnapshot(context.Background(), path, snapshotFilter{}, false, false)
+	if err == nil || summary.Entries != 2 {
+		t.Fatalf("importSnapshot(incomplete) = %+v, %v", summary, err)
+	}
+	progress, err := os.ReadFile(path + ".progress")
+	if err != nil || string(progress) != strconv.Itoa(len(first)+len(second))+"\n" {
+		t.Fatalf("progress = %q, %v", progress, err)
+	}
+
+	// Once the export is finished, resume only imports the rest.
+	delete(store.items, "first")
+	if err := os.WriteFile(path, bytes.Join([][]byte{first, second, last}, nil), 0o600); err != nil {
+		t.Fatalf("write export: %v", err)
+	}
+	summary, err = service.importSnapshot(context.Background(), path, snapshotFilter{}, true, false)
+	if err != nil || summary.Entries != 1 {
+		t.Fatalf("importSnapshot(resume) = %+v, %v", summary, err)
+	}
+	if _, ok := store.items["first"]; ok {
+		t.Fatal("resume imported an entry from before the checkpoint")
+	}
+	if _, ok := store.items["last"]; !ok {
+		t.Fatal("resume did not import the remaining entry")
+	}
+}
+
+func TestReadSnapshotRejectsDamagedExports(t *testing.T) {
+	tests := map[string][]byte{
+		"not gzip":           []byte("plain text"),
+		"missing checkpoint": gzipBytes(t, `{"key":"a"}`+"\n"),
+		"invalid json":       gzipBytes(t, "{\n"),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			ignore := func(snapshotRecord) error { return nil }
+			if _, err := readSnapshot(bytes.NewReader(data), 0, ignore, func(snapshotPosition) error { return nil }); err == nil {
+				t.Fatal("readSnapshot() succeeded")
+			}
+		})
+	}
+}
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	return buf.Bytes()
+}
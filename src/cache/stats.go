@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultStatsCacheTTL   = 10 * time.Second
+	defaultStatsSampleSize = 1000
+	maxStatsSampleSize     = 100000
+	statsScanCount         = 200
+	statsRandomBatch       = 200
+	statsTopPrefixes       = 10
+)
+
+// StatsConfig controls the admin statistics report. CacheTTL is in
+// milliseconds; both values fall back to the defaults above when zero.
+type StatsConfig struct {
+	CacheTTL   int `json:"cache_ms"`
+	SampleSize int `json:"sample_size"`
+}
+
+func (sc *StatsConfig) validate() error {
+	if sc.CacheTTL < 0 || sc.SampleSize < 0 {
+		return fmt.Errorf("stats limits must not be negative")
+	}
+	if sc.SampleSize > maxStatsSampleSize {
+		return fmt.Errorf("stats sample_size must not exceed %d", maxStatsSampleSize)
+	}
+	return nil
+}
+
+// ServerStats are the figures Redis keeps about itself since it started.
+type ServerStats struct {
+	Version        string  `json:"version,omitempty"`
+	Keys           int64   `json:"keys"`
+	KeysWithTTL    int64   `json:"keys_with_ttl"`
+	UsedMemory     int64   `json:"used_memory"`
+	UsedMemoryPeak int64   `json:"used_memory_peak"`
+	MaxMemory      int64   `json:"max_memory"`
+	EvictedKeys    int64   `json:"evicted_keys"`
+	ExpiredKeys    int64   `json:"expired_keys"`
+	KeyspaceHits   int64   `json:"keyspace_hits"`
+	KeyspaceMisses int64   `json:"keyspace_misses"`
+	HitRatio       float64 `json:"hit_ratio"`
+}
+
+// KeySample describes one sampled key. Size is the length of the stored
+// value and Bytes the memory Redis attributes to the whole key. TTL is
+// negative for keys without an expiry.
+type KeySample struct {
+	Key   string
+	Size  int64
+	Bytes int64
+	TTL   time.Duration
+}
+
+// StatsStore is implemented by stores that can describe their contents.
+type StatsStore interface {
+	ServerStats(ctx context.Context) (ServerStats, error)
+	// SampleKeys describes up to limit keys picked at random, or every key
+	// when there are no more than limit.
+	SampleKeys(ctx context.Context, limit int) ([]KeySample, error)
+}
+
+func (rs *RedisStore) ServerStats(ctx context.Context) (ServerStats, error) {
+	info, err := rs.client.Info(ctx).Result()
+	if err != nil {
+		return ServerStats{}, err
+	}
+	return parseServerStats(info), nil
+}
+
+// parseServerStats reads the fields it needs from INFO output. Only the
+// logical database the service uses is counted.
+func parseServerStats(info string) ServerStats {
+	var stats ServerStats
+	fields := map[string]*int64{
+		"used_memory":      &stats.UsedMemory,
+		"used_memory_peak": &stats.UsedMemoryPeak,
+		"maxmemory":        &stats.MaxMemory,
+		"evicted_keys":     &stats.EvictedKeys,
+		"expired_keys":     &stats.ExpiredKeys,
+		"keyspace_hits":    &stats.KeyspaceHits,
+		"keyspace_misses":  &stats.KeyspaceMisses,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		switch {
+		case name == "redis_version":
+			stats.Version = value
+		case name == "db0":
+			for _, pair := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(pair, "=")
+				n, _ := strconv.ParseInt(v, 10, 64)
+				switch k {
+				case "keys":
+					stats.Keys = n
+				case "expires":
+					stats.KeysWithTTL = n
+				}
+			}
+		case fields[name] != nil:
+			*fields[name], _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	stats.HitRatio = ratio(stats.KeyspaceHits, stats.KeyspaceMisses)
+	return stats
+}
+
+// SampleKeys scans the whole keyspace when it holds no more than limit keys.
+// Larger keyspaces are sampled with RANDOMKEY, which picks keys with equal
+// odds, rather than with a SCAN that would always start in the same place.
+// Draws are independent, so a key can be described more than once.
+func (rs *RedisStore) SampleKeys(ctx context.Context, limit int) ([]KeySample, error) {
+	keys, err := rs.sampleKeyNames(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	type keyCmds struct {
+		size   *redis.Cmd
+		legacy *redis.IntCmd
+		bytes  *redis.IntCmd
+		ttl    *redis.DurationCmd
+	}
+	cmds := make([]keyCmds, len(keys))
+	pipe := rs.client.Pipeline()
+	for i, key := range keys {
+		cmds[i] = keyCmds{
+			size:   pipe.Do(ctx, "hstrlen", key, "v"),
+			legacy: pipe.StrLen(ctx, key),
+			bytes:  pipe.MemoryUsage(ctx, key, 0),
+			ttl:    pipe.PTTL(ctx, key),
+		}
+	}
+	// Keys of other types answer some of these commands with WRONGTYPE,
+	// so the pipeline error is expected and each reply is checked instead.
+	_, _ = pipe.Exec(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	samples := make([]KeySample, 0, len(keys))
+	for i, key := range keys {
+		bytes, err := cmds[i].bytes.Result()
+		if errors.Is(err, redis.Nil) {
+			continue // deleted since the scan
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := cmds[i].size.Int64()
+		if err != nil {
+			size, _ = cmds[i].legacy.Result()
+		}
+		samples = append(samples, KeySample{Key: key, Size: size, Bytes: bytes, TTL: cmds[i].ttl.Val()})
+	}
+	return samples, nil
+}
+
+func (rs *RedisStore) sampleKeyNames(ctx context.Context, limit int) ([]string, error) {
+	size, err := rs.client.DBSize(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if size <= int64(limit) {
+		var cursor uint64
+		for {
+			batch, next, err := rs.client.Scan(ctx, cursor, "", statsScanCount).Result()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, batch...)
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+		return keys, nil
+	}
+
+	for len(keys) < limit {
+		pipe := rs.client.Pipeline()
+		cmds := make([]*redis.StringCmd, min(statsRandomBatch, limit-len(keys)))
+		for i := range cmds {
+			cmds[i] = pipe.RandomKey(ctx)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		drawn := 0
+		for _, cmd := range cmds {
+			if key, err := cmd.Result(); err == nil {
+				keys = append(keys, key)
+				drawn++
+			}
+		}
+		// An empty draw means the keyspace emptied since DBSIZE.
+		if drawn == 0 {
+			break
+		}
+	}
+	return keys, nil
+}
+
+func ratio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+type statsBucket struct {
+	Le    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+type prefixStats struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	Keys      int    `json:"keys"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type sampleStats struct {
+	Keys               int           `json:"keys"`
+	ValueSizes         []statsBucket `json:"value_sizes"`
+	TTLs               []statsBucket `json:"ttls"`
+	TopPrefixesByCount []prefixStats `json:"top_prefixes_by_count"`
+	TopPrefixesByBytes []prefixStats `json:"top_prefixes_by_bytes"`
+}
+
+type serviceStats struct {
+	StartedAt time.Time `json:"started_at"`
+	Reads     int64     `json:"reads"`
+	Hits      int64     `json:"hits"`
+	Misses    int64     `json:"misses"`
+	Writes    int64     `json:"writes"`
+	HitRatio  float64   `json:"hit_ratio"`
+}
+
+type statsReport struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Service     serviceStats `json:"service"`
+	Redis       *ServerStats `json:"redis,omitempty"`
+	Sample      *sampleStats `json:"sample,omitempty"`
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+var valueSizeBuckets = []struct {
+	label string
+	limit int64
+}{
+	{"1KiB", 1 << 10},
+	{"10KiB", 10 << 10},
+	{"100KiB", 100 << 10},
+	{"1MiB", 1 << 20},
+	{"10MiB", 10 << 20},
+	{"+Inf", -1},
+}
+
+var ttlBuckets = []struct {
+	label string
+	limit time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"+Inf", -1},
+}
+
+// stats builds the admin report and keeps the last one for a short while,
+// so that polling the endpoint does not turn into a stream of SCANs.
+type stats struct {
+	store      StatsStore
+	namespaces *namespaces
+	started    time.Time
+	cacheTTL   time.Duration
+	sampleSize int
+
+	mu          sync.Mutex
+	report      *statsReport
+	generatedAt time.Time
+}
+
+func newStats(config StatsConfig, store CacheStore, namespaces *namespaces) *stats {
+	s := &stats{
+		namespaces: namespaces,
+		started:    time.Now().UTC(),
+		cacheTTL:   defaultStatsCacheTTL,
+		sampleSize: defaultStatsSampleSize,
+	}
+	if config.CacheTTL > 0 {
+		s.cacheTTL = time.Duration(config.CacheTTL) * time.Millisecond
+	}
+	if config.SampleSize > 0 {
+		s.sampleSize = config.SampleSize
+	}
+	if statsStore, ok := store.(StatsStore); ok {
+		s.store = statsStore
+	}
+	return s
+}
+
+// get returns the cached report or builds a new one. Concurrent callers
+// wait for a single build instead of each starting their own.
+func (s *stats) get(ctx context.Context) *statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report != nil && time.Since(s.generatedAt) < s.cacheTTL {
+		return s.report
+	}
+	s.report = s.build(ctx)
+	s.generatedAt = time.Now()
+	return s.report
+}
+
+func (s *stats) build(ctx context.Context) *statsReport {
+	report := &statsReport{GeneratedAt: time.Now().UTC(), Service: serviceStats{StartedAt: s.started}}
+	for _, ns := range s.namespaces.order {
+		report.Service.Reads += ns.reads.Load()
+		report.Service.Hits += ns.hits.Load()
+		report.Service.Misses += ns.misses.Load()
+		report.Service.Writes += ns.writes.Load()
+	}
+	report.Service.HitRatio = ratio(report.Service.Hits, report.Service.Misses)
+	if s.store == nil {
+		return report
+	}
+
+	server, err := s.store.ServerStats(ctx)
+	if err != nil {
+		log.Printf("Redis stats error: %v", err)
+		report.Errors = append(report.Errors, "server stats unavailable")
+	} else {
+		report.Redis = &server
+	}
+	samples, err := s.store.SampleKeys(ctx, s.sampleSize)
+	if err != nil {
+		log.Printf("Redis key sample error: %v", err)
+		report.Errors = append(report.Errors, "key sample unavailable")
+	} else {
+		report.Sample = s.summarize(samples)
+	}
+	return report
+}
+
+func (s *stats) summarize(samples []KeySample) *sampleStats {
+	sizes := make([]int, len(valueSizeBuckets))
+	ttls := make([]int, len(ttlBuckets))
+	type prefixKey struct{ namespace, prefix string }
+	prefixes := make(map[prefixKey]*prefixStats)
+
+	result := &sampleStats{}
+	for _, sample := range samples {
+		ns, key, ok := s.namespaces.split(sample.Key)
+		if !ok {
+			continue
+		}
+		result.Keys++
+
+		for i, bucket := range valueSizeBuckets {
+			if bucket.limit < 0 || sample.Size <= bucket.limit {
+				sizes[i]++
+				break
+			}
+		}
+		if sample.TTL >= 0 {
+			for i, bucket := range ttlBuckets {
+				if bucket.limit < 0 || sample.TTL <= bucket.limit {
+					ttls[i]++
+					break
+				}
+			}
+		}
+
+		pk := prefixKey{namespace: ns.name, prefix: keyPrefix(key)}
+		p := prefixes[pk]
+		if p == nil {
+			p = &prefixStats{Namespace: pk.namespace, Prefix: pk.prefix}
+			prefixes[pk] = p
+		}
+		p.Keys++
+		p.Bytes += sample.Bytes
+	}
+
+	for i, bucket := range valueSizeBuckets {
+		result.ValueSizes = append(result.ValueSizes, statsBucket{Le: bucket.label, Count: sizes[i]})
+	}
+	for i, bucket := range ttlBuckets {
+		result.TTLs = append(result.TTLs, statsBucket{Le: bucket.label, Count: ttls[i]})
+	}
+
+	all := make([]prefixStats, 0, len(prefixes))
+	for _, p := range prefixes {
+		all = append(all, *p)
+	}
+	result.TopPrefixesByCount = topPrefixes(all, func(a, b prefixStats) bool { return a.Keys > b.Keys })
+	result.TopPrefixesByBytes = topPrefixes(all, func(a, b prefixStats) bool { return a.Bytes > b.Bytes })
+	return result
+}
+
+// keyPrefix is the part of a key up to and including its first colon, or
+// an empty string for keys without one.
+func keyPrefix(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
+}
+
+func topPrefixes(all []prefixStats, less func(a, b prefixStats) bool) []prefixStats {
+	sorted := append([]prefixStats(nil), all...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if less(sorted[i], sorted[j]) || less(sorted[j], sorted[i]) {
+			return less(sorted[i], sorted[j])
+		}
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Prefix < sorted[j].Prefix
+	})
+	if len(sorted) > statsTopPrefixes {
+		sorted = sorted[:statsTopPrefixes]
+	}
+	return sorted
+}
+
+func (cs *CacheService) statsHandler(w http.ResponseWriter, r *http.Request) {
+	// The report is shared with other callers, so it is not tied to the
+	// request that happens to build it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), readOpTimeout)
+	defer cancel()
+
+	report := cs.stats.get(ctx)
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, report)
+}
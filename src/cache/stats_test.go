@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// statsFakeStore describes its items as key samples and counts how often
+// the report is rebuilt.
+type statsFakeStore struct {
+	*fakeStore
+	server    ServerStats
+	serverErr error
+	builds    int
+}
+
+func (s *statsFakeStore) ServerStats(context.Context) (ServerStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.builds++
+	return s.server, s.serverErr
+}
+
+func (s *statsFakeStore) SampleKeys(_ context.Context, limit int) ([]KeySample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := []KeySample{{Key: internalKeyPrefix + "version", Size: 1, Bytes: 50, TTL: -1}}
+	for key, item := range s.items {
+		if len(samples) == limit {
+			break
+		}
+		samples = append(samples, KeySample{Key: key, Size: int64(len(item.Value)), Bytes: int64(len(item.Value)) + 100, TTL: item.TTL})
+	}
+	return samples, nil
+}
+
+const testInfo = "# Server\r\nredis_version:7.2.4\r\n# Memory\r\nused_memory:1048576\r\nused_memory_peak:2097152\r\nmaxmemory:0\r\n" +
+	"# Stats\r\nexpired_keys:12\r\nevicted_keys:3\r\nkeyspace_hits:75\r\nkeyspace_misses:25\r\n# Keyspace\r\ndb0:keys=42,expires=40,avg_ttl=1000\r\ndb1:keys=7,expires=0,avg_ttl=0\r\n"
+
+func TestParseServerStats(t *testing.T) {
+	got := parseServerStats(testInfo)
+	want := ServerStats{
+		Version:        "7.2.4",
+		Keys:           42,
+		KeysWithTTL:    40,
+		UsedMemory:     1 << 20,
+		UsedMemoryPeak: 2 << 20,
+		EvictedKeys:    3,
+		ExpiredKeys:    12,
+		KeyspaceHits:   75,
+		KeyspaceMisses: 25,
+		HitRatio:       0.75,
+	}
+	if got != want {
+		t.Fatalf("parseServerStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{
+		{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin}},
+		{Name: "writer", Token: "write-token", Scopes: []string{scopeRead, scopeWrite}},
+	}}
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := &statsFakeStore{fakeStore: newFakeStore(), server: parseServerStats(testInfo)}
+	service := newCacheService(config, store)
+	router := newRouter(service)
+
+	writer := map[string]string{"Authorization": "Bearer write-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"items:1","value":"small","ttl":"30"}`, writer), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"items:2","value":"small","ttl":"7200"}`, writer), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/ns/tenant/cache", `{"key":"users:1","value":"x","ttl":"600"}`, writer), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=items:1", "", writer), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=missing", "", writer), http.StatusNotFound)
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/stats", ""), http.StatusUnauthorized)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/stats", "", writer), http.StatusForbidden)
+
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/stats", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q", got)
+	}
+	var report statsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+
+	if report.Service.Hits != 1 || report.Service.Misses != 1 || report.Service.Writes != 3 || report.Service.HitRatio != 0.5 {
+		t.Fatalf("service stats = %+v", report.Service)
+	}
+	if report.Redis == nil || report.Redis.Keys != 42 || report.Redis.EvictedKeys != 3 {
+		t.Fatalf("redis stats = %+v", report.Redis)
+	}
+	sample := report.Sample
+	if sample == nil || sample.Keys != 3 {
+		t.Fatalf("sample = %+v", sample)
+	}
+	if sample.ValueSizes[0] != (statsBucket{Le: "1KiB", Count: 3}) {
+		t.Fatalf("value sizes = %+v", sample.ValueSizes)
+	}
+	wantTTLs := []int{1, 0, 1, 1, 0, 0}
+	for i, want := range wantTTLs {
+		if sample.TTLs[i].Count != want {
+			t.Fatalf("ttls = %+v, want counts %v", sample.TTLs, wantTTLs)
+		}
+	}
+	top := sample.TopPrefixesByCount[0]
+	if top != (prefixStats{Namespace: defaultNamespace, Prefix: "items:", Keys: 2, Bytes: 210}) {
+		t.Fatalf("top prefix by count = %+v", top)
+	}
+	if len(sample.TopPrefixesByBytes) != 2 || sample.TopPrefixesByBytes[1].Namespace != "tenant" {
+		t.Fatalf("top prefixes by bytes = %+v", sample.TopPrefixesByBytes)
+	}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/admin/stats", "", admin), http.StatusOK)
+	if store.builds != 1 {
+		t.Fatalf("report was built %d times, want it cached after the first", store.builds)
+	}
+}
+
+func TestStatsCacheExpiresAndReportsErrors(t *testing.T) {
+	store := &statsFakeStore{fakeStore: newFakeStore(), serverErr: errors.New("redis down")}
+	s := newStats(StatsConfig{CacheTTL: 1}, store, newNamespaces(nil, store, nil))
+
+	report := s.get(context.Background())
+	if report.Redis != nil || len(report.Errors) != 1 || report.Sample == nil {
+		t.Fatalf("report = %+v", report)
+	}
+	time.Sleep(2 * time.Millisecond)
+	s.get(context.Background())
+	if store.builds != 2 {
+		t.Fatalf("report was built %d times, want 2", store.builds)
+	}
+}
+
+func TestStatsWithoutStatsStore(t *testing.T) {
+	s := newStats(StatsConfig{}, newFakeStore(), newNamespaces(nil, newFakeStore(), nil))
+	report := s.get(context.Background())
+	if report.Redis != nil || report.Sample != nil || len(report.Errors) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	for key, want := range map[string]string{"items:1": "items:", "a:b:c": "a:", "plain": ""} {
+		if got := keyPrefix(key); got != want {
+			t.Fatalf("keyPrefix(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestStatsConfigValidation(t *testing.T) {
+	for _, config := range []StatsConfig{{CacheTTL: -1}, {SampleSize: -1}, {SampleSize: maxStatsSampleSize + 1}} {
+		if err := config.validate(); err == nil {
+			t.Fatalf("validate(%+v) succeeded", config)
+		}
+	}
+	if err := (&StatsConfig{CacheTTL: 500, SampleSize: 100}).validate(); err != nil {
+		t.Fatalf("validate() error: %v", err)
+	}
+}
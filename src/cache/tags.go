@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	tagKeyPrefix = internalKeyPrefix + "tag:"
+	tagsHeader   = "X-Cache-Tags"
+	maxItemTags  = 16
+)
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,128}$`)
+
+// TagStore is implemented by stores that can index keys by tag, which is
+// what invalidating a tag needs. Writes still record their tags without it.
+type TagStore interface {
+	// TagKey adds key to every index in indexes and keeps each index alive
+	// for at least ttl.
+	TagKey(ctx context.Context, indexes []string, key string, ttl time.Duration) error
+	// PopTagged removes and returns up to count keys from index.
+	PopTagged(ctx context.Context, index string, count int64) ([]string, error)
+}
+
+// tagKeyScript adds ARGV[1] to every set in KEYS and extends the TTL of each
+// set to ARGV[2] milliseconds when it would otherwise expire sooner.
+var tagKeyScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+for _, index in ipairs(KEYS) do
+  redis.call('SADD', index, ARGV[1])
+  if redis.call('PTTL', index) < ttl then
+    redis.call('PEXPIRE', index, ttl)
+  end
+end
+return 1
+`)
+
+func (rs *RedisStore) TagKey(ctx context.Context, indexes []string, key string, ttl time.Duration) error {
+	return tagKeyScript.Run(ctx, rs.client, indexes, key, ttl.Milliseconds()).Err()
+}
+
+func (rs *RedisStore) PopTagged(ctx context.Context, index string, count int64) ([]string, error) {
+	keys, err := rs.client.SPopN(ctx, index, count).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// parseTags validates the tags of a write and drops duplicates.
+func parseTags(raw []string) ([]string, error) {
+	var tags []string
+	for _, tag := range raw {
+		tag = strings.TrimSpace(tag)
+		if !validTag.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q must match %s", tag, validTag)
+		}
+		if !containsString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxItemTags {
+		return nil, fmt.Errorf("an entry may have at most %d tags", maxItemTags)
+	}
+	return tags, nil
+}
+
+// headerTags reads the comma-separated tags of a raw write.
+func headerTags(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	return parseTags(strings.Split(raw, ","))
+}
+
+// tagIndex keeps the per-namespace sets of keys written with each tag. The
+// sets are not updated when a key is rewritten or deleted, so readers check
+// the tags stored with the entry itself.
+type tagIndex struct {
+	store   TagStore
+	breaker *breakerStore
+}
+
+func newTagIndex(store CacheStore, breaker *breakerStore) *tagIndex {
+	t := &tagIndex{breaker: breaker}
+	if tagStore, ok := store.(TagStore); ok {
+		t.store = tagStore
+	}
+	return t
+}
+
+func tagIndexKey(ns *namespace, tag string) string {
+	return tagKeyPrefix + ns.name + ":" + tag
+}
+
+// add indexes key under its tags after a write. Like namespace accounting it
+// is best effort: failures are logged, and nothing is indexed while the
+// breaker is open.
+func (t *tagIndex) add(ctx context.Context, ns *namespace, key string, tags []string, ttl time.Duration) {
+	if len(tags) == 0 || t.store == nil || !t.breaker.allow() {
+		return
+	}
+	indexes := make([]string, len(tags))
+	for i, tag := range tags {
+		indexes[i] = tagIndexKey(ns, tag)
+	}
+	if err := t.store.TagKey(ctx, indexes, key, ttl); err != nil {
+		log.Printf("Redis tag error: %v", err)
+	}
+}
+
+// invalidateTag deletes every key of ns that still carries tag, one batch of
+// the index at a time. It returns how many keys it deleted, even on error.
+// Keys tagged while it runs are deleted too.
+func (cs *CacheService) invalidateTag(ctx context.Context, ns *namespace, tag string) (int64, error) {
+	var deleted int64
+	for {
+		if !cs.tags.breaker.allow() {
+			return deleted, errStoreUnavailable
+		}
+		popCtx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+		keys, err := cs.tags.store.PopTagged(popCtx, tagIndexKey(ns, tag), invalidatePageSize)
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		for _, key := range keys {
+			item, err := cs.read(withPrimaryReads(ctx), ns, key, 0)
+			if errors.Is(err, errCacheMiss) || (err == nil && !containsString(item.Tags, tag)) {
+				continue
+			}
+			if err != nil {
+				return deleted, err
+			}
+			removed, err := cs.deleteKey(ctx, ns, key)
+			if err != nil {
+				return deleted, err
+			}
+			if removed {
+				deleted++
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type tagFakeStore struct {
+	*fakeStore
+	indexes map[string]map[string]bool
+}
+
+func newTagFakeStore() *tagFakeStore {
+	return &tagFakeStore{fakeStore: newFakeStore(), indexes: make(map[string]map[string]bool)}
+}
+
+func (s *tagFakeStore) TagKey(_ context.Context, indexes []string, key string, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, index := range indexes {
+		if s.indexes[index] == nil {
+			s.indexes[index] = make(map[string]bool)
+		}
+		s.indexes[index][key] = true
+	}
+	return nil
+}
+
+func (s *tagFakeStore) PopTagged(_ context.Context, index string, count int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.indexes[index] {
+		if int64(len(keys)) == count {
+			break
+		}
+		keys = append(keys, key)
+		delete(s.indexes[index], key)
+	}
+	return keys, nil
+}
+
+func TestTagInvalidation(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := newTagFakeStore()
+	service := newCacheService(config, store)
+	router := newRouter(service)
+	var events []CacheEvent
+	service.events.addSink(func(event CacheEvent) { events = append(events, event) })
+
+	put := func(path, tags string) {
+		t.Helper()
+		headers := map[string]string{"Content-Type": "text/plain"}
+		if tags != "" {
+			headers[tagsHeader] = tags
+		}
+		requireStatus(t, serveWithHeaders(router, http.MethodPut, path, "v", headers), http.StatusOK)
+	}
+	put("/v2/cache/a", "products, prices")
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"b","value":"v","tags":["products"]}`), http.StatusOK)
+	put("/v2/cache/c", "prices")
+	put("/v2/cache/d", "products")
+	put("/v2/cache/d", "")
+	put("/v2/ns/tenant/cache/e", "products")
+	if got := store.items["a"].Tags; len(got) != 2 || got[0] != "products" || got[1] != "prices" {
+		t.Fatalf("stored tags = %q", got)
+	}
+	events = nil
+
+	w := serve(router, http.MethodDelete, "/v2/cache?tag=products", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"namespace":"default","tag":"products","deleted":2}`)
+	for key, want := range map[string]bool{"a": false, "b": false, "c": true, "d": true, namespaceKeyPrefix + "tenant:e": true} {
+		if _, ok := store.items[key]; ok != want {
+			t.Fatalf("%s present = %v, want %v", key, ok, want)
+		}
+	}
+	if len(events) != 1 || events[0].Op != eventInvalidate || events[0].Tag != "products" || events[0].Count != 2 || events[0].Prefix != "" {
+		t.Fatalf("events = %+v, want one tag invalidate event", events)
+	}
+
+	w = serve(router, http.MethodDelete, "/v2/ns/tenant/cache?tag=products", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"namespace":"tenant","tag":"products","deleted":1}`)
+}
+
+func TestTagValidation(t *testing.T) {
+	router := newRouter(newCacheService(testConfig(), newTagFakeStore()))
+
+	for _, tags := range []string{"has space", "a,,b", "ü"} {
+		w := serveWithHeaders(router, http.MethodPut, "/v2/cache/k", "v", map[string]string{tagsHeader: tags})
+		requireStatus(t, w, http.StatusBadRequest)
+		requireJSONField(t, w, "error", "invalid tags")
+	}
+	w := serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"v","tags":["a","b","c","d","e","f","g","h","i","j","k","l","m","n","o","p","q"]}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "details", "an entry may have at most 16 tags")
+
+	tags, err := parseTags([]string{"a", " a", "b"})
+	if err != nil || len(tags) != 2 {
+		t.Fatalf("parseTags = %q, %v, want duplicates dropped", tags, err)
+	}
+
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache?tag=a&prefix=b", ""), http.StatusBadRequest)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache?tag=has%20space", ""), http.StatusBadRequest)
+	requireStatus(t, serve(testRouter(newFakeStore()), http.MethodDelete, "/v2/cache?tag=a", ""), http.StatusNotImplemented)
+}
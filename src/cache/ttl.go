@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// TTL update modes accepted by CacheStore.UpdateTTL.
+const (
+	ttlModeSet    = "set"
+	ttlModeExtend = "extend"
+	ttlModeCap    = "cap"
+)
+
+// TTLUpdate changes the lifetime of an entry without touching its value.
+// Set replaces the TTL, extend adds to the remaining TTL and cap only ever
+// shortens it. The resulting TTL never exceeds Max.
+type TTLUpdate struct {
+	Mode string
+	TTL  time.Duration
+	Max  time.Duration
+}
+
+func validTTLMode(mode string) bool {
+	switch mode {
+	case ttlModeSet, ttlModeExtend, ttlModeCap:
+		return true
+	}
+	return false
+}
+
+// rescoreUsageScript defines rescore, which moves the expiry of member in the
+// namespace accounting when a TTL script is given the accounting sorted set
+// as KEYS[2]. Members the namespace does not account for are left alone.
+const rescoreUsageScript = `
+local function rescore(member, ttl)
+  if KEYS[2] == nil then
+    return
+  end
+  local time = redis.call('TIME')
+  local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+  redis.call('ZADD', KEYS[2], 'XX', now + ttl, member)
+end
+`
+
+// updateTTLScript applies a TTLUpdate atomically. ARGV is the mode, the TTL
+// and the maximum TTL, both in milliseconds, and optionally the accounting
+// member. It returns the new TTL in milliseconds, or -2 when the key does not
+// exist. The new TTL also becomes the lifetime sliding reads extend the entry
+// to; a cap lowers it to the cap.
+var updateTTLScript = redis.NewScript(rescoreUsageScript + `
+local current = redis.call('PTTL', KEYS[1])
+if current == -2 then
+  return -2
+end
+local mode = ARGV[1]
+local ttl = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+local hash = redis.call('TYPE', KEYS[1]).ok == 'hash'
+if mode == 'extend' and current > 0 then
+  ttl = current + ttl
+elseif mode == 'cap' and current > 0 and current <= ttl then
+  if hash and (tonumber(redis.call('HGET', KEYS[1], 'ttl')) or 0) > ttl then
+    redis.call('HSET', KEYS[1], 'ttl', ttl)
+  end
+  return current
+end
+if max > 0 and ttl > max then
+  ttl = max
+end
+redis.call('PEXPIRE', KEYS[1], ttl)
+if hash then
+  redis.call('HSET', KEYS[1], 'ttl', ttl)
+end
+rescore(ARGV[4], ttl)
+return ttl
+`)
+
+// touchScript slides the expiry of a read entry. It resets the TTL to the
+// lifetime the entry was last given, or to ARGV[1] milliseconds for entries
+// written before lifetimes were recorded, but never shortens it and never
+// adds an expiry to a key without one. ARGV[2] is the optional accounting
+// member.
+var touchScript = redis.NewScript(rescoreUsageScript + `
+local ttl = tonumber(ARGV[1])
+if redis.call('TYPE', KEYS[1]).ok == 'hash' then
+  ttl = tonumber(redis.call('HGET', KEYS[1], 'ttl')) or ttl
+end
+local current = redis.call('PTTL', KEYS[1])
+if current >= 0 and current < ttl then
+  redis.call('PEXPIRE', KEYS[1], ttl)
+  rescore(ARGV[2], ttl)
+end
+return current
+`)
+
+func (rs *RedisStore) UpdateTTL(ctx context.Context, key string, update TTLUpdate) (time.Duration, error) {
+	if update.TTL <= 0 {
+		return 0, fmt.Errorf("ttl must be greater than zero")
+	}
+	if !validTTLMode(update.Mode) {
+		return 0, fmt.Errorf("unknown ttl mode %q", update.Mode)
+	}
+
+	keys, args := usageScriptArgs(ctx, []string{key}, update.Mode, update.TTL.Milliseconds(), update.Max.Milliseconds())
+	ms, err := updateTTLScript.Run(ctx, rs.client, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if ms < 0 {
+		return 0, errCacheMiss
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// GetAndTouch reads key like Get and slides its TTL in the same round trip.
+// ttl is the lifetime to slide to for entries that have none recorded.
+func (rs *RedisStore) GetAndTouch(ctx context.Context, key string, ttl time.Duration) (CacheItem, error) {
+	if ttl <= 0 {
+		return CacheItem{}, fmt.Errorf("ttl must be greater than zero")
+	}
+	return rs.get(ctx, rs.client, key, ttl)
+}
+
+// updateTTL resolves the requested TTL change against the namespace limits.
+// Set mode is validated like a write; extend and cap are clamped to the
+// namespace maximum instead of rejected.
+func (cs *CacheService) updateTTL(ns *namespace, mode, rawTTL string) (TTLUpdate, error) {
+	if mode == "" {
+		mode = ttlModeSet
+	}
+	if !validTTLMode(mode) {
+		return TTLUpdate{}, fmt.Errorf("mode must be one of %s, %s or %s", ttlModeSet, ttlModeExtend, ttlModeCap)
+	}
+
+	update := TTLUpdate{Mode: mode, Max: time.Duration(maxTTLSeconds) * time.Second}
+	if ns.maxTTL > 0 {
+		update.Max = time.Duration(ns.maxTTL) * time.Second
+	}
+
+	var err error
+	if mode == ttlModeSet {
+		update.TTL, err = cs.namespaceTTL(ns, rawTTL)
+	} else {
+		update.TTL, err = cs.cacheTTL(rawTTL)
+	}
+	return update, err
+}
+
+// slidingTTL reports the TTL a read should reset its entry to when the
+// entry has no lifetime of its own, or zero when the read should leave the
+// TTL alone. Sliding expiration is on for every
+// read in a namespace with sliding_ttl set, and per request with ?sliding=1.
+func (cs *CacheService) slidingTTL(r *http.Request, ns *namespace) (time.Duration, error) {
+	sliding := ns.slidingTTL
+	if raw := r.URL.Query().Get("sliding"); raw != "" {
+		var err error
+		sliding, err = strconv.ParseBool(raw)
+		if err != nil {
+			return 0, errors.New("sliding must be a boolean")
+		}
+	}
+	if !sliding {
+		return 0, nil
+	}
+	return cs.namespaceTTL(ns, "")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPatchTTLModes(t *testing.T) {
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "v", TTL: time.Minute}
+	router := testRouter(store)
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{body: `{"ttl":"30","mode":"extend"}`, want: "90"},
+		{body: `{"ttl":"120","mode":"cap"}`, want: "90"},
+		{body: `{"ttl":"45","mode":"cap"}`, want: "45"},
+		{body: `{"ttl":"10","mode":"set"}`, want: "10"},
+		{body: `{"ttl":"20"}`, want: "20"},
+	}
+	for _, tt := range tests {
+		w := serve(router, http.MethodPatch, "/v2/cache/key", tt.body)
+		requireStatus(t, w, http.StatusOK)
+		requireBody(t, w, `{"ttl":`+tt.want+`}`)
+		if got := w.Header().Get("X-CACHE-TTL"); got != tt.want {
+			t.Fatalf("%s: X-CACHE-TTL = %q, want %s", tt.body, got, tt.want)
+		}
+	}
+
+	w := serve(router, http.MethodPatch, "/v2/cache/key", `{"ttl":"10","mode":"persist"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "mode must be one of set, extend or cap")
+}
+
+func TestPatchTTLNamespaceMax(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant", MaxTTL: 100}}
+	store := newFakeStore()
+	store.items[namespaceKeyPrefix+"tenant:key"] = CacheItem{Value: "v", TTL: 80 * time.Second}
+	router := newRouter(newCacheService(config, store))
+
+	w := serve(router, http.MethodPatch, "/v2/ns/tenant/cache/key", `{"ttl":"60","mode":"extend"}`)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"ttl":100}`)
+
+	w = serve(router, http.MethodPatch, "/v2/ns/tenant/cache/key", `{"ttl":"101"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "ttl must not exceed 100 seconds")
+}
+
+func TestTTLChangesMoveNamespaceUsage(t *testing.T) {
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(namespaceTestConfig(), store))
+	tenant := map[string]string{"Authorization": "Bearer tenant-token"}
+
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"a","value":"v","ttl":"1"}`, tenant), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"b","value":"v","ttl":"10"}`, tenant), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodPatch, "/v2/cache/a", `{"ttl":"60","mode":"extend"}`, tenant), http.StatusOK)
+
+	store.advance(8 * time.Second)
+	requireStatus(t, serveWithHeaders(router, http.MethodGet, "/api/cache?key=b&sliding=1", "", tenant), http.StatusOK)
+	store.advance(5 * time.Second)
+
+	usage, err := store.Usage(context.Background(), "tenant")
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if usage.Keys != 2 || usage.Bytes != 4 {
+		t.Fatalf("usage after the original TTLs passed = %+v, want both keys", usage)
+	}
+
+	store.advance(time.Minute)
+	usage, _ = store.Usage(context.Background(), "tenant")
+	if usage.Keys != 0 || usage.Bytes != 0 {
+		t.Fatalf("usage after the new TTLs passed = %+v, want none", usage)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "v", TTL: 5 * time.Second}
+	router := testRouter(store)
+
+	w := serve(router, http.MethodGet, "/api/cache?key=key", "")
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-CACHE-TTL"); got != "5" {
+		t.Fatalf("X-CACHE-TTL = %q, want 5", got)
+	}
+
+	w = serve(router, http.MethodGet, "/api/cache?key=key&sliding=1", "")
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-CACHE-TTL"); got != "300" {
+		t.Fatalf("sliding X-CACHE-TTL = %q, want 300", got)
+	}
+	if got := store.items["key"].TTL; got != 300*time.Second {
+		t.Fatalf("ttl after sliding read = %s, want 300s", got)
+	}
+
+	w = serve(router, http.MethodGet, "/v2/cache/key?sliding=maybe", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "sliding must be a boolean")
+}
+
+func TestSlidingNeverShortens(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/long?ttl=3600", "v"), http.StatusOK)
+	slide := func(key string) time.Duration {
+		t.Helper()
+		requireStatus(t, serve(router, http.MethodGet, "/v2/cache/"+key+"?sliding=1", ""), http.StatusOK)
+		return store.items[key].TTL
+	}
+
+	// A long-lived entry slides back to the TTL it was written with, not
+	// to the default of 300 seconds.
+	store.items["long"] = CacheItem{Value: "v", TTL: 3000 * time.Second}
+	if got := slide("long"); got != time.Hour {
+		t.Fatalf("ttl after sliding read = %s, want 1h", got)
+	}
+
+	// A cap lowers the lifetime it slides to.
+	requireStatus(t, serve(router, http.MethodPatch, "/v2/cache/long", `{"ttl":"600","mode":"cap"}`), http.StatusOK)
+	store.items["long"] = CacheItem{Value: "v", TTL: 100 * time.Second}
+	if got := slide("long"); got != 600*time.Second {
+		t.Fatalf("ttl after capped sliding read = %s, want 600s", got)
+	}
+
+	// An entry without a recorded lifetime keeps a TTL above the default.
+	store.items["legacy"] = CacheItem{Value: "v", TTL: 1000 * time.Second}
+	if got := slide("legacy"); got != 1000*time.Second {
+		t.Fatalf("ttl after sliding read = %s, want 1000s", got)
+	}
+}
+
+func TestSlidingExpirationPolicy(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "sessions", DefaultTTL: 30, SlidingTTL: true}}
+	store := newFakeStore()
+	key := namespaceKeyPrefix + "sessions:key"
+	store.items[key] = CacheItem{Value: "v", TTL: time.Second}
+	router := newRouter(newCacheService(config, store))
+
+	requireStatus(t, serve(router, http.MethodGet, "/v2/ns/sessions/cache/key", ""), http.StatusOK)
+	if got := store.items[key].TTL; got != 30*time.Second {
+		t.Fatalf("ttl after policy read = %s, want 30s", got)
+	}
+
+	store.items[key] = CacheItem{Value: "v", TTL: time.Second}
+	requireStatus(t, serve(router, http.MethodGet, "/v2/ns/sessions/cache/key?sliding=false", ""), http.StatusOK)
+	if got := store.items[key].TTL; got != time.Second {
+		t.Fatalf("ttl after opted-out read = %s, want 1s", got)
+	}
+}
+
+func TestRedisStoreRejectsInvalidTTLUpdate(t *testing.T) {
+	store := NewRedisStore(testConfig())
+	defer store.Close()
+
+	if _, err := store.UpdateTTL(context.Background(), "key", TTLUpdate{Mode: ttlModeSet}); err == nil {
+		t.Fatal("UpdateTTL accepted a zero ttl")
+	}
+	if _, err := store.UpdateTTL(context.Background(), "key", TTLUpdate{Mode: "persist", TTL: time.Second}); err == nil {
+		t.Fatal("UpdateTTL accepted an unknown mode")
+	}
+	if _, err := store.GetAndTouch(context.Background(), "key", 0); err == nil {
+		t.Fatal("GetAndTouch accepted a zero ttl")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type ttlPatchBody struct {
+	TTL  string `json:"ttl"`
+	Mode string `json:"mode"`
+}
+
+// DeleteCache removes the key in the path. It answers 204 when the key
+// existed and 404 when it did not.
+func (cs *CacheService) DeleteCache(w http.ResponseWriter, r *http.Request) {
+	ns := cs.requestNamespace(r)
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+	noteCapture(r, captureDelete, ns, key, 0, 0)
+
+	ctx, cancel := context.WithTimeout(r.Context(), writeOpTimeout)
+	defer cancel()
+
+	deleted, err := cs.store.Delete(ctx, ns.key(key))
+	if err != nil {
+		writeStoreError(w, "Redis delete error", err)
+		return
+	}
+	if !deleted {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+		return
+	}
+	cs.noteWrite(r)
+	cs.namespaces.release(ctx, ns, key)
+	cs.events.publish(CacheEvent{Op: eventDelete, Namespace: ns.name, Key: key})
+
+	writeNoStore(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PatchTTL changes the TTL of the key in the path without rewriting its
+// value. The body has the same string ttl field as the JSON envelope and an
+// optional mode of set, extend or cap. The response reports the new TTL.
+func (cs *CacheService) PatchTTL(w http.ResponseWriter, r *http.Request) {
+	ns := cs.requestNamespace(r)
+	key := r.PathValue("key")
+	if !cs.checkKey(w, ns, key) {
+		return
+	}
+
+	var requestBody ttlPatchBody
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if requestBody.TTL == "" {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid request body", "details": "ttl is required"})
+		return
+	}
+	update, err := cs.updateTTL(ns, requestBody.Mode, requestBody.TTL)
+	if err != nil {
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	noteCapture(r, captureTTL, ns, key, 0, update.TTL)
+
+	ctx, cancel := context.WithTimeout(r.Context(), writeOpTimeout)
+	defer cancel()
+
+	ttl, err := cs.store.UpdateTTL(cs.namespaces.withUsageMember(ctx, ns, key), ns.key(key), update)
+	if errors.Is(err, errCacheMiss) {
+		writeCacheError(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+		return
+	}
+	if err != nil {
+		writeStoreError(w, "Redis ttl update error", err)
+		return
+	}
+
+	cs.noteWrite(r)
+	ttlSeconds := int(ttl.Seconds())
+	cs.events.publish(CacheEvent{Op: eventTTL, Namespace: ns.name, Key: key, TTL: int64(ttlSeconds)})
+	writeNoStore(w)
+	w.Header().Set("X-CACHE-TTL", strconv.Itoa(ttlSeconds))
+	writeJSON(w, http.StatusOK, map[string]int{"ttl": ttlSeconds})
+}
+
+// invalidatePageSize is the SCAN count, or the number of tagged keys, taken
+// at a time while invalidating.
+const invalidatePageSize = 500
+
+type invalidateResponse struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+	Deleted   int64  `json:"deleted"`
+}
+
+// Invalidate removes every key of the request namespace that starts with the
+// prefix parameter, or that was written with the tag parameter, and
+// publishes one invalidate event for them rather than a delete event per
+// key. Keys written while the scan runs may survive a prefix invalidation.
+func (cs *CacheService) Invalidate(w http.ResponseWriter, r *http.Request) {
+	ns := cs.requestNamespace(r)
+	prefix := r.URL.Query().Get("prefix")
+	tag := r.URL.Query().Get("tag")
+	switch {
+	case prefix == "" && tag == "":
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "prefix or tag is required"})
+		return
+	case prefix != "" && tag != "":
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "use either prefix or tag, not both"})
+		return
+	case tag != "" && !validTag.MatchString(tag):
+		writeCacheError(w, http.StatusBadRequest, map[string]string{"error": "invalid tag", "details": fmt.Sprintf("tag must match %s", validTag)})
+		return
+	case prefix != "" && !cs.checkKey(w, ns, prefix):
+		return
+	}
+
+	var deleted int64
+	var err error
+	if tag != "" {
+		if cs.tags.store == nil {
+			writeCacheError(w, http.StatusNotImplemented, map[string]string{"error": "tag invalidation is not supported by this store"})
+			return
+		}
+		deleted, err = cs.invalidateTag(r.Context(), ns, tag)
+	} else {
+		inspector, ok := unwrapStore(cs.store).(KeyInspector)
+		if !ok {
+			writeCacheError(w, http.StatusNotImplemented, map[string]string{"error": "invalidation is not supported by this store"})
+			return
+		}
+		deleted, err = cs.invalidate(r.Context(), inspector, ns, prefix)
+	}
+	if err == nil || deleted > 0 {
+		cs.noteWrite(r)
+		cs.events.publish(CacheEvent{Op: eventInvalidate, Namespace: ns.name, Prefix: prefix, Tag: tag, Count: deleted})
+	}
+	if err != nil {
+		writeStoreError(w, "Redis invalidate error", err)
+		return
+	}
+	writeNoStore(w)
+	writeJSON(w, http.StatusOK, invalidateResponse{Namespace: ns.name, Prefix: prefix, Tag: tag, Deleted: deleted})
+}
+
+// invalidate scans ns for keys starting with prefix and deletes them, one
+// SCAN page at a time. It returns how many keys it deleted, even on error.
+func (cs *CacheService) invalidate(ctx context.Context, inspector KeyInspector, ns *namespace, prefix string) (int64, error) {
+	match := escapeGlob(ns.prefix) + escapeGlob(prefix) + "*"
+	var deleted int64
+	var cursor uint64
+	for {
+		scanCtx, cancel := context.WithTimeout(ctx, readOpTimeout)
+		storeKeys, next, err := inspector.ScanKeys(scanCtx, match, cursor, invalidatePageSize)
+		cancel()
+		if err != nil {
+			return deleted, err
+		}
+		for _, storeKey := range storeKeys {
+			// The default namespace has no prefix, so its scan also sees
+			// other namespaces' keys.
+			if keyNS, key, ok := cs.namespaces.split(storeKey); ok && keyNS == ns {
+				removed, err := cs.deleteKey(ctx, ns, key)
+				if err != nil {
+					return deleted, err
+				}
+				if removed {
+					deleted++
+				}
+			}
+		}
+		if next == 0 {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+func (cs *CacheService) deleteKey(ctx context.Context, ns *namespace, key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+
+	removed, err := cs.store.Delete(ctx, ns.key(key))
+	if removed {
+		cs.namespaces.release(ctx, ns, key)
+	}
+	return removed, err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestV2CacheResource(t *testing.T) {
+	store := newFakeStore()
+	router := testRouter(store)
+	key := "/v2/cache/query%2F%7Bitems%7D%20en"
+
+	w := serveRaw(router, http.MethodPut, key+"?ttl=60", "application/json", []byte(`{"data":{}}`))
+	requireStatus(t, w, http.StatusOK)
+	if _, ok := store.items["query/{items} en"]; !ok {
+		t.Fatalf("key was not URL-decoded: %v", store.items)
+	}
+
+	w = serveRaw(router, http.MethodGet, key, "", nil)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"data":{}}`)
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", got)
+	}
+
+	w = serveRaw(router, http.MethodHead, key, "", nil)
+	requireStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("X-CACHE-TTL"); got != "60" {
+		t.Fatalf("X-CACHE-TTL = %q, want 60", got)
+	}
+
+	w = serve(router, http.MethodPatch, key, `{"ttl":"600"}`)
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"ttl":600}`)
+	if got := store.items["query/{items} en"].TTL; got != 600*time.Second {
+		t.Fatalf("ttl after PATCH = %s, want 600s", got)
+	}
+
+	w = serveRaw(router, http.MethodDelete, key, "", nil)
+	requireStatus(t, w, http.StatusNoContent)
+	if _, ok := store.items["query/{items} en"]; ok {
+		t.Fatal("key still present after DELETE")
+	}
+
+	requireStatus(t, serveRaw(router, http.MethodGet, key, "", nil), http.StatusNotFound)
+	requireStatus(t, serveRaw(router, http.MethodDelete, key, "", nil), http.StatusNotFound)
+	requireStatus(t, serve(router, http.MethodPatch, key, `{"ttl":"60"}`), http.StatusNotFound)
+}
+
+func TestV2PatchTTLErrors(t *testing.T) {
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "v", TTL: time.Minute}
+	router := testRouter(store)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		errMsg string
+	}{
+		{name: "missing ttl", body: `{}`, status: http.StatusBadRequest, errMsg: "invalid request body"},
+		{name: "invalid json", body: `nope`, status: http.StatusBadRequest, errMsg: "invalid request body"},
+		{name: "invalid ttl", body: `{"ttl":"x"}`, status: http.StatusBadRequest, errMsg: "ttl must be a string representation of an integer"},
+		{name: "zero ttl", body: `{"ttl":"0"}`, status: http.StatusBadRequest, errMsg: "ttl must be greater than zero"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(router, http.MethodPatch, "/v2/cache/key", tt.body)
+			requireStatus(t, w, tt.status)
+			requireJSONField(t, w, "error", tt.errMsg)
+		})
+	}
+
+	store.setErr = errors.New("redis failed")
+	requireStatus(t, serve(router, http.MethodPatch, "/v2/cache/key", `{"ttl":"60"}`), http.StatusInternalServerError)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache/key", ""), http.StatusInternalServerError)
+}
+
+func TestV2Auth(t *testing.T) {
+	config := authTestConfig()
+	config.Auth.Tokens = append(config.Auth.Tokens, TokenConfig{Name: "deleter", Token: "delete-token", Scopes: []string{scopeDelete}})
+	store := newFakeStore()
+	store.items["key"] = CacheItem{Value: "v", TTL: time.Minute}
+	router := newRouter(newCacheService(config, store))
+
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/key", ""), http.StatusOK)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache/key", ""), http.StatusUnauthorized)
+
+	writer := map[string]string{"Authorization": "Bearer writer-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodDelete, "/v2/cache/key", "", writer), http.StatusForbidden)
+	requireStatus(t, serveWithHeaders(router, http.MethodPatch, "/v2/cache/key", `{"ttl":"60"}`, writer), http.StatusOK)
+
+	deleter := map[string]string{"Authorization": "Bearer delete-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodDelete, "/v2/cache/key", "", deleter), http.StatusNoContent)
+}
+
+func TestV2NamespaceRoutes(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant", MaxTTL: 100}}
+	store := newUsageFakeStore()
+	router := newRouter(newCacheService(config, store))
+
+	requireStatus(t, serveRaw(router, http.MethodPut, "/v2/ns/tenant/cache/key?ttl=50", "text/plain", []byte("v")), http.StatusOK)
+	if got := store.sizes["tenant"]["key"]; got != 4 {
+		t.Fatalf("tracked size = %d, want 4", got)
+	}
+
+	w := serve(router, http.MethodPatch, "/v2/ns/tenant/cache/key", `{"ttl":"101"}`)
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "ttl must not exceed 100 seconds")
+
+	requireStatus(t, serveRaw(router, http.MethodDelete, "/v2/ns/tenant/cache/key", "", nil), http.StatusNoContent)
+	if _, ok := store.sizes["tenant"]["key"]; ok {
+		t.Fatal("deleted key is still tracked")
+	}
+}
+
+func TestV2UnsupportedMethod(t *testing.T) {
+	w := serve(testRouter(newFakeStore()), http.MethodPost, "/v2/cache/key", `{}`)
+	requireStatus(t, w, http.StatusMethodNotAllowed)
+}
+
+func TestLegacyCacheRouteUnchanged(t *testing.T) {
+	router := testRouter(newFakeStore())
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPatch} {
+		w := serve(router, method, "/api/cache", "")
+		requireStatus(t, w, http.StatusNotFound)
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Fatalf("%s Cache-Control = %q, want no-store", method, got)
+		}
+	}
+}
+
+func TestV2InvalidatePrefix(t *testing.T) {
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	store := &inspectFakeStore{fakeStore: newFakeStore()}
+	service := newCacheService(config, store)
+	router := newRouter(service)
+	var events []CacheEvent
+	service.events.addSink(func(event CacheEvent) { events = append(events, event) })
+
+	for _, path := range []string{"/v2/cache/items:1", "/v2/cache/items:2", "/v2/cache/users:1", "/v2/ns/tenant/cache/items:3"} {
+		requireStatus(t, serveRaw(router, http.MethodPut, path, "text/plain", []byte("v")), http.StatusOK)
+	}
+	events = nil
+
+	w := serve(router, http.MethodDelete, "/v2/cache?prefix=items:", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"namespace":"default","prefix":"items:","deleted":2}`)
+	for key, want := range map[string]bool{"items:1": false, "items:2": false, "users:1": true, namespaceKeyPrefix + "tenant:items:3": true} {
+		if _, ok := store.items[key]; ok != want {
+			t.Fatalf("%s present = %v, want %v", key, ok, want)
+		}
+	}
+	if len(events) != 1 || events[0].Op != eventInvalidate || events[0].Prefix != "items:" || events[0].Count != 2 || events[0].Namespace != defaultNamespace {
+		t.Fatalf("events = %+v, want one invalidate event", events)
+	}
+
+	w = serve(router, http.MethodDelete, "/v2/ns/tenant/cache?prefix=items:", "")
+	requireStatus(t, w, http.StatusOK)
+	requireBody(t, w, `{"namespace":"tenant","prefix":"items:","deleted":1}`)
+
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache", ""), http.StatusBadRequest)
+	requireStatus(t, serve(router, http.MethodDelete, "/v2/cache?prefix="+internalKeyPrefix, ""), http.StatusBadRequest)
+	requireStatus(t, serve(testRouter(newFakeStore()), http.MethodDelete, "/v2/cache?prefix=items:", ""), http.StatusNotImplemented)
+}
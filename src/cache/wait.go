@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxKeyWait = 10 * time.Second
+	defaultMaxWaiters = 1000
+
+	// keySetChannel carries the Redis key of every write so that waiters on
+	// other replicas wake up too.
+	keySetChannel = internalKeyPrefix + "set"
+)
+
+var (
+	errTooManyWaiters = errors.New("too many waiting requests")
+	errWaitDisabled   = errors.New("wait is not enabled")
+)
+
+// WaitConfig turns on GET requests that wait for a missing key to be set and
+// bounds them. Lease long polls share its notifications. While it is off,
+// writes and lease releases do not publish their keys. Zero values fall back
+// to the defaults above.
+type WaitConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxWait    int  `json:"max_wait_ms"`
+	MaxWaiters int  `json:"max_waiters"`
+}
+
+func (wc *WaitConfig) validate() error {
+	if wc.MaxWait < 0 || wc.MaxWaiters < 0 {
+		return fmt.Errorf("wait limits must not be negative")
+	}
+	return nil
+}
+
+// KeyNotifier is implemented by stores that can broadcast writes to every
+// service instance. Without it waiters are only woken by writes handled by
+// the same process.
+type KeyNotifier interface {
+	PublishSet(ctx context.Context, key string) error
+	// SubscribeSets delivers the keys published by PublishSet until ctx is
+	// done, then closes the channel.
+	SubscribeSets(ctx context.Context) <-chan string
+}
+
+func (rs *RedisStore) PublishSet(ctx context.Context, key string) error {
+	return rs.client.Publish(ctx, keySetChannel, key).Err()
+}
+
+func (rs *RedisStore) SubscribeSets(ctx context.Context) <-chan string {
+	keys := make(chan string, 64)
+	go func() {
+		defer close(keys)
+		// Subscribing dials Redis, so it happens here rather than in the
+		// caller. The subscription reconnects on its own after failures.
+		sub := rs.client.Subscribe(ctx, keySetChannel)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case keys <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return keys
+}
+
+// keyWaiters tracks requests waiting for keys to be set. Each waiter gets a
+// channel that is closed when its key is written.
+type keyWaiters struct {
+	enabled    bool
+	maxWait    time.Duration
+	maxWaiters int
+	notifier   KeyNotifier
+	breaker    *breakerStore
+	stop       context.CancelFunc
+
+	mu    sync.Mutex
+	byKey map[string]map[chan struct{}]struct{}
+	count int
+}
+
+func newKeyWaiters(config WaitConfig, store CacheStore, breaker *breakerStore) *keyWaiters {
+	kw := &keyWaiters{
+		enabled:    config.Enabled,
+		breaker:    breaker,
+		maxWait:    defaultMaxKeyWait,
+		maxWaiters: defaultMaxWaiters,
+		byKey:      make(map[string]map[chan struct{}]struct{}),
+		stop:       func() {},
+	}
+	if config.MaxWait > 0 {
+		kw.maxWait = time.Duration(config.MaxWait) * time.Millisecond
+	}
+	if config.MaxWaiters > 0 {
+		kw.maxWaiters = config.MaxWaiters
+	}
+	if notifier, ok := store.(KeyNotifier); ok && kw.enabled {
+		kw.notifier = notifier
+		ctx, cancel := context.WithCancel(context.Background())
+		kw.stop = cancel
+		go func() {
+			for key := range notifier.SubscribeSets(ctx) {
+				kw.wake(key)
+			}
+		}()
+	}
+	return kw
+}
+
+// add registers a waiter for key. The returned func must be called once the
+// caller stops waiting.
+func (kw *keyWaiters) add(key string) (<-chan struct{}, func(), error) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+
+	if kw.count >= kw.maxWaiters {
+		return nil, nil, errTooManyWaiters
+	}
+	ch := make(chan struct{})
+	if kw.byKey[key] == nil {
+		kw.byKey[key] = make(map[chan struct{}]struct{})
+	}
+	kw.byKey[key][ch] = struct{}{}
+	kw.count++
+	waitMetrics.Add("waiting", 1)
+
+	remove := func() {
+		kw.mu.Lock()
+		defer kw.mu.Unlock()
+		if _, ok := kw.byKey[key][ch]; !ok {
+			return
+		}
+		delete(kw.byKey[key], ch)
+		if len(kw.byKey[key]) == 0 {
+			delete(kw.byKey, key)
+		}
+		kw.count--
+		waitMetrics.Add("waiting", -1)
+	}
+	return ch, remove, nil
+}
+
+// wake releases every waiter on key.
+func (kw *keyWaiters) wake(key string) {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+
+	for ch := range kw.byKey[key] {
+		close(ch)
+		kw.count--
+		waitMetrics.Add("waiting", -1)
+		waitMetrics.Add("woken", 1)
+	}
+	delete(kw.byKey, key)
+}
+
+// notify wakes local waiters on key and tells the other instances about the
+// write. Publishing is best effort and skipped while the breaker is open;
+// their waiters still time out. It does nothing while waits are off.
+func (kw *keyWaiters) notify(ctx context.Context, key string) {
+	if !kw.enabled {
+		return
+	}
+	kw.wake(key)
+	if kw.notifier == nil || !kw.breaker.allow() {
+		return
+	}
+	if err := kw.notifier.PublishSet(ctx, key); err != nil {
+		log.Printf("Redis publish error: %v", err)
+	}
+}
+
+func (kw *keyWaiters) close() {
+	kw.stop()
+}
+
+// waitForKey blocks until key is written, wait elapses, the request is
+// cancelled or the server starts draining, and then reads the key again. It
+// reports a miss if the key was not set in time. Both reads go to the
+// primary, since the write they look for may not have reached the replicas
+// yet.
+func (cs *CacheService) waitForKey(w http.ResponseWriter, r *http.Request, ns *namespace, key string, touch, wait time.Duration) (CacheItem, error) {
+	woken, done, err := cs.waiters.add(ns.key(key))
+	if err != nil {
+		return CacheItem{}, err
+	}
+	defer done()
+
+	// The key may have been written between the first read and add.
+	ctx := withPrimaryReads(r.Context())
+	item, err := cs.read(ctx, ns, key, touch)
+	if !errors.Is(err, errCacheMiss) {
+		return item, err
+	}
+
+	// Waits may outlast the server write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + readOpTimeout))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-woken:
+		return cs.read(ctx, ns, key, touch)
+	case <-timer.C:
+		waitMetrics.Add("timed_out", 1)
+	case <-r.Context().Done():
+	case <-cs.stopping:
+	}
+	return CacheItem{}, errCacheMiss
+}
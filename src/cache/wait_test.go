@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifierFakeStore broadcasts published keys to every subscriber, standing
+// in for Redis pub/sub between service instances.
+type notifierFakeStore struct {
+	*fakeStore
+	subMu       sync.Mutex
+	subscribers []chan string
+	published   int
+}
+
+func (s *notifierFakeStore) PublishSet(_ context.Context, key string) error {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	s.published++
+	for _, sub := range s.subscribers {
+		sub <- key
+	}
+	return nil
+}
+
+func (s *notifierFakeStore) SubscribeSets(ctx context.Context) <-chan string {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	keys := make(chan string, 16)
+	s.subscribers = append(s.subscribers, keys)
+	return keys
+}
+
+func waitTestConfig() *Config {
+	config := testConfig()
+	config.Wait.Enabled = true
+	return config
+}
+
+func waitForWaiters(t *testing.T, kw *keyWaiters, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		kw.mu.Lock()
+		count := kw.count
+		kw.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("waiters never reached %d", n)
+}
+
+func serveAsync(handler http.Handler, method, path, body string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- serve(handler, method, path, body)
+	}()
+	return done
+}
+
+func TestWaitForKeyWokenBySet(t *testing.T) {
+	service := newCacheService(waitTestConfig(), newFakeStore())
+	router := newRouter(service)
+
+	done := serveAsync(router, http.MethodGet, "/api/cache?key=k&wait=5000", "")
+	waitForWaiters(t, service.waiters, 1)
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"filled"}`), http.StatusOK)
+
+	select {
+	case w := <-done:
+		requireStatus(t, w, http.StatusOK)
+		requireBody(t, w, `"filled"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting GET was not woken")
+	}
+	waitForWaiters(t, service.waiters, 0)
+}
+
+func TestWaitForKeyReadsPrimary(t *testing.T) {
+	store := &primaryRecordingStore{fakeStore: newFakeStore()}
+	service := newCacheService(waitTestConfig(), store)
+	router := newRouter(service)
+
+	done := serveAsync(router, http.MethodGet, "/v2/cache/k?wait=5000", "")
+	waitForWaiters(t, service.waiters, 1)
+	store.mu.Lock()
+	if want := []bool{false, true}; !slices.Equal(store.primary, want) {
+		t.Errorf("reads before waiting asked for the primary %v, want %v", store.primary, want)
+	}
+	store.primary = nil
+	store.mu.Unlock()
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/k", "filled"), http.StatusOK)
+	requireBody(t, <-done, "filled")
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !slices.Equal(store.primary, []bool{true}) {
+		t.Fatalf("read after waking asked for the primary %v, want [true]", store.primary)
+	}
+}
+
+func TestWaitForKeyAcrossInstances(t *testing.T) {
+	store := &notifierFakeStore{fakeStore: newFakeStore()}
+	writer := newCacheService(waitTestConfig(), store)
+	reader := newCacheService(waitTestConfig(), store)
+	defer writer.Close()
+	defer reader.Close()
+
+	done := serveAsync(newRouter(reader), http.MethodGet, "/v2/cache/k?wait=5000", "")
+	waitForWaiters(t, reader.waiters, 1)
+	requireStatus(t, serve(newRouter(writer), http.MethodPut, "/v2/cache/k", "filled"), http.StatusOK)
+
+	select {
+	case w := <-done:
+		requireStatus(t, w, http.StatusOK)
+		requireBody(t, w, "filled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiter on another instance was not woken")
+	}
+}
+
+func TestWaitForKeyTimeoutAndCancel(t *testing.T) {
+	service := newCacheService(waitTestConfig(), newFakeStore())
+	router := newRouter(service)
+
+	start := time.Now()
+	w := serve(router, http.MethodGet, "/api/cache?key=k&wait=20", "")
+	requireStatus(t, w, http.StatusNotFound)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("wait returned after %s, before the 20ms deadline", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/api/cache?key=k&wait=5000", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	returned := make(chan struct{})
+	go func() {
+		router.ServeHTTP(rec, req)
+		close(returned)
+	}()
+	waitForWaiters(t, service.waiters, 1)
+	cancel()
+	select {
+	case <-returned:
+		requireStatus(t, rec, http.StatusNotFound)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled request kept waiting")
+	}
+	waitForWaiters(t, service.waiters, 0)
+}
+
+func TestWaitForKeyLimits(t *testing.T) {
+	config := testConfig()
+	config.Wait = WaitConfig{Enabled: true, MaxWait: 1000, MaxWaiters: 1}
+	service := newCacheService(config, newFakeStore())
+	router := newRouter(service)
+
+	w := serve(router, http.MethodGet, "/api/cache?key=k&wait=1001", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "wait must not exceed 1000")
+
+	done := serveAsync(router, http.MethodGet, "/api/cache?key=k&wait=1000", "")
+	waitForWaiters(t, service.waiters, 1)
+
+	before := counterValue(rejectionMetrics, "waiters")
+	w = serve(router, http.MethodGet, "/api/cache?key=other&wait=1000", "")
+	requireStatus(t, w, http.StatusServiceUnavailable)
+	requireJSONField(t, w, "error", "too many waiting requests")
+	requireCounterDelta(t, rejectionMetrics, "waiters", before, 1)
+
+	requireStatus(t, serve(router, http.MethodPost, "/api/cache", `{"key":"k","value":"v"}`), http.StatusOK)
+	requireStatus(t, <-done, http.StatusOK)
+
+	if err := (&WaitConfig{MaxWaiters: -1}).validate(); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Fatalf("validate() = %v, want negative limit error", err)
+	}
+}
+
+func TestWaitDisabled(t *testing.T) {
+	store := &notifierFakeStore{fakeStore: newFakeStore()}
+	service := newCacheService(testConfig(), store)
+	defer service.Close()
+	router := newRouter(service)
+
+	w := serve(router, http.MethodGet, "/v2/cache/k?wait=1000", "")
+	requireStatus(t, w, http.StatusBadRequest)
+	requireJSONField(t, w, "error", "wait is not enabled")
+	requireStatus(t, serve(router, http.MethodGet, "/v2/cache/k?wait=0", ""), http.StatusNotFound)
+
+	requireStatus(t, serve(router, http.MethodPut, "/v2/cache/k", "v"), http.StatusOK)
+	store.subMu.Lock()
+	subscribers, published := len(store.subscribers), store.published
+	store.subMu.Unlock()
+	if subscribers != 0 || published != 0 {
+		t.Fatalf("%d subscriptions and %d publishes while waits are off, want none", subscribers, published)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWarmConcurrency = 4
+	defaultWarmTimeout     = 10 * time.Second
+	defaultRefreshAhead    = 30 * time.Second
+	defaultRefreshInterval = 5 * time.Second
+
+	refreshModeListed = "listed"
+	refreshModeHot    = "hot"
+)
+
+// WarmConfig describes where cache entries are fetched from when warming
+// the cache and refreshing entries ahead of expiry.
+type WarmConfig struct {
+	Origin      string        `json:"origin_url"`
+	Manifest    string        `json:"manifest"`
+	Concurrency int           `json:"concurrency"`
+	Timeout     int           `json:"timeout_ms"`
+	Refresh     RefreshConfig `json:"refresh"`
+}
+
+// RefreshConfig controls the in-server refresh-ahead scheduler. In listed
+// mode every manifest entry is kept fresh; in hot mode only the manifest
+// entries that are currently among the most read keys.
+type RefreshConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Mode     string `json:"mode"`
+	Ahead    int    `json:"ahead_ms"`
+	Interval int    `json:"interval_ms"`
+}
+
+func (wc *WarmConfig) validate() error {
+	if wc.Concurrency < 0 || wc.Timeout < 0 || wc.Refresh.Ahead < 0 || wc.Refresh.Interval < 0 {
+		return fmt.Errorf("warm limits must not be negative")
+	}
+	if wc.Origin != "" {
+		u, err := url.Parse(wc.Origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("warm origin_url must be an absolute http or https URL")
+		}
+	}
+	switch wc.Refresh.Mode {
+	case "", refreshModeListed, refreshModeHot:
+	default:
+		return fmt.Errorf("warm refresh mode must be %s or %s", refreshModeListed, refreshModeHot)
+	}
+	if wc.Refresh.Enabled && (wc.Origin == "" || wc.Manifest == "") {
+		return fmt.Errorf("warm refresh needs origin_url and manifest")
+	}
+	return nil
+}
+
+// WarmEntry is one manifest line: the cache key, the GraphQL request that
+// produces its value and an optional TTL in seconds.
+type WarmEntry struct {
+	Key       string          `json:"key"`
+	Namespace string          `json:"namespace,omitempty"`
+	Request   json.RawMessage `json:"request"`
+	TTL       int             `json:"ttl,omitempty"`
+}
+
+// loadWarmManifest reads a JSON array of entries and checks each against the
+// service's namespaces and limits, so a bad manifest fails before any fetch.
+func (cs *CacheService) loadWarmManifest(path string) ([]WarmEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []WarmEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	for i, entry := range entries {
+		if _, _, err := cs.warmTarget(entry); err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %w", i, err)
+		}
+		var request map[string]any
+		if err := json.Unmarshal(entry.Request, &request); err != nil || request["query"] == nil {
+			return nil, fmt.Errorf("manifest entry %d: request must be a GraphQL request object with a query", i)
+		}
+	}
+	return entries, nil
+}
+
+// warmTarget resolves an entry's namespace and TTL with the same rules as
+// writes made over HTTP.
+func (cs *CacheService) warmTarget(entry WarmEntry) (*namespace, time.Duration, error) {
+	name := entry.Namespace
+	if name == "" {
+		name = defaultNamespace
+	}
+	ns, ok := cs.namespaces.byName[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("namespace %q not found", name)
+	}
+	if entry.Key == "" {
+		return nil, 0, errors.New("key is required")
+	}
+	if len(entry.Key) > cs.sizeLimits.MaxKeyLength {
+		return nil, 0, fmt.Errorf("key must not exceed %d bytes", cs.sizeLimits.MaxKeyLength)
+	}
+	if ns.prefix == "" && strings.HasPrefix(entry.Key, internalKeyPrefix) {
+		return nil, 0, fmt.Errorf("keys must not start with %s", internalKeyPrefix)
+	}
+	rawTTL := ""
+	if entry.TTL != 0 {
+		rawTTL = strconv.Itoa(entry.TTL)
+	}
+	ttl, err := cs.namespaceTTL(ns, rawTTL)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ns, ttl, nil
+}
+
+// warmer fetches entries from the origin and stores them.
+type warmer struct {
+	cs          *CacheService
+	origin      string
+	client      *http.Client
+	concurrency int
+}
+
+func newWarmer(cs *CacheService, config WarmConfig) *warmer {
+	wm := &warmer{
+		cs:          cs,
+		origin:      config.Origin,
+		client:      &http.Client{Timeout: defaultWarmTimeout},
+		concurrency: defaultWarmConcurrency,
+	}
+	if config.Concurrency > 0 {
+		wm.concurrency = config.Concurrency
+	}
+	if config.Timeout > 0 {
+		wm.client.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	return wm
+}
+
+// warmSummary counts the outcome of a warm run.
+type warmSummary struct {
+	Warmed int `json:"warmed"`
+	Failed int `json:"failed"`
+}
+
+// warmAll fetches and stores every entry, at most concurrency at a time.
+func (wm *warmer) warmAll(ctx context.Context, entries []WarmEntry) warmSummary {
+	var (
+		mu      sync.Mutex
+		summary warmSummary
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, wm.concurrency)
+	for _, entry := range entries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(entry WarmEntry) {
+			defer func() { <-sem; wg.Done() }()
+			err := wm.warm(ctx, entry)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				summary.Failed++
+				log.Printf("warm %q failed: %v", entry.Key, err)
+				return
+			}
+			summary.Warmed++
+		}(entry)
+	}
+	wg.Wait()
+	return summary
+}
+
+// warm fetches one entry and writes it like a POST to /api/cache would.
+func (wm *warmer) warm(ctx context.Context, entry WarmEntry) error {
+	ns, ttl, err := wm.cs.warmTarget(entry)
+	if err != nil {
+		return err
+	}
+	value, err := wm.fetch(ctx, entry.Request, wm.cs.maxValueSize(ns))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+
+	reservation, err := wm.cs.namespaces.reserve(ctx, ns, entry.Key, int64(len(entry.Key)+len(value)), ttl)
+	if err != nil {
+		return err
+	}
+	if err := wm.cs.store.Set(ctx, ns.key(entry.Key), CacheItem{Value: value, TTL: ttl}); err != nil {
+		wm.cs.namespaces.undo(ctx, reservation)
+		return err
+	}
+	ns.writes.Add(1)
+	wm.cs.waiters.notify(ctx, ns.key(entry.Key))
+	wm.cs.events.publish(CacheEvent{Op: eventSet, Namespace: ns.name, Key: entry.Key, TTL: int64(ttl.Seconds()), Size: int64(len(value))})
+	warmMetrics.Add("warmed", 1)
+	return nil
+}
+
+// fetch posts a GraphQL request to the origin. Responses that are not a 200
+// or that carry GraphQL errors are not cached.
+func (wm *warmer) fetch(ctx context.Context, request json.RawMessage, maxSize int64) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wm.origin, bytes.NewReader(request))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wm.client.Do(req)
+	if err != nil {
+		warmMetrics.Add("origin_errors", 1)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		warmMetrics.Add("origin_errors", 1)
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		warmMetrics.Add("origin_errors", 1)
+		return "", fmt.Errorf("origin returned status %d", resp.StatusCode)
+	}
+	if int64(len(body)) > maxSize {
+		return "", fmt.Errorf("response exceeds %d bytes", maxSize)
+	}
+	var result struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("origin returned invalid JSON: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		warmMetrics.Add("origin_errors", 1)
+		return "", fmt.Errorf("origin returned %d GraphQL errors", len(result.Errors))
+	}
+	return string(body), nil
+}
+
+// refresher re-fetches manifest entries shortly before they expire. With a
+// LeaseStore only one instance refreshes a given key at a time.
+type refresher struct {
+	warmer   *warmer
+	entries  []WarmEntry
+	mode     string
+	ahead    time.Duration
+	interval time.Duration
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+func newRefresher(wm *warmer, entries []WarmEntry, config RefreshConfig) *refresher {
+	rf := &refresher{
+		warmer:   wm,
+		entries:  entries,
+		mode:     refreshModeListed,
+		ahead:    defaultRefreshAhead,
+		interval: defaultRefreshInterval,
+	}
+	if config.Mode != "" {
+		rf.mode = config.Mode
+	}
+	if config.Ahead > 0 {
+		rf.ahead = time.Duration(config.Ahead) * time.Millisecond
+	}
+	if config.Interval > 0 {
+		rf.interval = time.Duration(config.Interval) * time.Millisecond
+	}
+	return rf
+}
+
+// startRefresh loads the manifest and starts the refresh-ahead scheduler
+// when it is enabled.
+func (cs *CacheService) startRefresh() error {
+	config := cs.config.Warm
+	if !config.Refresh.Enabled {
+		return nil
+	}
+	entries, err := cs.loadWarmManifest(config.Manifest)
+	if err != nil {
+		return err
+	}
+	cs.refresher = newRefresher(newWarmer(cs, config), entries, config.Refresh)
+	cs.refresher.start()
+	return nil
+}
+
+func (rf *refresher) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	rf.stop = cancel
+	rf.done = make(chan struct{})
+	go func() {
+		defer close(rf.done)
+		ticker := time.NewTicker(rf.interval)
+		defer ticker.Stop()
+		for {
+			rf.refreshDue(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (rf *refresher) close() {
+	if rf.stop != nil {
+		rf.stop()
+		<-rf.done
+	}
+}
+
+// refreshDue refreshes the entries that are missing or expire within the
+// refresh window.
+func (rf *refresher) refreshDue(ctx context.Context) {
+	var due []WarmEntry
+	var claims []func()
+	hot := rf.hotKeys()
+	for _, entry := range rf.entries {
+		ns, _, err := rf.warmer.cs.warmTarget(entry)
+		if err != nil {
+			continue
+		}
+		if hot != nil && !hot[ns.key(entry.Key)] {
+			continue
+		}
+		if !rf.isDue(ctx, ns.key(entry.Key)) {
+			continue
+		}
+		if release, ok := rf.claim(ctx, ns, entry.Key); ok {
+			due = append(due, entry)
+			claims = append(claims, release)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	summary := rf.warmer.warmAll(ctx, due)
+	for _, release := range claims {
+		release()
+	}
+	warmMetrics.Add("refreshed", int64(summary.Warmed))
+	warmMetrics.Add("refresh_failures", int64(summary.Failed))
+}
+
+// hotKeys returns the store keys currently among the most read, or nil when
+// every listed entry should be refreshed.
+func (rf *refresher) hotKeys() map[string]bool {
+	if rf.mode != refreshModeHot {
+		return nil
+	}
+	hot := make(map[string]bool)
+	hk := rf.warmer.cs.hotKeys
+	for _, entry := range hk.reads.top(hk.k) {
+		hot[entry.key] = true
+	}
+	return hot
+}
+
+func (rf *refresher) isDue(ctx context.Context, storeKey string) bool {
+	ctx, cancel := context.WithTimeout(ctx, readOpTimeout)
+	defer cancel()
+
+	item, err := rf.warmer.cs.store.Get(ctx, storeKey)
+	if errors.Is(err, errCacheMiss) {
+		return true
+	}
+	if err != nil {
+		log.Printf("refresh check error: %v", err)
+		return false
+	}
+	return item.TTL < rf.ahead
+}
+
+// claim takes the key's recompute lease for the length of a fetch, so that
+// instances sharing the store do not refresh the same key together. Without
+// a LeaseStore every instance refreshes on its own. The returned function
+// hands the lease back.
+func (rf *refresher) claim(ctx context.Context, ns *namespace, key string) (func(), bool) {
+	leaseStore := rf.warmer.cs.leases.store
+	if leaseStore == nil {
+		return func() {}, true
+	}
+	token, err := newRandomID()
+	if err != nil {
+		return nil, false
+	}
+	acquireCtx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	defer cancel()
+	acquired, _, err := leaseStore.AcquireLease(acquireCtx, leaseKey(ns, key), token, rf.warmer.client.Timeout+writeOpTimeout)
+	if err != nil {
+		log.Printf("Redis lease error: %v", err)
+		return nil, false
+	}
+	if !acquired {
+		return nil, false
+	}
+	return func() {
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), writeOpTimeout)
+		defer cancel()
+		if _, err := leaseStore.ReleaseLease(releaseCtx, leaseKey(ns, key), token); err != nil {
+			log.Printf("Redis lease error: %v", err)
+		}
+	}, true
+}
+
+// runWarm implements the warm subcommand. Flags override the warm section
+// of the config file.
+func runWarm(args []string) int {
+	flags := flag.NewFlagSet("warm", flag.ContinueOnError)
+	manifest := flags.String("manifest", "", "path to the warm manifest")
+	origin := flags.String("origin", "", "GraphQL origin URL")
+	concurrency := flags.Int("concurrency", 0, "number of concurrent fetches")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Printf("Failed to load config: %v", err)
+		return 1
+	}
+	if *manifest != "" {
+		config.Warm.Manifest = *manifest
+	}
+	if *origin != "" {
+		config.Warm.Origin = *origin
+	}
+	if *concurrency > 0 {
+		config.Warm.Concurrency = *concurrency
+	}
+	if config.Warm.Manifest == "" || config.Warm.Origin == "" {
+		log.Print("warm needs a manifest and an origin")
+		return 2
+	}
+	if err := config.Warm.validate(); err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	cacheService := newStoreService(config, NewRedisStore(config))
+	defer cacheService.Close()
+	if err := cacheService.HealthCheck(context.Background()); err != nil {
+		log.Printf("Failed to connect to Redis: %v", err)
+		return 1
+	}
+	return cacheService.warmFromManifest(context.Background(), os.Stdout)
+}
+
+func (cs *CacheService) warmFromManifest(ctx context.Context, out io.Writer) int {
+	entries, err := cs.loadWarmManifest(cs.config.Warm.Manifest)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	summary := newWarmer(cs, cs.config.Warm).warmAll(ctx, entries)
+	fmt.Fprintf(out, "warmed %d of %d entries, %d failed\n", summary.Warmed, len(entries), summary.Failed)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
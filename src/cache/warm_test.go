@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// graphQLOrigin answers each query with a response naming it, fails the
+// query "broken" and returns GraphQL errors for "invalid".
+func graphQLOrigin(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var inFlight, peak atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := inFlight.Add(1); n > peak.Load() {
+			peak.Store(n)
+		}
+		defer inFlight.Add(-1)
+		time.Sleep(5 * time.Millisecond)
+
+		var req struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		switch req.Query {
+		case "broken":
+			http.Error(w, "boom", http.StatusBadGateway)
+		case "invalid":
+			_, _ = w.Write([]byte(`{"errors":[{"message":"no such field"}]}`))
+		default:
+			_, _ = w.Write([]byte(`{"data":{"query":"` + req.Query + `"}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &peak
+}
+
+func writeManifest(t *testing.T, entries string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := os.WriteFile(path, []byte(entries), 0o600); err != nil {
+		t.Fatalf("write manifest: %v", err)
+	}
+	return path
+}
+
+func TestWarmFromManifest(t *testing.T) {
+	origin, peak := graphQLOrigin(t)
+	config := testConfig()
+	config.Namespaces = []NamespaceConfig{{Name: "tenant"}}
+	config.Warm = WarmConfig{Origin: origin.URL, Concurrency: 2, Manifest: writeManifest(t, `[
+		{"key": "items", "request": {"query": "items"}, "ttl": 120},
+		{"key": "traders", "request": {"query": "traders"}},
+		{"key": "maps", "namespace": "tenant", "request": {"query": "maps"}},
+		{"key": "quests", "request": {"query": "quests"}},
+		{"key": "broken", "request": {"query": "broken"}},
+		{"key": "invalid", "request": {"query": "invalid"}}
+	]`)}
+	store := newFakeStore()
+	service := newCacheService(config, store)
+
+	before := counterValue(warmMetrics, "warmed")
+	var out bytes.Buffer
+	if code := service.warmFromManifest(context.Background(), &out); code != 1 {
+		t.Fatalf("warmFromManifest() = %d, want 1 for failed entries", code)
+	}
+	if got := out.String(); got != "warmed 4 of 6 entries, 2 failed\n" {
+		t.Fatalf("output = %q", got)
+	}
+	requireCounterDelta(t, warmMetrics, "warmed", before, 4)
+	if got := peak.Load(); got > 2 {
+		t.Fatalf("origin saw %d concurrent requests, want at most 2", got)
+	}
+
+	items := store.items["items"]
+	if items.Value != `{"data":{"query":"items"}}` || items.TTL != 120*time.Second {
+		t.Fatalf("items entry = %+v", items)
+	}
+	if store.items["traders"].TTL != 300*time.Second {
+		t.Fatalf("traders entry = %+v, want the default TTL", store.items["traders"])
+	}
+	if _, ok := store.items[namespaceKeyPrefix+"tenant:maps"]; !ok {
+		t.Fatal("namespaced entry was not written to its namespace")
+	}
+	for _, key := range []string{"broken", "invalid"} {
+		if _, ok := store.items[key]; ok {
+			t.Fatalf("failed entry %q was cached", key)
+		}
+	}
+
+	requireStatus(t, serve(newRouter(service), http.MethodGet, "/api/cache?key=items", ""), http.StatusOK)
+}
+
+func TestLoadWarmManifestErrors(t *testing.T) {
+	config := testConfig()
+	service := newCacheService(config, newFakeStore())
+
+	tests := map[string]string{
+		"not json":          `{`,
+		"missing key":       `[{"request": {"query": "q"}}]`,
+		"unknown namespace": `[{"key": "k", "namespace": "missing", "request": {"query": "q"}}]`,
+		"missing query":     `[{"key": "k", "request": {"variables": {}}}]`,
+		"reserved key":      `[{"key": "` + internalKeyPrefix + `x", "request": {"query": "q"}}]`,
+		"negative ttl":      `[{"key": "k", "request": {"query": "q"}, "ttl": -5}]`,
+	}
+	for name, manifest := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := service.loadWarmManifest(writeManifest(t, manifest)); err == nil {
+				t.Fatal("loadWarmManifest() succeeded")
+			}
+		})
+	}
+	if _, err := service.loadWarmManifest(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loadWarmManifest() succeeded for a missing file")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	origin, _ := graphQLOrigin(t)
+	config := testConfig()
+	config.Warm = WarmConfig{Origin: origin.URL, Manifest: writeManifest(t, `[
+		{"key": "expiring", "request": {"query": "expiring"}, "ttl": 60},
+		{"key": "fresh", "request": {"query": "fresh"}, "ttl": 60},
+		{"key": "missing", "request": {"query": "missing"}, "ttl": 60}
+	]`)}
+	config.Warm.Refresh = RefreshConfig{Enabled: true, Ahead: 30000, Interval: 60000}
+	store := newFakeStore()
+	store.items["expiring"] = CacheItem{Value: "old", TTL: 10 * time.Second}
+	store.items["fresh"] = CacheItem{Value: "old", TTL: 50 * time.Second}
+	service := newCacheService(config, store)
+
+	before := counterValue(warmMetrics, "refreshed")
+	if err := service.startRefresh(); err != nil {
+		t.Fatalf("startRefresh() error: %v", err)
+	}
+	// The first pass runs as soon as the scheduler starts.
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(warmMetrics, "refreshed") < before+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	service.Close()
+
+	requireCounterDelta(t, warmMetrics, "refreshed", before, 2)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if got := store.items["expiring"]; got.Value != `{"data":{"query":"expiring"}}` || got.TTL != time.Minute {
+		t.Fatalf("expiring entry = %+v", got)
+	}
+	if _, ok := store.items["missing"]; !ok {
+		t.Fatal("missing entry was not refreshed")
+	}
+	if got := store.items["fresh"]; got.Value != "old" {
+		t.Fatalf("fresh entry was refreshed: %+v", got)
+	}
+}
+
+func TestRefreshHotModeAndLeases(t *testing.T) {
+	origin, _ := graphQLOrigin(t)
+	config := testConfig()
+	config.Warm = WarmConfig{Origin: origin.URL, Manifest: writeManifest(t, `[
+		{"key": "hot", "request": {"query": "hot"}},
+		{"key": "cold", "request": {"query": "cold"}},
+		{"key": "leased", "request": {"query": "leased"}}
+	]`)}
+	config.Warm.Refresh = RefreshConfig{Enabled: true, Mode: refreshModeHot}
+	store := newLeaseFakeStore()
+	service := newCacheService(config, store)
+	router := newRouter(service)
+
+	for _, key := range []string{"hot", "leased"} {
+		requireStatus(t, serve(router, http.MethodGet, "/api/cache?key="+key, ""), http.StatusNotFound)
+	}
+	requireStatus(t, serve(router, http.MethodPost, "/v2/lease/leased", ""), http.StatusCreated)
+
+	entries, err := service.loadWarmManifest(config.Warm.Manifest)
+	if err != nil {
+		t.Fatalf("loadWarmManifest() error: %v", err)
+	}
+	rf := newRefresher(newWarmer(service, config.Warm), entries, config.Warm.Refresh)
+	rf.refreshDue(context.Background())
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.items["hot"]; !ok {
+		t.Fatal("hot entry was not refreshed")
+	}
+	if _, ok := store.items["cold"]; ok {
+		t.Fatal("entry that is not hot was refreshed")
+	}
+	if _, ok := store.items["leased"]; ok {
+		t.Fatal("entry leased by another worker was refreshed")
+	}
+	if _, ok := store.leases[leaseKeyPrefix+"hot"]; ok {
+		t.Fatal("refresh lease was not released")
+	}
+}
+
+func TestWarmConfigValidation(t *testing.T) {
+	tests := []struct {
+		config WarmConfig
+		want   string
+	}{
+		{config: WarmConfig{Concurrency: -1}, want: "negative"},
+		{config: WarmConfig{Origin: "ftp://origin"}, want: "origin_url"},
+		{config: WarmConfig{Refresh: RefreshConfig{Mode: "all"}}, want: "mode"},
+		{config: WarmConfig{Refresh: RefreshConfig{Enabled: true}}, want: "needs origin_url and manifest"},
+	}
+	for _, tt := range tests {
+		if err := tt.config.validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("validate(%+v) = %v, want error containing %q", tt.config, err, tt.want)
+		}
+	}
+}
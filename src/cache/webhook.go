@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+const (
+	defaultWebhookMaxAttempts    = 8
+	defaultWebhookInitialBackoff = time.Second
+	defaultWebhookMaxBackoff     = 5 * time.Minute
+	defaultWebhookTimeout        = 5 * time.Second
+	defaultWebhookLogSize        = 1000
+	webhookPollInterval          = time.Second
+	webhookClaimBatch            = 16
+	webhookWorkers               = 4
+	webhookIntakeQueue           = 1024
+	maxWebhookHistory            = 1000
+
+	webhookKeyPrefix       = internalKeyPrefix + "webhooks:"
+	webhookSignatureHeader = "X-Cache-Webhook-Signature"
+	webhookTimestampHeader = "X-Cache-Webhook-Timestamp"
+	webhookIDHeader        = "X-Cache-Webhook-Id"
+)
+
+// Delivery states.
+const (
+	webhookPending   = "pending"
+	webhookRetrying  = "retrying"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+)
+
+// Delivery history lists.
+const (
+	webhookLogList  = "log"
+	webhookDeadList = "dead"
+)
+
+// WebhooksConfig lists the endpoints change events are posted to and how
+// failed deliveries are retried. Zero values fall back to the defaults above.
+type WebhooksConfig struct {
+	Endpoints      []WebhookEndpointConfig `json:"endpoints"`
+	MaxAttempts    int                     `json:"max_attempts"`
+	InitialBackoff int                     `json:"initial_backoff_ms"`
+	MaxBackoff     int                     `json:"max_backoff_ms"`
+	Timeout        int                     `json:"timeout_ms"`
+	LogSize        int64                   `json:"log_size"`
+}
+
+// WebhookEndpointConfig is one webhook receiver. Empty events, namespaces or
+// prefixes match everything.
+type WebhookEndpointConfig struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	SecretEnv  string   `json:"secret_env"`
+	Events     []string `json:"events"`
+	Namespaces []string `json:"namespaces"`
+	Prefixes   []string `json:"prefixes"`
+}
+
+// subscribes reports whether any endpoint receives events with op.
+func (wc *WebhooksConfig) subscribes(op string) bool {
+	for _, endpoint := range wc.Endpoints {
+		if len(endpoint.Events) == 0 || containsString(endpoint.Events, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func (wc *WebhooksConfig) validate() error {
+	if wc.MaxAttempts < 0 || wc.InitialBackoff < 0 || wc.MaxBackoff < 0 || wc.Timeout < 0 || wc.LogSize < 0 {
+		return fmt.Errorf("webhook limits must not be negative")
+	}
+	names := make(map[string]bool, len(wc.Endpoints))
+	for _, endpoint := range wc.Endpoints {
+		if endpoint.Name == "" {
+			return fmt.Errorf("webhook name is required")
+		}
+		if names[endpoint.Name] {
+			return fmt.Errorf("webhook %q is defined more than once", endpoint.Name)
+		}
+		names[endpoint.Name] = true
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q url must be an absolute http or https URL", endpoint.Name)
+		}
+		if secretValue(endpoint.Secret, endpoint.SecretEnv) == "" {
+			return fmt.Errorf("webhook %q has no secret or secret_env value", endpoint.Name)
+		}
+		for _, op := range endpoint.Events {
+			switch op {
+			case eventSet, eventDelete, eventTTL, eventExpire, eventInvalidate:
+			default:
+				return fmt.Errorf("webhook %q has unknown event %q", endpoint.Name, op)
+			}
+		}
+	}
+	return nil
+}
+
+// WebhookDelivery is one event on its way to one endpoint, along with the
+// outcome of its latest attempt.
+type WebhookDelivery struct {
+	ID          string     `json:"id"`
+	Endpoint    string     `json:"endpoint"`
+	Event       CacheEvent `json:"event"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	Status      int        `json:"status,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	AttemptedAt time.Time  `json:"attempted_at,omitzero"`
+}
+
+// WebhookStore keeps the delivery queue and history. RedisStore implements
+// it so that pending deliveries survive restarts and are shared between
+// instances; other stores fall back to an in-memory queue.
+type WebhookStore interface {
+	// EnqueueWebhook queues a delivery. With a positive dedupe window, a
+	// delivery with the same ID queued by another instance within the window
+	// is dropped.
+	EnqueueWebhook(ctx context.Context, delivery WebhookDelivery, dedupe time.Duration) error
+	// ClaimWebhooks hands out up to limit due deliveries and hides them from
+	// other claims for lease, so a crashed worker's deliveries come back.
+	ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	// FinishWebhook logs the latest attempt. A positive retryAfter queues the
+	// delivery again; otherwise it is removed, and dead deliveries are added
+	// to the dead-letter list. Both lists keep the latest logSize entries.
+	FinishWebhook(ctx context.Context, delivery WebhookDelivery, retryAfter time.Duration, logSize int64) error
+	// WebhookHistory returns the newest entries of the log or dead list.
+	WebhookHistory(ctx context.Context, list string, limit int64) ([]WebhookDelivery, error)
+}
+
+func webhookKeys() []string {
+	return []string{webhookKeyPrefix + "queue", webhookKeyPrefix + "items", webhookKeyPrefix + webhookLogList, webhookKeyPrefix + webhookDeadList}
+}
+
+// The webhook scripts share their keys: KEYS[1] is a sorted set of delivery
+// IDs scored by when they are due, KEYS[2] a hash of deliveries, KEYS[3] the
+// delivery log and KEYS[4] the dead-letter list.
+const webhookNowScript = `
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+var enqueueWebhookScript = redis.NewScript(webhookNowScript + `
+if ARGV[3] ~= '0' then
+  if not redis.call('SET', KEYS[5], '1', 'NX', 'PX', ARGV[3]) then
+    return 0
+  end
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], now, ARGV[1])
+return 1
+`)
+
+var claimWebhooksScript = redis.NewScript(webhookNowScript + `
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, ARGV[1])
+local claimed = {}
+for _, id in ipairs(ids) do
+  local delivery = redis.call('HGET', KEYS[2], id)
+  if delivery then
+    redis.call('ZADD', KEYS[1], now + tonumber(ARGV[2]), id)
+    table.insert(claimed, delivery)
+  else
+    redis.call('ZREM', KEYS[1], id)
+  end
+end
+return claimed
+`)
+
+var finishWebhookScript = redis.NewScript(webhookNowScript + `
+local limit = tonumber(ARGV[4]) - 1
+redis.call('LPUSH', KEYS[3], ARGV[2])
+redis.call('LTRIM', KEYS[3], 0, limit)
+if tonumber(ARGV[3]) > 0 then
+  redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+  redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+  return 1
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[1], ARGV[1])
+if ARGV[5] == '1' then
+  redis.call('LPUSH', KEYS[4], ARGV[2])
+  redis.call('LTRIM', KEYS[4], 0, limit)
+end
+return 1
+`)
+
+func (rs *RedisStore) EnqueueWebhook(ctx context.Context, delivery WebhookDelivery, dedupe time.Duration) error {
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	keys := append(webhookKeys(), webhookKeyPrefix+"dedupe:"+delivery.ID)
+	return enqueueWebhookScript.Run(ctx, rs.client, keys, delivery.ID, payload, dedupe.Milliseconds()).Err()
+}
+
+func (rs *RedisStore) ClaimWebhooks(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	raw, err := claimWebhooksScript.Run(ctx, rs.client, webhookKeys(), limit, lease.Milliseconds()).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeliveries(raw), nil
+}
+
+func (rs *RedisStore) FinishWebhook(ctx context.Context, delivery WebhookDelivery, retryAfter time.Duration, logSize int64) error {
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	dead := "0"
+	if delivery.State == webhookDead {
+		dead = "1"
+	}
+	return finishWebhookScript.Run(ctx, rs.client, webhookKeys(), delivery.ID, payload, retryAfter.Milliseconds(), logSize, dead).Err()
+}
+
+func (rs *RedisStore) WebhookHistory(ctx context.Context, list string, limit int64) ([]WebhookDelivery, error) {
+	raw, err := rs.client.LRange(ctx, webhookKeyPrefix+list, 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeDeliveries(raw), nil
+}
+
+func decodeDeliveries(raw []string) []WebhookDelivery {
+	deliveries := make([]WebhookDelivery, 0, len(raw))
+	for _, item := range raw {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal([]byte(item), &delivery); err != nil {
+			log.Printf("invalid webhook delivery: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries
+}
+
+// localWebhookStore is the in-memory WebhookStore used when the cache store
+// cannot keep deliveries. Pending deliveries are lost on restart.
+type localWebhookStore struct {
+	mu         sync.Mutex
+	deliveries map[string]WebhookDelivery
+	due        map[string]time.Time
+	lists      map[string][]WebhookDelivery
+}
+
+func newLocalWebhookStore() *localWebhookStore {
+	return &localWebhookStore{
+		deliveries: make(map[string]WebhookDelivery),
+		due:        make(map[string]time.Time),
+		lists:      make(map[string][]WebhookDelivery),
+	}
+}
+
+func (s *localWebhookStore) EnqueueWebhook(_ context.Context, delivery WebhookDelivery, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[delivery.ID] = delivery
+	s.due[delivery.ID] = time.Now()
+	return nil
+}
+
+func (s *localWebhookStore) ClaimWebhooks(_ context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var claimed []WebhookDelivery
+	for id, due := range s.due {
+		if len(claimed) == limit {
+			break
+		}
+		if due.After(now) {
+			continue
+		}
+		s.due[id] = now.Add(lease)
+		claimed = append(claimed, s.deliveries[id])
+	}
+	return claimed, nil
+}
+
+func (s *localWebhookStore) FinishWebhook(_ context.Context, delivery WebhookDelivery, retryAfter time.Duration, logSize int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.push(webhookLogList, delivery, logSize)
+	if retryAfter > 0 {
+		s.deliveries[delivery.ID] = delivery
+		s.due[delivery.ID] = time.Now().Add(retryAfter)
+		return nil
+	}
+	delete(s.deliveries, delivery.ID)
+	delete(s.due, delivery.ID)
+	if delivery.State == webhookDead {
+		s.push(webhookDeadList, delivery, logSize)
+	}
+	return nil
+}
+
+func (s *localWebhookStore) push(list string, delivery WebhookDelivery, limit int64) {
+	entries := append([]WebhookDelivery{delivery}, s.lists[list]...)
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	s.lists[list] = entries
+}
+
+func (s *localWebhookStore) WebhookHistory(_ context.Context, list string, limit int64) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.lists[list]
+	if int64(len(entries)) > limit {
+		entries = entries[:limit]
+	}
+	return append([]WebhookDelivery(nil), entries...), nil
+}
+
+type webhookEndpoint struct {
+	config WebhookEndpointConfig
+	secret []byte
+	events map[string]bool
+}
+
+func (e *webhookEndpoint) matches(event CacheEvent) bool {
+	if len(e.events) > 0 && !e.events[event.Op] {
+		return false
+	}
+	if len(e.config.Namespaces) > 0 && !containsString(e.config.Namespaces, event.Namespace) {
+		return false
+	}
+	if len(e.config.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range e.config.Prefixes {
+		if event.matchesPrefix(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// webhooks turns change events into signed deliveries and works through the
+// delivery queue with retries.
+type webhooks struct {
+	store          WebhookStore
+	breaker        *breakerStore
+	endpoints      []*webhookEndpoint
+	byName         map[string]*webhookEndpoint
+	client         *http.Client
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	logSize        int64
+	pollInterval   time.Duration
+	intake         chan CacheEvent
+	stop           context.CancelFunc
+	wg             sync.WaitGroup
+}
+
+func newWebhooks(config WebhooksConfig, store CacheStore, breaker *breakerStore) *webhooks {
+	wh := &webhooks{
+		byName:         make(map[string]*webhookEndpoint),
+		client:         &http.Client{Timeout: defaultWebhookTimeout},
+		maxAttempts:    defaultWebhookMaxAttempts,
+		initialBackoff: defaultWebhookInitialBackoff,
+		maxBackoff:     defaultWebhookMaxBackoff,
+		logSize:        defaultWebhookLogSize,
+		pollInterval:   webhookPollInterval,
+		stop:           func() {},
+	}
+	if config.MaxAttempts > 0 {
+		wh.maxAttempts = config.MaxAttempts
+	}
+	if config.InitialBackoff > 0 {
+		wh.initialBackoff = time.Duration(config.InitialBackoff) * time.Millisecond
+	}
+	if config.MaxBackoff > 0 {
+		wh.maxBackoff = time.Duration(config.MaxBackoff) * time.Millisecond
+	}
+	if config.Timeout > 0 {
+		wh.client.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	}
+	if config.LogSize > 0 {
+		wh.logSize = config.LogSize
+	}
+	// The breaker only guards the shared queue; the local one never fails.
+	if webhookStore, ok := store.(WebhookStore); ok {
+		wh.store = webhookStore
+		wh.breaker = breaker
+	} else {
+		wh.store = newLocalWebhookStore()
+	}
+	for _, endpointConfig := range config.Endpoints {
+		endpoint := &webhookEndpoint{
+			config: endpointConfig,
+			secret: []byte(secretValue(endpointConfig.Secret, endpointConfig.SecretEnv)),
+			events: make(map[string]bool, len(endpointConfig.Events)),
+		}
+		for _, op := range endpointConfig.Events {
+			endpoint.events[op] = true
+		}
+		wh.endpoints = append(wh.endpoints, endpoint)
+		wh.byName[endpoint.config.Name] = endpoint
+	}
+	return wh
+}
+
+// start launches the intake and delivery loops. Without endpoints there is
+// nothing to deliver and nothing is started.
+func (wh *webhooks) start() {
+	if len(wh.endpoints) == 0 {
+		return
+	}
+	wh.intake = make(chan CacheEvent, webhookIntakeQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	wh.stop = cancel
+	wh.wg.Add(2)
+	go wh.runIntake(ctx)
+	go wh.runDeliveries(ctx)
+}
+
+// close stops the loops and waits for deliveries in flight.
+func (wh *webhooks) close() {
+	wh.stop()
+	wh.wg.Wait()
+}
+
+// flush stops the loops and moves events still waiting for intake into the
+// delivery queue, so another instance can deliver them.
+func (wh *webhooks) flush(ctx context.Context) {
+	wh.close()
+	for ctx.Err() == nil {
+		select {
+		case event := <-wh.intake:
+			wh.enqueue(ctx, event)
+		default:
+			return
+		}
+	}
+}
+
+// handle is the event broker sink. It never blocks the write path.
+func (wh *webhooks) handle(event CacheEvent) {
+	if wh.intake == nil {
+		return
+	}
+	select {
+	case wh.intake <- event:
+	default:
+		webhookMetrics.Add("dropped", 1)
+	}
+}
+
+func (wh *webhooks) runIntake(ctx context.Context) {
+	defer wh.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-wh.intake:
+			wh.enqueue(ctx, event)
+		}
+	}
+}
+
+func (wh *webhooks) enqueue(ctx context.Context, event CacheEvent) {
+	for _, endpoint := range wh.endpoints {
+		if !endpoint.matches(event) {
+			continue
+		}
+		delivery := WebhookDelivery{Endpoint: endpoint.config.Name, Event: event, State: webhookPending, CreatedAt: time.Now().UTC()}
+		// Every instance reports the same expiry, so expire deliveries get a
+		// stable ID and are only queued once.
+		var dedupe time.Duration
+		if event.Op == eventExpire {
+			delivery.ID = expireDeliveryID(endpoint.config.Name, event)
+			dedupe = eventDedupeWindow
+		} else {
+			id, err := newRandomID()
+			if err != nil {
+				log.Printf("webhook id error: %v", err)
+				continue
+			}
+			delivery.ID = id
+		}
+
+		if !wh.breaker.allow() {
+			webhookMetrics.Add("dropped", 1)
+			continue
+		}
+		enqueueCtx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+		err := wh.store.EnqueueWebhook(enqueueCtx, delivery, dedupe)
+		cancel()
+		if err != nil {
+			webhookMetrics.Add("dropped", 1)
+			log.Printf("webhook enqueue error: %v", err)
+		}
+	}
+}
+
+func expireDeliveryID(endpoint string, event CacheEvent) string {
+	sum := sha256.Sum256([]byte(endpoint + "\n" + event.Namespace + "\n" + event.Key))
+	return "expire-" + hex.EncodeToString(sum[:16])
+}
+
+// runDeliveries polls the queue. While the queue cannot be reached, the
+// interval doubles up to the maximum retry backoff.
+func (wh *webhooks) runDeliveries(ctx context.Context) {
+	defer wh.wg.Done()
+	interval := wh.pollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if wh.deliverDue(ctx) {
+				interval = wh.pollInterval
+			} else {
+				interval = min(2*interval, max(wh.maxBackoff, wh.pollInterval))
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// deliverDue claims and delivers one batch. It reports false when the queue
+// could not be reached.
+func (wh *webhooks) deliverDue(ctx context.Context) bool {
+	if !wh.breaker.allow() {
+		return false
+	}
+	claimCtx, cancel := context.WithTimeout(ctx, writeOpTimeout)
+	deliveries, err := wh.store.ClaimWebhooks(claimCtx, webhookClaimBatch, wh.client.Timeout+writeOpTimeout)
+	cancel()
+	if err != nil {
+		log.Printf("webhook claim error: %v", err)
+		return false
+	}
+
+	sem := make(chan struct{}, webhookWorkers)
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(delivery WebhookDelivery) {
+			defer func() { <-sem; wg.Done() }()
+			wh.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return true
+}
+
+func (wh *webhooks) deliver(ctx context.Context, delivery WebhookDelivery) {
+	delivery.Attempts++
+	delivery.AttemptedAt = time.Now().UTC()
+	delivery.Status, delivery.Error = 0, ""
+
+	if endpoint, ok := wh.byName[delivery.Endpoint]; ok {
+		delivery.Status, delivery.Error = wh.post(ctx, endpoint, delivery)
+	} else {
+		delivery.Error = "endpoint is no longer configured"
+		delivery.Attempts = wh.maxAttempts
+	}
+
+	var retryAfter time.Duration
+	switch {
+	case delivery.Error == "":
+		delivery.State = webhookDelivered
+		webhookMetrics.Add("delivered", 1)
+	case delivery.Attempts >= wh.maxAttempts:
+		delivery.State = webhookDead
+		webhookMetrics.Add("dead", 1)
+	default:
+		delivery.State = webhookRetrying
+		retryAfter = wh.backoff(delivery.Attempts)
+		webhookMetrics.Add("retried", 1)
+	}
+
+	// Record the outcome even while shutting down, so the delivery is not
+	// attempted again once its claim runs out. While the breaker is open the
+	// outcome is lost and the delivery is retried after its claim.
+	if !wh.breaker.allow() {
+		log.Printf("webhook %s outcome not recorded: %v", delivery.ID, errStoreUnavailable)
+		return
+	}
+	finishCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), writeOpTimeout)
+	defer cancel()
+	if err := wh.store.FinishWebhook(finishCtx, delivery, retryAfter, wh.logSize); err != nil {
+		log.Printf("webhook finish error: %v", err)
+	}
+}
+
+type webhookPayload struct {
+	ID       string     `json:"id"`
+	Endpoint string     `json:"endpoint"`
+	Event    CacheEvent `json:"event"`
+}
+
+// post sends one attempt and returns the response status and, for a failed
+// attempt, what went wrong.
+func (wh *webhooks) post(ctx context.Context, endpoint *webhookEndpoint, delivery WebhookDelivery) (int, string) {
+	body, err := json.Marshal(webhookPayload{ID: delivery.ID, Endpoint: delivery.Endpoint, Event: delivery.Event})
+	if err != nil {
+		return 0, err.Error()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, delivery.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(endpoint.secret, timestamp, body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, ""
+}
+
+// signWebhook signs "<timestamp>.<body>" so that receivers can reject both
+// tampered and replayed deliveries.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff doubles the delay after every failed attempt up to the maximum,
+// and picks a point in the upper half of it so retries spread out.
+func (wh *webhooks) backoff(attempts int) time.Duration {
+	delay := wh.maxBackoff
+	if shift := attempts - 1; shift < 32 {
+		if scaled := wh.initialBackoff << shift; scaled > 0 {
+			delay = min(scaled, wh.maxBackoff)
+		}
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+func (cs *CacheService) webhookHistoryHandler(list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(100)
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n <= 0 || n > maxWebhookHistory {
+				writeCacheError(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("limit must be between 1 and %d", maxWebhookHistory)})
+				return
+			}
+			limit = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readOpTimeout)
+		defer cancel()
+
+		deliveries, err := cs.webhooks.store.WebhookHistory(ctx, list, limit)
+		if err != nil {
+			log.Printf("webhook history error: %v", err)
+			writeCacheError(w, http.StatusInternalServerError, map[string]string{"error": "internal server error"})
+			return
+		}
+		writeNoStore(w)
+		writeJSON(w, http.StatusOK, map[string][]WebhookDelivery{"deliveries": deliveries})
+	}
+}
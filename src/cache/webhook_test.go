@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	header  http.Header
+	payload webhookPayload
+	body    []byte
+}
+
+func webhookReceiver(t *testing.T, status int) (*httptest.Server, <-chan webhookRequest) {
+	t.Helper()
+	requests := make(chan webhookRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := webhookRequest{header: r.Header.Clone(), body: body}
+		if err := json.Unmarshal(body, &req.payload); err != nil {
+			t.Errorf("decode webhook: %v", err)
+		}
+		requests <- req
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func waitForHistory(t *testing.T, wh *webhooks, list string, n int) []WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := wh.store.WebhookHistory(context.Background(), list, 100)
+		if err != nil {
+			t.Fatalf("history: %v", err)
+		}
+		if len(deliveries) >= n {
+			return deliveries
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s history never reached %d entries", list, n)
+	return nil
+}
+
+func TestWebhookDeliveredSigned(t *testing.T) {
+	receiver, requests := webhookReceiver(t, http.StatusNoContent)
+	config := testConfig()
+	config.Auth = AuthConfig{Tokens: []TokenConfig{{Name: "admin", Token: "admin-token", Scopes: []string{scopeAdmin, scopeWrite, scopeDelete, scopeRead}}}}
+	config.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "origin", URL: receiver.URL, Secret: "s3cret", Events: []string{eventSet}}}}
+	service := newCacheService(config, newFakeStore())
+	defer service.Close()
+	router := newRouter(service)
+
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	requireStatus(t, serveWithHeaders(router, http.MethodPost, "/api/cache", `{"key":"items:1","value":"abc","ttl":"60"}`, admin), http.StatusOK)
+	requireStatus(t, serveWithHeaders(router, http.MethodDelete, "/v2/cache/items:1", "", admin), http.StatusNoContent)
+
+	var req webhookRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if req.payload.Event.Op != eventSet || req.payload.Event.Key != "items:1" || req.payload.Endpoint != "origin" || req.payload.ID == "" {
+		t.Fatalf("payload = %+v", req.payload)
+	}
+	if got := req.header.Get(webhookIDHeader); got != req.payload.ID {
+		t.Fatalf("%s = %q, want %q", webhookIDHeader, got, req.payload.ID)
+	}
+	want := "sha256=" + signWebhook([]byte("s3cret"), req.header.Get(webhookTimestampHeader), req.body)
+	if got := req.header.Get(webhookSignatureHeader); got != want {
+		t.Fatalf("%s = %q, want %q", webhookSignatureHeader, got, want)
+	}
+
+	delivered := waitForHistory(t, service.webhooks, webhookLogList, 1)
+	if delivered[0].State != webhookDelivered || delivered[0].Status != http.StatusNoContent || delivered[0].Attempts != 1 {
+		t.Fatalf("delivery log = %+v", delivered[0])
+	}
+
+	requireStatus(t, serve(router, http.MethodGet, "/api/admin/webhooks/deliveries", ""), http.StatusUnauthorized)
+	w := serveWithHeaders(router, http.MethodGet, "/api/admin/webhooks/deliveries?limit=10", "", admin)
+	requireStatus(t, w, http.StatusOK)
+	var body map[string][]WebhookDelivery
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode deliveries: %v", err)
+	}
+	if len(body["deliveries"]) != 1 || body["deliveries"][0].ID != req.payload.ID {
+		t.Fatalf("deliveries = %+v", body)
+	}
+	w = serveWithHeaders(router, http.MethodGet, "/api/admin/webhooks/deliveries?limit=0", "", admin)
+	requireStatus(t, w, http.StatusBadRequest)
+
+	select {
+	case extra := <-requests:
+		t.Fatalf("delete event was delivered to a set-only endpoint: %+v", extra.payload)
+	default:
+	}
+}
+
+func TestWebhookRetriesThenDeadLetters(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	wh := newWebhooks(WebhooksConfig{
+		Endpoints:      []WebhookEndpointConfig{{Name: "flaky", URL: receiver.URL, Secret: "s"}},
+		MaxAttempts:    3,
+		InitialBackoff: 1,
+		MaxBackoff:     2,
+	}, newFakeStore(), nil)
+	ctx := context.Background()
+	wh.enqueue(ctx, CacheEvent{Op: eventDelete, Namespace: defaultNamespace, Key: "k"})
+
+	before := counterValue(webhookMetrics, "dead")
+	retriedBefore := counterValue(webhookMetrics, "retried")
+	deadline := time.Now().Add(5 * time.Second)
+	for attempts.Load() < 3 && time.Now().Before(deadline) {
+		wh.deliverDue(ctx)
+		time.Sleep(time.Millisecond)
+	}
+
+	dead := waitForHistory(t, wh, webhookDeadList, 1)
+	if dead[0].State != webhookDead || dead[0].Attempts != 3 || dead[0].Status != http.StatusBadGateway || dead[0].Error == "" {
+		t.Fatalf("dead letter = %+v", dead[0])
+	}
+	if got := waitForHistory(t, wh, webhookLogList, 3); got[1].State != webhookRetrying {
+		t.Fatalf("delivery log = %+v", got)
+	}
+	wh.deliverDue(ctx)
+	if got := attempts.Load(); got != 3 {
+		t.Fatalf("receiver saw %d attempts, want 3", got)
+	}
+	requireCounterDelta(t, webhookMetrics, "dead", before, 1)
+	requireCounterDelta(t, webhookMetrics, "retried", retriedBefore, 2)
+}
+
+func TestExpireWebhookWithEventsOff(t *testing.T) {
+	receiver, requests := webhookReceiver(t, http.StatusNoContent)
+	config := testConfig()
+	config.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "edge", URL: receiver.URL, Secret: "s3cret", Events: []string{eventExpire}}}}
+	store := newEventFakeStore()
+	service := newCacheService(config, store)
+	defer service.Close()
+
+	store.expired <- "items:1"
+	select {
+	case req := <-requests:
+		if req.payload.Event.Op != eventExpire || req.payload.Event.Key != "items:1" {
+			t.Fatalf("payload = %+v", req.payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expire webhook was not delivered")
+	}
+
+	for _, events := range [][]string{nil, {eventExpire}} {
+		config := WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "edge", Events: events}}}
+		if !config.subscribes(eventExpire) {
+			t.Fatalf("endpoint with events %v does not subscribe to expire", events)
+		}
+	}
+	if (&WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "edge", Events: []string{eventSet}}}}).subscribes(eventExpire) {
+		t.Fatal("set-only endpoint subscribes to expire")
+	}
+}
+
+func TestWebhookEndpointMatching(t *testing.T) {
+	wh := newWebhooks(WebhooksConfig{Endpoints: []WebhookEndpointConfig{{
+		Name:       "filtered",
+		URL:        "http://example.invalid",
+		Secret:     "s",
+		Events:     []string{eventSet, eventExpire, eventInvalidate},
+		Namespaces: []string{"tenant"},
+		Prefixes:   []string{"items:"},
+	}}}, newFakeStore(), nil)
+	endpoint := wh.endpoints[0]
+
+	tests := []struct {
+		event CacheEvent
+		want  bool
+	}{
+		{event: CacheEvent{Op: eventSet, Namespace: "tenant", Key: "items:1"}, want: true},
+		{event: CacheEvent{Op: eventExpire, Namespace: "tenant", Key: "items:2"}, want: true},
+		{event: CacheEvent{Op: eventDelete, Namespace: "tenant", Key: "items:1"}},
+		{event: CacheEvent{Op: eventSet, Namespace: defaultNamespace, Key: "items:1"}},
+		{event: CacheEvent{Op: eventSet, Namespace: "tenant", Key: "users:1"}},
+		{event: CacheEvent{Op: eventInvalidate, Namespace: "tenant", Prefix: "it"}, want: true},
+		{event: CacheEvent{Op: eventInvalidate, Namespace: "tenant", Prefix: "items:1"}, want: true},
+		{event: CacheEvent{Op: eventInvalidate, Namespace: "tenant", Prefix: "users:"}},
+		{event: CacheEvent{Op: eventInvalidate, Namespace: "tenant", Tag: "products"}, want: true},
+	}
+	for _, tt := range tests {
+		if got := endpoint.matches(tt.event); got != tt.want {
+			t.Fatalf("matches(%+v) = %v, want %v", tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookExpireDeliveriesShareID(t *testing.T) {
+	event := CacheEvent{Op: eventExpire, Namespace: "tenant", Key: "session"}
+	if expireDeliveryID("a", event) != expireDeliveryID("a", event) {
+		t.Fatal("expire delivery ID is not stable")
+	}
+	if expireDeliveryID("a", event) == expireDeliveryID("b", event) {
+		t.Fatal("expire delivery ID does not depend on the endpoint")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	wh := newWebhooks(WebhooksConfig{InitialBackoff: 100, MaxBackoff: 1000}, newFakeStore(), nil)
+	for attempts, limit := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second, 64: time.Second} {
+		got := wh.backoff(attempts)
+		if got < limit/2 || got > limit {
+			t.Fatalf("backoff(%d) = %s, want between %s and %s", attempts, got, limit/2, limit)
+		}
+	}
+}
+
+func TestWebhooksConfigValidation(t *testing.T) {
+	t.Setenv("CACHE_TEST_WEBHOOK_SECRET", "from-env")
+
+	tests := []struct {
+		name   string
+		config WebhooksConfig
+		valid  bool
+	}{
+		{name: "empty", valid: true},
+		{name: "literal secret", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "https://example.com/hook", Secret: "s"}}}, valid: true},
+		{name: "env secret", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "http://example.com", SecretEnv: "CACHE_TEST_WEBHOOK_SECRET"}}}, valid: true},
+		{name: "missing secret", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "http://example.com", SecretEnv: "CACHE_TEST_MISSING"}}}},
+		{name: "unnamed", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{URL: "http://example.com", Secret: "s"}}}},
+		{name: "duplicate", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "http://example.com", Secret: "s"}, {Name: "a", URL: "http://example.com", Secret: "s"}}}},
+		{name: "relative url", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "/hook", Secret: "s"}}}},
+		{name: "unknown event", config: WebhooksConfig{Endpoints: []WebhookEndpointConfig{{Name: "a", URL: "http://example.com", Secret: "s", Events: []string{"flush"}}}}},
+		{name: "negative attempts", config: WebhooksConfig{MaxAttempts: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.valid && err != nil {
+				t.Fatalf("validate() error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("validate() succeeded for invalid config")
+			}
+			if err != nil && !strings.Contains(err.Error(), "webhook") {
+				t.Fatalf("validate() error %q does not mention webhooks", err)
+			}
+		})
+	}
+}